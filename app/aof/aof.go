@@ -0,0 +1,398 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// Fsync policies, as for Redis' appendfsync.
+const (
+	// FsyncAlways syncs every write before the command replies.
+	FsyncAlways = "always"
+	// FsyncEverySec syncs once a second in the background, so a crash loses
+	// at most about a second of writes.
+	FsyncEverySec = "everysec"
+	// FsyncNo leaves flushing to the operating system.
+	FsyncNo = "no"
+)
+
+// fsyncFile syncs the AOF to disk. Tests replace it to count syncs.
+var fsyncFile = (*os.File).Sync
+
+// AOF appends every write command, in RESP, to the current incremental
+// file of a multi-part AOF: a directory holding a manifest, a base file with
+// the dataset as of the last rewrite, and the incremental files since.
+type AOF struct {
+	mu       sync.Mutex
+	dir      string
+	name     string
+	manifest *manifest
+	// file is the incremental file being appended to.
+	file   *os.File
+	policy string
+	// size is how much of file holds complete commands.
+	size int64
+	// baseSize is the size of the base file, and incrsSize that of the
+	// incremental files before file. Automatic rewrites measure growth
+	// against baseSize.
+	baseSize  int64
+	incrsSize int64
+	// buf holds the commands not written yet because of a write error. They
+	// are retried every second.
+	buf          []byte
+	lastWriteErr error
+	needsFsync   bool
+	// rewriteIncrSeq is, while a rewrite runs, the sequence number of the
+	// incremental file it opened. The files before it are replaced by the
+	// new base.
+	rewriteIncrSeq int64
+	lastRewriteErr error
+}
+
+// ValidFsyncPolicy reports whether policy is one of the fsync policies.
+func ValidFsyncPolicy(policy string) bool {
+	return policy == FsyncAlways || policy == FsyncEverySec || policy == FsyncNo
+}
+
+// Open opens the AOF called name in dir for appending, creating the
+// directory and manifest if needed. Writes go to the last incremental file,
+// or a new one if there is none. Load, if used, runs first.
+//
+// A new AOF, whose manifest lists no files, starts as in Redis with a base
+// written by writeBase, in the RDB format if rdbFormat is set, so that base
+// and incremental files are both numbered from 1.
+func Open(dir, name, policy string, writeBase func(w io.Writer) error, rdbFormat bool) (*AOF, error) {
+	if !ValidFsyncPolicy(policy) {
+		return nil, fmt.Errorf("invalid appendfsync policy %q", policy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	a := &AOF{dir: dir, name: name, manifest: m, policy: policy}
+	if m.base != nil {
+		if a.baseSize, err = fileSize(filepath.Join(dir, m.base.name)); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.incrs) == 0 {
+		if err := a.openNewIncr(); err != nil {
+			return nil, err
+		}
+		if m.base == nil {
+			if err := a.finishRewrite(writeBase, rdbFormat); err != nil {
+				a.file.Close()
+				return nil, fmt.Errorf("can't create the base file: %w", err)
+			}
+		}
+	} else {
+		for _, f := range m.incrs[:len(m.incrs)-1] {
+			size, err := fileSize(filepath.Join(dir, f.name))
+			if err != nil {
+				return nil, err
+			}
+			a.incrsSize += size
+		}
+		last := m.incrs[len(m.incrs)-1]
+		file, err := os.OpenFile(filepath.Join(dir, last.name), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if a.size, err = fileSize(file.Name()); err != nil {
+			file.Close()
+			return nil, err
+		}
+		a.file = file
+	}
+	go a.cron()
+	return a, nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// openNewIncr starts a new incremental file, lists it in the manifest and
+// makes it the file written to. The caller holds mu, or is Open.
+func (a *AOF) openNewIncr() error {
+	seq := a.manifest.nextSeq(typeIncr)
+	path := filepath.Join(a.dir, incrName(a.name, seq))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	m := *a.manifest
+	m.incrs = append(append([]aofFile{}, m.incrs...), aofFile{name: incrName(a.name, seq), seq: seq, typ: typeIncr})
+	if err := persistManifest(a.dir, a.name, &m); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	a.manifest = &m
+	if a.file != nil {
+		// Commands written so far stay in the previous file; make them
+		// durable before moving on.
+		a.file.Sync()
+		a.file.Close()
+		a.incrsSize += a.size
+	}
+	a.file = file
+	a.size = 0
+	return nil
+}
+
+// Feed appends a command to the file. With the always policy it returns
+// once the command is on disk.
+func (a *AOF) Feed(cmd resp.Value) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf = append(a.buf, cmd.Serializer()...)
+	if a.lastWriteErr != nil {
+		return
+	}
+	a.flush()
+}
+
+// flush writes buf to the file. The caller holds mu.
+func (a *AOF) flush() {
+	n, err := a.file.Write(a.buf)
+	if err != nil {
+		// Cut off a partial write so the file still ends with a complete
+		// command. If that fails too, the partial write has to stay.
+		if n > 0 {
+			if terr := a.file.Truncate(a.size); terr != nil {
+				a.size += int64(n)
+				a.buf = a.buf[n:]
+			}
+		}
+		a.lastWriteErr = err
+		if a.policy == FsyncAlways {
+			fmt.Printf("Can't recover from AOF write error when the AOF fsync policy is 'always': %v. Exiting...\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Error writing to the AOF file: %v\n", err)
+		return
+	}
+	a.size += int64(n)
+	a.buf = a.buf[:0]
+	if a.lastWriteErr != nil {
+		fmt.Println("AOF write error looks solved, can write again.")
+		a.lastWriteErr = nil
+	}
+	if a.policy == FsyncAlways {
+		if err := fsyncFile(a.file); err != nil {
+			fmt.Printf("Can't persist AOF for fsync error when the AOF fsync policy is 'always': %v. Exiting...\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	a.needsFsync = true
+}
+
+// cron runs tick every second.
+func (a *AOF) cron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.tick()
+	}
+}
+
+// tick retries failed writes and, with the everysec policy, syncs the file.
+func (a *AOF) tick() {
+	a.mu.Lock()
+	if a.lastWriteErr != nil {
+		a.flush()
+	}
+	sync := a.policy == FsyncEverySec && a.needsFsync
+	a.needsFsync = false
+	file := a.file
+	a.mu.Unlock()
+	// Writers don't wait for the fsync.
+	if sync {
+		if err := fsyncFile(file); err != nil {
+			fmt.Printf("Error syncing the AOF file: %v\n", err)
+			a.mu.Lock()
+			a.lastWriteErr = err
+			a.mu.Unlock()
+		}
+	}
+}
+
+// LastWriteError returns the error of the last write or fsync, or nil once
+// writing works again. Writes are refused while it is set.
+func (a *AOF) LastWriteError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastWriteErr
+}
+
+// Size returns the size of the AOF, base and incremental files together,
+// counting only complete commands.
+func (a *AOF) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.baseSize + a.incrsSize + a.size
+}
+
+// BufferLength returns how many bytes wait to be written after an error.
+func (a *AOF) BufferLength() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.buf)
+}
+
+// BaseSize returns the size of the base file.
+func (a *AOF) BaseSize() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.baseSize
+}
+
+// HasBase reports whether the AOF has a base file. Until the first rewrite
+// creates one, the dataset is rebuilt from the incremental files alone.
+func (a *AOF) HasBase() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.manifest.base != nil
+}
+
+// Rewriting reports whether a rewrite is in progress.
+func (a *AOF) Rewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriteIncrSeq != 0
+}
+
+// LastRewriteError returns why the last rewrite failed, or nil if it
+// succeeded.
+func (a *AOF) LastRewriteError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastRewriteErr
+}
+
+// StartRewrite begins a rewrite by switching writes to a new incremental
+// file. The caller must have captured the dataset, as it is at this point,
+// for the base it passes to FinishRewrite; the new file then holds exactly
+// what the base lacks.
+func (a *AOF) StartRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rewriteIncrSeq != 0 {
+		return errors.New("a rewrite is already in progress")
+	}
+	// Commands held back by a write error are already part of the dataset,
+	// so they must not land in the new file; wait until they are written.
+	if a.lastWriteErr != nil {
+		a.flush()
+	}
+	if a.lastWriteErr != nil {
+		err := fmt.Errorf("can't rewrite while the AOF can't be written: %w", a.lastWriteErr)
+		a.lastRewriteErr = err
+		return err
+	}
+	if err := a.openNewIncr(); err != nil {
+		a.lastRewriteErr = err
+		return err
+	}
+	a.rewriteIncrSeq = a.manifest.incrs[len(a.manifest.incrs)-1].seq
+	return nil
+}
+
+// FinishRewrite has writeBase write the new base file, in the RDB format if
+// rdbFormat is set, and commits it in the manifest, where it replaces the
+// old base and the incremental files written before StartRewrite. Those are
+// then deleted. If anything fails, the AOF stays as it was, with one more
+// incremental file.
+func (a *AOF) FinishRewrite(writeBase func(w io.Writer) error, rdbFormat bool) error {
+	err := a.finishRewrite(writeBase, rdbFormat)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastRewriteErr = err
+	a.rewriteIncrSeq = 0
+	return err
+}
+
+func (a *AOF) finishRewrite(writeBase func(w io.Writer) error, rdbFormat bool) error {
+	tmpPath := filepath.Join(a.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	// The base goes straight to the file as it is produced.
+	buf := bufio.NewWriterSize(tmp, 64*1024)
+	err = writeBase(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpPath)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := &manifest{history: append([]aofFile{}, a.manifest.history...)}
+	seq := a.manifest.nextSeq(typeBase)
+	m.base = &aofFile{name: baseName(a.name, seq, rdbFormat), seq: seq, typ: typeBase}
+	if old := a.manifest.base; old != nil {
+		m.history = append(m.history, aofFile{name: old.name, seq: old.seq, typ: typeHistory})
+	}
+	for _, f := range a.manifest.incrs {
+		if f.seq < a.rewriteIncrSeq {
+			m.history = append(m.history, aofFile{name: f.name, seq: f.seq, typ: typeHistory})
+		} else {
+			m.incrs = append(m.incrs, f)
+		}
+	}
+	basePath := filepath.Join(a.dir, m.base.name)
+	if err := os.Rename(tmpPath, basePath); err != nil {
+		return err
+	}
+	committed = true
+	if err := persistManifest(a.dir, a.name, m); err != nil {
+		os.Remove(basePath)
+		return err
+	}
+	a.manifest = m
+	a.baseSize, _ = fileSize(basePath)
+	a.incrsSize = 0
+	for _, f := range m.incrs[:len(m.incrs)-1] {
+		if size, err := fileSize(filepath.Join(a.dir, f.name)); err == nil {
+			a.incrsSize += size
+		}
+	}
+	removeHistory(a.dir, m)
+	if err := persistManifest(a.dir, a.name, m); err != nil {
+		// The history files are gone; the next load drops their entries.
+		fmt.Printf("Failed to drop the AOF history files from the manifest: %v\n", err)
+	}
+	return nil
+}
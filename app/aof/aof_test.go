@@ -0,0 +1,173 @@
+package aof
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// feed feeds a the command made of args.
+func feed(a *AOF, args ...string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	a.Feed(resp.Value{Typ: "array", Array: values})
+}
+
+// open opens the AOF in dir, giving a new one an empty base.
+func open(dir, policy string) (*AOF, error) {
+	return Open(dir, "appendonly.aof", policy, func(w io.Writer) error { return nil }, false)
+}
+
+// countSyncs makes fsyncFile count its calls for the rest of the test.
+func countSyncs(t *testing.T) *atomic.Int32 {
+	var syncs atomic.Int32
+	t.Cleanup(func() { fsyncFile = (*os.File).Sync })
+	fsyncFile = func(f *os.File) error {
+		syncs.Add(1)
+		return nil
+	}
+	return &syncs
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := open(dir, "sometimes"); err == nil {
+		t.Error("Open accepted an invalid fsync policy")
+	}
+	a, err := open(dir, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(a, "SET", "a", "1")
+	// Opening it again appends to the same incremental file.
+	a, err = open(dir, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(a, "SET", "b", "2")
+	want := command("SET", "a", "1") + command("SET", "b", "2")
+	if data, _ := os.ReadFile(a.file.Name()); string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+	if a.Size() != int64(len(want)) {
+		t.Errorf("Size() = %d, want %d", a.Size(), len(want))
+	}
+}
+
+// TestOpenNew checks that a new AOF starts, as in Redis, with a base and an
+// incremental file both numbered 1.
+func TestOpenNew(t *testing.T) {
+	for _, rdbFormat := range []bool{false, true} {
+		dir := t.TempDir()
+		writeBase := func(w io.Writer) error {
+			_, err := io.WriteString(w, "base")
+			return err
+		}
+		a, err := Open(dir, "appendonly.aof", FsyncNo, writeBase, rdbFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := baseName("appendonly.aof", 1, rdbFormat)
+		want := "file " + base + " seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n"
+		if data, _ := os.ReadFile(filepath.Join(dir, "appendonly.aof.manifest")); string(data) != want {
+			t.Errorf("manifest = %q, want %q", data, want)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, base)); string(data) != "base" {
+			t.Errorf("base = %q, want %q", data, "base")
+		}
+		if !a.HasBase() || a.BaseSize() != 4 {
+			t.Errorf("HasBase() = %v, BaseSize() = %d", a.HasBase(), a.BaseSize())
+		}
+	}
+
+	failing := func(w io.Writer) error { return errors.New("no space left") }
+	if _, err := Open(t.TempDir(), "appendonly.aof", FsyncNo, failing, false); err == nil {
+		t.Error("Open succeeded without a base")
+	}
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		// syncs made by two writes, and by the two cron ticks that follow.
+		writeSyncs, tickSyncs int32
+	}{
+		{FsyncAlways, 2, 0},
+		{FsyncEverySec, 0, 1},
+		{FsyncNo, 0, 0},
+	}
+	for _, tt := range tests {
+		syncs := countSyncs(t)
+		a, err := open(t.TempDir(), tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed(a, "SET", "a", "1")
+		feed(a, "SET", "b", "2")
+		// Whatever the policy, the commands are written at once.
+		if data, _ := os.ReadFile(a.file.Name()); len(data) == 0 || int64(len(data)) != a.Size() {
+			t.Errorf("%s: file has %d bytes, Size() = %d", tt.policy, len(data), a.Size())
+		}
+		if got := syncs.Swap(0); got != tt.writeSyncs {
+			t.Errorf("%s: %d syncs from the writes, want %d", tt.policy, got, tt.writeSyncs)
+		}
+		a.tick()
+		a.tick()
+		if got := syncs.Load(); got != tt.tickSyncs {
+			t.Errorf("%s: %d syncs from the ticks, want %d", tt.policy, got, tt.tickSyncs)
+		}
+	}
+}
+
+// TestWriteError checks that commands that fail to be written are kept and
+// written by a later tick, and that the error is reported until then.
+func TestWriteError(t *testing.T) {
+	a, err := open(t.TempDir(), FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(a, "SET", "a", "1")
+	good := a.file
+	// Writing to a file opened read-only fails.
+	a.mu.Lock()
+	a.file, err = os.Open(good.Name())
+	a.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(a, "SET", "b", "2")
+	feed(a, "SET", "c", "3")
+	if a.LastWriteError() == nil {
+		t.Fatal("no write error reported")
+	}
+	if pending := len(command("SET", "b", "2") + command("SET", "c", "3")); a.BufferLength() != pending {
+		t.Errorf("BufferLength() = %d, want %d", a.BufferLength(), pending)
+	}
+	a.tick()
+	if a.LastWriteError() == nil {
+		t.Error("write error cleared while writes still fail")
+	}
+
+	a.mu.Lock()
+	a.file = good
+	a.mu.Unlock()
+	a.tick()
+	if err := a.LastWriteError(); err != nil {
+		t.Errorf("write error %v after a successful write", err)
+	}
+	want := command("SET", "a", "1") + command("SET", "b", "2") + command("SET", "c", "3")
+	if data, _ := os.ReadFile(good.Name()); string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+	if a.BufferLength() != 0 || a.Size() != int64(len(want)) {
+		t.Errorf("BufferLength() = %d, Size() = %d after the retry", a.BufferLength(), a.Size())
+	}
+}
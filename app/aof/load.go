@@ -0,0 +1,145 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/utils"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rdbMagic starts base files written in the RDB format.
+const rdbMagic = "REDIS"
+
+// Load replays the AOF called name in dir, file by file as its manifest
+// lists them, passing apply each command, or the commands of each MULTI/EXEC
+// block at once. A base file in the RDB format is passed to loadRDB instead.
+// Without a manifest, the AOF is empty.
+//
+// The last file may end in the middle of a command or transaction, cut
+// short by a crash. With loadTruncated, the incomplete tail is removed from
+// the file and the rest is kept; otherwise Load fails, as it does for
+// corruption anywhere else.
+func Load(dir, name string, loadTruncated bool, loadRDB func(path string) error, apply func(cmds []resp.Value)) error {
+	m, err := loadManifest(dir, name)
+	if err != nil {
+		return err
+	}
+	files := m.files()
+	for i, f := range files {
+		path := filepath.Join(dir, f.name)
+		last := i == len(files)-1
+		if f.typ == typeBase && isRDB(path) {
+			if err := loadRDB(path); err != nil {
+				return fmt.Errorf("loading the AOF base %s: %w", f.name, err)
+			}
+			continue
+		}
+		if err := loadFile(path, loadTruncated, last, apply); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// isRDB reports whether the file at path starts like an RDB file.
+func isRDB(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, len(rdbMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte(rdbMagic))
+}
+
+// loadFile replays one file of commands. Only the last file may be
+// truncated, and only if loadTruncated is set.
+func loadFile(path string, loadTruncated, last bool, apply func(cmds []resp.Value)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	parser := resp.NewParser(reader)
+	// valid is the offset just past the last complete command, or the
+	// MULTI of an unfinished transaction.
+	valid := int64(0)
+	var queue []resp.Value
+	inMulti := false
+	for {
+		val, err := parser.Parse()
+		if err != nil {
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("bad file format reading the append only file at offset %d: %w", valid, err)
+			}
+			if err == io.EOF && !inMulti && counter.n == valid {
+				return nil
+			}
+			if !last {
+				return fmt.Errorf("unexpected end of file at offset %d; only the last AOF file may be truncated", valid)
+			}
+			return truncated(path, valid, loadTruncated)
+		}
+		if !utils.IsValidRequest(val) {
+			return fmt.Errorf("bad file format reading the append only file at offset %d", valid)
+		}
+		offset := counter.n - int64(reader.Buffered())
+		switch strings.ToUpper(val.Array[0].Bulk) {
+		case "MULTI":
+			inMulti = true
+			queue = nil
+			continue
+		case "EXEC":
+			if !inMulti {
+				return fmt.Errorf("EXEC without MULTI in the append only file at offset %d", valid)
+			}
+			apply(queue)
+			inMulti = false
+		default:
+			if inMulti {
+				queue = append(queue, val)
+				continue
+			}
+			apply([]resp.Value{val})
+		}
+		valid = offset
+	}
+}
+
+// truncated handles an AOF whose tail past offset valid is incomplete.
+func truncated(path string, valid int64, loadTruncated bool) error {
+	if !loadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file at offset %d; "+
+			"remove the incomplete tail or enable aof-load-truncated", valid)
+	}
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s !!!\n", path)
+	if err := os.Truncate(path, valid); err != nil {
+		return fmt.Errorf("failed to truncate the append only file: %w", err)
+	}
+	fmt.Printf("AOF loaded anyway because aof-load-truncated is enabled; truncated to %d bytes\n", valid)
+	return nil
+}
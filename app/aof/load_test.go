@@ -0,0 +1,248 @@
+package aof
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// command encodes args the way Feed writes them.
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// writeAOF creates the AOF "appendonly.aof" in dir from the manifest and
+// file contents given.
+func writeAOF(t *testing.T, dir, manifest string, files map[string]string) {
+	t.Helper()
+	if manifest != "" {
+		if err := os.WriteFile(filepath.Join(dir, manifestName("appendonly.aof")), []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replay loads the AOF in dir and returns what was applied, one line per
+// call of apply, and the RDB files handed to loadRDB.
+func replay(dir string, loadTruncated bool) ([]string, []string, error) {
+	var applied, rdbs []string
+	loadRDB := func(path string) error {
+		rdbs = append(rdbs, filepath.Base(path))
+		return nil
+	}
+	err := Load(dir, "appendonly.aof", loadTruncated, loadRDB, func(cmds []resp.Value) {
+		var parts []string
+		for _, cmd := range cmds {
+			var args []string
+			for _, arg := range cmd.Array {
+				args = append(args, arg.Bulk)
+			}
+			parts = append(parts, strings.Join(args, " "))
+		}
+		applied = append(applied, strings.Join(parts, "; "))
+	})
+	return applied, rdbs, err
+}
+
+const twoFileManifest = "file appendonly.aof.1.base.aof seq 1 type b\n" +
+	"file appendonly.aof.1.incr.aof seq 1 type i\n"
+
+func TestLoad(t *testing.T) {
+	base := command("SET", "a", "1") + command("SET", "b", "2")
+	incr := command("INCR", "a") + command("MULTI") + command("SET", "c", "3") + command("DEL", "b") + command("EXEC")
+	tail := command("SET", "d", "4")
+	complete := []string{"SET a 1", "SET b 2", "INCR a", "SET c 3; DEL b"}
+
+	tests := []struct {
+		name          string
+		manifest      string
+		files         map[string]string
+		loadTruncated bool
+		want          []string
+		wantRDBs      []string
+		wantErr       string
+		// wantSize is the size the last file should have afterwards.
+		wantSize int
+	}{
+		{
+			name:     "complete",
+			manifest: twoFileManifest,
+			files:    map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": incr},
+			want:     complete,
+			wantSize: len(incr),
+		},
+		{
+			name:     "no manifest",
+			manifest: "",
+		},
+		{
+			name:          "truncated command, loaded",
+			manifest:      twoFileManifest,
+			files:         map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": incr + tail[:len(tail)-3]},
+			loadTruncated: true,
+			want:          complete,
+			wantSize:      len(incr),
+		},
+		{
+			name:     "truncated command, refused",
+			manifest: twoFileManifest,
+			files:    map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": incr + tail[:len(tail)-3]},
+			wantErr:  "aof-load-truncated",
+			wantSize: len(incr) + len(tail) - 3,
+		},
+		{
+			name:          "truncated inside a transaction",
+			manifest:      twoFileManifest,
+			files:         map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": incr + command("MULTI") + tail},
+			loadTruncated: true,
+			want:          complete,
+			wantSize:      len(incr),
+		},
+		{
+			name:          "truncated at the first byte",
+			manifest:      twoFileManifest,
+			files:         map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": "*"},
+			loadTruncated: true,
+			want:          []string{"SET a 1", "SET b 2"},
+			wantSize:      0,
+		},
+		{
+			name:          "truncated file before the last",
+			manifest:      twoFileManifest,
+			files:         map[string]string{"appendonly.aof.1.base.aof": base + "*3\r\n$3", "appendonly.aof.1.incr.aof": incr},
+			loadTruncated: true,
+			wantErr:       "only the last AOF file may be truncated",
+			wantSize:      len(incr),
+		},
+		{
+			name:          "corrupt tail",
+			manifest:      twoFileManifest,
+			files:         map[string]string{"appendonly.aof.1.base.aof": base, "appendonly.aof.1.incr.aof": incr + "garbage\r\n" + tail},
+			loadTruncated: true,
+			wantErr:       "bad file format",
+			wantSize:      len(incr) + len("garbage\r\n") + len(tail),
+		},
+		{
+			name:     "RDB base",
+			manifest: "file appendonly.aof.2.base.rdb seq 2 type b\nfile appendonly.aof.3.incr.aof seq 3 type i\n",
+			files:    map[string]string{"appendonly.aof.2.base.rdb": "REDIS0011", "appendonly.aof.3.incr.aof": incr},
+			want:     []string{"INCR a", "SET c 3; DEL b"},
+			wantRDBs: []string{"appendonly.aof.2.base.rdb"},
+			wantSize: len(incr),
+		},
+		{
+			name: "increments listed out of order",
+			manifest: "file appendonly.aof.2.incr.aof seq 2 type i\n" +
+				"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+				"file appendonly.aof.0.base.aof seq 9 type h\n",
+			files:    map[string]string{"appendonly.aof.1.incr.aof": base, "appendonly.aof.2.incr.aof": incr},
+			want:     complete,
+			wantSize: len(incr),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeAOF(t, dir, tt.manifest, tt.files)
+			applied, rdbs, err := replay(dir, tt.loadTruncated)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Load error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && !reflect.DeepEqual(applied, tt.want) {
+				t.Errorf("applied %q, want %q", applied, tt.want)
+			}
+			if !reflect.DeepEqual(rdbs, tt.wantRDBs) {
+				t.Errorf("RDB files loaded %q, want %q", rdbs, tt.wantRDBs)
+			}
+			if tt.manifest == "" {
+				return
+			}
+			m, err := parseManifest(tt.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := m.files()
+			info, err := os.Stat(filepath.Join(dir, files[len(files)-1].name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(tt.wantSize) {
+				t.Errorf("last file is %d bytes, want %d", info.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestLoadTruncatedTwice(t *testing.T) {
+	// Once truncated, the file loads cleanly even without
+	// aof-load-truncated.
+	dir := t.TempDir()
+	incr := command("SET", "a", "1")
+	writeAOF(t, dir, "file appendonly.aof.1.incr.aof seq 1 type i\n",
+		map[string]string{"appendonly.aof.1.incr.aof": incr + command("SET", "b", "2")[:7]})
+	for _, loadTruncated := range []bool{true, false} {
+		applied, _, err := replay(dir, loadTruncated)
+		if err != nil {
+			t.Fatalf("Load with loadTruncated=%v: %v", loadTruncated, err)
+		}
+		if want := []string{"SET a 1"}; !reflect.DeepEqual(applied, want) {
+			t.Errorf("applied %q, want %q", applied, want)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "base and increments",
+			data: "file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq 2 type i\n",
+			want: "file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq 2 type i\n",
+		},
+		{
+			name: "comments, blank lines and unknown keys",
+			data: "# comment\n\nfile a.1.incr.aof seq 1 type i startoffset 0\n",
+			want: "file a.1.incr.aof seq 1 type i\n",
+		},
+		{name: "two bases", data: "file a.1.base.aof seq 1 type b\nfile a.2.base.aof seq 2 type b\n", wantErr: true},
+		{name: "file listed twice", data: "file a seq 1 type i\nfile a seq 2 type i\n", wantErr: true},
+		{name: "increments sharing a seq", data: "file a seq 1 type i\nfile b seq 1 type i\n", wantErr: true},
+		{name: "zero seq", data: "file a seq 0 type i\n", wantErr: true},
+		{name: "unknown type", data: "file a seq 1 type x\n", wantErr: true},
+		{name: "odd number of fields", data: "file a seq 1 type\n", wantErr: true},
+		{name: "path in the name", data: "file ../a seq 1 type i\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseManifest(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseManifest error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && m.String() != tt.want {
+				t.Errorf("parsed manifest:\n%s\nwant:\n%s", m, tt.want)
+			}
+		})
+	}
+}
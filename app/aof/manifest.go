@@ -0,0 +1,264 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File types in the manifest, as in Redis 7.
+const (
+	typeBase    = "b"
+	typeIncr    = "i"
+	typeHistory = "h"
+)
+
+// aofFile is one entry of the manifest.
+type aofFile struct {
+	name string
+	seq  int64
+	typ  string
+}
+
+// manifest lists the files that make up the AOF: at most one base, holding
+// the dataset as of the last rewrite in RDB or AOF format, then the
+// incremental files written since, replayed in order. History files are
+// bases and increments superseded by a rewrite, waiting to be deleted.
+type manifest struct {
+	base    *aofFile
+	incrs   []aofFile
+	history []aofFile
+}
+
+func manifestName(name string) string {
+	return name + ".manifest"
+}
+
+func baseName(name string, seq int64, rdbFormat bool) string {
+	if rdbFormat {
+		return fmt.Sprintf("%s.%d.base.rdb", name, seq)
+	}
+	return fmt.Sprintf("%s.%d.base.aof", name, seq)
+}
+
+func incrName(name string, seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
+
+// nextSeq returns the sequence number for a new file of type typ, base or
+// incremental. History files count too, so a new file never takes the name
+// of an old one that couldn't be deleted.
+func (m *manifest) nextSeq(typ string) int64 {
+	files, suffix := m.incrs, ".incr."
+	if typ == typeBase {
+		files, suffix = nil, ".base."
+		if m.base != nil {
+			files = []aofFile{*m.base}
+		}
+	}
+	seq := int64(0)
+	for _, f := range files {
+		seq = max(seq, f.seq)
+	}
+	for _, f := range m.history {
+		if strings.Contains(f.name, suffix) {
+			seq = max(seq, f.seq)
+		}
+	}
+	return seq + 1
+}
+
+// files returns the files to replay, in order.
+func (m *manifest) files() []aofFile {
+	var files []aofFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) String() string {
+	var b strings.Builder
+	for _, f := range append(m.files(), m.history...) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.name, f.seq, f.typ)
+	}
+	return b.String()
+}
+
+// parseManifest parses a manifest, refusing anything inconsistent: unknown
+// keys or types, a second base, or a file listed twice. Increments out of
+// order are sorted back into order.
+func parseManifest(data string) (*manifest, error) {
+	m := &manifest{}
+	seen := map[string]bool{}
+	incrSeqs := map[int64]bool{}
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", n+1, line)
+		}
+		var f aofFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil || seq <= 0 {
+					return nil, fmt.Errorf("invalid sequence number on manifest line %d", n+1)
+				}
+				f.seq = seq
+			case "type":
+				f.typ = fields[i+1]
+			default:
+				// Unknown keys are left for newer versions, as Redis does.
+			}
+		}
+		if f.name == "" || f.seq == 0 || strings.ContainsRune(f.name, os.PathSeparator) {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", n+1, line)
+		}
+		if seen[f.name] {
+			return nil, fmt.Errorf("file %s is listed twice in the manifest", f.name)
+		}
+		seen[f.name] = true
+		switch f.typ {
+		case typeBase:
+			if m.base != nil {
+				return nil, errors.New("the manifest lists more than one base file")
+			}
+			m.base = &f
+		case typeIncr:
+			if incrSeqs[f.seq] {
+				return nil, fmt.Errorf("incremental files with the same sequence number %d in the manifest", f.seq)
+			}
+			incrSeqs[f.seq] = true
+			m.incrs = append(m.incrs, f)
+		case typeHistory:
+			m.history = append(m.history, f)
+		default:
+			return nil, fmt.Errorf("unknown file type %q on manifest line %d", f.typ, n+1)
+		}
+	}
+	sort.Slice(m.incrs, func(i, j int) bool { return m.incrs[i].seq < m.incrs[j].seq })
+	return m, nil
+}
+
+// persistManifest replaces the manifest in dir atomically.
+func persistManifest(dir, name string, m *manifest) error {
+	tmpPath := filepath.Join(dir, "temp-"+manifestName(name))
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(m.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(dir, manifestName(name)))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("persisting the AOF manifest: %w", err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// loadManifest reads the manifest of the AOF called name in dir and repairs
+// what can be repaired: history files are deleted, as are temporary files a
+// crash left behind, and increments are put back in order. It returns an
+// empty manifest if there is none and dir holds no AOF files; files without
+// a manifest are refused, as nothing says how to replay them.
+func loadManifest(dir, name string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName(name)))
+	if os.IsNotExist(err) {
+		parts, _ := filepath.Glob(filepath.Join(dir, name+".*.aof"))
+		rdbParts, _ := filepath.Glob(filepath.Join(dir, name+".*.rdb"))
+		if len(parts)+len(rdbParts) > 0 {
+			return nil, fmt.Errorf("found AOF files in %s but no manifest %s", dir, manifestName(name))
+		}
+		return &manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AOF manifest %s: %w", manifestName(name), err)
+	}
+	for _, f := range m.files() {
+		if _, err := os.Stat(filepath.Join(dir, f.name)); err != nil {
+			return nil, fmt.Errorf("AOF file %s listed in the manifest: %w", f.name, err)
+		}
+	}
+	temps, _ := filepath.Glob(filepath.Join(dir, "temp-*"))
+	for _, path := range temps {
+		os.Remove(path)
+	}
+	removeHistory(dir, m)
+	if m.String() != string(data) {
+		fmt.Println("Repaired the AOF manifest")
+		if err := persistManifest(dir, name, m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// removeHistory deletes the history files and drops them from the
+// manifest, which the caller then persists. After a crash part way, the
+// manifest lists history files that are gone, and they are dropped then.
+func removeHistory(dir string, m *manifest) {
+	for _, f := range m.history {
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to remove the AOF history file %s: %v\n", f.name, err)
+		}
+	}
+	m.history = nil
+}
+
+// UpgradeSingleFile moves a single-file AOF at oldPath, as written before
+// the AOF had several parts, into dir as the base of a new manifest. It does
+// nothing if there is no such file or dir already holds a manifest.
+func UpgradeSingleFile(oldPath, dir, name string) error {
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName(name))); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	m := &manifest{base: &aofFile{name: name, seq: 1, typ: typeBase}}
+	if err := persistManifest(dir, name, m); err != nil {
+		return err
+	}
+	fmt.Printf("Moved the append only file %s into %s\n", oldPath, dir)
+	return nil
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
@@ -0,0 +1,186 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// itemsPerCommand caps the elements of a collection written by one command,
+// so that loading a rewritten file never parses huge commands.
+const itemsPerCommand = 64
+
+// rewriter writes commands, keeping the first error.
+type rewriter struct {
+	w   io.Writer
+	err error
+}
+
+func (r *rewriter) emit(args ...string) {
+	if r.err != nil {
+		return
+	}
+	cmd := resp.Value{Typ: "array", Array: make([]resp.Value, len(args))}
+	for i, arg := range args {
+		cmd.Array[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	_, r.err = r.w.Write(cmd.Serializer())
+}
+
+// emitBatched writes command key followed by items, itemsPerCommand
+// elements of width values each at a time.
+func (r *rewriter) emitBatched(command, key string, width int, items []string) {
+	for len(items) > 0 {
+		n := min(len(items), itemsPerCommand*width)
+		r.emit(append([]string{command, key}, items[:n]...)...)
+		items = items[n:]
+	}
+}
+
+// WriteDataset writes the shortest command stream it can that rebuilds the
+// dataset: one or a few commands per key instead of its whole history. The
+// caller keeps the keyspace from changing meanwhile.
+func WriteDataset(w io.Writer, kV *kv.KV) error {
+	r := &rewriter{w: w}
+	rewriteStrings(r, kV)
+	rewriteLists(r, kV)
+	rewriteHashes(r, kV)
+	rewriteSets(r, kV)
+	rewriteSortedSets(r, kV)
+	rewriteStreams(r, kV)
+	if err := rewriteModules(r, kV); err != nil {
+		return err
+	}
+	return r.err
+}
+
+func rewriteStrings(r *rewriter, kV *kv.KV) {
+	kV.StringsMu.RLock()
+	defer kV.StringsMu.RUnlock()
+	now := time.Now().UnixMilli()
+	for key, value := range kV.Strings {
+		if value.Expires > 0 && value.Expires <= now {
+			continue
+		}
+		if value.Expires > 0 {
+			r.emit("SET", key, value.Str, "PXAT", strconv.FormatInt(value.Expires, 10))
+		} else {
+			r.emit("SET", key, value.Str)
+		}
+	}
+}
+
+func rewriteLists(r *rewriter, kV *kv.KV) {
+	kV.ListsMu.RLock()
+	defer kV.ListsMu.RUnlock()
+	for key, list := range kV.Lists {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = item.Bulk
+		}
+		r.emitBatched("RPUSH", key, 1, items)
+	}
+}
+
+func rewriteHashes(r *rewriter, kV *kv.KV) {
+	kV.HashesMu.RLock()
+	defer kV.HashesMu.RUnlock()
+	for key, hash := range kV.Hashes {
+		items := make([]string, 0, 2*len(hash))
+		for field, value := range hash {
+			items = append(items, field, value.Bulk)
+		}
+		r.emitBatched("HSET", key, 2, items)
+	}
+}
+
+func rewriteSets(r *rewriter, kV *kv.KV) {
+	kV.SetsMu.RLock()
+	defer kV.SetsMu.RUnlock()
+	for key, members := range kV.Sets {
+		items := make([]string, 0, len(members))
+		for member := range members {
+			items = append(items, member)
+		}
+		r.emitBatched("SADD", key, 1, items)
+	}
+}
+
+func rewriteSortedSets(r *rewriter, kV *kv.KV) {
+	kV.SortedsMu.RLock()
+	defer kV.SortedsMu.RUnlock()
+	for key, sortedSet := range kV.Sorteds {
+		members := sortedSet.Members()
+		items := make([]string, 0, 2*len(members))
+		for _, m := range members {
+			items = append(items, strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member)
+		}
+		r.emitBatched("ZADD", key, 2, items)
+	}
+}
+
+// rewriteStreams writes each stream as its entries, then XSETID for the
+// counters, then its groups with their consumers and pending entries.
+// Pending entries of deleted messages are dropped, as XCLAIM drops them.
+func rewriteStreams(r *rewriter, kV *kv.KV) {
+	kV.StreamsMu.RLock()
+	defer kV.StreamsMu.RUnlock()
+	for key, stream := range kV.Streams {
+		entries := stream.Entries()
+		for _, entry := range entries {
+			args := []string{"XADD", key, entry.ID.ToString()}
+			for _, f := range entry.Fields {
+				args = append(args, f.Name, f.Value)
+			}
+			r.emit(args...)
+		}
+		if len(entries) == 0 {
+			// Create the empty stream by adding an entry that MAXLEN 0 trims
+			// right away; XSETID then restores the real counters.
+			id := stream.LastID
+			if id == (kv.StreamId{}) {
+				id.Sequence = 1
+			}
+			r.emit("XADD", key, "MAXLEN", "0", id.ToString(), "x", "y")
+		}
+		r.emit("XSETID", key, stream.LastID.ToString(),
+			"ENTRIESADDED", strconv.FormatUint(stream.EntriesAdded, 10),
+			"MAXDELETEDID", stream.MaxDeletedID.ToString())
+		for _, group := range stream.Groups {
+			r.emit("XGROUP", "CREATE", key, group.Name, group.LastID.ToString(),
+				"ENTRIESREAD", strconv.FormatInt(group.EntriesRead, 10))
+			if group.MaxDeliveries > 0 {
+				r.emit("XGROUP", "SETDEADLETTER", key, group.Name,
+					strconv.FormatUint(group.MaxDeliveries, 10), group.DeadLetterKey)
+			}
+			for _, consumer := range group.Consumers {
+				r.emit("XGROUP", "CREATECONSUMER", key, group.Name, consumer.Name)
+			}
+			for _, id := range kv.SortedPendingIDs(group.Pending) {
+				nack := group.Pending[id]
+				r.emit("XCLAIM", key, group.Name, nack.Consumer, "0", id.ToString(),
+					"TIME", strconv.FormatInt(nack.DeliveryTime, 10),
+					"RETRYCOUNT", strconv.FormatUint(nack.DeliveryCount, 10),
+					"JUSTID", "FORCE")
+			}
+		}
+	}
+}
+
+func rewriteModules(r *rewriter, kV *kv.KV) error {
+	kV.ModulesMu.RLock()
+	defer kV.ModulesMu.RUnlock()
+	for key, mv := range kV.Modules {
+		if mv.Type.AOFRewrite == nil {
+			return fmt.Errorf("module type %s doesn't support AOF rewrites", mv.Type.Name)
+		}
+		mv.Type.AOFRewrite(func(command string, args ...string) {
+			r.emit(append([]string{command}, args...)...)
+		}, key, mv.Value)
+	}
+	return nil
+}
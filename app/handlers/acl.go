@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// acl implements ACL CAT. There are no users or permissions yet; the
+// categories only describe the commands.
+func acl(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if strings.ToUpper(args[0].Bulk) != "CAT" {
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", args[0].Bulk)}
+	}
+	if len(args) > 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'acl|cat' command"}
+	}
+	members := map[string][]string{}
+	for command := range Commands {
+		for _, category := range CommandCategories(command) {
+			members[category] = append(members[category], strings.ToLower(command))
+		}
+	}
+	var names []string
+	if len(args) == 1 {
+		for category := range members {
+			names = append(names, category)
+		}
+	} else {
+		category := strings.ToLower(strings.TrimPrefix(args[1].Bulk, "@"))
+		var ok bool
+		if names, ok = members[category]; !ok {
+			return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR Unknown category '%s'", args[1].Bulk)}
+		}
+	}
+	sort.Strings(names)
+	result := make([]resp.Value, len(names))
+	for i, name := range names {
+		result[i] = resp.Value{Typ: "bulk", Bulk: name}
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// Command flags, modelled on the flags of the Redis command table.
+const (
+	// CmdWrite marks commands that may modify the keyspace.
+	CmdWrite = 1 << iota
+	// CmdReadOnly marks commands that only read data.
+	CmdReadOnly
+	// CmdBlocking marks commands that may block the client. Inside a
+	// transaction they behave as if their timeout expired immediately.
+	CmdBlocking
+	// CmdNoMulti marks commands that cannot be queued in a transaction.
+	CmdNoMulti
+	// CmdNoScript marks commands that cannot be called from scripts.
+	CmdNoScript
+	// CmdPubSub marks the publish/subscribe commands.
+	CmdPubSub
+	// CmdAdmin marks server administration commands.
+	CmdAdmin
+	// CmdExclusive marks commands that write keys of several types, which no
+	// single type lock orders against other writers. Like EXEC, they run
+	// holding the keyspace exclusively, so they reach the AOF and replicas in
+	// the order they were applied.
+	CmdExclusive
+)
+
+// CommandInfo describes a command for validation before it runs. Arity
+// follows the Redis convention: it counts the command name, and a negative
+// value -N means "at least N".
+type CommandInfo struct {
+	Arity int
+	Flags int
+}
+
+func (c CommandInfo) Has(flag int) bool {
+	return c.Flags&flag != 0
+}
+
+var Commands = map[string]CommandInfo{
+	"PING": {-1, 0},
+	"ECHO": {2, 0},
+	"TYPE": {2, CmdReadOnly},
+	// keyspace commands
+	"DEL":      {-2, CmdWrite | CmdExclusive},
+	"FLUSHALL": {-1, CmdWrite | CmdExclusive},
+	"FLUSHDB":  {-1, CmdWrite | CmdExclusive},
+	// strings command
+	"SET":  {-3, CmdWrite},
+	"GET":  {2, CmdReadOnly},
+	"INCR": {2, CmdWrite},
+	// list commands
+	"RPUSH":  {-3, CmdWrite},
+	"LRANGE": {4, CmdReadOnly},
+	"LPUSH":  {-3, CmdWrite},
+	"LLEN":   {2, CmdReadOnly},
+	"LPOP":   {-2, CmdWrite},
+	"RPOP":   {-2, CmdWrite},
+	"BLPOP":  {-3, CmdWrite | CmdBlocking},
+	// Set commands
+	"SADD":     {-3, CmdWrite},
+	"SMEMBERS": {2, CmdReadOnly},
+	"SREM":     {-3, CmdWrite},
+	"SCARD":    {2, CmdReadOnly},
+	"SUNION":   {-2, CmdReadOnly},
+	"SINTER":   {-2, CmdReadOnly},
+	// Hash set command
+	"HSET":    {-4, CmdWrite},
+	"HGET":    {3, CmdReadOnly},
+	"HEXISTS": {3, CmdReadOnly},
+	"HDEL":    {-3, CmdWrite},
+	"HLEN":    {2, CmdReadOnly},
+	"HKEYS":   {2, CmdReadOnly},
+	"HVALS":   {2, CmdReadOnly},
+	// Stream commands
+	"XADD":      {-5, CmdWrite},
+	"XSETID":    {-3, CmdWrite},
+	"XRANGE":    {-4, CmdReadOnly},
+	"XREVRANGE": {-4, CmdReadOnly},
+	"XLEN":      {2, CmdReadOnly},
+	"XDEL":      {-3, CmdWrite},
+	"XTRIM":     {-4, CmdWrite},
+	"XINFO":     {-2, CmdReadOnly},
+	"XREAD":     {-4, CmdReadOnly | CmdBlocking},
+	// stream consumer groups. XGROUP SETDEADLETTER is an extension of this
+	// server; Redis has no dead-letter streams.
+	"XGROUP":     {-2, CmdWrite},
+	"XREADGROUP": {-7, CmdWrite | CmdBlocking},
+	"XACK":       {-4, CmdWrite},
+	"XPENDING":   {-3, CmdReadOnly},
+	"XCLAIM":     {-6, CmdWrite},
+	"XAUTOCLAIM": {-6, CmdWrite},
+	// sorted set commands
+	"ZADD":             {-4, CmdWrite},
+	"ZINCRBY":          {4, CmdWrite},
+	"ZSCORE":           {3, CmdReadOnly},
+	"ZCARD":            {2, CmdReadOnly},
+	"ZREM":             {-3, CmdWrite},
+	"ZRANK":            {-3, CmdReadOnly},
+	"ZRANGE":           {-4, CmdReadOnly},
+	"ZRANGESTORE":      {-5, CmdWrite},
+	"ZREVRANGE":        {-4, CmdReadOnly},
+	"ZRANGEBYSCORE":    {-4, CmdReadOnly},
+	"ZREVRANGEBYSCORE": {-4, CmdReadOnly},
+	"ZRANGEBYLEX":      {-4, CmdReadOnly},
+	"ZREVRANGEBYLEX":   {-4, CmdReadOnly},
+	"ZREVRANK":         {-3, CmdReadOnly},
+	"ZUNION":           {-3, CmdReadOnly},
+	"ZINTER":           {-3, CmdReadOnly},
+	"ZDIFF":            {-3, CmdReadOnly},
+	"ZUNIONSTORE":      {-4, CmdWrite},
+	"ZINTERSTORE":      {-4, CmdWrite},
+	"ZDIFFSTORE":       {-4, CmdWrite},
+	"ZINTERCARD":       {-3, CmdReadOnly},
+	"ZCOUNT":           {4, CmdReadOnly},
+	"ZLEXCOUNT":        {4, CmdReadOnly},
+	"ZPOPMIN":          {-2, CmdWrite},
+	"ZPOPMAX":          {-2, CmdWrite},
+	"ZMPOP":            {-4, CmdWrite},
+	"ZREMRANGEBYRANK":  {4, CmdWrite},
+	"ZREMRANGEBYSCORE": {4, CmdWrite},
+	"ZREMRANGEBYLEX":   {4, CmdWrite},
+	"ZRANDMEMBER":      {-2, CmdReadOnly},
+	"ZMSCORE":          {-3, CmdReadOnly},
+	// rdb
+	"BGSAVE":   {-1, CmdAdmin | CmdNoMulti | CmdNoScript},
+	"SAVE":     {1, CmdAdmin | CmdNoMulti | CmdNoScript},
+	"LASTSAVE": {1, CmdAdmin},
+	// aof
+	"BGREWRITEAOF": {1, CmdAdmin | CmdNoMulti | CmdNoScript},
+	// pubsub
+	"PUBLISH":     {3, CmdPubSub},
+	"SUBSCRIBE":   {-2, CmdPubSub | CmdNoScript},
+	"UNSUBSCRIBE": {-1, CmdPubSub | CmdNoScript},
+	// replications
+	"INFO":     {-1, 0},
+	"REPLCONF": {-1, CmdAdmin | CmdNoScript},
+	"PSYNC":    {-3, CmdAdmin | CmdNoMulti | CmdNoScript},
+	"CONFIG":   {-2, CmdAdmin | CmdNoScript},
+	// server
+	"ACL":   {-2, CmdAdmin | CmdNoScript},
+	"DEBUG": {-2, CmdAdmin | CmdNoScript},
+	// scripting
+	"EVAL":       {-3, CmdNoScript},
+	"EVALSHA":    {-3, CmdNoScript},
+	"EVAL_RO":    {-3, CmdNoScript},
+	"EVALSHA_RO": {-3, CmdNoScript},
+	"SCRIPT":     {-2, CmdNoScript},
+	// transactions
+	"MULTI":   {1, CmdNoScript},
+	"EXEC":    {1, CmdNoScript},
+	"DISCARD": {1, CmdNoScript},
+	"WATCH":   {-2, CmdNoScript},
+	"UNWATCH": {1, CmdNoScript},
+}
+
+// flagCategories lists the ACL categories implied by command flags.
+var flagCategories = []struct {
+	flag     int
+	category string
+}{
+	{CmdWrite, "write"},
+	{CmdReadOnly, "read"},
+	{CmdBlocking, "blocking"},
+	{CmdPubSub, "pubsub"},
+	{CmdAdmin, "admin"},
+}
+
+// commandCategories holds the ACL categories of commands beyond those their
+// flags imply, such as the ones modules declare for their commands.
+var commandCategories = map[string][]string{}
+
+// CommandCategories returns the ACL categories of a command.
+func CommandCategories(command string) []string {
+	info := Commands[command]
+	var categories []string
+	for _, fc := range flagCategories {
+		if info.Has(fc.flag) {
+			categories = append(categories, fc.category)
+		}
+	}
+	return append(categories, commandCategories[command]...)
+}
+
+// ValidateCommand looks up a command and checks its arity, returning the
+// error to reply with when the call can't run.
+func ValidateCommand(command string, args []resp.Value) (CommandInfo, *resp.Value) {
+	info, ok := Commands[command]
+	if !ok {
+		var quoted strings.Builder
+		for _, arg := range args {
+			fmt.Fprintf(&quoted, "'%s' ", arg.Bulk)
+		}
+		return info, &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", strings.ToLower(command), quoted.String())}
+	}
+	argc := len(args) + 1
+	if (info.Arity > 0 && argc != info.Arity) || argc < -info.Arity {
+		return info, &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))}
+	}
+	return info, nil
+}
+
+// Call runs a single command outside of any transaction. Commands share the
+// keyspace with each other but never overlap a running EXEC or script;
+// CmdExclusive commands don't overlap anything.
+func Call(command string, args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
+	handler, ok := Handlers[command]
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR unknown command '" + strings.ToLower(command) + "'"}
+	}
+	if isScriptCommand(command) || moduleCommands[command] || Commands[command].Has(CmdExclusive) {
+		server.KV.KeyspaceMu.Lock()
+		defer server.KV.KeyspaceMu.Unlock()
+		return invoke(handler, args, server, client)
+	}
+	server.KV.KeyspaceMu.RLock()
+	defer server.KV.KeyspaceMu.RUnlock()
+	return invoke(handler, args, server, client)
+}
+
+// invoke runs a handler and then delivers the keyspace events it raised,
+// now that it has released the locks it took.
+func invoke(handler HandlerFunc, args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
+	reply := handler(args, server, client)
+	server.KV.DispatchKeyspaceEvents()
+	return reply
+}
+
+// withKeyspaceReleased runs wait with the caller's shared hold on KeyspaceMu
+// dropped, so a blocked client never holds up an EXEC. Only commands started
+// through Call may block.
+func withKeyspaceReleased(kV *kv.KV, wait func()) {
+	kV.KeyspaceMu.RUnlock()
+	defer kV.KeyspaceMu.RLock()
+	wait()
+}
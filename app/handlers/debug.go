@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// debug implements DEBUG DIGEST and DEBUG DIGEST-VALUE, which let tests
+// compare datasets, for example a master's and a replica's.
+func debug(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	kV := server.KV
+	switch strings.ToUpper(args[0].Bulk) {
+	case "DIGEST":
+		if len(args) != 1 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'debug|digest' command"}
+		}
+		var final [20]byte
+		for _, key := range allKeys(kV) {
+			var digest [20]byte
+			kv.MixDigest(&digest, key)
+			valueDigest(kV, key, &digest)
+			kv.XorDigest(&final, string(digest[:]))
+		}
+		return resp.Value{Typ: "bulk", Bulk: hex.EncodeToString(final[:])}
+	case "DIGEST-VALUE":
+		result := make([]resp.Value, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			var digest [20]byte
+			valueDigest(kV, arg.Bulk, &digest)
+			result = append(result, resp.Value{Typ: "bulk", Bulk: hex.EncodeToString(digest[:])})
+		}
+		return resp.Value{Typ: "array", Array: result}
+	default:
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try DEBUG HELP.", args[0].Bulk)}
+	}
+}
+
+func allKeys(kV *kv.KV) []string {
+	var keys []string
+	kV.StringsMu.RLock()
+	for key := range kV.Strings {
+		keys = append(keys, key)
+	}
+	kV.StringsMu.RUnlock()
+	kV.ListsMu.RLock()
+	for key := range kV.Lists {
+		keys = append(keys, key)
+	}
+	kV.ListsMu.RUnlock()
+	kV.HashesMu.RLock()
+	for key := range kV.Hashes {
+		keys = append(keys, key)
+	}
+	kV.HashesMu.RUnlock()
+	kV.SetsMu.RLock()
+	for key := range kV.Sets {
+		keys = append(keys, key)
+	}
+	kV.SetsMu.RUnlock()
+	kV.SortedsMu.RLock()
+	for key := range kV.Sorteds {
+		keys = append(keys, key)
+	}
+	kV.SortedsMu.RUnlock()
+	kV.StreamsMu.RLock()
+	for key := range kV.Streams {
+		keys = append(keys, key)
+	}
+	kV.StreamsMu.RUnlock()
+	kV.ModulesMu.RLock()
+	for key := range kV.Modules {
+		keys = append(keys, key)
+	}
+	kV.ModulesMu.RUnlock()
+	return keys
+}
+
+// valueDigest folds the value at key into digest. Ordered values are mixed
+// in order; the members of sets, hashes and sorted sets are combined so that
+// their iteration order doesn't matter. A missing key leaves digest as is.
+func valueDigest(kV *kv.KV, key string, digest *[20]byte) {
+	kV.StringsMu.RLock()
+	value, ok := kV.Strings[key]
+	kV.StringsMu.RUnlock()
+	if ok {
+		kv.MixDigest(digest, value.Str)
+		return
+	}
+
+	kV.ListsMu.RLock()
+	list, ok := kV.Lists[key]
+	if ok {
+		for _, item := range list {
+			kv.MixDigest(digest, item.Bulk)
+		}
+	}
+	kV.ListsMu.RUnlock()
+	if ok {
+		return
+	}
+
+	kV.HashesMu.RLock()
+	hash, ok := kV.Hashes[key]
+	if ok {
+		for field, value := range hash {
+			var pair [20]byte
+			kv.MixDigest(&pair, field)
+			kv.MixDigest(&pair, value.Bulk)
+			kv.XorDigest(digest, string(pair[:]))
+		}
+	}
+	kV.HashesMu.RUnlock()
+	if ok {
+		return
+	}
+
+	kV.SetsMu.RLock()
+	set, ok := kV.Sets[key]
+	if ok {
+		for member := range set {
+			kv.XorDigest(digest, member)
+		}
+	}
+	kV.SetsMu.RUnlock()
+	if ok {
+		return
+	}
+
+	kV.SortedsMu.RLock()
+	sorted, ok := kV.Sorteds[key]
+	if ok {
+		for _, m := range sorted.Members() {
+			var pair [20]byte
+			kv.MixDigest(&pair, m.Member)
+			kv.MixDigest(&pair, strconv.FormatFloat(m.Score, 'g', 17, 64))
+			kv.XorDigest(digest, string(pair[:]))
+		}
+	}
+	kV.SortedsMu.RUnlock()
+	if ok {
+		return
+	}
+
+	kV.StreamsMu.RLock()
+	stream, ok := kV.Streams[key]
+	if ok {
+		for _, entry := range stream.Entries() {
+			kv.MixDigest(digest, entry.ID.ToString())
+			for _, f := range entry.Fields {
+				kv.MixDigest(digest, f.Name)
+				kv.MixDigest(digest, f.Value)
+			}
+		}
+		for _, name := range sortedGroupNames(stream) {
+			kv.MixDigest(digest, name)
+			kv.MixDigest(digest, stream.Groups[name].LastID.ToString())
+		}
+	}
+	kV.StreamsMu.RUnlock()
+	if ok {
+		return
+	}
+
+	kV.ModulesMu.RLock()
+	mv, ok := kV.Modules[key]
+	if ok && mv.Type.Digest != nil {
+		var md kv.Digest
+		mv.Type.Digest(&md, mv.Value)
+		sum := md.Sum()
+		kv.XorDigest(digest, string(sum[:]))
+	}
+	kV.ModulesMu.RUnlock()
+}
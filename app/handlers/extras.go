@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/rdb"
 	"github.com/r1i2t3/go-redis/app/resp"
 	"github.com/r1i2t3/go-redis/app/types"
 )
@@ -13,12 +15,12 @@ func ping(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 		return resp.Value{Typ: "string", Str: "PONG"}
 	}
 
-	return resp.Value{Typ: "string", Str: val[0].Bulk}
+	return resp.Value{Typ: "bulk", Bulk: val[0].Bulk}
 }
 
 func echo(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	if len(val) == 1 && val[0].Typ == "bulk" {
-		return resp.Value{Typ: "string", Str: val[0].Bulk}
+		return resp.Value{Typ: "bulk", Bulk: val[0].Bulk}
 	}
 	return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'echo' command"}
 }
@@ -27,51 +29,87 @@ func typeRedis(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Va
 	if len(val) != 1 {
 		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'type' command"}
 	}
-	key := val[0].Bulk
-	kv := server.KV
+	return resp.Value{Typ: "string", Str: KeyType(server.KV, val[0].Bulk)}
+}
+
+// KeyType returns the name of the type of the value at key, as TYPE reports
+// it, or "none" if the key doesn't exist.
+func KeyType(kv *kv.KV, key string) string {
 	kv.StringsMu.RLock()
-	if _, ok := kv.Strings[key]; ok {
-		return resp.Value{Typ: "string", Str: "string"}
-	}
+	_, ok := kv.Strings[key]
 	kv.StringsMu.RUnlock()
+	if ok {
+		return "string"
+	}
 
 	kv.HashesMu.RLock()
-	if _, ok := kv.Hashes[key]; ok {
-		return resp.Value{Typ: "string", Str: "hash"}
-	}
+	_, ok = kv.Hashes[key]
 	kv.HashesMu.RUnlock()
+	if ok {
+		return "hash"
+	}
 
 	kv.ListsMu.RLock()
-	if _, ok := kv.Lists[key]; ok {
-		return resp.Value{Typ: "string", Str: "list"}
-	}
+	_, ok = kv.Lists[key]
 	kv.ListsMu.RUnlock()
+	if ok {
+		return "list"
+	}
 
 	kv.SetsMu.RLock()
-	if _, ok := kv.Sets[key]; ok {
-		return resp.Value{Typ: "string", Str: "set"}
-	}
+	_, ok = kv.Sets[key]
 	kv.SetsMu.RUnlock()
+	if ok {
+		return "set"
+	}
 
 	kv.SortedsMu.RLock()
-	if _, ok := kv.Sorteds[key]; ok {
-		return resp.Value{Typ: "string", Str: "zset"}
-	}
+	_, ok = kv.Sorteds[key]
 	kv.SortedsMu.RUnlock()
+	if ok {
+		return "zset"
+	}
 
 	kv.StreamsMu.RLock()
-	if _, ok := kv.Streams[key]; ok {
-		return resp.Value{Typ: "string", Str: "stream"}
-	}
+	_, ok = kv.Streams[key]
 	kv.StreamsMu.RUnlock()
+	if ok {
+		return "stream"
+	}
+
+	kv.ModulesMu.RLock()
+	mv, ok := kv.Modules[key]
+	kv.ModulesMu.RUnlock()
+	if ok {
+		return mv.Type.Name
+	}
+
+	return "none"
+}
 
-	return resp.Value{Typ: "string", Str: "none"}
+// signalModifiedKey is the hook every write to a key goes through, whether a
+// command, an expiry or a deletion. It invalidates clients WATCHing the key.
+func signalModifiedKey(key string, server *types.Server) {
+	server.KV.SignalModifiedKey(key)
 }
 
-func incrementVersion(key string, server *types.Server) {
-	server.KV.VersionsMu.Lock()
-	server.KV.Versions[key]++
-	server.KV.VersionsMu.Unlock()
+// Keyspace event classes, repeated here because most handlers call their
+// *kv.KV "kv", hiding the package.
+const (
+	notifyGeneric = kv.NotifyGeneric
+	notifyString  = kv.NotifyString
+	notifyList    = kv.NotifyList
+	notifySet     = kv.NotifySet
+	notifyHash    = kv.NotifyHash
+	notifyZSet    = kv.NotifyZSet
+	notifyExpired = kv.NotifyExpired
+	notifyStream  = kv.NotifyStream
+)
+
+// notifyKeyspaceEvent reports a change to the keyspace event subscribers
+// once the running command returns.
+func notifyKeyspaceEvent(server *types.Server, class int, event, key string) {
+	server.KV.NotifyKeyspaceEvent(class, event, key)
 }
 
 func getConfig(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
@@ -86,6 +124,32 @@ func getConfig(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Va
 			result = append(result, resp.Value{Typ: "bulk", Bulk: "dir"}, resp.Value{Typ: "bulk", Bulk: server.Config.Dir})
 		case "dbfilename":
 			result = append(result, resp.Value{Typ: "bulk", Bulk: "dbFileName"}, resp.Value{Typ: "bulk", Bulk: server.Config.DbFileName})
+		case "save":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "save"}, resp.Value{Typ: "bulk", Bulk: rdb.FormatSavePoints(server.Config.SavePoints)})
+		case "stop-writes-on-bgsave-error":
+			value := "no"
+			if server.Config.StopWritesOnBGSaveError {
+				value = "yes"
+			}
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "stop-writes-on-bgsave-error"}, resp.Value{Typ: "bulk", Bulk: value})
+		case "rdb-format":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "rdb-format"}, resp.Value{Typ: "bulk", Bulk: server.Config.RDBFormat})
+		case "appendonly":
+			value := "no"
+			if server.Config.AppendOnly {
+				value = "yes"
+			}
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "appendonly"}, resp.Value{Typ: "bulk", Bulk: value})
+		case "appenddirname":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "appenddirname"}, resp.Value{Typ: "bulk", Bulk: server.Config.AppendDirname})
+		case "appendfsync":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "appendfsync"}, resp.Value{Typ: "bulk", Bulk: server.Config.AppendFsync})
+		case "auto-aof-rewrite-percentage":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "auto-aof-rewrite-percentage"}, resp.Value{Typ: "bulk", Bulk: strconv.Itoa(server.Config.AutoAOFRewritePercentage)})
+		case "auto-aof-rewrite-min-size":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: "auto-aof-rewrite-min-size"}, resp.Value{Typ: "bulk", Bulk: strconv.FormatInt(server.Config.AutoAOFRewriteMinSize, 10)})
+		case "lua-time-limit", "busy-reply-threshold":
+			result = append(result, resp.Value{Typ: "bulk", Bulk: v.Bulk}, resp.Value{Typ: "bulk", Bulk: strconv.Itoa(server.Config.LuaTimeLimit)})
 		}
 	}
 	return resp.Value{Typ: "array", Array: result}
@@ -6,10 +6,18 @@ import (
 	"github.com/r1i2t3/go-redis/app/types"
 )
 
-var Handlers = map[string]func([]resp.Value, *types.Server, *kv.ClientType) resp.Value{
+// HandlerFunc runs a command with its arguments, the command name excluded,
+// and returns the reply.
+type HandlerFunc func(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value
+
+var Handlers = map[string]HandlerFunc{
 	"PING": ping,
 	"ECHO": echo,
 	"TYPE": typeRedis,
+	// keyspace commands
+	"DEL":      del,
+	"FLUSHALL": flushall,
+	"FLUSHDB":  flushall,
 	// strings command
 	"SET":  set,
 	"GET":  get,
@@ -38,18 +46,60 @@ var Handlers = map[string]func([]resp.Value, *types.Server, *kv.ClientType) resp
 	"HKEYS":   hkeys,
 	"HVALS":   hvals,
 	// Stream commands
-	"XADD":   xadd,
-	"XRANGE": xrange,
-	"XREAD":  xread,
+	"XADD":      xadd,
+	"XSETID":    xsetid,
+	"XRANGE":    xrange,
+	"XREVRANGE": xrevrange,
+	"XLEN":      xlen,
+	"XDEL":      xdel,
+	"XTRIM":     xtrim,
+	"XINFO":     xinfo,
+	"XREAD":     xread,
+	// stream consumer groups
+	"XGROUP":     xgroup,
+	"XREADGROUP": xreadgroup,
+	"XACK":       xack,
+	"XPENDING":   xpending,
+	"XCLAIM":     xclaim,
+	"XAUTOCLAIM": xautoclaim,
 	// sorted set commands
-	"ZADD":   zadd,
-	"ZSCORE": zscore,
-	"ZCARD":  zcard,
-	"ZREM":   zrem,
-	"ZRANK":  zrank,
-	"ZRANGE": zrange,
+	"ZADD":             zadd,
+	"ZINCRBY":          zincrby,
+	"ZSCORE":           zscore,
+	"ZCARD":            zcard,
+	"ZREM":             zrem,
+	"ZRANK":            zrank,
+	"ZRANGE":           zrange,
+	"ZRANGESTORE":      zrangestore,
+	"ZREVRANGE":        zrevrange,
+	"ZRANGEBYSCORE":    zrangebyscore,
+	"ZREVRANGEBYSCORE": zrevrangebyscore,
+	"ZRANGEBYLEX":      zrangebylex,
+	"ZREVRANGEBYLEX":   zrevrangebylex,
+	"ZREVRANK":         zrevrank,
+	"ZUNION":           zunion,
+	"ZINTER":           zinter,
+	"ZDIFF":            zdiff,
+	"ZUNIONSTORE":      zunionstore,
+	"ZINTERSTORE":      zinterstore,
+	"ZDIFFSTORE":       zdiffstore,
+	"ZINTERCARD":       zintercard,
+	"ZCOUNT":           zcount,
+	"ZLEXCOUNT":        zlexcount,
+	"ZPOPMIN":          zpopmin,
+	"ZPOPMAX":          zpopmax,
+	"ZMPOP":            zmpop,
+	"ZREMRANGEBYRANK":  zremrangebyrank,
+	"ZREMRANGEBYSCORE": zremrangebyscore,
+	"ZREMRANGEBYLEX":   zremrangebylex,
+	"ZRANDMEMBER":      zrandmember,
+	"ZMSCORE":          zmscore,
 	// rdb
-	"BGSAVE": handleBgsave,
+	"BGSAVE":   handleBgsave,
+	"SAVE":     handleSave,
+	"LASTSAVE": handleLastsave,
+	// aof
+	"BGREWRITEAOF": handleBgrewriteaof,
 	// pubsub
 	"PUBLISH":     handlePublish,
 	"SUBSCRIBE":   handleSubscribe,
@@ -57,4 +107,10 @@ var Handlers = map[string]func([]resp.Value, *types.Server, *kv.ClientType) resp
 	// replications
 	"INFO":     Info,
 	"REPLCONF": REPLCONF,
+	"CONFIG":   getConfig,
+	// server
+	"ACL":   acl,
+	"DEBUG": debug,
+	// transactions
+	"UNWATCH": handleUnwatch,
 }
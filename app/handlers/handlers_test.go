@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	pubsub "github.com/r1i2t3/go-redis/app/pub_sub"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+func newTestServer() *types.Server {
+	return &types.Server{
+		KV:                kv.NewKv(),
+		PS:                pubsub.NewPubSub(),
+		IsMaster:          true,
+		ConnectedReplicas: map[net.Conn]*types.ReplicaInfo{},
+	}
+}
+
+func newTestClient() *kv.ClientType {
+	return &kv.ClientType{WatchedKeys: map[string]bool{}}
+}
+
+// command turns a command line into its name and arguments. Arguments are
+// separated by spaces; there is no quoting.
+func command(line string) (string, []resp.Value) {
+	fields := strings.Fields(line)
+	var args []resp.Value
+	for _, field := range fields[1:] {
+		args = append(args, resp.Value{Typ: "bulk", Bulk: field})
+	}
+	return strings.ToUpper(fields[0]), args
+}
+
+// call runs a command line and returns the reply.
+func call(server *types.Server, client *kv.ClientType, line string) resp.Value {
+	name, args := command(line)
+	return Call(name, args, server, client)
+}
+
+// run calls the command line given, failing the test on an error reply.
+func run(t *testing.T, server *types.Server, client *kv.ClientType, line string) resp.Value {
+	t.Helper()
+	reply := call(server, client, line)
+	if reply.Typ == "error" {
+		t.Fatalf("%s: %s%s", line, reply.Str, reply.Err)
+	}
+	return reply
+}
+
+// show renders a reply for comparing against the tables: integers and
+// strings as they are, nil as (nil), errors as their message and arrays in
+// brackets.
+func show(v resp.Value) string {
+	switch v.Typ {
+	case "array":
+		items := make([]string, len(v.Array))
+		for i, item := range v.Array {
+			items[i] = show(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case "bulk":
+		return v.Bulk
+	case "integer":
+		return strconv.Itoa(v.Num)
+	case "null":
+		return "(nil)"
+	case "error":
+		return v.Str + v.Err
+	}
+	return v.Str
+}
+
+// step is a command line and the reply it should get, as shown by show.
+type step struct {
+	command string
+	want    string
+}
+
+// runSteps runs the steps in order on one server and client.
+func runSteps(t *testing.T, server *types.Server, client *kv.ClientType, steps []step) {
+	t.Helper()
+	for _, s := range steps {
+		if got := show(call(server, client, s.command)); got != s.want {
+			t.Errorf("%s = %s, want %s", s.command, got, s.want)
+		}
+	}
+}
+
+// replicaConn is a replica connection that keeps what is written to it.
+type replicaConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *replicaConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// addTestReplica attaches an online replica to server, to see what is
+// propagated.
+func addTestReplica(server *types.Server) *replicaConn {
+	conn := &replicaConn{}
+	server.ConnectedReplicas[conn] = &types.ReplicaInfo{Conn: conn, State: types.ReplicaStateOnline}
+	return conn
+}
+
+// commands returns the command lines propagated since the last call.
+func (c *replicaConn) commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parser := resp.NewParser(&c.buf)
+	var lines []string
+	for {
+		cmd, err := parser.Parse()
+		if err != nil {
+			return lines
+		}
+		args := make([]string, len(cmd.Array))
+		for i, arg := range cmd.Array {
+			args[i] = arg.Bulk
+		}
+		lines = append(lines, strings.Join(args, " "))
+	}
+}
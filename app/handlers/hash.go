@@ -7,23 +7,31 @@ import (
 )
 
 func hset(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if len(args) < 3 {
+	if len(args) < 3 || len(args)%2 == 0 {
 		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hset' command"}
 	}
 	key := args[0].Bulk
-	field := args[1].Bulk
-	value := args[2].Bulk
 	server.KV.HashesMu.Lock()
 	defer server.KV.HashesMu.Unlock()
-	if _, exists := server.KV.Hashes[key]; !exists {
-		server.KV.Hashes[key] = make(map[string]resp.Value)
+	hash, exists := server.KV.MutableHash(key)
+	if !exists {
+		hash = make(map[string]resp.Value)
+		server.KV.Hashes[key] = hash
+	}
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		field := args[i].Bulk
+		if _, exists := hash[field]; !exists {
+			added++
+		}
+		hash[field] = resp.Value{Typ: "bulk", Bulk: args[i+1].Bulk}
 	}
-	server.KV.Hashes[key][field] = resp.Value{Typ: "bulk", Bulk: value}
-	incrementVersion(key, server)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyHash, "hset", key)
 	server.IncrementDirty()
 	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "HSET"}}, args...)}
 	server.Propagate(cmd)
-	return resp.Value{Typ: "integer", Num: 1}
+	return resp.Value{Typ: "integer", Num: added}
 }
 
 func hget(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
@@ -52,14 +60,16 @@ func hdel(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	defer server.KV.HashesMu.Unlock()
 	if hash, exists := server.KV.Hashes[key]; exists {
 		if _, exists := hash[field]; exists {
+			hash, _ = server.KV.MutableHash(key)
 			delete(hash, field)
-			incrementVersion(key, server)
+			signalModifiedKey(key, server)
+			notifyKeyspaceEvent(server, notifyHash, "hdel", key)
 			server.IncrementDirty()
+			cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "HDEL"}}, args...)}
+			server.Propagate(cmd)
 			return resp.Value{Typ: "integer", Num: 1}
 		}
 	}
-	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "HDEL"}}, args...)}
-	server.Propagate(cmd)
 	return resp.Value{Typ: "integer", Num: 0}
 }
 
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// DeleteKey removes key whatever its type and reports whether it existed.
+func DeleteKey(kV *kv.KV, key string) bool {
+	deleted := false
+	kV.StringsMu.Lock()
+	if _, ok := kV.Strings[key]; ok {
+		kV.PreserveString(key)
+		delete(kV.Strings, key)
+		deleted = true
+	}
+	kV.StringsMu.Unlock()
+	kV.ListsMu.Lock()
+	if _, ok := kV.Lists[key]; ok {
+		kV.PreserveList(key)
+		delete(kV.Lists, key)
+		deleted = true
+	}
+	kV.ListsMu.Unlock()
+	kV.HashesMu.Lock()
+	if _, ok := kV.Hashes[key]; ok {
+		kV.PreserveHash(key)
+		delete(kV.Hashes, key)
+		deleted = true
+	}
+	kV.HashesMu.Unlock()
+	kV.SetsMu.Lock()
+	if _, ok := kV.Sets[key]; ok {
+		kV.PreserveSet(key)
+		delete(kV.Sets, key)
+		deleted = true
+	}
+	kV.SetsMu.Unlock()
+	kV.SortedsMu.Lock()
+	if _, ok := kV.Sorteds[key]; ok {
+		kV.PreserveSortedSet(key)
+		delete(kV.Sorteds, key)
+		deleted = true
+	}
+	kV.SortedsMu.Unlock()
+	kV.StreamsMu.Lock()
+	if _, ok := kV.Streams[key]; ok {
+		kV.PreserveStream(key)
+		delete(kV.Streams, key)
+		deleted = true
+	}
+	kV.StreamsMu.Unlock()
+	kV.ModulesMu.Lock()
+	if _, ok := kV.Modules[key]; ok {
+		kV.PreserveModuleValue(key)
+		delete(kV.Modules, key)
+		deleted = true
+	}
+	kV.ModulesMu.Unlock()
+	return deleted
+}
+
+func del(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	deleted := 0
+	for _, arg := range args {
+		if DeleteKey(server.KV, arg.Bulk) {
+			signalModifiedKey(arg.Bulk, server)
+			notifyKeyspaceEvent(server, notifyGeneric, "del", arg.Bulk)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "DEL"}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: deleted}
+}
+
+// flushall empties every keyspace. There is a single database, so FLUSHDB is
+// the same command. The data is always dropped synchronously.
+func flushall(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) > 1 {
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	if len(args) == 1 {
+		if mode := strings.ToUpper(args[0].Bulk); mode != "SYNC" && mode != "ASYNC" {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+	kV := server.KV
+	kV.Flush()
+	kV.SignalFlushed()
+	server.IncrementDirty()
+	server.Propagate(resp.Value{Typ: "array", Array: []resp.Value{{Typ: "bulk", Bulk: "FLUSHALL"}}})
+	return resp.Value{Typ: "string", Str: "OK"}
+}
@@ -17,20 +17,23 @@ func rpush(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	key := args[0].Bulk
 	values := args[1:]
 	kv.ListsMu.Lock()
-	list := kv.Lists[key]
+	list, _ := kv.MutableList(key)
 	for _, v := range values {
 		list = append(list, resp.Value{Typ: "bulk", Bulk: v.Bulk})
 	}
 	kv.Lists[key] = list
 	length := len(list)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyList, "rpush", key)
+	server.IncrementDirty()
+	// The push is propagated before the lock is released, so that pushes to
+	// a key reach the AOF and replicas in the order they were applied.
+	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "RPUSH"}}, args...)}
+	server.Propagate(cmd)
 	kv.ListsMu.Unlock()
 	if len(values) > 0 {
 		kv.WakeUpClients(key, false)
 	}
-	incrementVersion(key, server)
-	server.IncrementDirty()
-	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "RPUSH"}}, args...)}
-	server.Propagate(cmd)
 	return resp.Value{Typ: "integer", Num: length}
 }
 
@@ -73,6 +76,7 @@ func lpush(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	key := args[0].Bulk
 	values := args[1:]
 	kv.ListsMu.Lock()
+	kv.PreserveList(key)
 	list := kv.Lists[key]
 	for i := len(values) - 1; i >= 0; i-- {
 		val := resp.Value{Typ: "bulk", Bulk: values[i].Bulk}
@@ -80,14 +84,15 @@ func lpush(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	}
 	kv.Lists[key] = list
 	length := len(list)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyList, "lpush", key)
+	server.IncrementDirty()
+	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "LPUSH"}}, args...)}
+	server.Propagate(cmd)
 	kv.ListsMu.Unlock()
 	if len(values) > 0 {
 		kv.WakeUpClients(key, false)
 	}
-	incrementVersion(key, server)
-	server.IncrementDirty()
-	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "LPUSH"}}, args...)}
-	server.Propagate(cmd)
 	return resp.Value{Typ: "integer", Num: length}
 }
 
@@ -131,13 +136,20 @@ func lpop(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	}
 	if num_pop == 1 || len(args) == 1 {
 		value := list[0]
+		kv.PreserveList(key)
 		kv.Lists[key] = list[1:]
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyList, "lpop", key)
+		server.IncrementDirty()
+		server.Propagate(resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "LPOP"}}, args...)})
 		return resp.Value{Typ: "bulk", Bulk: value.Bulk}
 	}
 	values := make([]resp.Value, num_pop)
 	copy(values, list[:num_pop])
+	kv.PreserveList(key)
 	kv.Lists[key] = list[num_pop:]
-	incrementVersion(key, server)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyList, "lpop", key)
 	server.IncrementDirty()
 	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "LPOP"}}, args...)}
 	server.Propagate(cmd)
@@ -169,7 +181,12 @@ func rpop(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	}
 	if num_pop == 1 {
 		value := list[len(list)-1]
+		kv.PreserveList(key)
 		kv.Lists[key] = list[:len(list)-1]
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyList, "rpop", key)
+		server.IncrementDirty()
+		server.Propagate(resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "RPOP"}}, args...)})
 		return resp.Value{Typ: "bulk", Bulk: value.Bulk}
 	}
 	if num_pop > len(list) {
@@ -180,15 +197,17 @@ func rpop(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	for i := 0; i < num_pop; i++ {
 		values[i] = list[len(list)-1-i]
 	}
+	kv.PreserveList(key)
 	kv.Lists[key] = list[:start]
-	incrementVersion(key, server)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyList, "rpop", key)
 	server.IncrementDirty()
 	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "RPOP"}}, args...)}
 	server.Propagate(cmd)
 	return resp.Value{Typ: "array", Array: values}
 }
 
-func blpop(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+func blpop(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
 	if len(args) < 2 {
 		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'blpop' command"}
 	}
@@ -207,12 +226,14 @@ RetryPop:
 	for _, key := range keys {
 		if list, exists := kV.Lists[key]; exists && len(list) > 0 {
 			val := list[0]
+			kV.PreserveList(key)
 			kV.Lists[key] = list[1:]
-			kV.ListsMu.Unlock()
-			incrementVersion(key, server)
+			signalModifiedKey(key, server)
+			notifyKeyspaceEvent(server, notifyList, "lpop", key)
 			server.IncrementDirty()
 			cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "BLPOP"}}, args...)}
 			server.Propagate(cmd)
+			kV.ListsMu.Unlock()
 			return resp.Value{Typ: "array", Array: []resp.Value{
 				{Typ: "bulk", Bulk: key},
 				val,
@@ -220,7 +241,7 @@ RetryPop:
 		}
 	}
 	kV.ListsMu.Unlock()
-	if timeout == 0 {
+	if timeout == 0 || blockingDenied(client) {
 		return resp.Value{Typ: "null"}
 	}
 	bc := &kv.BlockedClient{
@@ -230,7 +251,8 @@ RetryPop:
 	}
 	kV.RegisterBlockedClient(bc)
 	defer kV.UnregisterBlockedClient(bc)
-	wokenUp := <-bc.Ch
+	var wokenUp bool
+	withKeyspaceReleased(kV, func() { wokenUp = <-bc.Ch })
 	if wokenUp {
 		goto RetryPop
 
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// moduleCommands holds the commands added by RegisterCommand. Like scripts,
+// they run holding the keyspace exclusively, so module code never has to
+// lock anything itself.
+var moduleCommands = map[string]bool{}
+
+// RegisterCommand adds a command to the command table and Handlers. The
+// categories are ACL categories on top of those implied by the flags. It
+// must be called before the server starts serving clients.
+func RegisterCommand(name string, info CommandInfo, categories []string, handler HandlerFunc) error {
+	name = strings.ToUpper(name)
+	if name == "" || strings.ContainsAny(name, " |") {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	if _, ok := Commands[name]; ok {
+		return fmt.Errorf("command %s already exists", name)
+	}
+	if info.Arity == 0 {
+		return fmt.Errorf("command %s: arity must not be zero", name)
+	}
+	for _, category := range categories {
+		if category == "" || strings.ContainsAny(category, " @") {
+			return fmt.Errorf("command %s: invalid ACL category %q", name, category)
+		}
+	}
+	Commands[name] = info
+	Handlers[name] = handler
+	moduleCommands[name] = true
+	if len(categories) > 0 {
+		commandCategories[name] = categories
+	}
+	return nil
+}
+
+// CallFromModule runs a command on behalf of a module, like redis.call does
+// for scripts. The caller already holds the keyspace. With readOnly set,
+// write commands are refused.
+func CallFromModule(command string, args []resp.Value, server *types.Server, client *kv.ClientType, readOnly bool) resp.Value {
+	command = strings.ToUpper(command)
+	info, errReply := ValidateCommand(command, args)
+	if errReply != nil {
+		return *errReply
+	}
+	handler, ok := Handlers[command]
+	if !ok || info.Has(CmdNoScript) {
+		return resp.Value{Typ: "error", Str: "ERR This command is not allowed from modules"}
+	}
+	if info.Has(CmdWrite) {
+		if readOnly {
+			return resp.Value{Typ: "error", Str: "READONLY You can't write against a read only replica."}
+		}
+		if denied := writeDenied(server); denied != nil {
+			return *denied
+		}
+	}
+	return invoke(handler, args, server, client)
+}
+
+// BlockModuleClient runs wait with the module command's hold on the keyspace
+// dropped. It returns false without calling wait when the client can't
+// block, as inside MULTI or a script.
+//
+// The command's propagation batch is sent before the keyspace is released
+// and a new one begins once it is taken back: the batch is server-wide, so
+// left open it would swallow the writes of every client that runs
+// meanwhile.
+func BlockModuleClient(server *types.Server, client *kv.ClientType, wait func()) bool {
+	if blockingDenied(client) {
+		return false
+	}
+	server.EndAtomicPropagation()
+	server.KV.KeyspaceMu.Unlock()
+	defer func() {
+		server.KV.KeyspaceMu.Lock()
+		server.BeginAtomicPropagation()
+	}()
+	wait()
+	return true
+}
@@ -1,6 +1,13 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/aof"
 	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/rdb"
 	"github.com/r1i2t3/go-redis/app/resp"
@@ -8,8 +15,216 @@ import (
 )
 
 func handleBgsave(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if err := rdb.TriggerBackgroundSave(server); err != nil {
-		return resp.Value{Typ: "error", Err: err.Error()}
+	var err error
+	// Taking the snapshot needs the keyspace to itself for a moment.
+	withKeyspaceReleased(server.KV, func() {
+		err = rdb.TriggerBackgroundSave(server)
+	})
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
 	}
 	return resp.Value{Typ: "string", Str: "Background saving started"}
 }
+
+func handleSave(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	var err error
+	withKeyspaceReleased(server.KV, func() {
+		err = rdb.SaveForeground(server)
+	})
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
+	}
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+func handleLastsave(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	server.StateMutex.Lock()
+	defer server.StateMutex.Unlock()
+	return resp.Value{Typ: "integer", Num: int(server.LastSave.Unix())}
+}
+
+// errRewriteScheduled is returned by TriggerAOFRewrite when a BGSAVE is in
+// progress; the rewrite then starts from StartAOFRewriteCron.
+var errRewriteScheduled = errors.New("rewrite scheduled")
+
+func handleBgrewriteaof(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	var err error
+	// The rewrite needs the keyspace to itself for a moment.
+	withKeyspaceReleased(server.KV, func() {
+		err = TriggerAOFRewrite(server)
+	})
+	switch {
+	case err == errRewriteScheduled:
+		return resp.Value{Typ: "string", Str: "Background append only file rewriting scheduled"}
+	case err != nil:
+		return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
+	}
+	return resp.Value{Typ: "string", Str: "Background append only file rewriting started"}
+}
+
+// TriggerAOFRewrite starts rewriting the AOF in the background, or
+// schedules the rewrite if a BGSAVE is running. The caller must not hold
+// KeyspaceMu.
+func TriggerAOFRewrite(server *types.Server) error {
+	if server.AOF == nil {
+		return errors.New("background append only file rewriting needs appendonly enabled")
+	}
+	server.BackgroundMu.Lock()
+	defer server.BackgroundMu.Unlock()
+	if server.AOF.Rewriting() {
+		return errors.New("background append only file rewriting already in progress")
+	}
+	if server.IsSaving.Load() {
+		server.AOFRewriteScheduled.Store(true)
+		return errRewriteScheduled
+	}
+	server.AOFRewriteScheduled.Store(false)
+
+	// The dataset is captured while no command runs, and the new
+	// incremental file started at that same point, so together they miss
+	// nothing.
+	kV := server.KV
+	kV.KeyspaceMu.Lock()
+	if err := server.AOF.StartRewrite(); err != nil {
+		kV.KeyspaceMu.Unlock()
+		return err
+	}
+	snapshot := kV.Snapshot()
+	kV.KeyspaceMu.Unlock()
+
+	go func() {
+		defer snapshot.Release()
+		start := time.Now()
+		writeBase := AOFBaseWriter(server, snapshot.View())
+		if err := server.AOF.FinishRewrite(writeBase, server.Config.AOFUseRDBPreamble); err != nil {
+			fmt.Printf("Background AOF rewrite failed: %v\n", err)
+			return
+		}
+		fmt.Printf("Background AOF rewrite finished successfully in %v.\n", time.Since(start))
+	}()
+	return nil
+}
+
+// AOFBaseWriter returns the function writing kV as an AOF base file, in the
+// RDB format with aof-use-rdb-preamble and as commands otherwise.
+func AOFBaseWriter(server *types.Server, kV *kv.KV) func(w io.Writer) error {
+	rdbPreamble, format := server.Config.AOFUseRDBPreamble, server.Config.RDBFormat
+	return func(w io.Writer) error {
+		if rdbPreamble {
+			return rdb.SaveTo(w, kV, format)
+		}
+		return aof.WriteDataset(w, kV)
+	}
+}
+
+// StartAOFRewriteCron runs aofRewriteCron every second.
+func StartAOFRewriteCron(server *types.Server) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		aofRewriteCron(server)
+	}
+}
+
+// aofRewriteCron runs the rewrite BGREWRITEAOF scheduled during a BGSAVE,
+// or rewrites the AOF once it has outgrown the auto-aof-rewrite-percentage
+// and auto-aof-rewrite-min-size limits.
+func aofRewriteCron(server *types.Server) {
+	if server.AOF.Rewriting() || server.IsSaving.Load() {
+		return
+	}
+	if server.AOFRewriteScheduled.Load() {
+		TriggerAOFRewrite(server)
+		return
+	}
+	percentage := int64(server.Config.AutoAOFRewritePercentage)
+	size, base := server.AOF.Size(), server.AOF.BaseSize()
+	if percentage == 0 || size < server.Config.AutoAOFRewriteMinSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	if growth := (size - base) * 100 / base; growth >= percentage {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		TriggerAOFRewrite(server)
+	}
+}
+
+// writeDenied returns the error write commands get while the dataset can't
+// be persisted, so that clients don't believe their writes are durable:
+// while the AOF can't be written, or, with stop-writes-on-bgsave-error,
+// after a failed BGSAVE until a save succeeds.
+func writeDenied(server *types.Server) *resp.Value {
+	if server.AOF != nil {
+		if err := server.AOF.LastWriteError(); err != nil {
+			return &resp.Value{Typ: "error", Str: "MISCONF Errors writing to the AOF file: " + err.Error()}
+		}
+	}
+	if server.Config.StopWritesOnBGSaveError && len(server.Config.SavePoints) > 0 && bgsaveError(server) != nil {
+		return &resp.Value{Typ: "error", Str: "MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. Commands that may modify the data set are disabled, because this instance is configured to report errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error."}
+	}
+	return nil
+}
+
+func bgsaveError(server *types.Server) error {
+	server.StateMutex.Lock()
+	defer server.StateMutex.Unlock()
+	return server.LastBGSaveErr
+}
+
+// infoPersistence renders the persistence section of INFO.
+func infoPersistence(server *types.Server) resp.Value {
+	var b strings.Builder
+	b.WriteString("# Persistence\r\n")
+	server.StateMutex.Lock()
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", server.Dirty)
+	lastSave := int64(0)
+	if !server.LastSave.IsZero() {
+		lastSave = server.LastSave.Unix()
+	}
+	fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", lastSave)
+	lastTry := server.LastBGSaveTry
+	server.StateMutex.Unlock()
+	saving := server.IsSaving.Load()
+	fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", boolToInt(saving))
+	saveTime, saveBytes := int64(-1), int64(0)
+	if saving {
+		saveTime = int64(time.Since(lastTry).Seconds())
+		saveBytes = server.RDBSaveBytes.Load()
+	}
+	fmt.Fprintf(&b, "rdb_current_bgsave_time_sec:%d\r\n", saveTime)
+	fmt.Fprintf(&b, "rdb_current_bgsave_bytes_written:%d\r\n", saveBytes)
+	status := "ok"
+	if bgsaveError(server) != nil {
+		status = "err"
+	}
+	fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(&b, "aof_enabled:%d\r\n", boolToInt(server.AOF != nil))
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", boolToInt(server.AOF != nil && server.AOF.Rewriting()))
+	fmt.Fprintf(&b, "aof_rewrite_scheduled:%d\r\n", boolToInt(server.AOFRewriteScheduled.Load()))
+	status = "ok"
+	if server.AOF != nil && server.AOF.LastRewriteError() != nil {
+		status = "err"
+	}
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", status)
+	status = "ok"
+	if server.AOF != nil && server.AOF.LastWriteError() != nil {
+		status = "err"
+	}
+	fmt.Fprintf(&b, "aof_last_write_status:%s\r\n", status)
+	if server.AOF != nil {
+		fmt.Fprintf(&b, "aof_current_size:%d\r\n", server.AOF.Size())
+		fmt.Fprintf(&b, "aof_base_size:%d\r\n", server.AOF.BaseSize())
+		fmt.Fprintf(&b, "aof_buffer_length:%d\r\n", server.AOF.BufferLength())
+	}
+	return resp.Value{Typ: "bulk", Bulk: b.String()}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/aof"
+	"github.com/r1i2t3/go-redis/app/rdb"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// newAOFTestServer returns a test server with the AOF enabled in a
+// temporary directory.
+func newAOFTestServer(t *testing.T) *types.Server {
+	t.Helper()
+	server := newTestServer()
+	server.Config.Dir = t.TempDir()
+	server.Config.AppendOnly = true
+	server.Config.AppendDirname = "appendonlydir"
+	server.Config.AppendFilename = "appendonly.aof"
+	server.Config.AppendFsync = aof.FsyncNo
+	var err error
+	if server.AOF, err = aof.Open(aofDir(server), "appendonly.aof", aof.FsyncNo, AOFBaseWriter(server, server.KV), false); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func aofDir(server *types.Server) string {
+	return filepath.Join(server.Config.Dir, server.Config.AppendDirname)
+}
+
+// aofCommands returns the command lines in the server's AOF, whose base
+// must be in AOF format.
+func aofCommands(t *testing.T, server *types.Server) []string {
+	t.Helper()
+	var lines []string
+	loadRDB := func(path string) error {
+		t.Fatalf("unexpected RDB base %s", path)
+		return nil
+	}
+	err := aof.Load(aofDir(server), "appendonly.aof", false, loadRDB, func(cmds []resp.Value) {
+		for _, cmd := range cmds {
+			args := make([]string, len(cmd.Array))
+			for i, arg := range cmd.Array {
+				args[i] = arg.Bulk
+			}
+			lines = append(lines, strings.Join(args, " "))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// waitRewrite waits for the AOF rewrite in progress, if any, to finish.
+func waitRewrite(t *testing.T, server *types.Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.AOF.Rewriting() {
+		if time.Now().After(deadline) {
+			t.Fatal("AOF rewrite did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := server.AOF.LastRewriteError(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// infoField returns a field of INFO persistence.
+func infoField(t *testing.T, server *types.Server, name string) string {
+	t.Helper()
+	for _, line := range strings.Split(infoPersistence(server).Bulk, "\r\n") {
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return value
+		}
+	}
+	t.Fatalf("INFO persistence has no %s", name)
+	return ""
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	server, client := newAOFTestServer(t), newTestClient()
+	runSteps(t, server, client, []step{
+		{"SET a 1", "OK"},
+		{"INCR a", "2"},
+		{"RPUSH l x y", "2"},
+		{"LPOP l", "x"},
+		{"BGREWRITEAOF", "Background append only file rewriting started"},
+	})
+	waitRewrite(t, server)
+	run(t, server, client, "SET b 1")
+	want := []string{"SET a 2", "RPUSH l y", "SET b 1"}
+	if got := aofCommands(t, server); !slices.Equal(got, want) {
+		t.Errorf("AOF after rewrite = %q, want %q", got, want)
+	}
+
+	plain := newTestServer()
+	if got := show(call(plain, client, "BGREWRITEAOF")); got != "ERR background append only file rewriting needs appendonly enabled" {
+		t.Errorf("BGREWRITEAOF without an AOF = %s", got)
+	}
+}
+
+// TestAOFOrderUnderConcurrentWrites hammers a few keys from several clients
+// at once and checks that replaying the AOF rebuilds the live dataset, so
+// writes reach the AOF in the order they were applied.
+func TestAOFOrderUnderConcurrentWrites(t *testing.T) {
+	server := newAOFTestServer(t)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newTestClient()
+			for i := range 200 {
+				v := fmt.Sprintf("%d-%d", g, i)
+				call(server, client, "RPUSH l "+v)
+				call(server, client, "LPUSH l "+v)
+				call(server, client, "SET s "+v)
+				call(server, client, "INCR n")
+				if i%3 == 0 {
+					call(server, client, "LPOP l")
+					call(server, client, "DEL s")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	replayed, client := newTestServer(), newTestClient()
+	for _, line := range aofCommands(t, server) {
+		if reply := call(replayed, client, line); reply.Typ == "error" {
+			t.Fatalf("replaying %q: %s", line, reply.Str)
+		}
+	}
+	if !reflect.DeepEqual(replayed.KV.Lists, server.KV.Lists) {
+		t.Error("replayed lists differ from the live ones")
+	}
+	if !reflect.DeepEqual(replayed.KV.Strings, server.KV.Strings) {
+		t.Errorf("replayed strings = %v, want %v", replayed.KV.Strings, server.KV.Strings)
+	}
+}
+
+// TestBgrewriteaofDuringBgsave checks that a rewrite asked for while a
+// BGSAVE runs is scheduled, and started by the cron once the save is done.
+func TestBgrewriteaofDuringBgsave(t *testing.T) {
+	server, client := newAOFTestServer(t), newTestClient()
+	runSteps(t, server, client, []step{
+		{"SET a 1", "OK"},
+		{"SET a 2", "OK"},
+	})
+	server.IsSaving.Store(true)
+	if got := show(call(server, client, "BGREWRITEAOF")); got != "Background append only file rewriting scheduled" {
+		t.Fatalf("BGREWRITEAOF during BGSAVE = %s", got)
+	}
+	if got := infoField(t, server, "aof_rewrite_scheduled"); got != "1" {
+		t.Errorf("aof_rewrite_scheduled = %s, want 1", got)
+	}
+	aofRewriteCron(server)
+	if server.AOF.Rewriting() {
+		t.Fatal("rewrite started while the BGSAVE runs")
+	}
+
+	server.IsSaving.Store(false)
+	aofRewriteCron(server)
+	waitRewrite(t, server)
+	if server.AOFRewriteScheduled.Load() {
+		t.Error("rewrite still scheduled after it ran")
+	}
+	if got := aofCommands(t, server); !slices.Equal(got, []string{"SET a 2"}) {
+		t.Errorf("AOF after the scheduled rewrite = %q", got)
+	}
+}
+
+func TestAutoAOFRewrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		percentage int
+		minSize    int64
+		// writes made before the cron runs, each a few dozen bytes.
+		writes  int
+		rewrite bool
+	}{
+		{"disabled", 0, 0, 10, false},
+		{"below min size", 100, 1 << 20, 10, false},
+		{"grown enough", 100, 1, 10, true},
+		{"nothing written", 100, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newAOFTestServer(t), newTestClient()
+			server.Config.AutoAOFRewritePercentage = tt.percentage
+			server.Config.AutoAOFRewriteMinSize = tt.minSize
+			for i := 0; i < tt.writes; i++ {
+				run(t, server, client, "INCR a")
+			}
+			aofRewriteCron(server)
+			waitRewrite(t, server)
+			// A rewrite resets the base size, which is 0 for a new file.
+			if rewritten := server.AOF.BaseSize() != 0; rewritten != tt.rewrite {
+				t.Errorf("rewritten = %v, want %v", rewritten, tt.rewrite)
+			}
+		})
+	}
+
+	// Growth is measured from the size of the last rewrite.
+	server, client := newAOFTestServer(t), newTestClient()
+	server.Config.AutoAOFRewritePercentage = 100
+	server.Config.AutoAOFRewriteMinSize = 1
+	for i := 0; i < 3; i++ {
+		run(t, server, client, "RPUSH l "+strings.Repeat("x", 100))
+	}
+	aofRewriteCron(server)
+	waitRewrite(t, server)
+	base := server.AOF.BaseSize()
+	if base == 0 || base != server.AOF.Size() {
+		t.Fatalf("base size %d, size %d after the rewrite", base, server.AOF.Size())
+	}
+	run(t, server, client, "RPUSH l y")
+	aofRewriteCron(server)
+	waitRewrite(t, server)
+	if server.AOF.BaseSize() != base {
+		t.Error("rewritten below the growth percentage")
+	}
+	for server.AOF.Size() < 2*base {
+		run(t, server, client, "RPUSH l "+strings.Repeat("x", 100))
+	}
+	aofRewriteCron(server)
+	waitRewrite(t, server)
+	if server.AOF.BaseSize() == base {
+		t.Error("not rewritten once the file doubled")
+	}
+}
+
+// waitBgsave waits for the BGSAVE in progress, if any, to finish.
+func waitBgsave(t *testing.T, server *types.Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.IsSaving.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSaveAndLastsave(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	server.Config.Dir = t.TempDir()
+	server.Config.DbFileName = "dump.rdb"
+	server.Config.RDBFormat = rdb.FormatRedis
+	run(t, server, client, "SET a 1")
+	before := time.Now().Unix()
+	run(t, server, client, "SAVE")
+	if got := show(call(server, client, "LASTSAVE")); got < strconv.FormatInt(before, 10) {
+		t.Errorf("LASTSAVE = %s, before SAVE was %d", got, before)
+	}
+	if server.Dirty != 0 {
+		t.Errorf("Dirty = %d after SAVE", server.Dirty)
+	}
+	loaded := newTestServer()
+	if err := rdb.Load(filepath.Join(server.Config.Dir, "dump.rdb"), loaded.KV, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := show(call(loaded, client, "GET a")); got != "1" {
+		t.Errorf("GET a after loading the SAVE = %s", got)
+	}
+
+	server.IsSaving.Store(true)
+	if got := show(call(server, client, "SAVE")); got != "ERR background save already in progress" {
+		t.Errorf("SAVE during BGSAVE = %s", got)
+	}
+}
+
+// TestStopWritesOnBgsaveError checks that writes get MISCONF after a failed
+// BGSAVE, and again once a save succeeds.
+func TestStopWritesOnBgsaveError(t *testing.T) {
+	misconf := "MISCONF Redis is configured to save RDB snapshots"
+	tests := []struct {
+		name       string
+		stopWrites bool
+		save       string
+		denied     bool
+	}{
+		{"stop-writes-on-bgsave-error yes", true, "900 1", true},
+		{"stop-writes-on-bgsave-error no", false, "900 1", false},
+		{"saving disabled", true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			dir := t.TempDir()
+			server.Config.Dir = filepath.Join(dir, "missing")
+			server.Config.DbFileName = "dump.rdb"
+			server.Config.RDBFormat = rdb.FormatRedis
+			server.Config.StopWritesOnBGSaveError = tt.stopWrites
+			server.Config.SavePoints, _ = rdb.ParseSavePoints(tt.save)
+			runSteps(t, server, client, []step{
+				{"SET a 1", "OK"},
+				{"BGSAVE", "Background saving started"},
+			})
+			waitBgsave(t, server)
+			if got := infoField(t, server, "rdb_last_bgsave_status"); got != "err" {
+				t.Errorf("rdb_last_bgsave_status = %s after a failed BGSAVE", got)
+			}
+			got := dispatch(t, server, client, "SET a 2")
+			if denied := strings.HasPrefix(got, misconf); denied != tt.denied {
+				t.Fatalf("SET after a failed BGSAVE = %s, denied %v", got, tt.denied)
+			}
+			// Reads are still served.
+			if got := dispatch(t, server, client, "GET a"); got == "" || strings.HasPrefix(got, "MISCONF") {
+				t.Errorf("GET after a failed BGSAVE = %s", got)
+			}
+
+			server.Config.Dir = dir
+			run(t, server, client, "BGSAVE")
+			waitBgsave(t, server)
+			if got := infoField(t, server, "rdb_last_bgsave_status"); got != "ok" {
+				t.Errorf("rdb_last_bgsave_status = %s after a successful BGSAVE", got)
+			}
+			if got := dispatch(t, server, client, "SET a 3"); got != "OK" {
+				t.Errorf("SET after a successful BGSAVE = %s", got)
+			}
+		})
+	}
+
+	// SAVE clears the error as well.
+	server, client := newTestServer(), newTestClient()
+	dir := t.TempDir()
+	server.Config.Dir = filepath.Join(dir, "missing")
+	server.Config.DbFileName = "dump.rdb"
+	server.Config.StopWritesOnBGSaveError = true
+	server.Config.SavePoints, _ = rdb.ParseSavePoints("900 1")
+	run(t, server, client, "BGSAVE")
+	waitBgsave(t, server)
+	if got := dispatch(t, server, client, "SET a 1"); !strings.HasPrefix(got, misconf) {
+		t.Fatalf("SET after a failed BGSAVE = %s", got)
+	}
+	server.Config.Dir = dir
+	run(t, server, client, "SAVE")
+	if got := dispatch(t, server, client, "SET a 1"); got != "OK" {
+		t.Errorf("SET after SAVE = %s", got)
+	}
+}
+
+func TestInfoBgsaveProgress(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	server.Config.Dir = t.TempDir()
+	server.Config.DbFileName = "dump.rdb"
+	server.Config.RDBFormat = rdb.FormatRedis
+	want := map[string]string{
+		"rdb_bgsave_in_progress":           "0",
+		"rdb_current_bgsave_time_sec":      "-1",
+		"rdb_current_bgsave_bytes_written": "0",
+	}
+	for name, value := range want {
+		if got := infoField(t, server, name); got != value {
+			t.Errorf("%s = %s without a BGSAVE, want %s", name, got, value)
+		}
+	}
+
+	// The counters of a BGSAVE caught in progress.
+	server.IsSaving.Store(true)
+	server.LastBGSaveTry = time.Now().Add(-3 * time.Second)
+	server.RDBSaveBytes.Store(1234)
+	want = map[string]string{
+		"rdb_bgsave_in_progress":           "1",
+		"rdb_current_bgsave_time_sec":      "3",
+		"rdb_current_bgsave_bytes_written": "1234",
+	}
+	for name, value := range want {
+		if got := infoField(t, server, name); got != value {
+			t.Errorf("%s = %s during a BGSAVE, want %s", name, got, value)
+		}
+	}
+	server.IsSaving.Store(false)
+
+	// A real BGSAVE counts every byte of the file.
+	for i := 0; i < 100; i++ {
+		run(t, server, client, fmt.Sprintf("RPUSH l item-%d", i))
+	}
+	run(t, server, client, "BGSAVE")
+	waitBgsave(t, server)
+	info, err := os.Stat(filepath.Join(server.Config.Dir, "dump.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.RDBSaveBytes.Load(); got != info.Size() {
+		t.Errorf("BGSAVE counted %d bytes, the file has %d", got, info.Size())
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/rdb"
@@ -26,6 +27,9 @@ func Info(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 		fmt.Println(len(results))
 		return resp.Value{Typ: "array", Array: results}
 	}
+	if args[0].Bulk == "persistence" {
+		return infoPersistence(server)
+	}
 	return resp.Value{Typ: "bulk", Bulk: "Commands not implemented till now"}
 }
 
@@ -45,13 +49,23 @@ func HandlePsync(args []resp.Value, server *types.Server, conn *kv.ClientType) {
 	replId := server.ReplicationID
 	replOffset := 0
 	writer.Write(resp.Value{Typ: "string", Str: fmt.Sprintf("FULLRESYNC %s %d", replId, replOffset)})
-	rdbBuffer, err := rdb.SaveToBuffer(server.KV)
+	// The replica gets the dataset as of a single instant, serialized
+	// without holding up other clients.
+	server.KV.KeyspaceMu.Lock()
+	snapshot := server.KV.Snapshot()
+	server.SetReplicaSendingRDB(replicaInfo)
+	server.KV.KeyspaceMu.Unlock()
+	// The payload goes out as it is serialized, framed by an EOF mark since
+	// its length isn't known up front.
+	err := writer.WriteRDB(func(w io.Writer) error {
+		return rdb.SaveTo(w, snapshot.View(), server.Config.RDBFormat)
+	})
+	snapshot.Release()
 	if err != nil {
-		fmt.Println("Failed to create RDB snapshot for replica:", err)
+		fmt.Println("Failed to send RDB snapshot to replica:", err)
 		conn.Conn.Close()
 		return
 	}
-	writer.WriteRDB(rdbBuffer)
 	server.SetReplicaOnline(replicaInfo)
 	fmt.Printf("Replica at %s is now online.\n", conn.Conn.RemoteAddr())
 
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestReplicaKeepsWritesDuringSync checks that the writes made while a
+// replica's snapshot is sent reach it once it is online, in order and ahead
+// of later writes.
+func TestReplicaKeepsWritesDuringSync(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	conn := &replicaConn{}
+	replica := server.AddReplica(conn)
+	// Writes before the snapshot is taken are part of it.
+	run(t, server, client, "SET a 1")
+	server.SetReplicaSendingRDB(replica)
+	run(t, server, client, "SET b 1")
+	run(t, server, client, "RPUSH l x")
+	if got := conn.commands(); len(got) != 0 {
+		t.Fatalf("replica sent %q while its snapshot is sent", got)
+	}
+
+	server.SetReplicaOnline(replica)
+	run(t, server, client, "SET c 1")
+	want := []string{"SET b 1", "RPUSH l x", "SET c 1"}
+	if got := conn.commands(); !slices.Equal(got, want) {
+		t.Errorf("replica got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/lua"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// scriptRun tracks the script being executed, for SCRIPT KILL and BUSY.
+type scriptRun struct {
+	start  time.Time
+	wrote  atomic.Bool
+	killed atomic.Bool
+}
+
+// scriptEngine holds the script cache, keyed by SHA1 digest, and the script
+// currently running. Scripts run one at a time, holding the keyspace
+// exclusively.
+type scriptEngine struct {
+	mu      sync.Mutex
+	scripts map[string]*lua.Chunk
+	running *scriptRun
+}
+
+var scripts = &scriptEngine{scripts: map[string]*lua.Chunk{}}
+
+var errScriptKilled = errors.New("script killed")
+
+// The scripting commands are registered here rather than in the Handlers
+// literal because scripts dispatch through Handlers themselves.
+func init() {
+	Handlers["EVAL"] = eval
+	Handlers["EVALSHA"] = evalsha
+	Handlers["EVAL_RO"] = evalRO
+	Handlers["EVALSHA_RO"] = evalshaRO
+	Handlers["SCRIPT"] = scriptCommand
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles body and caches it unless it is cached already.
+func (e *scriptEngine) load(body string) (string, *lua.Chunk, *resp.Value) {
+	sha := sha1hex(body)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if chunk, ok := e.scripts[sha]; ok {
+		return sha, chunk, nil
+	}
+	chunk, err := lua.Compile(body, "user_script")
+	if err != nil {
+		return "", nil, &resp.Value{Typ: "error", Str: "ERR Error compiling script (new function): " + err.Error()}
+	}
+	e.scripts[sha] = chunk
+	return sha, chunk, nil
+}
+
+func (e *scriptEngine) lookup(sha string) *lua.Chunk {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.scripts[strings.ToLower(sha)]
+}
+
+func (e *scriptEngine) setRunning(run *scriptRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.running = run
+}
+
+// busyReply returns the BUSY error once the running script has exceeded the
+// configured time limit, and nil otherwise.
+func (e *scriptEngine) busyReply(server *types.Server) *resp.Value {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	limit := time.Duration(server.Config.LuaTimeLimit) * time.Millisecond
+	if e.running == nil || limit <= 0 || time.Since(e.running.start) < limit {
+		return nil
+	}
+	return &resp.Value{Typ: "error", Str: "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."}
+}
+
+// isScriptCommand reports whether command runs a script, which needs the
+// keyspace to itself like EXEC does.
+func isScriptCommand(command string) bool {
+	switch command {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO":
+		return true
+	}
+	return false
+}
+
+func eval(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return evalGeneric(args, server, false, false)
+}
+
+func evalsha(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return evalGeneric(args, server, true, false)
+}
+
+func evalRO(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return evalGeneric(args, server, false, true)
+}
+
+func evalshaRO(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return evalGeneric(args, server, true, true)
+}
+
+func evalGeneric(args []resp.Value, server *types.Server, bySHA, readOnly bool) resp.Value {
+	numKeys, err := strconv.Atoi(args[1].Bulk)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	if numKeys < 0 {
+		return resp.Value{Typ: "error", Str: "ERR Number of keys can't be negative"}
+	}
+	if numKeys > len(args)-2 {
+		return resp.Value{Typ: "error", Str: "ERR Number of keys can't be greater than number of args"}
+	}
+	var sha string
+	var chunk *lua.Chunk
+	if bySHA {
+		sha = strings.ToLower(args[0].Bulk)
+		if chunk = scripts.lookup(sha); chunk == nil {
+			return resp.Value{Typ: "error", Str: "NOSCRIPT No matching script. Please use EVAL."}
+		}
+	} else {
+		var errReply *resp.Value
+		if sha, chunk, errReply = scripts.load(args[0].Bulk); errReply != nil {
+			return *errReply
+		}
+	}
+	return runScript(server, chunk, sha, args[2:2+numKeys], args[2+numKeys:], readOnly)
+}
+
+// runScript executes a script with the keyspace held exclusively by the
+// caller. Scripts are replicated by their effects: the write commands they
+// call reach replicas as one MULTI/EXEC block.
+func runScript(server *types.Server, chunk *lua.Chunk, sha string, keys, argv []resp.Value, readOnly bool) resp.Value {
+	run := &scriptRun{start: time.Now()}
+	scripts.setRunning(run)
+	defer scripts.setRunning(nil)
+	server.BeginAtomicPropagation()
+	defer server.EndAtomicPropagation()
+
+	state := lua.NewState()
+	state.Globals.Set("KEYS", argsToLua(keys))
+	state.Globals.Set("ARGV", argsToLua(argv))
+	state.Globals.Set("redis", redisLib(server, run, readOnly))
+	state.StrictGlobals = true
+	state.Interrupt = func() error {
+		if run.killed.Load() {
+			return errScriptKilled
+		}
+		return nil
+	}
+
+	vals, err := state.Run(chunk)
+	if err != nil {
+		return scriptErrorReply(err, sha)
+	}
+	var result lua.Value
+	if len(vals) > 0 {
+		result = vals[0]
+	}
+	return luaToResp(result)
+}
+
+func scriptErrorReply(err error, sha string) resp.Value {
+	if errors.Is(err, errScriptKilled) {
+		return resp.Value{Typ: "error", Str: "ERR Script killed by user with SCRIPT KILL..."}
+	}
+	var luaErr *lua.Error
+	if errors.As(err, &luaErr) {
+		// Errors raised by redis.call carry the command's own error reply.
+		if t, ok := luaErr.Value.(*lua.Table); ok {
+			if msg, ok := t.Get("err").(string); ok {
+				return resp.Value{Typ: "error", Str: msg}
+			}
+		}
+	}
+	return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR %s script: %s", err.Error(), sha)}
+}
+
+func argsToLua(args []resp.Value) *lua.Table {
+	t := lua.NewTable()
+	for _, arg := range args {
+		t.Append(arg.Bulk)
+	}
+	return t
+}
+
+func redisLib(server *types.Server, run *scriptRun, readOnly bool) *lua.Table {
+	// Commands called by the script run as a client that never blocks.
+	client := &kv.ClientType{DenyBlocking: true, WatchedKeys: map[string]bool{}}
+	call := func(raise bool) lua.GoFunction {
+		return func(s *lua.State, args []lua.Value) ([]lua.Value, error) {
+			reply := scriptCall(args, server, client, run, readOnly)
+			if reply.Typ == "error" {
+				if raise {
+					return nil, &lua.Error{Value: statusTable("err", reply.Str)}
+				}
+				return []lua.Value{statusTable("err", reply.Str)}, nil
+			}
+			return []lua.Value{respToLua(reply)}, nil
+		}
+	}
+	t := lua.NewTable()
+	t.Set("call", lua.NewFunction("call", call(true)))
+	t.Set("pcall", lua.NewFunction("pcall", call(false)))
+	t.Set("error_reply", lua.NewFunction("error_reply", replyHelper("err", "error_reply")))
+	t.Set("status_reply", lua.NewFunction("status_reply", replyHelper("ok", "status_reply")))
+	t.Set("sha1hex", lua.NewFunction("sha1hex", func(s *lua.State, args []lua.Value) ([]lua.Value, error) {
+		str, err := s.CheckString(args, 0, "sha1hex")
+		if err != nil {
+			return nil, err
+		}
+		return []lua.Value{sha1hex(str)}, nil
+	}))
+	t.Set("log", lua.NewFunction("log", func(s *lua.State, args []lua.Value) ([]lua.Value, error) {
+		if _, err := s.CheckNumber(args, 0, "log"); err != nil {
+			return nil, err
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			parts = append(parts, lua.ToString(arg))
+		}
+		fmt.Println("Script log:", strings.Join(parts, " "))
+		return nil, nil
+	}))
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		t.Set(level, float64(i))
+	}
+	t.SetReadOnly()
+	return t
+}
+
+// scriptCall runs one redis.call from a script and returns its reply.
+func scriptCall(args []lua.Value, server *types.Server, client *kv.ClientType, run *scriptRun, readOnly bool) resp.Value {
+	if len(args) == 0 {
+		return resp.Value{Typ: "error", Str: "ERR Please specify at least one argument for this redis lib call"}
+	}
+	cmdArgs := make([]resp.Value, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			cmdArgs[i] = resp.Value{Typ: "bulk", Bulk: v}
+		case float64:
+			cmdArgs[i] = resp.Value{Typ: "bulk", Bulk: lua.ToString(v)}
+		default:
+			return resp.Value{Typ: "error", Str: "ERR Lua redis lib command arguments must be strings or integers"}
+		}
+	}
+	command := strings.ToUpper(cmdArgs[0].Bulk)
+	info, errReply := ValidateCommand(command, cmdArgs[1:])
+	if errReply != nil {
+		return *errReply
+	}
+	if info.Has(CmdNoScript) {
+		return resp.Value{Typ: "error", Str: "ERR This Redis command is not allowed from script"}
+	}
+	if info.Has(CmdWrite) {
+		if readOnly {
+			return resp.Value{Typ: "error", Str: "ERR Write commands are not allowed from read-only scripts."}
+		}
+		if denied := writeDenied(server); denied != nil {
+			return *denied
+		}
+		run.wrote.Store(true)
+	}
+	handler, ok := Handlers[command]
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR This Redis command is not allowed from script"}
+	}
+	return invoke(handler, cmdArgs[1:], server, client)
+}
+
+func replyHelper(field, name string) lua.GoFunction {
+	return func(s *lua.State, args []lua.Value) ([]lua.Value, error) {
+		str, err := s.CheckString(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		return []lua.Value{statusTable(field, str)}, nil
+	}
+}
+
+func statusTable(field, value string) *lua.Table {
+	t := lua.NewTable()
+	t.Set(field, value)
+	return t
+}
+
+// respToLua converts a command reply the way Redis does: nil becomes false,
+// status and error replies become tables with an ok or err field.
+func respToLua(v resp.Value) lua.Value {
+	switch v.Typ {
+	case "integer":
+		return float64(v.Num)
+	case "bulk":
+		return v.Bulk
+	case "string":
+		return statusTable("ok", v.Str)
+	case "error":
+		return statusTable("err", v.Str)
+	case "array":
+		t := lua.NewTable()
+		for i, item := range v.Array {
+			t.Set(float64(i+1), respToLua(item))
+		}
+		return t
+	}
+	return false
+}
+
+// luaToResp converts a script's result into a reply. Numbers are truncated
+// to integers and arrays stop at the first nil, as in Redis.
+func luaToResp(v lua.Value) resp.Value {
+	switch v := v.(type) {
+	case string:
+		return resp.Value{Typ: "bulk", Bulk: v}
+	case float64:
+		return resp.Value{Typ: "integer", Num: int(math.Trunc(v))}
+	case bool:
+		if v {
+			return resp.Value{Typ: "integer", Num: 1}
+		}
+	case *lua.Table:
+		if msg, ok := v.Get("err").(string); ok {
+			return resp.Value{Typ: "error", Str: msg}
+		}
+		if msg, ok := v.Get("ok").(string); ok {
+			return resp.Value{Typ: "string", Str: msg}
+		}
+		items := []resp.Value{}
+		for i := 1; ; i++ {
+			item := v.Get(float64(i))
+			if item == nil {
+				break
+			}
+			items = append(items, luaToResp(item))
+		}
+		return resp.Value{Typ: "array", Array: items}
+	}
+	return resp.Value{Typ: "null"}
+}
+
+// scriptCommand implements SCRIPT. It never touches the keyspace, so it runs
+// without waiting for a script in progress; that is what lets SCRIPT KILL
+// stop one.
+func scriptCommand(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	sub := strings.ToUpper(args[0].Bulk)
+	switch {
+	case sub == "LOAD" && len(args) == 2:
+		sha, _, errReply := scripts.load(args[1].Bulk)
+		if errReply != nil {
+			return *errReply
+		}
+		return resp.Value{Typ: "bulk", Bulk: sha}
+	case sub == "EXISTS" && len(args) >= 2:
+		result := make([]resp.Value, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			exists := 0
+			if scripts.lookup(arg.Bulk) != nil {
+				exists = 1
+			}
+			result = append(result, resp.Value{Typ: "integer", Num: exists})
+		}
+		return resp.Value{Typ: "array", Array: result}
+	case sub == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 {
+			if mode := strings.ToUpper(args[1].Bulk); mode != "SYNC" && mode != "ASYNC" {
+				return resp.Value{Typ: "error", Str: "ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+			}
+		}
+		scripts.mu.Lock()
+		scripts.scripts = map[string]*lua.Chunk{}
+		scripts.mu.Unlock()
+		return resp.Value{Typ: "string", Str: "OK"}
+	case sub == "KILL" && len(args) == 1:
+		scripts.mu.Lock()
+		run := scripts.running
+		scripts.mu.Unlock()
+		if run == nil {
+			return resp.Value{Typ: "error", Str: "NOTBUSY No scripts in execution right now."}
+		}
+		if run.wrote.Load() {
+			return resp.Value{Typ: "error", Str: "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+		}
+		run.killed.Store(true)
+		return resp.Value{Typ: "string", Str: "OK"}
+	}
+	return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try SCRIPT HELP.", strings.ToLower(args[0].Bulk))}
+}
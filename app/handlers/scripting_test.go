@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// evalReply runs a script command. Scripts contain spaces, so the arguments
+// are given one by one rather than as a command line.
+func evalReply(server *types.Server, client *kv.ClientType, name string, args ...string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	return Call(name, values, server, client)
+}
+
+// runningScript waits for a script to start and returns it.
+func runningScript(t *testing.T) *scriptRun {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		scripts.mu.Lock()
+		run := scripts.running
+		scripts.mu.Unlock()
+		if run != nil {
+			return run
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("script did not start")
+	return nil
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		script string
+		args   []string
+		want   string
+	}{
+		// Lua to RESP
+		{"return nil", nil, "(nil)"},
+		{"return false", nil, "(nil)"},
+		{"return true", nil, "1"},
+		{"return 3.99", nil, "3"},
+		{"return -3.5", nil, "-3"},
+		{"return 'x'", nil, "x"},
+		{"return {1, 'a', {2, 3}}", nil, "[1 a [2 3]]"},
+		{"return {1, 2, nil, 4}", nil, "[1 2]"},
+		{"return {1, false, 3}", nil, "[1 (nil) 3]"},
+		{"return {}", nil, "[]"},
+		{"return {ok = 'FINE'}", nil, "FINE"},
+		{"return {err = 'MY failure'}", nil, "MY failure"},
+		{"return redis.status_reply('PONG')", nil, "PONG"},
+		{"return redis.error_reply('MY failure')", nil, "MY failure"},
+
+		// RESP to Lua
+		{"return type(redis.call('GET', 'missing'))", nil, "boolean"},
+		{"return redis.call('GET', 'missing') == false", nil, "1"},
+		{"return type(redis.call('INCR', 'n'))", nil, "number"},
+		{"return redis.call('SET', 'a', 'b').ok", nil, "OK"},
+		{"return redis.call('PING')", nil, "PONG"},
+		{"redis.call('RPUSH', 'l', 'x', 'y') return redis.call('LRANGE', 'l', 0, -1)", nil, "[x y]"},
+		{"return redis.call('SET', KEYS[1], ARGV[1], 'GET')", []string{"1", "a", "c"}, "b"},
+
+		// KEYS and ARGV
+		{"return {KEYS[1], ARGV[1], #KEYS, #ARGV}", []string{"1", "k", "a", "b"}, "[k a 1 2]"},
+		{"return #KEYS + #ARGV", []string{"0"}, "0"},
+		{"return 1", []string{"-1"}, "ERR Number of keys can't be negative"},
+		{"return 1", []string{"2", "k"}, "ERR Number of keys can't be greater than number of args"},
+		{"return 1", []string{"x"}, "ERR value is not an integer or out of range"},
+
+		// errors from commands
+		{"redis.call('SET', 's', 'x') return redis.call('INCR', 's')", nil, "ERR value is not an integer or out of range"},
+		{"local r = redis.pcall('INCR', 's') return {type(r), r.err}", nil, "[table ERR value is not an integer or out of range]"},
+		{"local ok, e = pcall(redis.call, 'INCR', 's') return {tostring(ok), e.err}", nil, "[false ERR value is not an integer or out of range]"},
+		{"return redis.pcall('GET')", nil, "ERR wrong number of arguments for 'get' command"},
+		{"return redis.call()", nil, "ERR Please specify at least one argument for this redis lib call"},
+		{"return redis.call('GET', {})", nil, "ERR Lua redis lib command arguments must be strings or integers"},
+		{"return redis.call('MULTI')", nil, "ERR This Redis command is not allowed from script"},
+		{"return redis.call('EVAL', 'return 1', 0)", nil, "ERR This Redis command is not allowed from script"},
+		{"return redis.call('SUBSCRIBE', 'ch')", nil, "ERR This Redis command is not allowed from script"},
+		// Blocking commands return at once, as if they timed out.
+		{"return redis.call('BLPOP', 'empty', 0)", nil, "(nil)"},
+
+		// script errors
+		{"return 1 +", nil, "ERR Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'"},
+		{"error('boom')", nil, "ERR user_script:1: boom script: " + sha1hex("error('boom')")},
+		{"x = 1", nil, "ERR user_script:1: Script attempted to create global variable 'x' script: " + sha1hex("x = 1")},
+		{"return y", nil, "ERR user_script:1: Script attempted to access nonexistent global variable 'y' script: " + sha1hex("return y")},
+		{"redis.call = nil", nil, "ERR user_script:1: Attempt to modify a readonly table script: " + sha1hex("redis.call = nil")},
+	}
+	server, client := newTestServer(), newTestClient()
+	for _, tt := range tests {
+		args := append([]string{tt.script}, tt.args...)
+		if tt.args == nil {
+			args = append(args, "0")
+		}
+		if got := show(evalReply(server, client, "EVAL", args...)); got != tt.want {
+			t.Errorf("EVAL %q %q = %s, want %s", tt.script, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEvalReadOnly(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "SET a 1")
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"return redis.call('GET', 'a')", "1"},
+		{"return redis.call('SET', 'a', 2)", "ERR Write commands are not allowed from read-only scripts."},
+		{"return redis.pcall('INCR', 'a')", "ERR Write commands are not allowed from read-only scripts."},
+	}
+	for _, tt := range tests {
+		if got := show(evalReply(server, client, "EVAL_RO", tt.script, "0")); got != tt.want {
+			t.Errorf("EVAL_RO %q = %s, want %s", tt.script, got, tt.want)
+		}
+	}
+	if got := show(call(server, client, "GET a")); got != "1" {
+		t.Errorf("GET a = %s after read-only scripts, want 1", got)
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	script := "return ARGV[1]"
+	sha := sha1hex(script)
+	steps := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"SCRIPT", []string{"FLUSH"}, "OK"},
+		{"EVALSHA", []string{sha, "0", "x"}, "NOSCRIPT No matching script. Please use EVAL."},
+		{"SCRIPT", []string{"EXISTS", sha, "nope"}, "[0 0]"},
+		{"SCRIPT", []string{"LOAD", script}, sha},
+		{"SCRIPT", []string{"EXISTS", sha, "nope"}, "[1 0]"},
+		{"EVALSHA", []string{sha, "0", "x"}, "x"},
+		// Digests are matched case-insensitively.
+		{"EVALSHA_RO", []string{strings.ToUpper(sha), "0", "y"}, "y"},
+		{"SCRIPT", []string{"LOAD", "return +"}, "ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'"},
+		{"SCRIPT", []string{"FLUSH", "LATER"}, "ERR SCRIPT FLUSH only support SYNC|ASYNC option"},
+		{"SCRIPT", []string{"FLUSH", "ASYNC"}, "OK"},
+		{"SCRIPT", []string{"EXISTS", sha}, "[0]"},
+		// EVAL caches the scripts it runs.
+		{"EVAL", []string{script, "0", "z"}, "z"},
+		{"EVALSHA", []string{sha, "0", "w"}, "w"},
+		{"SCRIPT", []string{"FOO"}, "ERR unknown subcommand or wrong number of arguments for 'foo'. Try SCRIPT HELP."},
+		{"SCRIPT", []string{"KILL"}, "NOTBUSY No scripts in execution right now."},
+	}
+	for _, s := range steps {
+		if got := show(evalReply(server, client, s.name, s.args...)); got != s.want {
+			t.Errorf("%s %q = %s, want %s", s.name, s.args, got, s.want)
+		}
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	scriptKill := func() string {
+		return show(Handlers["SCRIPT"]([]resp.Value{{Typ: "bulk", Bulk: "KILL"}}, server, client))
+	}
+
+	// A script that has not written can be killed.
+	replies := make(chan resp.Value)
+	go func() {
+		replies <- evalReply(server, client, "EVAL", "redis.call('GET', 'a') while true do end", "0")
+	}()
+	runningScript(t)
+	if got := scriptKill(); got != "OK" {
+		t.Fatalf("SCRIPT KILL = %s, want OK", got)
+	}
+	select {
+	case reply := <-replies:
+		if got := show(reply); got != "ERR Script killed by user with SCRIPT KILL..." {
+			t.Errorf("killed script replied %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("script was not killed")
+	}
+
+	// Once it has written, it cannot. The script waits for a key that the
+	// test sets without taking the keyspace lock the script holds.
+	go func() {
+		replies <- evalReply(server, client, "EVAL", "redis.call('SET', 'w', 1) while not redis.call('GET', 'stop') do end return 'done'", "0")
+	}()
+	run := runningScript(t)
+	for !run.wrote.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if got := scriptKill(); got != "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command." {
+		t.Errorf("SCRIPT KILL = %s, want UNKILLABLE", got)
+	}
+	_, args := command("SET stop 1")
+	Handlers["SET"](args, server, client)
+	if got := show(<-replies); got != "done" {
+		t.Errorf("script replied %s, want done", got)
+	}
+	if got := scriptKill(); got != "NOTBUSY No scripts in execution right now." {
+		t.Errorf("SCRIPT KILL = %s after the script ended", got)
+	}
+}
+
+// TestScriptPropagation checks that scripts are replicated by their effects,
+// wrapped in MULTI/EXEC when they write more than once.
+func TestScriptPropagation(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	replica := addTestReplica(server)
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{"redis.call('SET', 'a', 1) redis.call('GET', 'a') redis.call('RPUSH', 'l', 2.0)", []string{"MULTI", "SET a 1", "RPUSH l 2", "EXEC"}},
+		{"return redis.call('SET', 'b', 'x')", []string{"SET b x"}},
+		{"return redis.call('GET', 'a')", nil},
+		// Writes made before an error are still propagated.
+		{"redis.call('SET', 'c', 1) redis.call('SET', 'd', 1) error('late')", []string{"MULTI", "SET c 1", "SET d 1", "EXEC"}},
+		// Failed writes change nothing and are not propagated.
+		{"redis.pcall('INCR', 'b')", nil},
+	}
+	for _, tt := range tests {
+		evalReply(server, client, "EVAL", tt.script, "0")
+		if got := replica.commands(); !slices.Equal(got, tt.want) {
+			t.Errorf("%q propagated %q, want %q", tt.script, got, tt.want)
+		}
+	}
+}
@@ -15,13 +15,26 @@ func sadd(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	kv := server.KV
 	kv.SetsMu.Lock()
 	defer kv.SetsMu.Unlock()
-	if _, ok := kv.Sets[key]; !ok {
-		kv.Sets[key] = make(map[*resp.Value]struct{})
+	set, ok := kv.MutableSet(key)
+	if !ok {
+		set = make(map[string]struct{})
+		kv.Sets[key] = set
 	}
+	added := 0
 	for _, member := range members {
-		kv.Sets[key][&member] = struct{}{}
+		if _, ok := set[member.Bulk]; !ok {
+			set[member.Bulk] = struct{}{}
+			added++
+		}
+	}
+	if added > 0 {
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifySet, "sadd", key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "SADD"}}, args...)}
+		server.Propagate(cmd)
 	}
-	return resp.Value{Typ: "integer", Num: (len(members))}
+	return resp.Value{Typ: "integer", Num: added}
 }
 
 func smembers(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
@@ -35,7 +48,7 @@ func smembers(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Va
 	if members, ok := kv.Sets[key]; ok {
 		var result []resp.Value
 		for member := range members {
-			result = append(result, *member)
+			result = append(result, resp.Value{Typ: "bulk", Bulk: member})
 		}
 		return resp.Value{Typ: "array", Array: result}
 	}
@@ -51,13 +64,28 @@ func srem(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	kv := server.KV
 	kv.SetsMu.Lock()
 	defer kv.SetsMu.Unlock()
-	if _, ok := kv.Sets[key]; !ok {
+	set, ok := kv.MutableSet(key)
+	if !ok {
 		return resp.Value{Typ: "integer", Num: 0}
 	}
+	removed := 0
 	for _, member := range members {
-		delete(kv.Sets[key], &member)
+		if _, ok := set[member.Bulk]; ok {
+			delete(set, member.Bulk)
+			removed++
+		}
+	}
+	if removed > 0 {
+		if len(set) == 0 {
+			delete(kv.Sets, key)
+		}
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifySet, "srem", key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "SREM"}}, args...)}
+		server.Propagate(cmd)
 	}
-	return resp.Value{Typ: "integer", Num: (len(members))}
+	return resp.Value{Typ: "integer", Num: removed}
 }
 
 func scard(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
@@ -82,7 +110,7 @@ func sunion(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Valu
 	kv := server.KV
 	kv.SetsMu.Lock()
 	defer kv.SetsMu.Unlock()
-	resultSet := make(map[*resp.Value]struct{})
+	resultSet := make(map[string]struct{})
 	for _, key := range keys {
 		if members, ok := kv.Sets[key.Bulk]; ok {
 			for member := range members {
@@ -92,7 +120,7 @@ func sunion(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Valu
 	}
 	var result []resp.Value
 	for member := range resultSet {
-		result = append(result, *member)
+		result = append(result, resp.Value{Typ: "bulk", Bulk: member})
 	}
 	return resp.Value{Typ: "array", Array: result}
 }
@@ -105,7 +133,7 @@ func sinter(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Valu
 	kv := server.KV
 	kv.SetsMu.Lock()
 	defer kv.SetsMu.Unlock()
-	resultSet := make(map[*resp.Value]struct{})
+	resultSet := make(map[string]struct{})
 	for i, key := range keys {
 		if members, ok := kv.Sets[key.Bulk]; ok {
 			if i == 0 {
@@ -123,7 +151,7 @@ func sinter(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Valu
 	}
 	var result []resp.Value
 	for member := range resultSet {
-		result = append(result, *member)
+		result = append(result, resp.Value{Typ: "bulk", Bulk: member})
 	}
 	return resp.Value{Typ: "array", Array: result}
 }
@@ -1,60 +1,189 @@
 package handlers
 
 import (
-	"sort"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"strconv"
+	"strings"
 
 	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/resp"
 	"github.com/r1i2t3/go-redis/app/types"
 )
 
-func SortKeysByValues(m map[string]float64) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+const (
+	zaddNX = 1 << iota
+	zaddXX
+	zaddGT
+	zaddLT
+	zaddCH
+	zaddINCR
+)
+
+// parseScore accepts the same spellings Redis does, including +inf and -inf,
+// and rejects NaN.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("ERR value is not a valid float")
 	}
-	sort.Slice(keys, func(i, j int) bool {
-		return m[keys[i]] < m[keys[j]]
-	})
+	return score, nil
+}
 
-	return keys
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score != 0 && (math.Abs(score) >= 1e17 || math.Abs(score) < 1e-5):
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	default:
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
 }
 
 func zadd(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	if len(args) < 3 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZADD' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zadd' command"}
 	}
-	kvStore := server.KV
-	key := args[0].Bulk
-	score, err := strconv.ParseFloat(args[1].Bulk, 64)
+	flags := 0
+	i := 1
+Options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "NX":
+			flags |= zaddNX
+		case "XX":
+			flags |= zaddXX
+		case "GT":
+			flags |= zaddGT
+		case "LT":
+			flags |= zaddLT
+		case "CH":
+			flags |= zaddCH
+		case "INCR":
+			flags |= zaddINCR
+		default:
+			break Options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	if flags&zaddNX != 0 && flags&zaddXX != 0 {
+		return resp.Value{Typ: "error", Str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if (flags&zaddGT != 0 && flags&zaddNX != 0) || (flags&zaddLT != 0 && flags&zaddNX != 0) || (flags&zaddGT != 0 && flags&zaddLT != 0) {
+		return resp.Value{Typ: "error", Str: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if flags&zaddINCR != 0 && len(pairs) > 2 {
+		return resp.Value{Typ: "error", Str: "ERR INCR option supports a single increment-element pair"}
+	}
+	return zaddGeneric("ZADD", args, args[0].Bulk, pairs, flags, server)
+}
+
+func zincrby(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zincrby' command"}
+	}
+	return zaddGeneric("ZINCRBY", args, args[0].Bulk, args[1:], zaddINCR, server)
+}
 
-	if err != nil {
-		return resp.Value{Typ: "error", Bulk: "ERR invalid score"}
+// zaddGeneric applies score/member pairs to the sorted set at key, following
+// the same rules as Redis' zaddGenericCommand.
+func zaddGeneric(name string, args []resp.Value, key string, pairs []resp.Value, flags int, server *types.Server) resp.Value {
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(pairs[j*2].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: err.Error()}
+		}
+		scores[j] = score
 	}
-	value := args[2].Bulk
+
+	kvStore := server.KV
 	kvStore.SortedsMu.Lock()
 	defer kvStore.SortedsMu.Unlock()
-	sorted_set, exists := kvStore.Sorteds[key]
+	sorted_set, exists := kvStore.MutableSortedSet(key)
+	if !exists && flags&zaddXX != 0 {
+		if flags&zaddINCR != 0 {
+			return resp.Value{Typ: "null"}
+		}
+		return resp.Value{Typ: "integer", Num: 0}
+	}
 	if !exists {
-		sorted_set = make(map[string]float64)
-		kvStore.Sorteds[key] = sorted_set
+		sorted_set = kv.NewSortedSet()
 	}
-	returns := 1
-	if _, exists := sorted_set[value]; exists {
-		returns = 0
+
+	added, updated := 0, 0
+	var newScore float64
+	aborted := false
+	for j, score := range scores {
+		member := pairs[j*2+1].Bulk
+		current, found := sorted_set.Score(member)
+		if !found {
+			if flags&zaddXX != 0 {
+				aborted = true
+				continue
+			}
+			newScore = score
+			sorted_set.Set(member, newScore)
+			added++
+			continue
+		}
+		if flags&zaddNX != 0 {
+			aborted = true
+			continue
+		}
+		newScore = score
+		if flags&zaddINCR != 0 {
+			newScore = current + score
+			if math.IsNaN(newScore) {
+				return resp.Value{Typ: "error", Str: "ERR resulting score is not a number (NaN)"}
+			}
+		}
+		if (flags&zaddGT != 0 && newScore <= current) || (flags&zaddLT != 0 && newScore >= current) {
+			aborted = true
+			continue
+		}
+		if newScore != current {
+			sorted_set.Set(member, newScore)
+			updated++
+		}
 	}
-	sorted_set[value] = score
-	incrementVersion(key, server)
-	server.IncrementDirty()
-	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "ZADD"}}, args...)}
-	server.Propagate(cmd)
-	return resp.Value{Typ: "integer", Num: returns}
+
+	if added+updated > 0 {
+		if !exists {
+			kvStore.Sorteds[key] = sorted_set
+		}
+		signalModifiedKey(key, server)
+		event := "zadd"
+		if flags&zaddINCR != 0 {
+			event = "zincr"
+		}
+		notifyKeyspaceEvent(server, notifyZSet, event, key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: name}}, args...)}
+		server.Propagate(cmd)
+	}
+	if flags&zaddINCR != 0 {
+		if aborted {
+			return resp.Value{Typ: "null"}
+		}
+		return resp.Value{Typ: "bulk", Bulk: formatScore(newScore)}
+	}
+	if flags&zaddCH != 0 {
+		return resp.Value{Typ: "integer", Num: added + updated}
+	}
+	return resp.Value{Typ: "integer", Num: added}
 }
 
 func zscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	if len(args) != 2 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZSCORE' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zscore' command"}
 	}
 	kvStore := server.KV
 	key := args[0].Bulk
@@ -65,16 +194,16 @@ func zscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Valu
 	if !exists {
 		return resp.Value{Typ: "null"}
 	}
-	score, exists := sorted_set[value]
+	score, exists := sorted_set.Score(value)
 	if !exists {
 		return resp.Value{Typ: "null"}
 	}
-	return resp.Value{Typ: "bulk", Bulk: strconv.FormatFloat(score, 'f', -1, 64)}
+	return resp.Value{Typ: "bulk", Bulk: formatScore(score)}
 }
 
 func zcard(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	if len(args) != 1 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZCARD' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zcard' command"}
 	}
 	kvStore := server.KV
 	key := args[0].Bulk
@@ -84,87 +213,261 @@ func zcard(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	if !exists {
 		return resp.Value{Typ: "integer", Num: 0}
 	}
-	return resp.Value{Typ: "integer", Num: len(sorted_set)}
+	return resp.Value{Typ: "integer", Num: sorted_set.Len()}
 }
 
 func zrem(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	if len(args) < 2 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZREM' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrem' command"}
 	}
 	kvStore := server.KV
 	key := args[0].Bulk
-	value := args[1].Bulk
 	kvStore.SortedsMu.Lock()
 	defer kvStore.SortedsMu.Unlock()
-	sorted_set, exists := kvStore.Sorteds[key]
+	sorted_set, exists := kvStore.MutableSortedSet(key)
 	if !exists {
 		return resp.Value{Typ: "integer", Num: 0}
 	}
-	if _, exists := sorted_set[value]; exists {
-		delete(sorted_set, value)
-		return resp.Value{Typ: "integer", Num: 1}
+	removed := 0
+	for _, member := range args[1:] {
+		if sorted_set.Remove(member.Bulk) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		if sorted_set.Len() == 0 {
+			delete(kvStore.Sorteds, key)
+		}
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyZSet, "zrem", key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "ZREM"}}, args...)}
+		server.Propagate(cmd)
 	}
-	return resp.Value{Typ: "integer", Num: 0}
+	return resp.Value{Typ: "integer", Num: removed}
 }
 
-func zrank(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if len(args) != 2 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZRANK' command"}
+func zmscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zmscore' command"}
 	}
 	kvStore := server.KV
-	key := args[0].Bulk
-	value := args[1].Bulk
 	kvStore.SortedsMu.RLock()
 	defer kvStore.SortedsMu.RUnlock()
-	sorted_set, exists := kvStore.Sorteds[key]
+	sorted_set := kvStore.Sorteds[args[0].Bulk]
+	result := make([]resp.Value, len(args)-1)
+	for i, member := range args[1:] {
+		result[i] = resp.Value{Typ: "null"}
+		if sorted_set == nil {
+			continue
+		}
+		if score, ok := sorted_set.Score(member.Bulk); ok {
+			result[i] = resp.Value{Typ: "bulk", Bulk: formatScore(score)}
+		}
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+// zpopGeneric removes up to count members from the low end of the sorted set
+// at key, or the high end when max is set. Callers hold SortedsMu. The pop
+// is propagated as ZPOPMIN/ZPOPMAX with an explicit count so replicas remove
+// exactly the same members.
+func zpopGeneric(key string, count int, max bool, server *types.Server) []kv.ZMember {
+	kvStore := server.KV
+	if count <= 0 {
+		return []kv.ZMember{}
+	}
+	sorted_set, exists := kvStore.MutableSortedSet(key)
 	if !exists {
-		return resp.Value{Typ: "null"}
+		return []kv.ZMember{}
+	}
+	if count > sorted_set.Len() {
+		count = sorted_set.Len()
+	}
+	popped := sorted_set.Range(0, count-1, max)
+	for _, m := range popped {
+		sorted_set.Remove(m.Member)
+	}
+	if sorted_set.Len() == 0 {
+		delete(kvStore.Sorteds, key)
+	}
+	name := "ZPOPMIN"
+	if max {
+		name = "ZPOPMAX"
+	}
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyZSet, strings.ToLower(name), key)
+	server.IncrementDirty()
+	server.Propagate(resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: name},
+		{Typ: "bulk", Bulk: key},
+		{Typ: "bulk", Bulk: strconv.Itoa(len(popped))},
+	}})
+	return popped
+}
+
+func zpopmin(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 1 || len(args) > 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zpopmin' command"}
 	}
-	sorted_keys := SortKeysByValues(sorted_set)
-	for i, k := range sorted_keys {
-		if k == value {
-			return resp.Value{Typ: "integer", Num: i}
+	return zpopCommand(args, server, false)
+}
+
+func zpopmax(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 1 || len(args) > 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zpopmax' command"}
+	}
+	return zpopCommand(args, server, true)
+}
+
+func zpopCommand(args []resp.Value, server *types.Server, max bool) resp.Value {
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
 		}
+		if n < 0 {
+			return resp.Value{Typ: "error", Str: "ERR value is out of range, must be positive"}
+		}
+		count = n
 	}
-	return resp.Value{Typ: "null"}
+	kvStore := server.KV
+	kvStore.SortedsMu.Lock()
+	defer kvStore.SortedsMu.Unlock()
+	return zmembersToResp(zpopGeneric(args[0].Bulk, count, max, server), true)
 }
 
-func zrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if len(args) < 2 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'ZRANGE' command"}
+func zmpop(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zmpop' command"}
 	}
+	numKeys, err := strconv.Atoi(args[0].Bulk)
+	if err != nil || numKeys <= 0 {
+		return resp.Value{Typ: "error", Str: "ERR numkeys should be greater than 0"}
+	}
+	if numKeys > len(args)-2 {
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	keys := args[1 : 1+numKeys]
+	rest := args[1+numKeys:]
+	var max bool
+	switch strings.ToUpper(rest[0].Bulk) {
+	case "MIN":
+		max = false
+	case "MAX":
+		max = true
+	default:
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	count := 1
+	rest = rest[1:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || !strings.EqualFold(rest[0].Bulk, "COUNT") {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		count, err = strconv.Atoi(rest[1].Bulk)
+		if err != nil || count <= 0 {
+			return resp.Value{Typ: "error", Str: "ERR count should be greater than 0"}
+		}
+	}
+
 	kvStore := server.KV
-	key := args[0].Bulk
-	start, err := strconv.Atoi(args[1].Bulk)
-	if err != nil {
-		return resp.Value{Typ: "error", Bulk: "ERR invalid start index"}
+	kvStore.SortedsMu.Lock()
+	defer kvStore.SortedsMu.Unlock()
+	for _, key := range keys {
+		if _, exists := kvStore.Sorteds[key.Bulk]; !exists {
+			continue
+		}
+		popped := zpopGeneric(key.Bulk, count, max, server)
+		pairs := make([]resp.Value, len(popped))
+		for i, m := range popped {
+			pairs[i] = resp.Value{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: m.Member},
+				{Typ: "bulk", Bulk: formatScore(m.Score)},
+			}}
+		}
+		return resp.Value{Typ: "array", Array: []resp.Value{
+			{Typ: "bulk", Bulk: key.Bulk},
+			{Typ: "array", Array: pairs},
+		}}
 	}
-	end, err := strconv.Atoi(args[2].Bulk)
-	if err != nil {
-		return resp.Value{Typ: "error", Bulk: "ERR invalid end index"}
+	return resp.Value{Typ: "null"}
+}
+
+// zrandmemberMaxCount bounds the number of reply elements ZRANDMEMBER
+// builds for a negative count, which asks for that many members whatever
+// the size of the set; WITHSCORES replies take two elements per member.
+// Redis bounds the count only by LONG_MAX/2 and streams the reply, while
+// here the whole reply is held in memory, so the bound is this server's
+// own, reported in the error a larger count gets.
+const zrandmemberMaxCount = 1 << 24
+
+func zrandmember(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 1 || len(args) > 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrandmember' command"}
 	}
-	kvStore.SortedsMu.RLock()
-	defer kvStore.SortedsMu.RUnlock()
-	sorted_set, exists := kvStore.Sorteds[key]
-	if !exists {
-		return resp.Value{Typ: "array", Array: []resp.Value{}}
+	withCount := len(args) > 1
+	count := int64(1)
+	if withCount {
+		n, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		count = n
 	}
-	sorted_keys := SortKeysByValues(sorted_set)
-	if start < 0 {
-		start = len(sorted_keys) + start
+	withScores := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2].Bulk, "WITHSCORES") {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		withScores = true
 	}
-	if end >= len(sorted_keys) {
-		end = len(sorted_keys) - 1
+	maxCount := int64(zrandmemberMaxCount)
+	if withScores {
+		maxCount /= 2
 	}
-	if end < 0 {
-		end = len(sorted_keys) + end
+	if count < -maxCount {
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR value is out of range, a negative count must be at least -%d", maxCount)}
 	}
-	if start >= len(sorted_keys) || start > end {
-		return resp.Value{Typ: "array", Array: []resp.Value{}}
+
+	kvStore := server.KV
+	kvStore.SortedsMu.RLock()
+	defer kvStore.SortedsMu.RUnlock()
+	sorted_set, exists := kvStore.Sorteds[args[0].Bulk]
+	if !exists {
+		if withCount {
+			return resp.Value{Typ: "array", Array: []resp.Value{}}
+		}
+		return resp.Value{Typ: "null"}
 	}
-	result := make([]resp.Value, end-start+1)
-	for i := start; i <= end; i++ {
-		result[i-start] = resp.Value{Typ: "bulk", Bulk: sorted_keys[i]}
+	length := sorted_set.Len()
+	if !withCount {
+		rank := rand.IntN(length)
+		return resp.Value{Typ: "bulk", Bulk: sorted_set.Range(rank, rank, false)[0].Member}
 	}
-	return resp.Value{Typ: "array", Array: result}
+
+	picked := make([]kv.ZMember, 0)
+	switch {
+	case count < 0:
+		// A negative count may return the same member several times.
+		for i := int64(0); i < -count; i++ {
+			rank := rand.IntN(length)
+			picked = append(picked, sorted_set.Range(rank, rank, false)[0])
+		}
+	case count >= int64(length):
+		picked = sorted_set.Members()
+		rand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	default:
+		seen := make(map[int]struct{}, count)
+		for int64(len(picked)) < count {
+			rank := rand.IntN(length)
+			if _, ok := seen[rank]; ok {
+				continue
+			}
+			seen[rank] = struct{}{}
+			picked = append(picked, sorted_set.Range(rank, rank, false)[0])
+		}
+	}
+	return zmembersToResp(picked, withScores)
 }
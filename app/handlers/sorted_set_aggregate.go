@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+const (
+	zsetOpUnion = iota
+	zsetOpInter
+	zsetOpDiff
+)
+
+const (
+	aggregateSum = iota
+	aggregateMin
+	aggregateMax
+)
+
+func zaggregate(target *float64, value float64, aggregate int) {
+	switch aggregate {
+	case aggregateSum:
+		*target += value
+		// The sum of +inf and -inf is NaN, which Redis replaces with zero.
+		if math.IsNaN(*target) {
+			*target = 0
+		}
+	case aggregateMin:
+		if value < *target {
+			*target = value
+		}
+	case aggregateMax:
+		if value > *target {
+			*target = value
+		}
+	}
+}
+
+// zsetOpInput reads key as a sorted set, or as a plain set whose members all
+// score 1. Missing keys read as empty. Callers hold SortedsMu and SetsMu.
+func zsetOpInput(kvStore *kv.KV, key string) map[string]float64 {
+	if sorted_set, ok := kvStore.Sorteds[key]; ok {
+		members := make(map[string]float64, sorted_set.Len())
+		for _, m := range sorted_set.Members() {
+			members[m.Member] = m.Score
+		}
+		return members
+	}
+	if set, ok := kvStore.Sets[key]; ok {
+		members := make(map[string]float64, len(set))
+		for member := range set {
+			members[member] = 1
+		}
+		return members
+	}
+	return map[string]float64{}
+}
+
+// zsetOpGeneric implements ZUNION, ZINTER and ZDIFF together with their
+// STORE forms. args starts at numkeys; dstKey is set for the STORE forms.
+func zsetOpGeneric(name string, args []resp.Value, server *types.Server, dstKey string, op int) resp.Value {
+	store := dstKey != ""
+	lowerName := strings.ToLower(name)
+	numKeys, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	if numKeys < 1 {
+		return resp.Value{Typ: "error", Str: "ERR at least 1 input key is needed for '" + lowerName + "' command"}
+	}
+	if numKeys > len(args)-1 {
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = args[1+i].Bulk
+	}
+
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := aggregateSum
+	withScores := false
+	for i := 1 + numKeys; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		remaining := len(args) - i - 1
+		switch {
+		case opt == "WEIGHTS" && op != zsetOpDiff && remaining >= numKeys:
+			for j := 0; j < numKeys; j++ {
+				weight, err := parseScore(args[i+1+j].Bulk)
+				if err != nil {
+					return resp.Value{Typ: "error", Str: "ERR weight value is not a float"}
+				}
+				weights[j] = weight
+			}
+			i += numKeys
+		case opt == "AGGREGATE" && op != zsetOpDiff && remaining >= 1:
+			switch strings.ToUpper(args[i+1].Bulk) {
+			case "SUM":
+				aggregate = aggregateSum
+			case "MIN":
+				aggregate = aggregateMin
+			case "MAX":
+				aggregate = aggregateMax
+			default:
+				return resp.Value{Typ: "error", Str: "ERR syntax error"}
+			}
+			i++
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	kvStore := server.KV
+	if store {
+		kvStore.SortedsMu.Lock()
+		defer kvStore.SortedsMu.Unlock()
+	} else {
+		kvStore.SortedsMu.RLock()
+		defer kvStore.SortedsMu.RUnlock()
+	}
+	kvStore.SetsMu.RLock()
+	inputs := make([]map[string]float64, numKeys)
+	for i, key := range keys {
+		inputs[i] = zsetOpInput(kvStore, key)
+	}
+	kvStore.SetsMu.RUnlock()
+
+	weighted := func(i int, score float64) float64 {
+		value := score * weights[i]
+		if math.IsNaN(value) {
+			return 0
+		}
+		return value
+	}
+
+	result := map[string]float64{}
+	switch op {
+	case zsetOpUnion:
+		for i, input := range inputs {
+			for member, score := range input {
+				value := weighted(i, score)
+				if current, ok := result[member]; ok {
+					zaggregate(&current, value, aggregate)
+					result[member] = current
+				} else {
+					result[member] = value
+				}
+			}
+		}
+	case zsetOpInter:
+	Members:
+		for member, score := range inputs[0] {
+			value := weighted(0, score)
+			for i := 1; i < len(inputs); i++ {
+				other, ok := inputs[i][member]
+				if !ok {
+					continue Members
+				}
+				zaggregate(&value, weighted(i, other), aggregate)
+			}
+			result[member] = value
+		}
+	case zsetOpDiff:
+	Diff:
+		for member, score := range inputs[0] {
+			for i := 1; i < len(inputs); i++ {
+				if _, ok := inputs[i][member]; ok {
+					continue Diff
+				}
+			}
+			result[member] = score
+		}
+	}
+
+	sorted := kv.NewSortedSet()
+	for member, score := range result {
+		sorted.Set(member, score)
+	}
+	if !store {
+		return zmembersToResp(sorted.Members(), withScores)
+	}
+
+	kvStore.PreserveSortedSet(dstKey)
+	_, dstExisted := kvStore.Sorteds[dstKey]
+	if sorted.Len() == 0 {
+		delete(kvStore.Sorteds, dstKey)
+	} else {
+		kvStore.Sorteds[dstKey] = sorted
+	}
+	if sorted.Len() > 0 || dstExisted {
+		signalModifiedKey(dstKey, server)
+		notifyKeyspaceEvent(server, notifyZSet, lowerName, dstKey)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: name}, {Typ: "bulk", Bulk: dstKey}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: sorted.Len()}
+}
+
+func zunion(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zunion' command"}
+	}
+	return zsetOpGeneric("ZUNION", args, server, "", zsetOpUnion)
+}
+
+func zinter(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zinter' command"}
+	}
+	return zsetOpGeneric("ZINTER", args, server, "", zsetOpInter)
+}
+
+func zdiff(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zdiff' command"}
+	}
+	return zsetOpGeneric("ZDIFF", args, server, "", zsetOpDiff)
+}
+
+func zunionstore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zunionstore' command"}
+	}
+	return zsetOpGeneric("ZUNIONSTORE", args[1:], server, args[0].Bulk, zsetOpUnion)
+}
+
+func zinterstore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zinterstore' command"}
+	}
+	return zsetOpGeneric("ZINTERSTORE", args[1:], server, args[0].Bulk, zsetOpInter)
+}
+
+func zdiffstore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zdiffstore' command"}
+	}
+	return zsetOpGeneric("ZDIFFSTORE", args[1:], server, args[0].Bulk, zsetOpDiff)
+}
+
+func zintercard(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zintercard' command"}
+	}
+	numKeys, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR numkeys should be greater than 0"}
+	}
+	if numKeys < 1 {
+		return resp.Value{Typ: "error", Str: "ERR numkeys should be greater than 0"}
+	}
+	if numKeys > len(args)-1 {
+		return resp.Value{Typ: "error", Str: "ERR Number of keys can't be greater than number of args"}
+	}
+	limit := 0
+	rest := args[1+numKeys:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || !strings.EqualFold(rest[0].Bulk, "LIMIT") {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		limit, err = strconv.Atoi(rest[1].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR LIMIT can't be negative"}
+		}
+		if limit < 0 {
+			return resp.Value{Typ: "error", Str: "ERR LIMIT can't be negative"}
+		}
+	}
+
+	kvStore := server.KV
+	kvStore.SortedsMu.RLock()
+	defer kvStore.SortedsMu.RUnlock()
+	kvStore.SetsMu.RLock()
+	defer kvStore.SetsMu.RUnlock()
+	inputs := make([]map[string]float64, numKeys)
+	for i := range inputs {
+		inputs[i] = zsetOpInput(kvStore, args[1+i].Bulk)
+	}
+	cardinality := 0
+Members:
+	for member := range inputs[0] {
+		for i := 1; i < len(inputs); i++ {
+			if _, ok := inputs[i][member]; !ok {
+				continue Members
+			}
+		}
+		cardinality++
+		if limit > 0 && cardinality >= limit {
+			break
+		}
+	}
+	return resp.Value{Typ: "integer", Num: cardinality}
+}
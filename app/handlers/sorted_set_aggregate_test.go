@@ -0,0 +1,91 @@
+package handlers
+
+import "testing"
+
+func TestZsetOperations(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"ZUNION 2 z1 z2 WITHSCORES", "[a 1 b 12 c 23 d 30]"},
+		{"ZUNION 2 z1 z2", "[a b c d]"},
+		{"ZUNION 2 z1 z2 WEIGHTS 2 1 WITHSCORES", "[a 2 b 14 c 26 d 30]"},
+		{"ZUNION 2 z1 z2 AGGREGATE MIN WITHSCORES", "[a 1 b 2 c 3 d 30]"},
+		{"ZUNION 2 z1 z2 AGGREGATE MAX WITHSCORES", "[a 1 b 10 c 20 d 30]"},
+		{"ZUNION 2 z1 z2 WEIGHTS 1 -1 AGGREGATE max WITHSCORES", "[d -30 a 1 b 2 c 3]"},
+		{"ZUNION 2 z1 missing", "[a b c]"},
+		// A plain set's members score 1.
+		{"ZUNION 2 z1 s WITHSCORES", "[d 1 e 1 a 2 b 2 c 3]"},
+		// inf + -inf and inf * 0 are NaN, which score 0 instead.
+		{"ZUNION 2 pinf minf WITHSCORES", "[x 0]"},
+		{"ZUNION 1 pinf WEIGHTS 0 WITHSCORES", "[x 0]"},
+
+		{"ZINTER 2 z1 z2 WITHSCORES", "[b 12 c 23]"},
+		{"ZINTER 2 z1 z2 WEIGHTS 1 -1 AGGREGATE MAX WITHSCORES", "[b 2 c 3]"},
+		{"ZINTER 2 z1 z2 AGGREGATE MIN WITHSCORES", "[b 2 c 3]"},
+		{"ZINTER 2 z1 s WITHSCORES", "[a 2]"},
+		{"ZINTER 2 z1 missing", "[]"},
+
+		{"ZDIFF 2 z1 z2 WITHSCORES", "[a 1]"},
+		{"ZDIFF 1 z1", "[a b c]"},
+		{"ZDIFF 2 z1 s", "[b c]"},
+		{"ZDIFF 2 missing z1", "[]"},
+
+		{"ZINTERCARD 2 z1 z2", "2"},
+		{"ZINTERCARD 2 z1 z2 LIMIT 1", "1"},
+		{"ZINTERCARD 2 z1 z2 LIMIT 0", "2"},
+		{"ZINTERCARD 1 s", "3"},
+
+		{"ZUNION 0 z1", "ERR at least 1 input key is needed for 'zunion' command"},
+		{"ZINTERSTORE d 0 z1", "ERR at least 1 input key is needed for 'zinterstore' command"},
+		{"ZUNION x z1", "ERR value is not an integer or out of range"},
+		{"ZUNION 3 z1 z2", "ERR syntax error"},
+		{"ZUNION 2 z1 z2 WEIGHTS 1", "ERR syntax error"},
+		{"ZUNION 2 z1 z2 WEIGHTS 1 x", "ERR weight value is not a float"},
+		{"ZUNION 2 z1 z2 AGGREGATE AVG", "ERR syntax error"},
+		{"ZUNION 2 z1 z2 AGGREGATE", "ERR syntax error"},
+		{"ZDIFF 2 z1 z2 WEIGHTS 1 1", "ERR syntax error"},
+		{"ZDIFF 2 z1 z2 AGGREGATE MIN", "ERR syntax error"},
+		{"ZUNIONSTORE d 2 z1 z2 WITHSCORES", "ERR syntax error"},
+		{"ZINTERCARD 0 z1", "ERR numkeys should be greater than 0"},
+		{"ZINTERCARD 3 z1 z2", "ERR Number of keys can't be greater than number of args"},
+		{"ZINTERCARD 2 z1 z2 LIMIT -1", "ERR LIMIT can't be negative"},
+		{"ZINTERCARD 2 z1 z2 COUNT 1", "ERR syntax error"},
+	}
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{
+		"ZADD z1 1 a 2 b 3 c",
+		"ZADD z2 10 b 20 c 30 d",
+		"SADD s a d e",
+		"ZADD pinf +inf x",
+		"ZADD minf -inf x",
+	} {
+		run(t, server, client, line)
+	}
+	for _, tt := range tests {
+		if got := show(call(server, client, tt.command)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestZsetOperationStore(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z1 1 a 2 b 3 c")
+	run(t, server, client, "ZADD z2 10 b 20 c 30 d")
+	runSteps(t, server, client, []step{
+		{"ZUNIONSTORE d 2 z1 z2 WEIGHTS 1 2", "4"},
+		{"ZRANGE d 0 -1 WITHSCORES", "[a 1 b 22 c 43 d 60]"},
+		{"ZDIFFSTORE d 2 z1 z2", "1"},
+		{"ZRANGE d 0 -1 WITHSCORES", "[a 1]"},
+		// The destination may be one of the inputs.
+		{"ZINTERSTORE z1 2 z1 z2 AGGREGATE MAX", "2"},
+		{"ZRANGE z1 0 -1 WITHSCORES", "[b 10 c 20]"},
+		// An empty result deletes the destination.
+		{"ZINTERSTORE d 2 z1 missing", "0"},
+		{"ZCARD d", "0"},
+	})
+	if _, ok := server.KV.Sorteds["d"]; ok {
+		t.Errorf("d exists after storing an empty result")
+	}
+}
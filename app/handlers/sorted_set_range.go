@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+const (
+	zrangeAuto = iota
+	zrangeRank
+	zrangeScore
+	zrangeLex
+)
+
+// zrangeSpec is a parsed score or lex interval. belowMin reports whether an
+// element sorts before the interval and withinMax whether it does not sort
+// after it, so the interval covers the ascending ranks
+// [count(belowMin), count(withinMax)).
+type zrangeSpec interface {
+	belowMin(score float64, member string) bool
+	withinMax(score float64, member string) bool
+}
+
+type zScoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r zScoreRange) belowMin(score float64, _ string) bool {
+	return score < r.min || (r.minex && score == r.min)
+}
+
+func (r zScoreRange) withinMax(score float64, _ string) bool {
+	return score < r.max || (!r.maxex && score == r.max)
+}
+
+// zLexBound is one end of a lex interval. inf is -1 for "-", 1 for "+" and 0
+// for a "[" or "(" prefixed member.
+type zLexBound struct {
+	member    string
+	exclusive bool
+	inf       int
+}
+
+type zLexRange struct {
+	min, max zLexBound
+}
+
+func (r zLexRange) belowMin(_ float64, member string) bool {
+	switch r.min.inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	if r.min.exclusive {
+		return member <= r.min.member
+	}
+	return member < r.min.member
+}
+
+func (r zLexRange) withinMax(_ float64, member string) bool {
+	switch r.max.inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	if r.max.exclusive {
+		return member < r.max.member
+	}
+	return member <= r.max.member
+}
+
+func parseScoreBound(s string) (float64, bool, bool) {
+	exclusive := false
+	if strings.HasPrefix(s, "(") {
+		exclusive = true
+		s = s[1:]
+	}
+	score, err := parseScore(s)
+	if err != nil {
+		return 0, false, false
+	}
+	return score, exclusive, true
+}
+
+func parseScoreRange(min, max string) (zScoreRange, bool) {
+	var r zScoreRange
+	var ok bool
+	if r.min, r.minex, ok = parseScoreBound(min); !ok {
+		return r, false
+	}
+	if r.max, r.maxex, ok = parseScoreBound(max); !ok {
+		return r, false
+	}
+	return r, true
+}
+
+func parseLexBound(s string) (zLexBound, bool) {
+	switch {
+	case s == "-":
+		return zLexBound{inf: -1}, true
+	case s == "+":
+		return zLexBound{inf: 1}, true
+	case strings.HasPrefix(s, "("):
+		return zLexBound{member: s[1:], exclusive: true}, true
+	case strings.HasPrefix(s, "["):
+		return zLexBound{member: s[1:]}, true
+	default:
+		return zLexBound{}, false
+	}
+}
+
+func parseLexRange(min, max string) (zLexRange, bool) {
+	var r zLexRange
+	var ok bool
+	if r.min, ok = parseLexBound(min); !ok {
+		return r, false
+	}
+	if r.max, ok = parseLexBound(max); !ok {
+		return r, false
+	}
+	return r, true
+}
+
+// zrangeRanks returns the ascending ranks [first, last) covered by spec.
+func zrangeRanks(sorted_set *kv.SortedSet, spec zrangeSpec) (int, int) {
+	first := sorted_set.CountWhile(spec.belowMin)
+	last := sorted_set.CountWhile(spec.withinMax)
+	if last < first {
+		last = first
+	}
+	return first, last
+}
+
+// zrangeByRank normalises Redis-style start/stop indexes, where negative
+// values count from the end, and returns the selected members.
+func zrangeByRank(sorted_set *kv.SortedSet, start, end int, reverse bool) []kv.ZMember {
+	length := sorted_set.Len()
+	if start < 0 {
+		start = length + start
+	}
+	if end < 0 {
+		end = length + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= length {
+		return []kv.ZMember{}
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return sorted_set.Range(start, end, reverse)
+}
+
+// zrangeBySpec returns the members inside spec, walking from the lowest
+// score or, when reverse is set, from the highest. offset and count apply in
+// that walking order; a negative count means no limit.
+func zrangeBySpec(sorted_set *kv.SortedSet, spec zrangeSpec, reverse bool, offset, count int) []kv.ZMember {
+	first, last := zrangeRanks(sorted_set, spec)
+	if reverse {
+		length := sorted_set.Len()
+		first, last = length-last, length-first
+	}
+	if offset < 0 || first+offset >= last || count == 0 {
+		return []kv.ZMember{}
+	}
+	start := first + offset
+	end := last - 1
+	if count > 0 && start+count-1 < end {
+		end = start + count - 1
+	}
+	return sorted_set.Range(start, end, reverse)
+}
+
+func zmembersToResp(members []kv.ZMember, withScores bool) resp.Value {
+	result := make([]resp.Value, 0, len(members))
+	for _, m := range members {
+		result = append(result, resp.Value{Typ: "bulk", Bulk: m.Member})
+		if withScores {
+			result = append(result, resp.Value{Typ: "bulk", Bulk: formatScore(m.Score)})
+		}
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+// zrangeGeneric implements ZRANGE, ZRANGESTORE and the legacy ZREVRANGE,
+// ZRANGEBYSCORE, ZREVRANGEBYSCORE, ZRANGEBYLEX and ZREVRANGEBYLEX. args
+// starts at the source key; storeKey is set for ZRANGESTORE. Only the
+// unified forms (rangeType zrangeAuto) accept BYSCORE, BYLEX and REV.
+func zrangeGeneric(name string, args []resp.Value, server *types.Server, storeKey string, rangeType int, reverse bool) resp.Value {
+	store := storeKey != ""
+	withScores := false
+	offset, count := 0, -1
+	hasLimit := false
+	unified := rangeType == zrangeAuto
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		switch {
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		case opt == "LIMIT" && i+2 < len(args):
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1].Bulk)
+			count, err2 = strconv.Atoi(args[i+2].Bulk)
+			if err1 != nil || err2 != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			hasLimit = true
+			i += 2
+		case opt == "BYSCORE" && rangeType == zrangeAuto:
+			rangeType = zrangeScore
+		case opt == "BYLEX" && rangeType == zrangeAuto:
+			rangeType = zrangeLex
+		case opt == "REV" && unified && !reverse:
+			reverse = true
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+	if rangeType == zrangeAuto {
+		rangeType = zrangeRank
+	}
+	if hasLimit && rangeType == zrangeRank {
+		return resp.Value{Typ: "error", Str: "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"}
+	}
+	if withScores && rangeType == zrangeLex {
+		return resp.Value{Typ: "error", Str: "ERR syntax error, WITHSCORES not supported in combination with BYLEX"}
+	}
+
+	key := args[0].Bulk
+	min, max := args[1].Bulk, args[2].Bulk
+	if reverse && rangeType != zrangeRank {
+		min, max = max, min
+	}
+
+	var spec zrangeSpec
+	var start, end int
+	switch rangeType {
+	case zrangeRank:
+		var err1, err2 error
+		start, err1 = strconv.Atoi(min)
+		end, err2 = strconv.Atoi(max)
+		if err1 != nil || err2 != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+		}
+	case zrangeScore:
+		r, ok := parseScoreRange(min, max)
+		if !ok {
+			return resp.Value{Typ: "error", Str: "ERR min or max is not a float"}
+		}
+		spec = r
+	case zrangeLex:
+		r, ok := parseLexRange(min, max)
+		if !ok {
+			return resp.Value{Typ: "error", Str: "ERR min or max not valid string range item"}
+		}
+		spec = r
+	}
+
+	kvStore := server.KV
+	if store {
+		kvStore.SortedsMu.Lock()
+		defer kvStore.SortedsMu.Unlock()
+	} else {
+		kvStore.SortedsMu.RLock()
+		defer kvStore.SortedsMu.RUnlock()
+	}
+	members := []kv.ZMember{}
+	if sorted_set, exists := kvStore.Sorteds[key]; exists {
+		if rangeType == zrangeRank {
+			members = zrangeByRank(sorted_set, start, end, reverse)
+		} else {
+			members = zrangeBySpec(sorted_set, spec, reverse, offset, count)
+		}
+	}
+	if !store {
+		return zmembersToResp(members, withScores)
+	}
+
+	kvStore.PreserveSortedSet(storeKey)
+	_, dstExisted := kvStore.Sorteds[storeKey]
+	if len(members) == 0 {
+		delete(kvStore.Sorteds, storeKey)
+	} else {
+		dst := kv.NewSortedSet()
+		for _, m := range members {
+			dst.Set(m.Member, m.Score)
+		}
+		kvStore.Sorteds[storeKey] = dst
+	}
+	if len(members) > 0 || dstExisted {
+		signalModifiedKey(storeKey, server)
+		notifyKeyspaceEvent(server, notifyZSet, "zrangestore", storeKey)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: name}, {Typ: "bulk", Bulk: storeKey}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: len(members)}
+}
+
+func zrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrange' command"}
+	}
+	return zrangeGeneric("ZRANGE", args, server, "", zrangeAuto, false)
+}
+
+func zrangestore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 4 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrangestore' command"}
+	}
+	return zrangeGeneric("ZRANGESTORE", args[1:], server, args[0].Bulk, zrangeAuto, false)
+}
+
+func zrevrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrevrange' command"}
+	}
+	return zrangeGeneric("ZREVRANGE", args, server, "", zrangeRank, true)
+}
+
+func zrangebyscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrangebyscore' command"}
+	}
+	return zrangeGeneric("ZRANGEBYSCORE", args, server, "", zrangeScore, false)
+}
+
+func zrevrangebyscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrevrangebyscore' command"}
+	}
+	return zrangeGeneric("ZREVRANGEBYSCORE", args, server, "", zrangeScore, true)
+}
+
+func zrangebylex(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrangebylex' command"}
+	}
+	return zrangeGeneric("ZRANGEBYLEX", args, server, "", zrangeLex, false)
+}
+
+func zrevrangebylex(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrevrangebylex' command"}
+	}
+	return zrangeGeneric("ZREVRANGEBYLEX", args, server, "", zrangeLex, true)
+}
+
+func zrank(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 2 && len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrank' command"}
+	}
+	return zrankGeneric(args, server, false)
+}
+
+func zrevrank(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 2 && len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zrevrank' command"}
+	}
+	return zrankGeneric(args, server, true)
+}
+
+func zrankGeneric(args []resp.Value, server *types.Server, reverse bool) resp.Value {
+	withScore := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2].Bulk, "WITHSCORE") {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		withScore = true
+	}
+	kvStore := server.KV
+	key := args[0].Bulk
+	value := args[1].Bulk
+	kvStore.SortedsMu.RLock()
+	defer kvStore.SortedsMu.RUnlock()
+	sorted_set, exists := kvStore.Sorteds[key]
+	if !exists {
+		return resp.Value{Typ: "null"}
+	}
+	rank, exists := sorted_set.Rank(value, reverse)
+	if !exists {
+		return resp.Value{Typ: "null"}
+	}
+	if withScore {
+		score, _ := sorted_set.Score(value)
+		return resp.Value{Typ: "array", Array: []resp.Value{
+			{Typ: "integer", Num: rank},
+			{Typ: "bulk", Bulk: formatScore(score)},
+		}}
+	}
+	return resp.Value{Typ: "integer", Num: rank}
+}
+
+func zcount(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zcount' command"}
+	}
+	spec, ok := parseScoreRange(args[1].Bulk, args[2].Bulk)
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR min or max is not a float"}
+	}
+	return zcountGeneric(args[0].Bulk, spec, server)
+}
+
+func zlexcount(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zlexcount' command"}
+	}
+	spec, ok := parseLexRange(args[1].Bulk, args[2].Bulk)
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR min or max not valid string range item"}
+	}
+	return zcountGeneric(args[0].Bulk, spec, server)
+}
+
+func zcountGeneric(key string, spec zrangeSpec, server *types.Server) resp.Value {
+	kvStore := server.KV
+	kvStore.SortedsMu.RLock()
+	defer kvStore.SortedsMu.RUnlock()
+	sorted_set, exists := kvStore.Sorteds[key]
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	first, last := zrangeRanks(sorted_set, spec)
+	return resp.Value{Typ: "integer", Num: last - first}
+}
+
+func zremrangebyrank(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zremrangebyrank' command"}
+	}
+	start, err1 := strconv.Atoi(args[1].Bulk)
+	end, err2 := strconv.Atoi(args[2].Bulk)
+	if err1 != nil || err2 != nil {
+		return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	return zremrangeGeneric("ZREMRANGEBYRANK", args, server, func(sorted_set *kv.SortedSet) []kv.ZMember {
+		return zrangeByRank(sorted_set, start, end, false)
+	})
+}
+
+func zremrangebyscore(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zremrangebyscore' command"}
+	}
+	spec, ok := parseScoreRange(args[1].Bulk, args[2].Bulk)
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR min or max is not a float"}
+	}
+	return zremrangeGeneric("ZREMRANGEBYSCORE", args, server, func(sorted_set *kv.SortedSet) []kv.ZMember {
+		return zrangeBySpec(sorted_set, spec, false, 0, -1)
+	})
+}
+
+func zremrangebylex(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'zremrangebylex' command"}
+	}
+	spec, ok := parseLexRange(args[1].Bulk, args[2].Bulk)
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR min or max not valid string range item"}
+	}
+	return zremrangeGeneric("ZREMRANGEBYLEX", args, server, func(sorted_set *kv.SortedSet) []kv.ZMember {
+		return zrangeBySpec(sorted_set, spec, false, 0, -1)
+	})
+}
+
+// zremrangeGeneric removes the members selected by pick from the sorted set
+// at args[0]. The range arguments are already deterministic, so the command
+// is propagated unchanged.
+func zremrangeGeneric(name string, args []resp.Value, server *types.Server, pick func(*kv.SortedSet) []kv.ZMember) resp.Value {
+	kvStore := server.KV
+	key := args[0].Bulk
+	kvStore.SortedsMu.Lock()
+	defer kvStore.SortedsMu.Unlock()
+	sorted_set, exists := kvStore.MutableSortedSet(key)
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	members := pick(sorted_set)
+	for _, m := range members {
+		sorted_set.Remove(m.Member)
+	}
+	if len(members) > 0 {
+		if sorted_set.Len() == 0 {
+			delete(kvStore.Sorteds, key)
+		}
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyZSet, strings.ToLower(name), key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: name}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: len(members)}
+}
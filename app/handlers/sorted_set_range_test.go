@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestZrange(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		// by rank
+		{"ZRANGE z 0 -1", "[a b c d e]"},
+		{"ZRANGE z 1 2 WITHSCORES", "[b 2 c 3]"},
+		{"ZRANGE z -2 -1", "[d e]"},
+		{"ZRANGE z -100 1", "[a b]"},
+		{"ZRANGE z 3 1", "[]"},
+		{"ZRANGE z 5 10", "[]"},
+		{"ZRANGE z 3 100", "[d e]"},
+		{"ZRANGE z 0 1 REV", "[e d]"},
+		{"ZREVRANGE z 0 1 WITHSCORES", "[e 5 d 4]"},
+		{"ZRANGE missing 0 -1", "[]"},
+		{"ZRANGE z 0 -1 LIMIT 0 1", "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"},
+		{"ZRANGE z a 1", "ERR value is not an integer or out of range"},
+		{"ZREVRANGE z 0 1 REV", "ERR syntax error"},
+
+		// by score
+		{"ZRANGE z 2 4 BYSCORE", "[b c d]"},
+		{"ZRANGE z (2 4 BYSCORE", "[c d]"},
+		{"ZRANGE z (2 (4 BYSCORE", "[c]"},
+		{"ZRANGE z (2 (3 BYSCORE", "[]"},
+		{"ZRANGE z 4 2 BYSCORE", "[]"},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 1 2", "[b c]"},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 3 -1", "[d e]"},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 5 1", "[]"},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT -1 1", "[]"},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 0 0", "[]"},
+		{"ZRANGE z 4 2 BYSCORE REV", "[d c b]"},
+		{"ZRANGE z +inf -inf BYSCORE REV LIMIT 1 2 WITHSCORES", "[d 4 c 3]"},
+		{"ZRANGE z 2 4 BYSCORE REV", "[]"},
+		{"ZRANGEBYSCORE z (1 3", "[b c]"},
+		{"ZRANGEBYSCORE z -inf +inf LIMIT 4 10 WITHSCORES", "[e 5]"},
+		{"ZREVRANGEBYSCORE z 3 (1", "[c b]"},
+		{"ZREVRANGEBYSCORE z +inf -inf LIMIT 0 2", "[e d]"},
+		{"ZRANGEBYSCORE z x 3", "ERR min or max is not a float"},
+		{"ZRANGEBYSCORE z 1 nan", "ERR min or max is not a float"},
+		{"ZRANGEBYSCORE z 1 3 REV", "ERR syntax error"},
+		{"ZRANGEBYSCORE z 1 3 BYLEX", "ERR syntax error"},
+		{"ZRANGE z 0 -1 BYSCORE BYLEX", "ERR syntax error"},
+		{"ZRANGE z 0 -1 BYSCORE LIMIT 1", "ERR syntax error"},
+		{"ZRANGE z 0 -1 BYSCORE LIMIT x 1", "ERR value is not an integer or out of range"},
+
+		// by lex
+		{"ZRANGE l [b (d BYLEX", "[b c]"},
+		{"ZRANGE l - + BYLEX LIMIT 1 2", "[b c]"},
+		{"ZRANGE l + - BYLEX REV", "[e d c b a]"},
+		{"ZRANGE l (e [b BYLEX REV", "[d c b]"},
+		{"ZRANGE l (b (c BYLEX", "[]"},
+		{"ZRANGE l + - BYLEX", "[]"},
+		{"ZRANGEBYLEX l - [c", "[a b c]"},
+		{"ZREVRANGEBYLEX l [c - LIMIT 1 1", "[b]"},
+		{"ZRANGEBYLEX l b d", "ERR min or max not valid string range item"},
+		{"ZRANGE l - + BYLEX WITHSCORES", "ERR syntax error, WITHSCORES not supported in combination with BYLEX"},
+
+		// ranks
+		{"ZRANK z c", "2"},
+		{"ZRANK z c WITHSCORE", "[2 3]"},
+		{"ZREVRANK z c WITHSCORE", "[2 3]"},
+		{"ZREVRANK z a", "4"},
+		{"ZRANK z zz", "(nil)"},
+		{"ZRANK z c WITHSCORES", "ERR syntax error"},
+	}
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z 1 a 2 b 3 c 4 d 5 e")
+	run(t, server, client, "ZADD l 0 a 0 b 0 c 0 d 0 e")
+	for _, tt := range tests {
+		if got := show(call(server, client, tt.command)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestZrangestore(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z 1 a 2 b 3 c")
+	runSteps(t, server, client, []step{
+		{"ZRANGESTORE dst z 1 2", "2"},
+		{"ZRANGE dst 0 -1 WITHSCORES", "[b 2 c 3]"},
+		{"ZRANGESTORE dst z +inf (1 BYSCORE REV LIMIT 0 1", "1"},
+		{"ZRANGE dst 0 -1 WITHSCORES", "[c 3]"},
+		{"ZRANGESTORE dst z 0 -1 WITHSCORES", "ERR syntax error"},
+		// An empty result deletes the destination.
+		{"ZRANGESTORE dst z 10 20", "0"},
+		{"ZCARD dst", "0"},
+		{"ZRANGESTORE dst missing 0 -1", "0"},
+	})
+	if _, ok := server.KV.Sorteds["dst"]; ok {
+		t.Errorf("dst exists after storing an empty range")
+	}
+}
+
+func TestZcount(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"ZCOUNT z -inf +inf", "5"},
+		{"ZCOUNT z 2 4", "3"},
+		{"ZCOUNT z (2 (4", "1"},
+		{"ZCOUNT z 4 2", "0"},
+		{"ZCOUNT missing 0 10", "0"},
+		{"ZCOUNT z a 2", "ERR min or max is not a float"},
+		{"ZLEXCOUNT l - +", "5"},
+		{"ZLEXCOUNT l [b (e", "3"},
+		{"ZLEXCOUNT l (e [b", "0"},
+		{"ZLEXCOUNT l b e", "ERR min or max not valid string range item"},
+	}
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z 1 a 2 b 3 c 4 d 5 e")
+	run(t, server, client, "ZADD l 0 a 0 b 0 c 0 d 0 e")
+	for _, tt := range tests {
+		if got := show(call(server, client, tt.command)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestZremrange(t *testing.T) {
+	tests := []struct {
+		command  string
+		want     string
+		contents string
+	}{
+		{"ZREMRANGEBYRANK z 0 1", "2", "c:3 d:4 e:5"},
+		{"ZREMRANGEBYRANK z -2 -1", "2", "a:1 b:2 c:3"},
+		{"ZREMRANGEBYRANK z 3 1", "0", "a:1 b:2 c:3 d:4 e:5"},
+		{"ZREMRANGEBYRANK z 0 -1", "5", "(none)"},
+		{"ZREMRANGEBYRANK z a 1", "ERR value is not an integer or out of range", "a:1 b:2 c:3 d:4 e:5"},
+		{"ZREMRANGEBYSCORE z (1 3", "2", "a:1 d:4 e:5"},
+		{"ZREMRANGEBYSCORE z -inf +inf", "5", "(none)"},
+		{"ZREMRANGEBYSCORE z 6 10", "0", "a:1 b:2 c:3 d:4 e:5"},
+		{"ZREMRANGEBYSCORE z 1 x", "ERR min or max is not a float", "a:1 b:2 c:3 d:4 e:5"},
+		{"ZREMRANGEBYLEX z [b (d", "2", "a:0 d:0 e:0"},
+		{"ZREMRANGEBYLEX z - +", "5", "(none)"},
+		{"ZREMRANGEBYLEX z (e +", "0", "a:0 b:0 c:0 d:0 e:0"},
+		{"ZREMRANGEBYLEX z b d", "ERR min or max not valid string range item", "a:0 b:0 c:0 d:0 e:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			if strings.Contains(tt.command, "BYLEX") {
+				run(t, server, client, "ZADD z 0 a 0 b 0 c 0 d 0 e")
+			} else {
+				run(t, server, client, "ZADD z 1 a 2 b 3 c 4 d 5 e")
+			}
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			if got := zsetContents(server, "z"); got != tt.contents {
+				t.Errorf("z = %s, want %s", got, tt.contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// zsetContents lists the sorted set at key as member:score pairs, in order.
+func zsetContents(server *types.Server, key string) string {
+	z, ok := server.KV.Sorteds[key]
+	if !ok {
+		return "(none)"
+	}
+	var pairs []string
+	for _, m := range z.Members() {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", m.Member, formatScore(m.Score)))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func TestZadd(t *testing.T) {
+	tests := []struct {
+		command  string
+		want     string
+		contents string
+	}{
+		{"ZADD z 3 c", "1", "a:1 b:2 c:3"},
+		{"ZADD z 5 a 3 c", "1", "b:2 c:3 a:5"},
+		{"ZADD z 1 a", "0", "a:1 b:2"},
+		{"ZADD z CH 5 a 3 c", "2", "b:2 c:3 a:5"},
+		{"ZADD z CH 1 a", "0", "a:1 b:2"},
+		{"ZADD z NX 5 a 3 c", "1", "a:1 b:2 c:3"},
+		{"ZADD z XX 5 a 3 c", "0", "b:2 a:5"},
+		{"ZADD z XX CH 5 a 3 c", "1", "b:2 a:5"},
+		{"ZADD z GT 0 a 5 b", "0", "a:1 b:5"},
+		{"ZADD z GT CH 0 a 5 b", "1", "a:1 b:5"},
+		{"ZADD z LT CH 0 a 5 b", "1", "a:0 b:2"},
+		{"ZADD z GT 3 c", "1", "a:1 b:2 c:3"},
+		{"ZADD z XX GT CH 3 a 3 c", "1", "b:2 a:3"},
+		{"ZADD z INCR 2 a", "3", "b:2 a:3"},
+		{"ZADD z INCR 2 c", "2", "a:1 b:2 c:2"},
+		{"ZADD z INCR +inf a", "inf", "b:2 a:inf"},
+		{"ZADD z NX INCR 2 a", "(nil)", "a:1 b:2"},
+		{"ZADD z XX INCR 2 c", "(nil)", "a:1 b:2"},
+		{"ZADD z GT INCR -1 a", "(nil)", "a:1 b:2"},
+		{"ZADD z LT INCR -1 a", "0", "a:0 b:2"},
+		{"ZADD missing XX 1 a", "0", "a:1 b:2"},
+		{"ZADD missing XX INCR 1 a", "(nil)", "a:1 b:2"},
+		{"ZINCRBY z 1.5 b", "3.5", "a:1 b:3.5"},
+		{"ZINCRBY z -1 new", "-1", "new:-1 a:1 b:2"},
+		{"ZADD z 1e30 a", "0", "b:2 a:1e+30"},
+
+		{"ZADD z NX XX 1 a", "ERR XX and NX options at the same time are not compatible", "a:1 b:2"},
+		{"ZADD z GT LT 1 a", "ERR GT, LT, and/or NX options at the same time are not compatible", "a:1 b:2"},
+		{"ZADD z NX GT 1 a", "ERR GT, LT, and/or NX options at the same time are not compatible", "a:1 b:2"},
+		{"ZADD z INCR 1 a 2 b", "ERR INCR option supports a single increment-element pair", "a:1 b:2"},
+		{"ZADD z 1", "ERR wrong number of arguments for 'zadd' command", "a:1 b:2"},
+		{"ZADD z 1 a 2", "ERR syntax error", "a:1 b:2"},
+		{"ZADD z CH 1", "ERR syntax error", "a:1 b:2"},
+		{"ZADD z nan a", "ERR value is not a valid float", "a:1 b:2"},
+		{"ZADD z 5 a x c", "ERR value is not a valid float", "a:1 b:2"},
+		{"ZINCRBY z one a", "ERR value is not a valid float", "a:1 b:2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			run(t, server, client, "ZADD z 1 a 2 b")
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			if got := zsetContents(server, "z"); got != tt.contents {
+				t.Errorf("z = %s, want %s", got, tt.contents)
+			}
+			if got := zsetContents(server, "missing"); got != "(none)" {
+				t.Errorf("missing = %s, want it not created", got)
+			}
+		})
+	}
+}
+
+func TestZaddIncrNaN(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	runSteps(t, server, client, []step{
+		{"ZADD z INCR +inf a", "inf"},
+		{"ZADD z INCR -inf a", "ERR resulting score is not a number (NaN)"},
+		{"ZINCRBY z -inf a", "ERR resulting score is not a number (NaN)"},
+		{"ZSCORE z a", "inf"},
+	})
+}
+
+func TestZpop(t *testing.T) {
+	tests := []struct {
+		command  string
+		want     string
+		contents string
+	}{
+		{"ZPOPMIN z", "[a 1]", "b:2 c:3"},
+		{"ZPOPMAX z", "[c 3]", "a:1 b:2"},
+		{"ZPOPMIN z 2", "[a 1 b 2]", "c:3"},
+		{"ZPOPMAX z 2", "[c 3 b 2]", "a:1"},
+		{"ZPOPMIN z 10", "[a 1 b 2 c 3]", "(none)"},
+		{"ZPOPMIN z 0", "[]", "a:1 b:2 c:3"},
+		{"ZPOPMIN missing", "[]", "a:1 b:2 c:3"},
+		{"ZPOPMIN z -1", "ERR value is out of range, must be positive", "a:1 b:2 c:3"},
+		{"ZPOPMIN z x", "ERR value is not an integer or out of range", "a:1 b:2 c:3"},
+		{"ZPOPMIN z 1 2", "ERR wrong number of arguments for 'zpopmin' command", "a:1 b:2 c:3"},
+
+		// ZMPOP pops from the first non-empty key and names it.
+		{"ZMPOP 1 z MIN", "[z [[a 1]]]", "b:2 c:3"},
+		{"ZMPOP 1 z MAX COUNT 2", "[z [[c 3] [b 2]]]", "a:1"},
+		{"ZMPOP 2 missing z MIN COUNT 5", "[z [[a 1] [b 2] [c 3]]]", "(none)"},
+		{"ZMPOP 1 missing MIN", "(nil)", "a:1 b:2 c:3"},
+		{"ZMPOP 0 z MIN", "ERR numkeys should be greater than 0", "a:1 b:2 c:3"},
+		{"ZMPOP 2 z MIN", "ERR syntax error", "a:1 b:2 c:3"},
+		{"ZMPOP 1 z LEFT", "ERR syntax error", "a:1 b:2 c:3"},
+		{"ZMPOP 1 z MIN COUNT 0", "ERR count should be greater than 0", "a:1 b:2 c:3"},
+		{"ZMPOP 1 z MIN LIMIT 1", "ERR syntax error", "a:1 b:2 c:3"},
+		{"ZMPOP 1 z MIN COUNT", "ERR syntax error", "a:1 b:2 c:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			run(t, server, client, "ZADD z 1 a 2 b 3 c")
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			if got := zsetContents(server, "z"); got != tt.contents {
+				t.Errorf("z = %s, want %s", got, tt.contents)
+			}
+		})
+	}
+}
+
+func TestZmscore(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z 1 a 2.5 b")
+	runSteps(t, server, client, []step{
+		{"ZMSCORE z a x b", "[1 (nil) 2.5]"},
+		{"ZMSCORE missing a", "[(nil)]"},
+		{"ZMSCORE z", "ERR wrong number of arguments for 'zmscore' command"},
+	})
+}
+
+func TestZrandmember(t *testing.T) {
+	members := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	tests := []struct {
+		command string
+		// length is the number of members in the reply, or -1 for a single
+		// bulk string.
+		length     int
+		distinct   bool
+		withScores bool
+	}{
+		{"ZRANDMEMBER z", -1, true, false},
+		{"ZRANDMEMBER z 2", 2, true, false},
+		{"ZRANDMEMBER z 4", 4, true, false},
+		{"ZRANDMEMBER z 10", 4, true, false},
+		{"ZRANDMEMBER z 9223372036854775807", 4, true, false},
+		{"ZRANDMEMBER z 3 WITHSCORES", 3, true, true},
+		{"ZRANDMEMBER z 0", 0, true, false},
+		// A negative count allows repeats and is always honoured.
+		{"ZRANDMEMBER z -10", 10, false, false},
+		{"ZRANDMEMBER z -3 WITHSCORES", 3, false, true},
+	}
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "ZADD z 1 a 2 b 3 c 4 d")
+	for _, tt := range tests {
+		reply := call(server, client, tt.command)
+		if tt.length < 0 {
+			if _, ok := members[reply.Bulk]; reply.Typ != "bulk" || !ok {
+				t.Errorf("%s = %s, want a member", tt.command, show(reply))
+			}
+			continue
+		}
+		step := 1
+		if tt.withScores {
+			step = 2
+		}
+		if reply.Typ != "array" || len(reply.Array) != tt.length*step {
+			t.Errorf("%s = %s, want %d members", tt.command, show(reply), tt.length)
+			continue
+		}
+		seen := map[string]bool{}
+		for i := 0; i < len(reply.Array); i += step {
+			member := reply.Array[i].Bulk
+			score, ok := members[member]
+			if !ok || tt.withScores && reply.Array[i+1].Bulk != score {
+				t.Errorf("%s returned %s", tt.command, show(reply))
+			}
+			if tt.distinct && seen[member] {
+				t.Errorf("%s repeated %s", tt.command, member)
+			}
+			seen[member] = true
+		}
+	}
+	runSteps(t, server, client, []step{
+		{"ZRANDMEMBER missing", "(nil)"},
+		{"ZRANDMEMBER missing 3", "[]"},
+		{"ZRANDMEMBER z 1 SCORES", "ERR syntax error"},
+		{"ZRANDMEMBER z x", "ERR value is not an integer or out of range"},
+		// Negative counts are bounded, as the reply is built in memory.
+		{"ZRANDMEMBER z -16777217", "ERR value is out of range, a negative count must be at least -16777216"},
+		{"ZRANDMEMBER z -8388609 WITHSCORES", "ERR value is out of range, a negative count must be at least -8388608"},
+		{"ZRANDMEMBER z -9223372036854775808", "ERR value is out of range, a negative count must be at least -16777216"},
+		{"ZRANDMEMBER missing -9223372036854775808", "ERR value is out of range, a negative count must be at least -16777216"},
+	})
+}
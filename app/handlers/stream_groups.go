@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+	"github.com/r1i2t3/go-redis/app/utils"
+)
+
+var streamMaxID = kv.StreamId{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}
+
+func noGroupError(key, group string) resp.Value {
+	return resp.Value{Typ: "error", Str: fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)}
+}
+
+func xgroup(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xgroup' command"}
+	}
+	sub := strings.ToUpper(args[0].Bulk)
+	arityOK := false
+	switch sub {
+	case "CREATE":
+		arityOK = len(args) >= 4 && len(args) <= 7
+	case "SETID":
+		arityOK = len(args) == 4 || len(args) == 6
+	case "DESTROY":
+		arityOK = len(args) == 3
+	case "CREATECONSUMER", "DELCONSUMER":
+		arityOK = len(args) == 4
+	case "SETDEADLETTER":
+		arityOK = len(args) == 4 || len(args) == 5
+	default:
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0].Bulk)}
+	}
+	if !arityOK {
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR wrong number of arguments for 'xgroup|%s' command", strings.ToLower(sub))}
+	}
+	key := args[1].Bulk
+	groupName := args[2].Bulk
+
+	mkStream := false
+	entriesRead := kv.EntriesInvalid
+	if sub == "CREATE" || sub == "SETID" {
+		for i := 4; i < len(args); i++ {
+			switch strings.ToUpper(args[i].Bulk) {
+			case "MKSTREAM":
+				if sub != "CREATE" {
+					return resp.Value{Typ: "error", Str: "ERR syntax error"}
+				}
+				mkStream = true
+			case "ENTRIESREAD":
+				if i+1 >= len(args) {
+					return resp.Value{Typ: "error", Str: "ERR syntax error"}
+				}
+				n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+				if err != nil {
+					return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+				}
+				if n < 0 && n != kv.EntriesInvalid {
+					return resp.Value{Typ: "error", Str: "ERR value for ENTRIESREAD must be positive or -1"}
+				}
+				entriesRead = n
+				i++
+			default:
+				return resp.Value{Typ: "error", Str: "ERR syntax error"}
+			}
+		}
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists && !(sub == "CREATE" && mkStream) {
+		return resp.Value{Typ: "error", Str: "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}
+	}
+
+	var id kv.StreamId
+	if sub == "CREATE" || sub == "SETID" {
+		if args[3].Bulk == "$" {
+			if exists {
+				id = stream.LastID
+			}
+		} else {
+			parsed, err := utils.ParseStreamID(args[3].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+			}
+			id = parsed
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	var reply resp.Value
+	switch sub {
+	case "CREATE":
+		if !exists {
+			stream = kv.NewStream()
+			kV.Streams[key] = stream
+		}
+		if _, ok := stream.Groups[groupName]; ok {
+			return resp.Value{Typ: "error", Str: "BUSYGROUP Consumer Group name already exists"}
+		}
+		stream.Groups[groupName] = kv.NewConsumerGroup(groupName, id, entriesRead)
+		reply = resp.Value{Typ: "string", Str: "OK"}
+	case "SETID":
+		group, ok := stream.Groups[groupName]
+		if !ok {
+			return noGroupError(key, groupName)
+		}
+		group.LastID = id
+		group.EntriesRead = entriesRead
+		reply = resp.Value{Typ: "string", Str: "OK"}
+	case "DESTROY":
+		if _, ok := stream.Groups[groupName]; !ok {
+			return resp.Value{Typ: "integer", Num: 0}
+		}
+		delete(stream.Groups, groupName)
+		// Readers blocked on the group must notice it is gone.
+		kV.WakeUpClients(key, true)
+		reply = resp.Value{Typ: "integer", Num: 1}
+	case "CREATECONSUMER":
+		group, ok := stream.Groups[groupName]
+		if !ok {
+			return noGroupError(key, groupName)
+		}
+		_, created := group.Consumer(args[3].Bulk, true, now)
+		if !created {
+			return resp.Value{Typ: "integer", Num: 0}
+		}
+		reply = resp.Value{Typ: "integer", Num: 1}
+	case "DELCONSUMER":
+		group, ok := stream.Groups[groupName]
+		if !ok {
+			return noGroupError(key, groupName)
+		}
+		pending, ok := group.DeleteConsumer(args[3].Bulk)
+		if !ok {
+			return resp.Value{Typ: "integer", Num: 0}
+		}
+		reply = resp.Value{Typ: "integer", Num: pending}
+	case "SETDEADLETTER":
+		// Not a Redis subcommand: XGROUP SETDEADLETTER key group
+		// max-deliveries [dead-letter-key] makes the group move an entry
+		// delivered max-deliveries times to the dead-letter stream instead
+		// of delivering it again; 0 turns that off.
+		group, ok := stream.Groups[groupName]
+		if !ok {
+			return noGroupError(key, groupName)
+		}
+		maxDeliveries, err := strconv.ParseUint(args[3].Bulk, 10, 64)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR max-deliveries must be a non-negative integer"}
+		}
+		deadLetterKey := ""
+		if len(args) == 5 {
+			deadLetterKey = args[4].Bulk
+		}
+		if maxDeliveries > 0 && deadLetterKey == "" {
+			return resp.Value{Typ: "error", Str: "ERR a dead-letter key is required when max-deliveries is set"}
+		}
+		if deadLetterKey == key {
+			return resp.Value{Typ: "error", Str: "ERR the dead-letter key must differ from the stream key"}
+		}
+		group.MaxDeliveries = maxDeliveries
+		group.DeadLetterKey = deadLetterKey
+		if maxDeliveries == 0 {
+			group.DeadLetterKey = ""
+		}
+		reply = resp.Value{Typ: "string", Str: "OK"}
+	}
+
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyStream, "xgroup-"+strings.ToLower(sub), key)
+	server.IncrementDirty()
+	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "XGROUP"}}, args...)}
+	server.Propagate(cmd)
+	return reply
+}
+
+func xreadgroup(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
+	if len(args) < 6 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xreadgroup' command"}
+	}
+	if !strings.EqualFold(args[0].Bulk, "GROUP") {
+		return resp.Value{Typ: "error", Str: "ERR Missing GROUP option for XREADGROUP"}
+	}
+	groupName := args[1].Bulk
+	consumerName := args[2].Bulk
+	count := 0
+	var blockTimeout time.Duration = -1
+	noAck := false
+	i := 3
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		if opt == "STREAMS" {
+			i++
+			break
+		}
+		switch {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+			i++
+		case opt == "BLOCK" && i+1 < len(args):
+			ms, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR timeout is not an integer or out of range"}
+			}
+			if ms < 0 {
+				return resp.Value{Typ: "error", Str: "ERR timeout is negative"}
+			}
+			blockTimeout = time.Duration(ms) * time.Millisecond
+			i++
+		case opt == "NOACK":
+			noAck = true
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+	remainingArgs := len(args) - i
+	if remainingArgs <= 0 || remainingArgs%2 != 0 {
+		return resp.Value{Typ: "error", Str: "ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified."}
+	}
+	numStreams := remainingArgs / 2
+	keys := make([]string, numStreams)
+	ids := make([]kv.StreamId, numStreams)
+	newOnly := make([]bool, numStreams)
+	history := false
+	for j := 0; j < numStreams; j++ {
+		keys[j] = args[i+j].Bulk
+		idStr := args[i+j+numStreams].Bulk
+		switch idStr {
+		case ">":
+			newOnly[j] = true
+		case "$":
+			return resp.Value{Typ: "error", Str: "ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."}
+		default:
+			id, err := utils.ParseStreamID(idStr)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+			}
+			ids[j] = id
+			history = true
+		}
+	}
+
+	kV := server.KV
+RetryRead:
+	kV.StreamsMu.Lock()
+	for _, key := range keys {
+		stream, exists := kV.Streams[key]
+		if !exists || stream.Groups[groupName] == nil {
+			kV.StreamsMu.Unlock()
+			return resp.Value{Typ: "error", Str: fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, groupName)}
+		}
+	}
+	now := time.Now().UnixMilli()
+	finalResult := make([]resp.Value, 0)
+	dirty := false
+	for j, key := range keys {
+		stream, _ := kV.MutableStream(key)
+		group := stream.Groups[groupName]
+		consumer, created := group.Consumer(consumerName, true, now)
+		dirty = dirty || created
+
+		var entries []resp.Value
+		if newOnly[j] {
+			start, ok := group.LastID.Next()
+			if !ok {
+				continue
+			}
+			served := stream.Range(start, streamMaxID, count, false)
+			if len(served) == 0 {
+				continue
+			}
+			entries = make([]resp.Value, 0, len(served))
+			for _, entry := range served {
+				stream.MarkRead(group, entry.ID)
+				if !noAck {
+					group.Deliver(entry.ID, consumer, now)
+				}
+				entries = append(entries, streamEntryWithID(entry))
+			}
+			consumer.ActiveTime = now
+		} else {
+			entries = make([]resp.Value, 0)
+			for _, id := range kv.SortedPendingIDs(consumer.Pending) {
+				if id.Compare(ids[j]) <= 0 {
+					continue
+				}
+				if count > 0 && len(entries) >= count {
+					break
+				}
+				entry, ok := stream.Get(id)
+				if !ok {
+					// The entry was deleted while still pending.
+					entries = append(entries, resp.Value{Typ: "array", Array: []resp.Value{
+						{Typ: "bulk", Bulk: id.ToString()},
+						{Typ: "null"},
+					}})
+					continue
+				}
+				nack := consumer.Pending[id]
+				if deadLetterDue(group, nack) {
+					deadLetter(server, key, stream, group, nack)
+					continue
+				}
+				nack.DeliveryTime = now
+				nack.DeliveryCount++
+				entries = append(entries, streamEntryWithID(entry))
+			}
+		}
+		if len(entries) > 0 {
+			dirty = true
+			propagated := []resp.Value{
+				{Typ: "bulk", Bulk: "XREADGROUP"},
+				{Typ: "bulk", Bulk: "GROUP"},
+				{Typ: "bulk", Bulk: groupName},
+				{Typ: "bulk", Bulk: consumerName},
+				{Typ: "bulk", Bulk: "COUNT"},
+				{Typ: "bulk", Bulk: strconv.Itoa(len(entries))},
+			}
+			if noAck {
+				propagated = append(propagated, resp.Value{Typ: "bulk", Bulk: "NOACK"})
+			}
+			propagated = append(propagated,
+				resp.Value{Typ: "bulk", Bulk: "STREAMS"},
+				resp.Value{Typ: "bulk", Bulk: key},
+				args[i+j+numStreams],
+			)
+			signalModifiedKey(key, server)
+			server.Propagate(resp.Value{Typ: "array", Array: propagated})
+		}
+		if len(entries) > 0 || !newOnly[j] {
+			finalResult = append(finalResult, resp.Value{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: key},
+				{Typ: "array", Array: entries},
+			}})
+		}
+	}
+	if dirty {
+		server.IncrementDirty()
+	}
+
+	if len(finalResult) > 0 || history {
+		kV.StreamsMu.Unlock()
+		return resp.Value{Typ: "array", Array: finalResult}
+	}
+	if blockTimeout < 0 || blockingDenied(client) {
+		kV.StreamsMu.Unlock()
+		return resp.Value{Typ: "null"}
+	}
+	if waitForStreams(kV, keys, nil, blockTimeout, kV.StreamsMu.Unlock) {
+		goto RetryRead
+	}
+	return resp.Value{Typ: "null"}
+}
+
+// waitForStreams blocks until one of keys is signalled or timeout expires.
+// A zero timeout blocks forever. release is called once the client is
+// registered, so the caller can drop its locks without missing a wake-up. It
+// reports whether it was woken up.
+func waitForStreams(kV *kv.KV, keys []string, streamIDs map[string]kv.StreamId, timeout time.Duration, release func()) bool {
+	bc := &kv.BlockedClient{
+		Ch:        make(chan bool, 1),
+		Keys:      keys,
+		StreamIDs: streamIDs,
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		bc.Deadline = time.Now().Add(timeout)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	kV.RegisterBlockedClient(bc)
+	defer kV.UnregisterBlockedClient(bc)
+	release()
+	woken := false
+	withKeyspaceReleased(kV, func() {
+		select {
+		case <-bc.Ch:
+			woken = true
+		case <-expired:
+		}
+	})
+	return woken
+}
+
+func xack(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xack' command"}
+	}
+	key := args[0].Bulk
+	groupName := args[1].Bulk
+	ids := make([]kv.StreamId, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := utils.ParseStreamID(arg.Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+		}
+		ids = append(ids, id)
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	group, ok := stream.Groups[groupName]
+	if !ok {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	acked := 0
+	for _, id := range ids {
+		if group.Ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		signalModifiedKey(key, server)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "XACK"}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: acked}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+)
+
+func TestXgroup(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "XADD s 1-0 f v")
+	run(t, server, client, "XADD s 2-0 f v")
+	runSteps(t, server, client, []step{
+		{"XGROUP CREATE s g 0", "OK"},
+		{"XGROUP CREATE s g 0", "BUSYGROUP Consumer Group name already exists"},
+		{"XGROUP CREATE s last $", "OK"},
+		{"XGROUP CREATE missing g 0", "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP CREATE new g $ MKSTREAM", "OK"},
+		{"XGROUP CREATE s bad x", "ERR Invalid stream ID specified as stream command argument"},
+		{"XGROUP CREATE s bad 0 ENTRIESREAD -2", "ERR value for ENTRIESREAD must be positive or -1"},
+		{"XGROUP CREATE s bad 0 FOO", "ERR syntax error"},
+		{"XGROUP SETID s g 0 MKSTREAM x", "ERR syntax error"},
+		{"XGROUP SETID s g 0 MKSTREAM", "ERR wrong number of arguments for 'xgroup|setid' command"},
+		{"XGROUP SETID s nope 0", "NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XGROUP CREATECONSUMER s g alice", "1"},
+		{"XGROUP CREATECONSUMER s g alice", "0"},
+		{"XGROUP DELCONSUMER s g bob", "0"},
+		{"XGROUP DESTROY s last", "1"},
+		{"XGROUP DESTROY s last", "0"},
+		{"XGROUP DESTROY s", "ERR wrong number of arguments for 'xgroup|destroy' command"},
+		{"XGROUP FOO s g", "ERR unknown subcommand 'FOO'. Try XGROUP HELP."},
+	})
+	if stream, ok := server.KV.Streams["new"]; !ok || stream.Len() != 0 {
+		t.Errorf("MKSTREAM did not create an empty stream")
+	}
+	if got := server.KV.Streams["s"].Groups["g"].LastID.ToString(); got != "0-0" {
+		t.Errorf("group g starts at %s, want 0-0", got)
+	}
+}
+
+func TestXreadgroup(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{"XADD s 1-0 a 1", "XADD s 2-0 b 2", "XADD s 3-0 c 3", "XGROUP CREATE s g 0"} {
+		run(t, server, client, line)
+	}
+	runSteps(t, server, client, []step{
+		// > serves new entries and adds them to the consumer's PEL.
+		{"XREADGROUP GROUP g alice COUNT 2 STREAMS s >", "[[s [[1-0 [a 1]] [2-0 [b 2]]]]]"},
+		{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[3-0 [c 3]]]]]"},
+		{"XREADGROUP GROUP g bob STREAMS s >", "(nil)"},
+		// An explicit ID serves the consumer's own history after it.
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-0 [a 1]] [2-0 [b 2]]]]]"},
+		{"XREADGROUP GROUP g alice STREAMS s 1-0", "[[s [[2-0 [b 2]]]]]"},
+		{"XREADGROUP GROUP g alice COUNT 1 STREAMS s 0", "[[s [[1-0 [a 1]]]]]"},
+		{"XREADGROUP GROUP g carol STREAMS s 0", "[[s []]]"},
+		// Acknowledged entries leave the history.
+		{"XACK s g 1-0 9-0", "1"},
+		{"XACK s g 1-0", "0"},
+		{"XACK s nope 2-0", "0"},
+		{"XACK s g x", "ERR Invalid stream ID specified as stream command argument"},
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[2-0 [b 2]]]]]"},
+
+		{"XREADGROUP GROUP nope alice STREAMS s >", "NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option"},
+		{"XREADGROUP GROUP g alice STREAMS s $", "ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."},
+		{"XREADGROUP GROUP g alice STREAMS s t >", "ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified."},
+		{"XREADGROUP GROUP g alice BLOCK -1 STREAMS s >", "ERR timeout is negative"},
+		{"XREADGROUP g alice x STREAMS s >", "ERR Missing GROUP option for XREADGROUP"},
+	})
+
+	group := server.KV.Streams["s"].Groups["g"]
+	if got := group.LastID.ToString(); got != "3-0" {
+		t.Errorf("last delivered ID = %s, want 3-0", got)
+	}
+	if len(group.Pending) != 2 || len(group.Consumers["alice"].Pending) != 1 || len(group.Consumers["bob"].Pending) != 1 {
+		t.Errorf("group PEL has %d entries, alice %d, bob %d; want 2, 1, 1", len(group.Pending), len(group.Consumers["alice"].Pending), len(group.Consumers["bob"].Pending))
+	}
+	if nack := group.Pending[kv.StreamId{Timestamp: 2}]; nack.DeliveryCount != 4 {
+		t.Errorf("2-0 delivered %d times, want 4", nack.DeliveryCount)
+	}
+}
+
+func TestXreadgroupNoack(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "XADD s 1-0 a 1")
+	run(t, server, client, "XGROUP CREATE s g 0")
+	replica := addTestReplica(server)
+	runSteps(t, server, client, []step{
+		{"XREADGROUP GROUP g alice NOACK STREAMS s >", "[[s [[1-0 [a 1]]]]]"},
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s []]]"},
+	})
+	if got := replica.commands(); len(got) != 1 || got[0] != "XREADGROUP GROUP g alice COUNT 1 NOACK STREAMS s >" {
+		t.Errorf("propagated %q", got)
+	}
+}
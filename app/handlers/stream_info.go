@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// infoPairs flattens alternating field names and values into the RESP2 form
+// XINFO replies with.
+func infoPairs(pairs ...any) resp.Value {
+	result := make([]resp.Value, 0, len(pairs))
+	for i := 0; i < len(pairs); i += 2 {
+		result = append(result, resp.Value{Typ: "bulk", Bulk: pairs[i].(string)})
+		switch v := pairs[i+1].(type) {
+		case resp.Value:
+			result = append(result, v)
+		case string:
+			result = append(result, resp.Value{Typ: "bulk", Bulk: v})
+		case int:
+			result = append(result, resp.Value{Typ: "integer", Num: v})
+		case int64:
+			result = append(result, resp.Value{Typ: "integer", Num: int(v)})
+		case uint64:
+			result = append(result, resp.Value{Typ: "integer", Num: int(v)})
+		}
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+func streamEntriesRead(group *kv.ConsumerGroup) resp.Value {
+	if group.EntriesRead == kv.EntriesInvalid {
+		return resp.Value{Typ: "null"}
+	}
+	return resp.Value{Typ: "integer", Num: int(group.EntriesRead)}
+}
+
+func streamLag(stream *kv.Stream, group *kv.ConsumerGroup) resp.Value {
+	lag, ok := stream.Lag(group)
+	if !ok {
+		return resp.Value{Typ: "null"}
+	}
+	return resp.Value{Typ: "integer", Num: int(lag)}
+}
+
+func sortedGroupNames(stream *kv.Stream) []string {
+	names := make([]string, 0, len(stream.Groups))
+	for name := range stream.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedConsumerNames(group *kv.ConsumerGroup) []string {
+	names := make([]string, 0, len(group.Consumers))
+	for name := range group.Consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func xinfo(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xinfo' command"}
+	}
+	sub := strings.ToUpper(args[0].Bulk)
+	switch sub {
+	case "STREAM":
+		if len(args) < 2 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xinfo|stream' command"}
+		}
+	case "GROUPS":
+		if len(args) != 2 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xinfo|groups' command"}
+		}
+	case "CONSUMERS":
+		if len(args) != 3 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xinfo|consumers' command"}
+		}
+	default:
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XINFO HELP.", args[0].Bulk)}
+	}
+	key := args[1].Bulk
+
+	kV := server.KV
+	kV.StreamsMu.RLock()
+	defer kV.StreamsMu.RUnlock()
+	stream, exists := kV.Streams[key]
+	if !exists {
+		return resp.Value{Typ: "error", Str: "ERR no such key"}
+	}
+	now := time.Now().UnixMilli()
+
+	switch sub {
+	case "GROUPS":
+		groups := make([]resp.Value, 0, len(stream.Groups))
+		for _, name := range sortedGroupNames(stream) {
+			group := stream.Groups[name]
+			groups = append(groups, infoPairs(
+				"name", group.Name,
+				"consumers", len(group.Consumers),
+				"pending", len(group.Pending),
+				"last-delivered-id", group.LastID.ToString(),
+				"entries-read", streamEntriesRead(group),
+				"lag", streamLag(stream, group),
+			))
+		}
+		return resp.Value{Typ: "array", Array: groups}
+	case "CONSUMERS":
+		group, ok := stream.Groups[args[2].Bulk]
+		if !ok {
+			return noGroupError(key, args[2].Bulk)
+		}
+		consumers := make([]resp.Value, 0, len(group.Consumers))
+		for _, name := range sortedConsumerNames(group) {
+			consumer := group.Consumers[name]
+			inactive := int64(-1)
+			if consumer.ActiveTime != -1 {
+				inactive = now - consumer.ActiveTime
+			}
+			consumers = append(consumers, infoPairs(
+				"name", consumer.Name,
+				"pending", len(consumer.Pending),
+				"idle", now-consumer.SeenTime,
+				"inactive", inactive,
+			))
+		}
+		return resp.Value{Typ: "array", Array: consumers}
+	}
+
+	full := false
+	count := 10
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		switch {
+		case opt == "FULL" && !full:
+			full = true
+		case opt == "COUNT" && full && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			count = max(n, 0)
+			i++
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	header := []any{
+		"length", stream.Len(),
+		"radix-tree-keys", stream.Nodes(),
+		"radix-tree-nodes", stream.Nodes(),
+		"last-generated-id", stream.LastID.ToString(),
+		"max-deleted-entry-id", stream.MaxDeletedID.ToString(),
+		"entries-added", stream.EntriesAdded,
+		"recorded-first-entry-id", stream.FirstID().ToString(),
+	}
+	if !full {
+		first, last := resp.Value{Typ: "null"}, resp.Value{Typ: "null"}
+		if entry, ok := stream.First(); ok {
+			first = streamEntryWithID(entry)
+		}
+		if entry, ok := stream.Last(); ok {
+			last = streamEntryWithID(entry)
+		}
+		return infoPairs(append(header,
+			"groups", len(stream.Groups),
+			"first-entry", first,
+			"last-entry", last,
+		)...)
+	}
+
+	entries := make([]resp.Value, 0)
+	for _, entry := range stream.Range(kv.StreamId{}, streamMaxID, count, false) {
+		entries = append(entries, streamEntryWithID(entry))
+	}
+	groups := make([]resp.Value, 0, len(stream.Groups))
+	for _, name := range sortedGroupNames(stream) {
+		group := stream.Groups[name]
+		pending := make([]resp.Value, 0)
+		for _, id := range kv.SortedPendingIDs(group.Pending) {
+			if count > 0 && len(pending) >= count {
+				break
+			}
+			nack := group.Pending[id]
+			pending = append(pending, resp.Value{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: id.ToString()},
+				{Typ: "bulk", Bulk: nack.Consumer},
+				{Typ: "integer", Num: int(nack.DeliveryTime)},
+				{Typ: "integer", Num: int(nack.DeliveryCount)},
+			}})
+		}
+		consumers := make([]resp.Value, 0, len(group.Consumers))
+		for _, consumerName := range sortedConsumerNames(group) {
+			consumer := group.Consumers[consumerName]
+			consumerPending := make([]resp.Value, 0)
+			for _, id := range kv.SortedPendingIDs(consumer.Pending) {
+				if count > 0 && len(consumerPending) >= count {
+					break
+				}
+				nack := consumer.Pending[id]
+				consumerPending = append(consumerPending, resp.Value{Typ: "array", Array: []resp.Value{
+					{Typ: "bulk", Bulk: id.ToString()},
+					{Typ: "integer", Num: int(nack.DeliveryTime)},
+					{Typ: "integer", Num: int(nack.DeliveryCount)},
+				}})
+			}
+			consumers = append(consumers, infoPairs(
+				"name", consumer.Name,
+				"seen-time", consumer.SeenTime,
+				"active-time", consumer.ActiveTime,
+				"pel-count", len(consumer.Pending),
+				"pending", resp.Value{Typ: "array", Array: consumerPending},
+			))
+		}
+		groups = append(groups, infoPairs(
+			"name", group.Name,
+			"last-delivered-id", group.LastID.ToString(),
+			"entries-read", streamEntriesRead(group),
+			"lag", streamLag(stream, group),
+			"pel-count", len(group.Pending),
+			"pending", resp.Value{Typ: "array", Array: pending},
+			"consumers", resp.Value{Typ: "array", Array: consumers},
+		))
+	}
+	return infoPairs(append(header,
+		"entries", resp.Value{Typ: "array", Array: entries},
+		"groups", resp.Value{Typ: "array", Array: groups},
+	)...)
+}
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+	"github.com/r1i2t3/go-redis/app/utils"
+)
+
+func noKeyOrGroupError(key, group string) resp.Value {
+	return resp.Value{Typ: "error", Str: fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group)}
+}
+
+func xpending(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 2 && (len(args) < 5 || len(args) > 8) {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xpending' command"}
+	}
+	key := args[0].Bulk
+	groupName := args[1].Bulk
+	extended := len(args) > 2
+
+	var minIdle int64
+	var start, end kv.StreamId
+	var count int
+	consumerName := ""
+	if extended {
+		i := 2
+		if strings.EqualFold(args[i].Bulk, "IDLE") {
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			minIdle = n
+			i += 2
+			if len(args)-i < 3 {
+				return resp.Value{Typ: "error", Str: "ERR syntax error"}
+			}
+		}
+		var errMsg string
+		if start, errMsg = parseStreamRangeBound(args[i].Bulk, false); errMsg != "" {
+			return resp.Value{Typ: "error", Str: errMsg}
+		}
+		if end, errMsg = parseStreamRangeBound(args[i+1].Bulk, true); errMsg != "" {
+			return resp.Value{Typ: "error", Str: errMsg}
+		}
+		n, err := strconv.Atoi(args[i+2].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		count = max(n, 0)
+		i += 3
+		if i < len(args) {
+			consumerName = args[i].Bulk
+			i++
+		}
+		if i != len(args) {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	kV := server.KV
+	kV.StreamsMu.RLock()
+	defer kV.StreamsMu.RUnlock()
+	stream, exists := kV.Streams[key]
+	if !exists {
+		return noKeyOrGroupError(key, groupName)
+	}
+	group, ok := stream.Groups[groupName]
+	if !ok {
+		return noKeyOrGroupError(key, groupName)
+	}
+
+	if !extended {
+		if len(group.Pending) == 0 {
+			return resp.Value{Typ: "array", Array: []resp.Value{
+				{Typ: "integer", Num: 0},
+				{Typ: "null"},
+				{Typ: "null"},
+				{Typ: "null"},
+			}}
+		}
+		ids := kv.SortedPendingIDs(group.Pending)
+		names := make([]string, 0, len(group.Consumers))
+		for name, consumer := range group.Consumers {
+			if len(consumer.Pending) > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		perConsumer := make([]resp.Value, 0, len(names))
+		for _, name := range names {
+			perConsumer = append(perConsumer, resp.Value{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: name},
+				{Typ: "bulk", Bulk: strconv.Itoa(len(group.Consumers[name].Pending))},
+			}})
+		}
+		return resp.Value{Typ: "array", Array: []resp.Value{
+			{Typ: "integer", Num: len(ids)},
+			{Typ: "bulk", Bulk: ids[0].ToString()},
+			{Typ: "bulk", Bulk: ids[len(ids)-1].ToString()},
+			{Typ: "array", Array: perConsumer},
+		}}
+	}
+
+	pel := group.Pending
+	if consumerName != "" {
+		consumer, ok := group.Consumers[consumerName]
+		if !ok {
+			return resp.Value{Typ: "array", Array: []resp.Value{}}
+		}
+		pel = consumer.Pending
+	}
+	now := time.Now().UnixMilli()
+	result := make([]resp.Value, 0)
+	for _, id := range kv.SortedPendingIDs(pel) {
+		if len(result) >= count {
+			break
+		}
+		if id.Compare(start) < 0 {
+			continue
+		}
+		if id.Compare(end) > 0 {
+			break
+		}
+		nack := pel[id]
+		idle := now - nack.DeliveryTime
+		if minIdle > 0 && idle < minIdle {
+			continue
+		}
+		result = append(result, resp.Value{Typ: "array", Array: []resp.Value{
+			{Typ: "bulk", Bulk: id.ToString()},
+			{Typ: "bulk", Bulk: nack.Consumer},
+			{Typ: "integer", Num: int(max(idle, 0))},
+			{Typ: "integer", Num: int(nack.DeliveryCount)},
+		}})
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+// streamClaimArgs carries the XCLAIM options applied to each claimed entry.
+type streamClaimArgs struct {
+	deliveryTime int64
+	retryCount   int64
+	retryGiven   bool
+	justID       bool
+	force        bool
+	minIdle      int64
+	consumerName string
+	now          int64
+	key          string
+	groupName    string
+}
+
+// streamClaim hands the pending entry id over to the claiming consumer. It
+// returns the reply element for the entry and whether anything was claimed;
+// entries deleted from the stream are dropped from the PEL and reported as
+// nil, and entries that exhausted the group's delivery budget are moved to
+// its dead-letter stream instead of being claimed.
+func streamClaim(server *types.Server, stream *kv.Stream, group *kv.ConsumerGroup, id kv.StreamId, opts streamClaimArgs) (resp.Value, bool, bool) {
+	nack, ok := group.Pending[id]
+	if !ok && opts.force {
+		if _, exists := stream.Get(id); exists {
+			consumer, _ := group.Consumer(opts.consumerName, true, opts.now)
+			nack = group.Deliver(id, consumer, opts.now)
+			ok = true
+		}
+	}
+	if !ok {
+		return resp.Value{}, false, false
+	}
+	if opts.minIdle > 0 && opts.now-nack.DeliveryTime < opts.minIdle {
+		return resp.Value{}, false, false
+	}
+	entry, exists := stream.Get(id)
+	if !exists {
+		group.Ack(id)
+		propagateXack(server, opts.key, opts.groupName, id)
+		return resp.Value{Typ: "null"}, false, true
+	}
+	if !opts.justID && !opts.retryGiven && deadLetterDue(group, nack) {
+		deadLetter(server, opts.key, stream, group, nack)
+		return resp.Value{}, false, false
+	}
+
+	consumer, _ := group.Consumer(opts.consumerName, true, opts.now)
+	if nack.Consumer != consumer.Name {
+		if owner, ok := group.Consumers[nack.Consumer]; ok {
+			delete(owner.Pending, id)
+		}
+		nack.Consumer = consumer.Name
+		consumer.Pending[id] = nack
+	}
+	nack.DeliveryTime = opts.deliveryTime
+	if opts.retryGiven {
+		nack.DeliveryCount = uint64(opts.retryCount)
+	} else if !opts.justID {
+		nack.DeliveryCount++
+	}
+	if !opts.justID {
+		consumer.ActiveTime = opts.now
+	}
+
+	// Replicas receive an explicit, idempotent claim so delivery metadata
+	// matches exactly.
+	propagated := []resp.Value{
+		{Typ: "bulk", Bulk: "XCLAIM"},
+		{Typ: "bulk", Bulk: opts.key},
+		{Typ: "bulk", Bulk: opts.groupName},
+		{Typ: "bulk", Bulk: consumer.Name},
+		{Typ: "bulk", Bulk: "0"},
+		{Typ: "bulk", Bulk: id.ToString()},
+		{Typ: "bulk", Bulk: "TIME"},
+		{Typ: "bulk", Bulk: strconv.FormatInt(nack.DeliveryTime, 10)},
+		{Typ: "bulk", Bulk: "RETRYCOUNT"},
+		{Typ: "bulk", Bulk: strconv.FormatUint(nack.DeliveryCount, 10)},
+		{Typ: "bulk", Bulk: "FORCE"},
+		{Typ: "bulk", Bulk: "JUSTID"},
+		{Typ: "bulk", Bulk: "LASTID"},
+		{Typ: "bulk", Bulk: group.LastID.ToString()},
+	}
+	server.Propagate(resp.Value{Typ: "array", Array: propagated})
+
+	if opts.justID {
+		return resp.Value{Typ: "bulk", Bulk: id.ToString()}, true, false
+	}
+	return streamEntryWithID(entry), true, false
+}
+
+func propagateXack(server *types.Server, key, groupName string, id kv.StreamId) {
+	server.Propagate(resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "XACK"},
+		{Typ: "bulk", Bulk: key},
+		{Typ: "bulk", Bulk: groupName},
+		{Typ: "bulk", Bulk: id.ToString()},
+	}})
+}
+
+// deadLetterDue reports whether delivering nack once more would exceed the
+// group's MaxDeliveries.
+func deadLetterDue(group *kv.ConsumerGroup, nack *kv.PendingEntry) bool {
+	return group.MaxDeliveries > 0 && group.DeadLetterKey != "" && nack.DeliveryCount >= group.MaxDeliveries
+}
+
+// deadLetter copies a poison entry to the group's dead-letter stream, tagged
+// with where it came from, and acknowledges it in the source group. Callers
+// hold StreamsMu.
+func deadLetter(server *types.Server, key string, stream *kv.Stream, group *kv.ConsumerGroup, nack *kv.PendingEntry) {
+	kV := server.KV
+	if entry, ok := stream.Get(nack.ID); ok {
+		dlq, exists := kV.MutableStream(group.DeadLetterKey)
+		if !exists {
+			dlq = kv.NewStream()
+			kV.Streams[group.DeadLetterKey] = dlq
+		}
+		if id, ok := dlq.NextID(uint64(time.Now().UnixMilli())); ok {
+			fields := []kv.StreamField{
+				{Name: "dlq-stream", Value: key},
+				{Name: "dlq-group", Value: group.Name},
+				{Name: "dlq-id", Value: nack.ID.ToString()},
+				{Name: "dlq-deliveries", Value: strconv.FormatUint(nack.DeliveryCount, 10)},
+			}
+			fields = append(fields, entry.Fields...)
+			propagated := []resp.Value{
+				{Typ: "bulk", Bulk: "XADD"},
+				{Typ: "bulk", Bulk: group.DeadLetterKey},
+				{Typ: "bulk", Bulk: id.ToString()},
+			}
+			for _, f := range fields {
+				propagated = append(propagated, resp.Value{Typ: "bulk", Bulk: f.Name}, resp.Value{Typ: "bulk", Bulk: f.Value})
+			}
+			dlq.Append(id, fields)
+			signalModifiedKey(group.DeadLetterKey, server)
+			notifyKeyspaceEvent(server, notifyStream, "xadd", group.DeadLetterKey)
+			kV.WakeUpStreamClients(group.DeadLetterKey, id)
+			server.Propagate(resp.Value{Typ: "array", Array: propagated})
+		}
+	}
+	group.Ack(nack.ID)
+	signalModifiedKey(key, server)
+	server.IncrementDirty()
+	propagateXack(server, key, group.Name, nack.ID)
+}
+
+func xclaim(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 5 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xclaim' command"}
+	}
+	key := args[0].Bulk
+	groupName := args[1].Bulk
+	now := time.Now().UnixMilli()
+	opts := streamClaimArgs{
+		consumerName: args[2].Bulk,
+		now:          now,
+		deliveryTime: -1,
+		key:          key,
+		groupName:    groupName,
+	}
+	minIdle, err := strconv.ParseInt(args[3].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+	opts.minIdle = max(minIdle, 0)
+
+	ids := make([]kv.StreamId, 0)
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := utils.ParseStreamID(args[i].Bulk)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+	}
+	var lastID kv.StreamId
+	lastIDGiven := false
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case opt == "FORCE":
+			opts.force = true
+		case opt == "JUSTID":
+			opts.justID = true
+		case opt == "IDLE" && moreArgs > 0:
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid IDLE option argument for XCLAIM"}
+			}
+			opts.deliveryTime = now - n
+			i++
+		case opt == "TIME" && moreArgs > 0:
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid TIME option argument for XCLAIM"}
+			}
+			opts.deliveryTime = n
+			i++
+		case opt == "RETRYCOUNT" && moreArgs > 0:
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil || n < 0 {
+				return resp.Value{Typ: "error", Str: "ERR Invalid RETRYCOUNT option argument for XCLAIM"}
+			}
+			opts.retryCount = n
+			opts.retryGiven = true
+			i++
+		case opt == "LASTID" && moreArgs > 0:
+			id, err := utils.ParseStreamID(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+			}
+			lastID = id
+			lastIDGiven = true
+			i++
+		default:
+			return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].Bulk)}
+		}
+	}
+	if opts.deliveryTime < 0 || opts.deliveryTime > now {
+		opts.deliveryTime = now
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return noKeyOrGroupError(key, groupName)
+	}
+	group, ok := stream.Groups[groupName]
+	if !ok {
+		return noKeyOrGroupError(key, groupName)
+	}
+	if lastIDGiven && lastID.Compare(group.LastID) > 0 {
+		group.LastID = lastID
+	}
+
+	result := make([]resp.Value, 0, len(ids))
+	dirty := false
+	for _, id := range ids {
+		reply, claimed, removed := streamClaim(server, stream, group, id, opts)
+		if claimed || removed {
+			result = append(result, reply)
+			dirty = true
+		}
+	}
+	if dirty {
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyStream, "xclaim", key)
+		server.IncrementDirty()
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+func xautoclaim(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 5 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xautoclaim' command"}
+	}
+	key := args[0].Bulk
+	groupName := args[1].Bulk
+	now := time.Now().UnixMilli()
+	opts := streamClaimArgs{
+		consumerName: args[2].Bulk,
+		now:          now,
+		deliveryTime: now,
+		key:          key,
+		groupName:    groupName,
+	}
+	minIdle, err := strconv.ParseInt(args[3].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+	opts.minIdle = max(minIdle, 0)
+	start, errMsg := parseStreamRangeBound(args[4].Bulk, false)
+	if errMsg != "" {
+		return resp.Value{Typ: "error", Str: errMsg}
+	}
+	count := 100
+	for i := 5; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		switch {
+		case opt == "JUSTID":
+			opts.justID = true
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if n < 1 {
+				return resp.Value{Typ: "error", Str: "ERR COUNT must be > 0"}
+			}
+			count = n
+			i++
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return noKeyOrGroupError(key, groupName)
+	}
+	group, ok := stream.Groups[groupName]
+	if !ok {
+		return noKeyOrGroupError(key, groupName)
+	}
+
+	// Like Redis, scan at most ten PEL entries per requested claim so a huge
+	// PEL full of young entries can't stall the server.
+	attempts := count * 10
+	claimedEntries := make([]resp.Value, 0)
+	deleted := make([]resp.Value, 0)
+	next := kv.StreamId{}
+	ids := kv.SortedPendingIDs(group.Pending)
+	pos := sort.Search(len(ids), func(i int) bool { return ids[i].Compare(start) >= 0 })
+	for ; pos < len(ids) && attempts > 0 && len(claimedEntries) < count; pos++ {
+		attempts--
+		reply, claimed, removed := streamClaim(server, stream, group, ids[pos], opts)
+		switch {
+		case removed:
+			deleted = append(deleted, resp.Value{Typ: "bulk", Bulk: ids[pos].ToString()})
+		case claimed:
+			claimedEntries = append(claimedEntries, reply)
+		}
+	}
+	if pos < len(ids) {
+		next = ids[pos]
+	}
+	if len(claimedEntries) > 0 || len(deleted) > 0 {
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyStream, "xautoclaim", key)
+		server.IncrementDirty()
+	}
+	return resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: next.ToString()},
+		{Typ: "array", Array: claimedEntries},
+		{Typ: "array", Array: deleted},
+	}}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/types"
+	"github.com/r1i2t3/go-redis/app/utils"
+)
+
+// newPendingTestServer returns a server whose stream s has entries 1-0, 2-0
+// and 3-0 pending in group g: the first two delivered to alice, 1-0 ten
+// seconds ago, and the last to bob.
+func newPendingTestServer(t *testing.T) (*types.Server, *kv.ClientType) {
+	t.Helper()
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{
+		"XADD s 1-0 a 1",
+		"XADD s 2-0 b 2",
+		"XADD s 3-0 c 3",
+		"XGROUP CREATE s g 0",
+		"XREADGROUP GROUP g alice COUNT 2 STREAMS s >",
+		"XREADGROUP GROUP g bob STREAMS s >",
+	} {
+		run(t, server, client, line)
+	}
+	age(t, server, "1-0", 10*time.Second)
+	return server, client
+}
+
+// age moves the last delivery of pending entry id in group g of s back by d.
+func age(t *testing.T, server *types.Server, id string, d time.Duration) {
+	t.Helper()
+	nack := server.KV.Streams["s"].Groups["g"].Pending[streamID(t, id)]
+	nack.DeliveryTime -= d.Milliseconds()
+}
+
+func streamID(t *testing.T, s string) kv.StreamId {
+	t.Helper()
+	id, err := utils.ParseStreamID(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// nackState describes pending entry id in group g of s as owner/deliveries,
+// checking the owner's PEL agrees with the group's.
+func nackState(t *testing.T, server *types.Server, id string) string {
+	t.Helper()
+	group := server.KV.Streams["s"].Groups["g"]
+	nack, ok := group.Pending[streamID(t, id)]
+	if !ok {
+		return "(none)"
+	}
+	if group.Consumers[nack.Consumer].Pending[nack.ID] != nack {
+		t.Errorf("%s is not in the PEL of its owner %s", id, nack.Consumer)
+	}
+	return fmt.Sprintf("%s/%d", nack.Consumer, nack.DeliveryCount)
+}
+
+func TestXpending(t *testing.T) {
+	server, client := newPendingTestServer(t)
+	runSteps(t, server, client, []step{
+		{"XPENDING s g", "[3 1-0 3-0 [[alice 2] [bob 1]]]"},
+		{"XGROUP CREATE s empty $", "OK"},
+		{"XPENDING s empty", "[0 (nil) (nil) (nil)]"},
+		{"XPENDING s nope", "NOGROUP No such key 's' or consumer group 'nope'"},
+		{"XPENDING missing g", "NOGROUP No such key 'missing' or consumer group 'g'"},
+		{"XPENDING s g - +", "ERR wrong number of arguments for 'xpending' command"},
+		{"XPENDING s g x + 10", "ERR Invalid stream ID specified as stream command argument"},
+		{"XPENDING s g - + x", "ERR value is not an integer or out of range"},
+		{"XPENDING s g IDLE 5 - +", "ERR syntax error"},
+		{"XPENDING s g - + 10 bob x", "ERR syntax error"},
+	})
+
+	// The extended form lists ID, owner, idle time and delivery count; the
+	// idle time is checked separately as it depends on the clock.
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"XPENDING s g - + 10", "1-0/alice/1 2-0/alice/1 3-0/bob/1"},
+		{"XPENDING s g - + 2", "1-0/alice/1 2-0/alice/1"},
+		{"XPENDING s g - + 0", ""},
+		{"XPENDING s g (1-0 + 10", "2-0/alice/1 3-0/bob/1"},
+		{"XPENDING s g - (3-0 10", "1-0/alice/1 2-0/alice/1"},
+		{"XPENDING s g 2 3 10", "2-0/alice/1 3-0/bob/1"},
+		{"XPENDING s g - + 10 bob", "3-0/bob/1"},
+		{"XPENDING s g - + 10 carol", ""},
+		{"XPENDING s g IDLE 5000 - + 10", "1-0/alice/1"},
+		{"XPENDING s g IDLE 5000 - + 10 bob", ""},
+	}
+	for _, tt := range tests {
+		reply := call(server, client, tt.command)
+		if reply.Typ != "array" {
+			t.Errorf("%s = %s, want an array", tt.command, show(reply))
+			continue
+		}
+		var got []string
+		for _, item := range reply.Array {
+			got = append(got, fmt.Sprintf("%s/%s/%d", item.Array[0].Bulk, item.Array[1].Bulk, item.Array[3].Num))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, strings.Join(got, " "), tt.want)
+		}
+	}
+	if idle := call(server, client, "XPENDING s g - 1-0 1").Array[0].Array[2].Num; idle < 10000 || idle > 20000 {
+		t.Errorf("1-0 idle for %dms, want about 10000", idle)
+	}
+}
+
+func TestXclaim(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+		// id is the pending entry checked afterwards, with its state as
+		// returned by nackState.
+		id    string
+		state string
+	}{
+		// Only entries idle for at least min-idle-time are claimed.
+		{"XCLAIM s g bob 5000 1-0 2-0", "[[1-0 [a 1]]]", "1-0", "bob/2"},
+		{"XCLAIM s g bob 5000 1-0 2-0", "[[1-0 [a 1]]]", "2-0", "alice/1"},
+		{"XCLAIM s g bob 20000 1-0", "[]", "1-0", "alice/1"},
+		{"XCLAIM s g alice 0 1-0", "[[1-0 [a 1]]]", "1-0", "alice/2"},
+		// JUSTID does not count as a delivery.
+		{"XCLAIM s g bob 0 1-0 JUSTID", "[1-0]", "1-0", "bob/1"},
+		{"XCLAIM s g bob 0 1-0 RETRYCOUNT 7", "[[1-0 [a 1]]]", "1-0", "bob/7"},
+		{"XCLAIM s g carol 0 3-0", "[[3-0 [c 3]]]", "3-0", "carol/2"},
+		// Entries nobody has pending are only claimed with FORCE.
+		{"XCLAIM s g bob 0 4-0", "[]", "4-0", "(none)"},
+		{"XCLAIM s g bob 0 4-0 FORCE", "[[4-0 [d 4]]]", "4-0", "bob/2"},
+		{"XCLAIM s g bob 0 9-0 FORCE", "[]", "9-0", "(none)"},
+		{"XCLAIM s g bob 0 1-0 LASTID 9-0", "[[1-0 [a 1]]]", "1-0", "bob/2"},
+
+		{"XCLAIM s g bob x 1-0", "ERR Invalid min-idle-time argument for XCLAIM", "1-0", "alice/1"},
+		{"XCLAIM s g bob 0 x", "ERR Invalid stream ID specified as stream command argument", "1-0", "alice/1"},
+		{"XCLAIM s g bob 0 1-0 FOO", "ERR Unrecognized XCLAIM option 'FOO'", "1-0", "alice/1"},
+		{"XCLAIM s g bob 0 1-0 IDLE x", "ERR Invalid IDLE option argument for XCLAIM", "1-0", "alice/1"},
+		{"XCLAIM s g bob 0 1-0 RETRYCOUNT -1", "ERR Invalid RETRYCOUNT option argument for XCLAIM", "1-0", "alice/1"},
+		{"XCLAIM s nope bob 0 1-0", "NOGROUP No such key 's' or consumer group 'nope'", "1-0", "alice/1"},
+		{"XCLAIM s g bob 0", "ERR wrong number of arguments for 'xclaim' command", "1-0", "alice/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newPendingTestServer(t)
+			run(t, server, client, "XADD s 4-0 d 4")
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			if got := nackState(t, server, tt.id); got != tt.state {
+				t.Errorf("%s is %s, want %s", tt.id, got, tt.state)
+			}
+			if strings.Contains(tt.command, "LASTID") {
+				if got := server.KV.Streams["s"].Groups["g"].LastID.ToString(); got != "9-0" {
+					t.Errorf("last delivered ID = %s, want 9-0", got)
+				}
+			}
+		})
+	}
+}
+
+func TestXclaimIdle(t *testing.T) {
+	server, client := newPendingTestServer(t)
+	run(t, server, client, "XCLAIM s g bob 0 2-0 IDLE 60000")
+	nack := server.KV.Streams["s"].Groups["g"].Pending[streamID(t, "2-0")]
+	if idle := time.Now().UnixMilli() - nack.DeliveryTime; idle < 60000 || idle > 70000 {
+		t.Errorf("2-0 idle for %dms after IDLE 60000", idle)
+	}
+	run(t, server, client, "XCLAIM s g bob 0 2-0 TIME 1000")
+	if nack.DeliveryTime != 1000 {
+		t.Errorf("delivery time = %d after TIME 1000", nack.DeliveryTime)
+	}
+	// A time in the future is clamped to now.
+	run(t, server, client, "XCLAIM s g bob 0 2-0 TIME 99999999999999")
+	if nack.DeliveryTime > time.Now().UnixMilli() {
+		t.Errorf("delivery time %d is in the future", nack.DeliveryTime)
+	}
+}
+
+func TestXautoclaim(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+		states  string
+	}{
+		{"XAUTOCLAIM s g bob 5000 0", "[0-0 [[1-0 [a 1]] [2-0 [b 2]]] []]", "bob/2 bob/2 bob/1"},
+		{"XAUTOCLAIM s g bob 5000 0 COUNT 1", "[2-0 [[1-0 [a 1]]] []]", "bob/2 alice/1 bob/1"},
+		{"XAUTOCLAIM s g bob 5000 (1-0", "[0-0 [[2-0 [b 2]]] []]", "alice/1 bob/2 bob/1"},
+		{"XAUTOCLAIM s g carol 5000 - JUSTID", "[0-0 [1-0 2-0] []]", "carol/1 carol/1 bob/1"},
+		{"XAUTOCLAIM s g carol 0 0", "[0-0 [[1-0 [a 1]] [2-0 [b 2]] [3-0 [c 3]]] []]", "carol/2 carol/2 carol/2"},
+		{"XAUTOCLAIM s g carol 20000 0", "[0-0 [] []]", "alice/1 alice/1 bob/1"},
+
+		{"XAUTOCLAIM s g bob 0 0 COUNT 0", "ERR COUNT must be > 0", "alice/1 alice/1 bob/1"},
+		{"XAUTOCLAIM s g bob 0 0 COUNT x", "ERR value is not an integer or out of range", "alice/1 alice/1 bob/1"},
+		{"XAUTOCLAIM s g bob x 0", "ERR Invalid min-idle-time argument for XAUTOCLAIM", "alice/1 alice/1 bob/1"},
+		{"XAUTOCLAIM s g bob 0 x", "ERR Invalid stream ID specified as stream command argument", "alice/1 alice/1 bob/1"},
+		{"XAUTOCLAIM s g bob 0 0 FOO", "ERR syntax error", "alice/1 alice/1 bob/1"},
+		{"XAUTOCLAIM s nope bob 0 0", "NOGROUP No such key 's' or consumer group 'nope'", "alice/1 alice/1 bob/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newPendingTestServer(t)
+			age(t, server, "2-0", 10*time.Second)
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			states := []string{nackState(t, server, "1-0"), nackState(t, server, "2-0"), nackState(t, server, "3-0")}
+			if got := strings.Join(states, " "); got != tt.states {
+				t.Errorf("PEL is %s, want %s", got, tt.states)
+			}
+		})
+	}
+}
+
+func TestXgroupSetdeadletter(t *testing.T) {
+	server, client := newPendingTestServer(t)
+	runSteps(t, server, client, []step{
+		{"XGROUP SETDEADLETTER s g -1 dlq", "ERR max-deliveries must be a non-negative integer"},
+		{"XGROUP SETDEADLETTER s g 2", "ERR a dead-letter key is required when max-deliveries is set"},
+		{"XGROUP SETDEADLETTER s g 2 s", "ERR the dead-letter key must differ from the stream key"},
+		{"XGROUP SETDEADLETTER s nope 2 dlq", "NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XGROUP SETDEADLETTER s g 0", "OK"},
+		{"XGROUP SETDEADLETTER s g 2 dlq", "OK"},
+	})
+	replica := addTestReplica(server)
+	runSteps(t, server, client, []step{
+		// The second delivery of 1-0 and 2-0 is still within budget.
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-0 [a 1]] [2-0 [b 2]]]]]"},
+		// A third delivery exceeds it, so 1-0 moves to the dead-letter
+		// stream instead of being claimed.
+		{"XCLAIM s g bob 5000 1-0", "[]"},
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s []]]"},
+		{"XPENDING s g", "[1 3-0 3-0 [[bob 1]]]"},
+	})
+
+	dlq, ok := server.KV.Streams["dlq"]
+	if !ok || dlq.Len() != 2 {
+		t.Fatalf("dead-letter stream missing or not holding two entries")
+	}
+	for i, entry := range dlq.Entries() {
+		var fields []string
+		for _, field := range entry.Fields {
+			fields = append(fields, field.Name+"="+field.Value)
+		}
+		want := fmt.Sprintf("dlq-stream=s dlq-group=g dlq-id=%d-0 dlq-deliveries=2 %c=%d", i+1, 'a'+i, i+1)
+		if got := strings.Join(fields, " "); got != want {
+			t.Errorf("dead letter %d is %q, want %q", i, got, want)
+		}
+	}
+
+	var moves []string
+	for _, line := range replica.commands() {
+		if strings.HasPrefix(line, "XADD dlq") || strings.HasPrefix(line, "XACK") {
+			moves = append(moves, strings.Fields(line)[0]+" "+strings.Fields(line)[1])
+		}
+	}
+	if got := strings.Join(moves, ", "); got != "XADD dlq, XACK s, XADD dlq, XACK s" {
+		t.Errorf("propagated moves %s", got)
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -11,191 +12,642 @@ import (
 	"github.com/r1i2t3/go-redis/app/utils"
 )
 
+const (
+	streamTrimNone = iota
+	streamTrimMaxLen
+	streamTrimMinID
+)
+
+// streamAddTrimArgs holds the options shared by XADD and XTRIM.
+type streamAddTrimArgs struct {
+	id         kv.StreamId
+	idGiven    bool
+	seqGiven   bool
+	noMkStream bool
+	strategy   int
+	approx     bool
+	maxLen     int
+	minID      kv.StreamId
+	threshold  string
+	limit      int
+	fieldsAt   int
+}
+
+// parseStreamAddOrTrimArgs parses the options following the key of an XADD
+// or XTRIM command, the same way Redis' streamParseAddOrTrimArgsOrReply
+// does. For XADD, fieldsAt is the index of the first field after the ID.
+func parseStreamAddOrTrimArgs(args []resp.Value, xadd bool) (streamAddTrimArgs, string) {
+	var parsed streamAddTrimArgs
+	limitGiven := false
+	i := 1
+	for ; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		opt := strings.ToUpper(args[i].Bulk)
+		switch {
+		case xadd && opt == "*":
+			i++
+			parsed.fieldsAt = i
+			goto Done
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs > 0:
+			if parsed.strategy != streamTrimNone {
+				return parsed, "ERR syntax error, MAXLEN and MINID options at the same time are not compatible"
+			}
+			parsed.approx = false
+			if moreArgs >= 2 && (args[i+1].Bulk == "~" || args[i+1].Bulk == "=") {
+				parsed.approx = args[i+1].Bulk == "~"
+				i++
+			}
+			i++
+			parsed.threshold = args[i].Bulk
+			if opt == "MAXLEN" {
+				maxLen, err := strconv.Atoi(parsed.threshold)
+				if err != nil {
+					return parsed, "ERR value is not an integer or out of range"
+				}
+				if maxLen < 0 {
+					return parsed, "ERR The MAXLEN argument must be >= 0."
+				}
+				parsed.strategy = streamTrimMaxLen
+				parsed.maxLen = maxLen
+			} else {
+				minID, err := utils.ParseStreamID(parsed.threshold)
+				if err != nil {
+					return parsed, "ERR Invalid stream ID specified as stream command argument"
+				}
+				parsed.strategy = streamTrimMinID
+				parsed.minID = minID
+			}
+		case opt == "LIMIT" && moreArgs > 0:
+			limit, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return parsed, "ERR value is not an integer or out of range"
+			}
+			if limit < 0 {
+				return parsed, "ERR The LIMIT argument must be >= 0."
+			}
+			parsed.limit = limit
+			limitGiven = true
+			i++
+		case xadd && opt == "NOMKSTREAM":
+			parsed.noMkStream = true
+		case xadd:
+			id, seqGiven, err := parseXaddID(args[i].Bulk)
+			if err != nil {
+				return parsed, "ERR Invalid stream ID specified as stream command argument"
+			}
+			parsed.id = id
+			parsed.idGiven = true
+			parsed.seqGiven = seqGiven
+			i++
+			parsed.fieldsAt = i
+			goto Done
+		default:
+			return parsed, "ERR syntax error"
+		}
+	}
+Done:
+	if xadd && parsed.fieldsAt == 0 {
+		parsed.fieldsAt = len(args)
+	}
+	if limitGiven && parsed.strategy == streamTrimNone {
+		return parsed, "ERR syntax error, LIMIT cannot be used without specifying a trimming strategy"
+	}
+	if !xadd && parsed.strategy == streamTrimNone {
+		return parsed, "ERR syntax error, XTRIM must be called with a trimming strategy"
+	}
+	if limitGiven && !parsed.approx {
+		return parsed, "ERR syntax error, LIMIT cannot be used without the special ~ option"
+	}
+	if !limitGiven && parsed.approx {
+		parsed.limit = 100 * kv.StreamNodeMaxEntries
+	}
+	return parsed, ""
+}
+
+// parseXaddID parses an explicit XADD ID, either <ms>-<seq>, <ms> or
+// <ms>-*. seqGiven is false for the <ms>-* form.
+func parseXaddID(s string) (kv.StreamId, bool, error) {
+	if ms, ok := strings.CutSuffix(s, "-*"); ok {
+		timestamp, err := strconv.ParseUint(ms, 10, 64)
+		if err != nil {
+			return kv.StreamId{}, false, err
+		}
+		return kv.StreamId{Timestamp: timestamp}, false, nil
+	}
+	id, err := utils.ParseStreamID(s)
+	return id, true, err
+}
+
+// streamTrim applies the trimming options in parsed to stream and returns
+// how many entries were evicted.
+func streamTrim(stream *kv.Stream, parsed streamAddTrimArgs) int {
+	switch parsed.strategy {
+	case streamTrimMaxLen:
+		return stream.TrimMaxLen(parsed.maxLen, parsed.approx, parsed.limit)
+	case streamTrimMinID:
+		return stream.TrimMinID(parsed.minID, parsed.approx, parsed.limit)
+	}
+	return 0
+}
+
+// streamTrimPropagationArgs renders the trimming options for replicas.
+// Approximate trimming depends on node layout, so it is rewritten as an exact
+// trim to whatever the stream was actually trimmed to.
+func streamTrimPropagationArgs(stream *kv.Stream, parsed streamAddTrimArgs) []resp.Value {
+	strategy := "MAXLEN"
+	if parsed.strategy == streamTrimMinID {
+		strategy = "MINID"
+	}
+	threshold := parsed.threshold
+	if parsed.approx {
+		if parsed.strategy == streamTrimMaxLen {
+			threshold = strconv.Itoa(stream.Len())
+		} else if stream.Len() > 0 {
+			threshold = stream.FirstID().ToString()
+		}
+	}
+	return []resp.Value{
+		{Typ: "bulk", Bulk: strategy},
+		{Typ: "bulk", Bulk: "="},
+		{Typ: "bulk", Bulk: threshold},
+	}
+}
+
 func xadd(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if len(args) < 3 {
+	if len(args) < 4 {
 		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xadd' command"}
 	}
 	kV := server.KV
 	key := args[0].Bulk
-	fieldsArray := args[1:]
+	parsed, errMsg := parseStreamAddOrTrimArgs(args, true)
+	if errMsg != "" {
+		return resp.Value{Typ: "error", Str: errMsg}
+	}
+	fieldsArray := args[parsed.fieldsAt:]
+	if len(fieldsArray) < 2 || len(fieldsArray)%2 != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xadd' command"}
+	}
+	if parsed.idGiven && parsed.seqGiven && parsed.id == (kv.StreamId{}) {
+		return resp.Value{Typ: "error", Str: "ERR The ID specified in XADD must be greater than 0-0"}
+	}
 
-	fields := make(map[string]resp.Value)
+	fields := make([]kv.StreamField, 0, len(fieldsArray)/2)
 	for i := 0; i < len(fieldsArray); i += 2 {
-		if i+1 >= len(fieldsArray) {
-			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xadd' command"}
-		}
-		fields[fieldsArray[i].Bulk] = fieldsArray[i+1]
+		fields = append(fields, kv.StreamField{Name: fieldsArray[i].Bulk, Value: fieldsArray[i+1].Bulk})
 	}
 	kV.StreamsMu.Lock()
 	defer kV.StreamsMu.Unlock()
-	stream, exists := kV.Streams[key]
-
+	stream, exists := kV.MutableStream(key)
+	if !exists && parsed.noMkStream {
+		return resp.Value{Typ: "null"}
+	}
 	if !exists {
-		stream = &kv.Stream{
-			Entries: []kv.StreamEntry{},
-			Groups:  make(map[string]*kv.ConsumerGroup),
+		stream = kv.NewStream()
+	}
+	if stream.LastID.Timestamp == math.MaxUint64 && stream.LastID.Sequence == math.MaxUint64 {
+		return resp.Value{Typ: "error", Str: "ERR The stream has exhausted the last possible ID, unable to add more items"}
+	}
+
+	var id kv.StreamId
+	switch {
+	case !parsed.idGiven:
+		id, _ = stream.NextID(uint64(time.Now().UnixMilli()))
+	case !parsed.seqGiven:
+		id = parsed.id
+		if id.Timestamp == stream.LastID.Timestamp {
+			if stream.LastID.Sequence == math.MaxUint64 {
+				return resp.Value{Typ: "error", Str: "ERR The ID specified in XADD is equal or smaller than the target stream top item"}
+			}
+			id.Sequence = stream.LastID.Sequence + 1
 		}
+	default:
+		id = parsed.id
+	}
+	if id.Compare(stream.LastID) <= 0 {
+		return resp.Value{Typ: "error", Str: "ERR The ID specified in XADD is equal or smaller than the target stream top item"}
+	}
+
+	if !exists {
 		kV.Streams[key] = stream
 	}
+	stream.Append(id, fields)
+	streamTrim(stream, parsed)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyStream, "xadd", key)
+	server.IncrementDirty()
+	kV.WakeUpStreamClients(key, id)
+
+	// Replicas get the generated ID and the effective trim threshold so they
+	// end up with exactly the same entries.
+	cmdArgs := []resp.Value{{Typ: "bulk", Bulk: "XADD"}, args[0]}
+	if parsed.noMkStream {
+		cmdArgs = append(cmdArgs, resp.Value{Typ: "bulk", Bulk: "NOMKSTREAM"})
+	}
+	if parsed.strategy != streamTrimNone {
+		cmdArgs = append(cmdArgs, streamTrimPropagationArgs(stream, parsed)...)
+	}
+	cmdArgs = append(cmdArgs, resp.Value{Typ: "bulk", Bulk: id.ToString()})
+	cmdArgs = append(cmdArgs, fieldsArray...)
+	server.Propagate(resp.Value{Typ: "array", Array: cmdArgs})
+	return resp.Value{Typ: "bulk", Bulk: id.ToString()}
+}
 
-	id := kv.StreamId{Timestamp: uint64(time.Now().UnixMilli()), Sequence: uint64(len(stream.Entries) + 1)}
-	entry := kv.StreamEntry{
-		ID:     id,
-		Fields: fields,
+func xsetid(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 2 && len(args) != 4 && len(args) != 6 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xsetid' command"}
+	}
+	key := args[0].Bulk
+	lastID, err := utils.ParseStreamID(args[1].Bulk)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+	}
+	entriesAdded := int64(-1)
+	var maxDeletedID kv.StreamId
+	maxDeletedGiven := false
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "ENTRIESADDED":
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if n < 0 {
+				return resp.Value{Typ: "error", Str: "ERR entries_added must be positive"}
+			}
+			entriesAdded = n
+		case "MAXDELETEDID":
+			id, err := utils.ParseStreamID(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+			}
+			if lastID.Compare(id) < 0 {
+				return resp.Value{Typ: "error", Str: "ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id"}
+			}
+			maxDeletedID = id
+			maxDeletedGiven = true
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return resp.Value{Typ: "error", Str: "ERR no such key"}
+	}
+	if last, ok := stream.Last(); ok && lastID.Compare(last.ID) < 0 {
+		return resp.Value{Typ: "error", Str: "ERR The ID specified in XSETID is smaller than the target stream top item"}
+	}
+	if entriesAdded != -1 && uint64(stream.Len()) > uint64(entriesAdded) {
+		return resp.Value{Typ: "error", Str: "ERR The entries_added specified in XSETID is smaller than the target stream length"}
+	}
+	stream.LastID = lastID
+	if entriesAdded != -1 {
+		stream.EntriesAdded = uint64(entriesAdded)
 	}
-	stream.Entries = append(stream.Entries, entry)
-	incrementVersion(key, server)
+	if maxDeletedGiven {
+		stream.MaxDeletedID = maxDeletedID
+	}
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyStream, "xsetid", key)
 	server.IncrementDirty()
-	kV.WakeUpClients(key, true)
-	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "XADD"}}, args...)}
+	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "XSETID"}}, args...)}
 	server.Propagate(cmd)
-	return resp.Value{Typ: "bulk", Bulk: id.ToString()}
+	return resp.Value{Typ: "string", Str: "OK"}
 }
 
 func streamEntryToResp(entry kv.StreamEntry) resp.Value {
 	fields := make([]resp.Value, 0, len(entry.Fields)*2)
-	for k, v := range entry.Fields {
-		fields = append(fields, resp.Value{Typ: "bulk", Bulk: k}, v)
+	for _, f := range entry.Fields {
+		fields = append(fields, resp.Value{Typ: "bulk", Bulk: f.Name}, resp.Value{Typ: "bulk", Bulk: f.Value})
 	}
 	return resp.Value{Typ: "array", Array: fields}
 }
 
-func xrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
-	if len(args) < 3 {
-		return resp.Value{Typ: "error", Bulk: "ERR wrong number of arguments for 'xrange' command"}
+func streamEntryWithID(entry kv.StreamEntry) resp.Value {
+	return resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: entry.ID.ToString()},
+		streamEntryToResp(entry),
+	}}
+}
+
+// parseStreamRangeBound parses one end of an XRANGE-style interval: "-",
+// "+", a full ID, a bare millisecond time or a "(" prefixed exclusive ID. A
+// missing sequence defaults to the lowest value for a start bound and the
+// highest for an end bound.
+func parseStreamRangeBound(s string, isEnd bool) (kv.StreamId, string) {
+	switch s {
+	case "-":
+		return kv.StreamId{}, ""
+	case "+":
+		return streamMaxID, ""
+	}
+	exclusive := false
+	if strings.HasPrefix(s, "(") {
+		exclusive = true
+		s = s[1:]
+	}
+	var id kv.StreamId
+	var err error
+	if strings.Contains(s, "-") {
+		id, err = utils.ParseStreamID(s)
+	} else {
+		id.Timestamp, err = strconv.ParseUint(s, 10, 64)
+		if isEnd {
+			id.Sequence = math.MaxUint64
+		}
+	}
+	if err != nil {
+		return id, "ERR Invalid stream ID specified as stream command argument"
+	}
+	if exclusive {
+		var ok bool
+		if isEnd {
+			id, ok = id.Prev()
+			if !ok {
+				return id, "ERR invalid end ID for the interval"
+			}
+		} else {
+			id, ok = id.Next()
+			if !ok {
+				return id, "ERR invalid start ID for the interval"
+			}
+		}
+	}
+	return id, ""
+}
+
+// xrangeGeneric implements XRANGE and XREVRANGE. XREVRANGE takes its bounds
+// in end, start order.
+func xrangeGeneric(name string, args []resp.Value, server *types.Server, reverse bool) resp.Value {
+	if len(args) != 3 && len(args) != 5 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for '" + name + "' command"}
 	}
-	kV := server.KV
 	key := args[0].Bulk
-	start := args[1].Bulk
-	end := args[2].Bulk
+	startArg, endArg := args[1].Bulk, args[2].Bulk
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+	start, errMsg := parseStreamRangeBound(startArg, false)
+	if errMsg != "" {
+		return resp.Value{Typ: "error", Str: errMsg}
+	}
+	end, errMsg := parseStreamRangeBound(endArg, true)
+	if errMsg != "" {
+		return resp.Value{Typ: "error", Str: errMsg}
+	}
+	count := -1
+	if len(args) == 5 {
+		if !strings.EqualFold(args[3].Bulk, "COUNT") {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(args[4].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		count = max(n, 0)
+	}
+	if count == 0 {
+		return resp.Value{Typ: "null"}
+	}
+
+	kV := server.KV
 	kV.StreamsMu.RLock()
 	defer kV.StreamsMu.RUnlock()
 	stream, exists := kV.Streams[key]
-	if !exists {
-		return resp.Value{Typ: "error", Bulk: "ERR no such key"}
+	if !exists || start.Compare(end) > 0 {
+		return resp.Value{Typ: "array", Array: []resp.Value{}}
+	}
+	entries := stream.Range(start, end, max(count, 0), reverse)
+	result := make([]resp.Value, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, streamEntryWithID(entry))
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+func xrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return xrangeGeneric("xrange", args, server, false)
+}
+
+func xrevrange(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	return xrangeGeneric("xrevrange", args, server, true)
+}
+
+func xlen(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xlen' command"}
 	}
-	if start == "-" {
-		start = "0-0"
+	kV := server.KV
+	kV.StreamsMu.RLock()
+	defer kV.StreamsMu.RUnlock()
+	stream, exists := kV.Streams[args[0].Bulk]
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
 	}
-	if end == "+" {
-		end = "999999999999999999-999999"
+	return resp.Value{Typ: "integer", Num: stream.Len()}
+}
+
+func xdel(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xdel' command"}
 	}
-	startID, err := utils.ParseStreamID(start)
-	if err != nil {
-		return resp.Value{Typ: "Error", Bulk: "ERR invalid start ID"}
+	key := args[0].Bulk
+	ids := make([]kv.StreamId, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := utils.ParseStreamID(arg.Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
+		}
+		ids = append(ids, id)
 	}
-	endID, err := utils.ParseStreamID(end)
-	if err != nil {
-		return resp.Value{Typ: "Error", Bulk: "ERR invalid end ID"}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
 	}
-	var result []resp.Value
-	for _, entry := range stream.Entries {
-		stream := make([]resp.Value, 0, 2)
-		stream = append(stream, resp.Value{Typ: "bulk", Bulk: entry.ID.ToString()})
-		if entry.ID.IsGreaterThan(startID) && entry.ID.IsSmallerThan(endID) {
-			stream = append(stream, streamEntryToResp(entry))
+	deleted := 0
+	for _, id := range ids {
+		if stream.Delete(id) {
+			deleted++
 		}
-		result = append(result, resp.Value{Typ: "array", Array: stream})
 	}
-	return resp.Value{Typ: "array", Array: result}
+	if deleted > 0 {
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyStream, "xdel", key)
+		server.IncrementDirty()
+		cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "XDEL"}}, args...)}
+		server.Propagate(cmd)
+	}
+	return resp.Value{Typ: "integer", Num: deleted}
+}
+
+func xtrim(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+	if len(args) < 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xtrim' command"}
+	}
+	key := args[0].Bulk
+	parsed, errMsg := parseStreamAddOrTrimArgs(args, false)
+	if errMsg != "" {
+		return resp.Value{Typ: "error", Str: errMsg}
+	}
+
+	kV := server.KV
+	kV.StreamsMu.Lock()
+	defer kV.StreamsMu.Unlock()
+	stream, exists := kV.MutableStream(key)
+	if !exists {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	removed := streamTrim(stream, parsed)
+	if removed > 0 {
+		signalModifiedKey(key, server)
+		notifyKeyspaceEvent(server, notifyStream, "xtrim", key)
+		server.IncrementDirty()
+		cmdArgs := []resp.Value{{Typ: "bulk", Bulk: "XTRIM"}, args[0]}
+		cmdArgs = append(cmdArgs, streamTrimPropagationArgs(stream, parsed)...)
+		server.Propagate(resp.Value{Typ: "array", Array: cmdArgs})
+	}
+	return resp.Value{Typ: "integer", Num: removed}
 }
 
-func xread(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
+func xread(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
 	if len(args) < 3 {
 		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'xread' command"}
 	}
-	keyVal := server.KV
 	var blockTimeout time.Duration = -1
+	count := 0
 	i := 0
-	if strings.EqualFold(args[i].Bulk, "BLOCK") {
-		i++
-		if len(args) < i+2 {
+Options:
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case opt == "BLOCK" && moreArgs > 0:
+			ms, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR timeout is not an integer or out of range"}
+			}
+			if ms < 0 {
+				return resp.Value{Typ: "error", Str: "ERR timeout is negative"}
+			}
+			blockTimeout = time.Duration(ms) * time.Millisecond
+			i++
+		case opt == "COUNT" && moreArgs > 0:
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			count = max(n, 0)
+			i++
+		case opt == "STREAMS" && moreArgs > 0:
+			i++
+			break Options
+		default:
 			return resp.Value{Typ: "error", Str: "ERR syntax error"}
 		}
-		ms, err := strconv.Atoi(args[i].Bulk)
-		if err != nil || ms < 0 {
-			return resp.Value{Typ: "error", Str: "ERR invalid block timeout"}
-		}
-		blockTimeout = time.Duration(ms) * time.Millisecond
-		i++
-	}
-	if strings.ToUpper(args[i].Bulk) != "STREAMS" {
-		return resp.Value{Typ: "error", Str: "ERR syntax error"}
 	}
-	i++
 	remainingArgs := len(args) - i
 	if remainingArgs%2 != 0 || remainingArgs == 0 {
-		return resp.Value{Typ: "error", Str: "ERR Unbalanced XREAD list of streams: keys and IDs must be specified in pairs."}
+		return resp.Value{Typ: "error", Str: "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."}
 	}
 	numStreams := remainingArgs / 2
-	streamKeys := make([]string, numStreams)
-	lastIDs := make(map[string]string, numStreams)
-	for j := 0; j < numStreams; j++ {
-		key := args[i+j].Bulk
-		id := args[i+j+numStreams].Bulk
-		streamKeys[j] = key
-		lastIDs[key] = id
+	keys := make([]string, numStreams)
+	for j := range keys {
+		keys[j] = args[i+j].Bulk
 	}
 
-RetryRead:
-	keyVal.StreamsMu.RLock()
-	finalResult := make([]resp.Value, 0)
-
-	for _, key := range streamKeys {
-		stream, exists := keyVal.Streams[key]
-		if !exists {
-			continue
-		}
-
-		lastIDStr := lastIDs[key]
-		startID, err := utils.ParseStreamID(lastIDStr)
-		if err != nil {
-			keyVal.StreamsMu.RUnlock()
-			return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified"}
-		}
-
-		streamEntries := make([]resp.Value, 0)
-		for _, entry := range stream.Entries {
-			if entry.ID.IsGreaterThan(startID) {
-				entryResp := resp.Value{Typ: "array", Array: []resp.Value{
-					{Typ: "bulk", Bulk: entry.ID.ToString()},
-					streamEntryToResp(entry),
-				}}
-				streamEntries = append(streamEntries, entryResp)
+	// "$" and "+" are resolved once, against the streams as they are now, so
+	// a reader that blocks only sees entries added after it arrived.
+	kV := server.KV
+	kV.StreamsMu.RLock()
+	afterIDs := make(map[string]kv.StreamId, numStreams)
+	for j, key := range keys {
+		idStr := args[i+j+numStreams].Bulk
+		stream, exists := kV.Streams[key]
+		var id kv.StreamId
+		switch idStr {
+		case "$":
+			if exists {
+				id = stream.LastID
+			}
+		case "+":
+			if exists {
+				if last, ok := stream.Last(); ok {
+					id, _ = last.ID.Prev()
+				}
+			}
+		default:
+			var err error
+			if strings.Contains(idStr, "-") {
+				id, err = utils.ParseStreamID(idStr)
+			} else {
+				id.Timestamp, err = strconv.ParseUint(idStr, 10, 64)
+			}
+			if err != nil {
+				kV.StreamsMu.RUnlock()
+				return resp.Value{Typ: "error", Str: "ERR Invalid stream ID specified as stream command argument"}
 			}
 		}
+		afterIDs[key] = id
+	}
+	kV.StreamsMu.RUnlock()
 
-		if len(streamEntries) > 0 {
+	var deadline time.Time
+	if blockTimeout > 0 {
+		deadline = time.Now().Add(blockTimeout)
+	}
+	timedOut := false
+	for {
+		kV.StreamsMu.RLock()
+		finalResult := make([]resp.Value, 0)
+		for _, key := range keys {
+			stream, exists := kV.Streams[key]
+			if !exists {
+				continue
+			}
+			start, ok := afterIDs[key].Next()
+			if !ok {
+				continue
+			}
+			entries := stream.Range(start, streamMaxID, count, false)
+			if len(entries) == 0 {
+				continue
+			}
+			streamEntries := make([]resp.Value, 0, len(entries))
+			for _, entry := range entries {
+				streamEntries = append(streamEntries, streamEntryWithID(entry))
+			}
 			finalResult = append(finalResult, resp.Value{Typ: "array", Array: []resp.Value{
 				{Typ: "bulk", Bulk: key},
 				{Typ: "array", Array: streamEntries},
 			}})
 		}
+		if len(finalResult) > 0 {
+			kV.StreamsMu.RUnlock()
+			return resp.Value{Typ: "array", Array: finalResult}
+		}
+		if blockTimeout < 0 || timedOut || blockingDenied(client) {
+			kV.StreamsMu.RUnlock()
+			return resp.Value{Typ: "null"}
+		}
+		// The wait is registered before StreamsMu is released, so an XADD
+		// landing in between still wakes us.
+		wait := blockTimeout
+		if !deadline.IsZero() {
+			if wait = time.Until(deadline); wait <= 0 {
+				timedOut = true
+				kV.StreamsMu.RUnlock()
+				continue
+			}
+		}
+		if !waitForStreams(kV, keys, afterIDs, wait, kV.StreamsMu.RUnlock) {
+			timedOut = true
+		}
 	}
-	keyVal.StreamsMu.RUnlock()
-
-	if len(finalResult) > 0 {
-		return resp.Value{Typ: "array", Array: finalResult}
-	}
-	if blockTimeout < 0 {
-		return resp.Value{Typ: "null"}
-	}
-	if blockTimeout == 0 {
-		blockTimeout = 365 * 24 * time.Hour
-	}
-
-	bc := &kv.BlockedClient{
-		Ch:       make(chan bool, 1),
-		Keys:     streamKeys,
-		Deadline: time.Now().Add(blockTimeout),
-		Context:  lastIDs,
-	}
-	keyVal.RegisterBlockedClient(bc)
-	defer keyVal.UnregisterBlockedClient(bc)
-
-	wokenUp := <-bc.Ch
-	if wokenUp {
-		goto RetryRead
-	}
-	return resp.Value{Typ: "null"}
 }
@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+func TestXaddIDs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"XADD s 5-6 f v", "5-6"},
+		{"XADD s 6-0 f v", "6-0"},
+		{"XADD s 7 f v", "7-0"},
+		{"XADD s 5-* f v", "5-6"},
+		{"XADD s 6-* f v", "6-0"},
+		{"XADD s 5-5 f v", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD s 4-9 f v", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD s 4-* f v", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD new 0-0 f v", "ERR The ID specified in XADD must be greater than 0-0"},
+		{"XADD new 0-* f v", "0-1"},
+		{"XADD new 0-1 f v", "0-1"},
+		{"XADD s 5-x f v", "ERR Invalid stream ID specified as stream command argument"},
+		{"XADD s x-* f v", "ERR Invalid stream ID specified as stream command argument"},
+		{"XADD s 9-0 f", "ERR wrong number of arguments for 'xadd' command"},
+		{"XADD s 9-0 f v g", "ERR wrong number of arguments for 'xadd' command"},
+		{"XADD s NOMKSTREAM 9-0 f v", "9-0"},
+		{"XADD new NOMKSTREAM * f v", "(nil)"},
+		{"XADD s MAXLEN x * f v", "ERR value is not an integer or out of range"},
+		{"XADD s MAXLEN -1 * f v", "ERR The MAXLEN argument must be >= 0."},
+		{"XADD s MAXLEN 1 MINID 0 * f v", "ERR syntax error, MAXLEN and MINID options at the same time are not compatible"},
+		{"XADD s MINID x * f v", "ERR Invalid stream ID specified as stream command argument"},
+		{"XADD s LIMIT 10 * f v", "ERR syntax error, LIMIT cannot be used without specifying a trimming strategy"},
+		{"XADD s MAXLEN 1 LIMIT 10 * f v", "ERR syntax error, LIMIT cannot be used without the special ~ option"},
+		{"XADD s MAXLEN = 1 LIMIT 10 * f v", "ERR syntax error, LIMIT cannot be used without the special ~ option"},
+		{"XADD s MAXLEN ~ 1 LIMIT -1 * f v", "ERR The LIMIT argument must be >= 0."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			run(t, server, client, "XADD s 5-5 f v")
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			_, created := server.KV.Streams["new"]
+			if wantCreated := !strings.HasPrefix(tt.want, "ERR") && tt.want != "(nil)" && strings.Contains(tt.command, "new"); created != wantCreated {
+				t.Errorf("stream new created = %v, want %v", created, wantCreated)
+			}
+		})
+	}
+}
+
+func TestXaddExhaustedIDs(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	runSteps(t, server, client, []step{
+		{"XADD s 5-18446744073709551615 f v", "5-18446744073709551615"},
+		{"XADD s 5-* f v", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XSETID s 18446744073709551615-18446744073709551615", "OK"},
+		{"XADD s * f v", "ERR The stream has exhausted the last possible ID, unable to add more items"},
+	})
+}
+
+func TestXsetid(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+		lastID  string
+	}{
+		{"XSETID s 3-0", "OK", "3-0"},
+		{"XSETID s 2-2", "OK", "2-2"},
+		{"XSETID s 5-0 ENTRIESADDED 10 MAXDELETEDID 4-0", "OK", "5-0"},
+		{"XSETID s 2-1", "ERR The ID specified in XSETID is smaller than the target stream top item", "2-2"},
+		{"XSETID missing 1-1", "ERR no such key", "2-2"},
+		{"XSETID s x", "ERR Invalid stream ID specified as stream command argument", "2-2"},
+		{"XSETID s 5-0 ENTRIESADDED 1", "ERR The entries_added specified in XSETID is smaller than the target stream length", "2-2"},
+		{"XSETID s 5-0 ENTRIESADDED -1", "ERR entries_added must be positive", "2-2"},
+		{"XSETID s 5-0 ENTRIESADDED x", "ERR value is not an integer or out of range", "2-2"},
+		{"XSETID s 5-0 MAXDELETEDID 6-0", "ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id", "2-2"},
+		{"XSETID s 5-0 MAXDELETEDID x", "ERR Invalid stream ID specified as stream command argument", "2-2"},
+		{"XSETID s 5-0 FOO 1", "ERR syntax error", "2-2"},
+		{"XSETID s 5-0 ENTRIESADDED", "ERR wrong number of arguments for 'xsetid' command", "2-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			run(t, server, client, "XADD s 1-1 f v")
+			run(t, server, client, "XADD s 2-2 f v")
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			stream := server.KV.Streams["s"]
+			if got := stream.LastID.ToString(); got != tt.lastID {
+				t.Errorf("last ID = %s, want %s", got, tt.lastID)
+			}
+			if tt.want == "OK" && strings.Contains(tt.command, "ENTRIESADDED") {
+				if stream.EntriesAdded != 10 || stream.MaxDeletedID.ToString() != "4-0" {
+					t.Errorf("entries added %d, max deleted ID %s", stream.EntriesAdded, stream.MaxDeletedID.ToString())
+				}
+			}
+		})
+	}
+
+	server, client := newTestServer(), newTestClient()
+	runSteps(t, server, client, []step{
+		{"XADD s 1-1 f v", "1-1"},
+		{"XSETID s 9-0", "OK"},
+		{"XADD s 9-0 f v", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD s 9-* f v", "9-1"},
+	})
+}
+
+// TestStreamTrimPropagation checks trimming and that replicas are told the
+// exact outcome of an approximate trim, which depends on the node layout.
+func TestStreamTrimPropagation(t *testing.T) {
+	tests := []struct {
+		command    string
+		length     int
+		first      string
+		propagated string
+	}{
+		{"XADD s MAXLEN 100 1-0 f v", 100, "0-152", "XADD s MAXLEN = 100 1-0 f v"},
+		{"XADD s MAXLEN = 100 1-0 f v", 100, "0-152", "XADD s MAXLEN = 100 1-0 f v"},
+		{"XADD s MAXLEN ~ 100 1-0 f v", 151, "0-101", "XADD s MAXLEN = 151 1-0 f v"},
+		{"XADD s MAXLEN ~ 100 LIMIT 50 1-0 f v", 251, "0-1", "XADD s MAXLEN = 251 1-0 f v"},
+		{"XADD s MAXLEN ~ 300 1-0 f v", 251, "0-1", "XADD s MAXLEN = 251 1-0 f v"},
+		{"XADD s MINID 0-181 1-0 f v", 71, "0-181", "XADD s MINID = 0-181 1-0 f v"},
+		{"XADD s MINID ~ 0-181 1-0 f v", 151, "0-101", "XADD s MINID = 0-101 1-0 f v"},
+		{"XADD s NOMKSTREAM MAXLEN 0 1-0 f v", 0, "0-0", "XADD s NOMKSTREAM MAXLEN = 0 1-0 f v"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			for i := 1; i <= 250; i++ {
+				run(t, server, client, fmt.Sprintf("XADD s 0-%d f v", i))
+			}
+			replica := addTestReplica(server)
+			run(t, server, client, tt.command)
+			stream := server.KV.Streams["s"]
+			if stream.Len() != tt.length || stream.FirstID().ToString() != tt.first {
+				t.Errorf("stream has %d entries from %s, want %d from %s", stream.Len(), stream.FirstID().ToString(), tt.length, tt.first)
+			}
+			if got := replica.commands(); len(got) != 1 || got[0] != tt.propagated {
+				t.Errorf("propagated %q, want %q", got, tt.propagated)
+			}
+		})
+	}
+}
+
+func TestXrange(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"XRANGE s - +", "[[1-0 [f 1]] [1-1 [f 2]] [2-0 [f 3]] [3-5 [f 4]]]"},
+		{"XRANGE s 1 1", "[[1-0 [f 1]] [1-1 [f 2]]]"},
+		{"XRANGE s 1-1 2", "[[1-1 [f 2]] [2-0 [f 3]]]"},
+		{"XRANGE s (1-0 (3-5", "[[1-1 [f 2]] [2-0 [f 3]]]"},
+		{"XRANGE s - + COUNT 2", "[[1-0 [f 1]] [1-1 [f 2]]]"},
+		{"XRANGE s - + COUNT 0", "(nil)"},
+		{"XRANGE s 3 2", "[]"},
+		{"XRANGE missing - +", "[]"},
+		{"XREVRANGE s + -", "[[3-5 [f 4]] [2-0 [f 3]] [1-1 [f 2]] [1-0 [f 1]]]"},
+		{"XREVRANGE s 2 1 COUNT 2", "[[2-0 [f 3]] [1-1 [f 2]]]"},
+		{"XREVRANGE s (2-0 -", "[[1-1 [f 2]] [1-0 [f 1]]]"},
+		{"XREVRANGE s - +", "[]"},
+		{"XRANGE s (0-0 +", "[[1-0 [f 1]] [1-1 [f 2]] [2-0 [f 3]] [3-5 [f 4]]]"},
+		{"XRANGE s - (0-0", "ERR invalid end ID for the interval"},
+		{"XRANGE s (18446744073709551615-18446744073709551615 +", "ERR invalid start ID for the interval"},
+		{"XRANGE s x +", "ERR Invalid stream ID specified as stream command argument"},
+		{"XRANGE s - + LIMIT 1", "ERR syntax error"},
+		{"XRANGE s - + COUNT x", "ERR value is not an integer or out of range"},
+		{"XRANGE s -", "ERR wrong number of arguments for 'xrange' command"},
+		{"XREVRANGE s +", "ERR wrong number of arguments for 'xrevrange' command"},
+		{"XLEN s", "4"},
+		{"XLEN missing", "0"},
+	}
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{"XADD s 1-0 f 1", "XADD s 1-1 f 2", "XADD s 2-0 f 3", "XADD s 3-5 f 4"} {
+		run(t, server, client, line)
+	}
+	for _, tt := range tests {
+		if got := show(call(server, client, tt.command)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestXdel(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{"XADD s 1-0 f 1", "XADD s 2-0 f 2", "XADD s 3-0 f 3", "XGROUP CREATE s g 0", "XREADGROUP GROUP g alice STREAMS s >"} {
+		run(t, server, client, line)
+	}
+	runSteps(t, server, client, []step{
+		{"XDEL s 2-0 9-0", "1"},
+		{"XDEL s 2-0", "0"},
+		{"XDEL missing 1-0", "0"},
+		{"XDEL s x", "ERR Invalid stream ID specified as stream command argument"},
+		{"XRANGE s - +", "[[1-0 [f 1]] [3-0 [f 3]]]"},
+		// Deleting the last entry keeps the last generated ID.
+		{"XDEL s 3-0", "1"},
+		{"XADD s 3-0 f 3", "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		// Deleted entries still pending are reported as nil and dropped from
+		// the PEL.
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-0 [f 1]] [2-0 (nil)] [3-0 (nil)]]]]"},
+		{"XCLAIM s g bob 0 2-0", "[(nil)]"},
+		{"XAUTOCLAIM s g bob 0 0", "[0-0 [[1-0 [f 1]]] [3-0]]"},
+		{"XPENDING s g", "[1 1-0 1-0 [[bob 1]]]"},
+	})
+	stream := server.KV.Streams["s"]
+	if stream.Len() != 1 || stream.MaxDeletedID.ToString() != "3-0" || stream.EntriesAdded != 3 {
+		t.Errorf("stream has %d entries, max deleted ID %s, %d added", stream.Len(), stream.MaxDeletedID.ToString(), stream.EntriesAdded)
+	}
+}
+
+func TestXtrim(t *testing.T) {
+	tests := []struct {
+		command    string
+		want       string
+		length     int
+		propagated string
+	}{
+		{"XTRIM s MAXLEN 100", "150", 100, "XTRIM s MAXLEN = 100"},
+		{"XTRIM s MAXLEN = 100", "150", 100, "XTRIM s MAXLEN = 100"},
+		{"XTRIM s MAXLEN ~ 100", "100", 150, "XTRIM s MAXLEN = 150"},
+		{"XTRIM s MAXLEN ~ 100 LIMIT 99", "0", 250, ""},
+		{"XTRIM s MAXLEN 300", "0", 250, ""},
+		{"XTRIM s MINID 0-101", "100", 150, "XTRIM s MINID = 0-101"},
+		{"XTRIM s MINID ~ 0-151", "100", 150, "XTRIM s MINID = 0-101"},
+		{"XTRIM s MAXLEN 0", "250", 0, "XTRIM s MAXLEN = 0"},
+		{"XTRIM missing MAXLEN 0", "0", 250, ""},
+		{"XTRIM s FOO 100", "ERR syntax error", 250, ""},
+		{"XTRIM s LIMIT 10", "ERR syntax error, LIMIT cannot be used without specifying a trimming strategy", 250, ""},
+		{"XTRIM s", "ERR wrong number of arguments for 'xtrim' command", 250, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			for i := 1; i <= 250; i++ {
+				run(t, server, client, fmt.Sprintf("XADD s 0-%d f v", i))
+			}
+			replica := addTestReplica(server)
+			if got := show(call(server, client, tt.command)); got != tt.want {
+				t.Errorf("reply = %s, want %s", got, tt.want)
+			}
+			if got := server.KV.Streams["s"].Len(); got != tt.length {
+				t.Errorf("stream has %d entries, want %d", got, tt.length)
+			}
+			if got := strings.Join(replica.commands(), ", "); got != tt.propagated {
+				t.Errorf("propagated %q, want %q", got, tt.propagated)
+			}
+		})
+	}
+}
+
+func TestXinfo(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{
+		"XADD s 1-0 f 1",
+		"XADD s 2-0 f 2",
+		"XADD s 3-0 f 3",
+		"XGROUP CREATE s g 0",
+		"XGROUP CREATE s late $",
+		"XREADGROUP GROUP g alice COUNT 1 STREAMS s >",
+		"XGROUP CREATECONSUMER s g bob",
+	} {
+		run(t, server, client, line)
+	}
+	runSteps(t, server, client, []step{
+		{"XINFO GROUPS s", "[[name g consumers 2 pending 1 last-delivered-id 1-0 entries-read 1 lag 2] [name late consumers 0 pending 0 last-delivered-id 3-0 entries-read (nil) lag 0]]"},
+		{"XINFO GROUPS missing", "ERR no such key"},
+		{"XINFO CONSUMERS s nope", "NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XINFO STREAM s FOO", "ERR syntax error"},
+		{"XINFO STREAM s COUNT 1", "ERR syntax error"},
+		{"XINFO FOO s", "ERR unknown subcommand 'FOO'. Try XINFO HELP."},
+		// Lag is unknown once an entry the group has not read is deleted.
+		{"XDEL s 2-0", "1"},
+		{"XINFO GROUPS s", "[[name g consumers 2 pending 1 last-delivered-id 1-0 entries-read 1 lag (nil)] [name late consumers 0 pending 0 last-delivered-id 3-0 entries-read (nil) lag 0]]"},
+	})
+
+	reply := run(t, server, client, "XINFO STREAM s")
+	fields := map[string]string{}
+	for i := 0; i+1 < len(reply.Array); i += 2 {
+		fields[reply.Array[i].Bulk] = show(reply.Array[i+1])
+	}
+	for field, want := range map[string]string{
+		"length":               "2",
+		"last-generated-id":    "3-0",
+		"max-deleted-entry-id": "2-0",
+		"entries-added":        "3",
+		"groups":               "2",
+		"first-entry":          "[1-0 [f 1]]",
+		"last-entry":           "[3-0 [f 3]]",
+	} {
+		if fields[field] != want {
+			t.Errorf("XINFO STREAM %s = %s, want %s", field, fields[field], want)
+		}
+	}
+
+	reply = run(t, server, client, "XINFO CONSUMERS s g")
+	if got := show(reply); !strings.HasPrefix(got, "[[name alice pending 1 idle ") || !strings.Contains(got, "[name bob pending 0 idle ") || !strings.HasSuffix(got, "inactive -1]]") {
+		t.Errorf("XINFO CONSUMERS s g = %s", got)
+	}
+}
+
+func TestXaddKeepsFieldOrder(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	runSteps(t, server, client, []step{
+		{"XADD s 1-0 z 1 a 2 m 3", "1-0"},
+		{"XADD s 1-1 a 1 a 2", "1-1"},
+		{"XRANGE s - +", "[[1-0 [z 1 a 2 m 3]] [1-1 [a 1 a 2]]]"},
+	})
+}
+
+func TestXread(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"XREAD STREAMS s 0", "[[s [[1-0 [f 1]] [1-1 [f 2]] [2-0 [f 3]]]]]"},
+		{"XREAD STREAMS s 1-0", "[[s [[1-1 [f 2]] [2-0 [f 3]]]]]"},
+		{"XREAD STREAMS s 1", "[[s [[1-1 [f 2]] [2-0 [f 3]]]]]"},
+		{"XREAD COUNT 1 STREAMS s 0", "[[s [[1-0 [f 1]]]]]"},
+		{"XREAD COUNT 0 STREAMS s 0", "[[s [[1-0 [f 1]] [1-1 [f 2]] [2-0 [f 3]]]]]"},
+		{"XREAD STREAMS s t 1-1 0", "[[s [[2-0 [f 3]]]] [t [[5-0 [g 1]]]]]"},
+		{"XREAD STREAMS s missing 2-0 0", "(nil)"},
+		// $ only returns entries added later, + returns the last entry.
+		{"XREAD STREAMS s $", "(nil)"},
+		{"XREAD STREAMS s +", "[[s [[2-0 [f 3]]]]]"},
+		{"XREAD COUNT 5 STREAMS s t + +", "[[s [[2-0 [f 3]]]] [t [[5-0 [g 1]]]]]"},
+		{"XREAD STREAMS missing +", "(nil)"},
+
+		{"XREAD STREAMS s x", "ERR Invalid stream ID specified as stream command argument"},
+		{"XREAD STREAMS s t 0", "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+		{"XREAD COUNT x STREAMS s 0", "ERR value is not an integer or out of range"},
+		{"XREAD BLOCK x STREAMS s 0", "ERR timeout is not an integer or out of range"},
+		{"XREAD BLOCK -1 STREAMS s 0", "ERR timeout is negative"},
+		{"XREAD LIMIT 1 STREAMS s 0", "ERR syntax error"},
+		{"XREAD s 0", "ERR wrong number of arguments for 'xread' command"},
+	}
+	server, client := newTestServer(), newTestClient()
+	for _, line := range []string{"XADD s 1-0 f 1", "XADD s 1-1 f 2", "XADD s 2-0 f 3", "XADD t 5-0 g 1"} {
+		run(t, server, client, line)
+	}
+	for _, tt := range tests {
+		if got := show(call(server, client, tt.command)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+// blockedOn waits until n clients are blocked on key.
+func blockedOn(t *testing.T, server *types.Server, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.KV.BlockedClientsMu.RLock()
+		blocked := len(server.KV.BlockedClients[key])
+		server.KV.BlockedClientsMu.RUnlock()
+		if blocked == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients blocked on %s, want %d", blocked, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestXreadBlock(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	run(t, server, client, "XADD s 1-0 f 1")
+
+	// Readers of $ see only what is added after they block; a reader of a
+	// later ID keeps waiting until an entry passes it.
+	replies := map[string]chan string{}
+	for _, line := range []string{"XREAD BLOCK 0 STREAMS s $", "XREAD BLOCK 0 COUNT 1 STREAMS s 3-0"} {
+		reply := make(chan string, 1)
+		replies[line] = reply
+		go func() {
+			reply <- show(call(server, newTestClient(), line))
+		}()
+	}
+	blockedOn(t, server, "s", 2)
+
+	run(t, server, client, "XADD s 2-0 f 2")
+	if got := <-replies["XREAD BLOCK 0 STREAMS s $"]; got != "[[s [[2-0 [f 2]]]]]" {
+		t.Errorf("reader of $ got %s", got)
+	}
+	blockedOn(t, server, "s", 1)
+	select {
+	case got := <-replies["XREAD BLOCK 0 COUNT 1 STREAMS s 3-0"]:
+		t.Fatalf("reader of 3-0 woke with %s", got)
+	default:
+	}
+
+	run(t, server, client, "XADD s 3-0 f 3")
+	run(t, server, client, "XADD s 4-0 f 4")
+	if got := <-replies["XREAD BLOCK 0 COUNT 1 STREAMS s 3-0"]; got != "[[s [[4-0 [f 4]]]]]" {
+		t.Errorf("reader of 3-0 got %s", got)
+	}
+
+	start := time.Now()
+	if got := show(call(server, client, "XREAD BLOCK 50 STREAMS s $")); got != "(nil)" {
+		t.Errorf("XREAD BLOCK 50 = %s, want (nil)", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("XREAD BLOCK 50 returned after %v", elapsed)
+	}
+}
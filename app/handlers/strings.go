@@ -25,12 +25,33 @@ func get(val []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 	}
 
 	if value.Expires > 0 && value.Expires < time.Now().UnixMilli() {
-		kv.StringsMu.Lock()
-		delete(kv.Strings, key)
-		kv.StringsMu.Unlock()
+		expireKey(key, value.Expires, server)
 		return resp.Value{Typ: "null"}
 	}
-	return resp.Value{Typ: "string", Str: value.Str}
+	return resp.Value{Typ: "bulk", Bulk: value.Str}
+}
+
+// expireKey deletes a string whose TTL has passed, unless it was replaced
+// since it was read, and propagates the deletion as a DEL the way Redis
+// replicates expirations.
+func expireKey(key string, expires int64, server *types.Server) {
+	kv := server.KV
+	kv.StringsMu.Lock()
+	value, ok := kv.Strings[key]
+	if !ok || value.Expires != expires {
+		kv.StringsMu.Unlock()
+		return
+	}
+	kv.PreserveString(key)
+	delete(kv.Strings, key)
+	kv.SignalExpiredKey(key)
+	notifyKeyspaceEvent(server, notifyExpired, "expired", key)
+	server.IncrementDirty()
+	server.Propagate(resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "DEL"},
+		{Typ: "bulk", Bulk: key},
+	}})
+	kv.StringsMu.Unlock()
 }
 
 func set(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
@@ -43,6 +64,7 @@ func set(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 
 	var setter string // NX / XX
 	var ex, px int    // expire seconds / ms
+	var at int64      // absolute expiry in ms, from EXAT / PXAT
 	keepTTL, get := false, false
 
 	for i := 2; i < len(args); i++ {
@@ -74,14 +96,29 @@ func set(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 			} else {
 				return resp.Value{Typ: "error", Str: "ERR syntax error"}
 			}
+		case "EXAT", "PXAT":
+			if keepTTL || i+1 >= len(args) {
+				return resp.Value{Typ: "error", Str: "ERR syntax error"}
+			}
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil || n <= 0 {
+				return resp.Value{Typ: "error", Str: "ERR invalid expire time in 'set' command"}
+			}
+			if opt == "EXAT" {
+				n *= 1000
+			}
+			at = n
+			i++
 		default:
 			return resp.Value{Typ: "error", Str: "ERR syntax error"}
 		}
 	}
 
-	kv.StringsMu.RLock()
+	// The key is read and written under one lock, so that NX, XX, KEEPTTL and
+	// GET see the value the write replaces.
+	kv.StringsMu.Lock()
+	defer kv.StringsMu.Unlock()
 	oldVal, exists := kv.Strings[key]
-	kv.StringsMu.RUnlock()
 
 	switch setter {
 	case "NX":
@@ -100,21 +137,29 @@ func set(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value {
 		expiration = time.Now().Add(time.Duration(ex) * time.Second).UnixMilli()
 	} else if px > 0 {
 		expiration = time.Now().Add(time.Duration(px) * time.Millisecond).UnixMilli()
+	} else if at > 0 {
+		expiration = at
 	}
 	insert := resp.Value{Typ: "string", Str: newVal, Expires: expiration}
-	kv.StringsMu.Lock()
+	kv.PreserveString(key)
 	kv.Strings[key] = insert
-	kv.StringsMu.Unlock()
-	incrementVersion(key, server)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyString, "set", key)
 	server.IncrementDirty()
+	// The write is propagated with an absolute expiry, so that replicas and
+	// the AOF don't restart the TTL when they apply it later, and before the
+	// lock is released, so that they apply writes in the same order.
+	setCMD := []resp.Value{{Typ: "bulk", Bulk: "SET"}, args[0], args[1]}
+	if expiration > 0 {
+		setCMD = append(setCMD, resp.Value{Typ: "bulk", Bulk: "PXAT"}, resp.Value{Typ: "bulk", Bulk: strconv.FormatInt(expiration, 10)})
+	}
+	server.Propagate(resp.Value{Typ: "array", Array: setCMD})
 	if get {
 		if exists {
 			return oldVal
 		}
 		return resp.Value{Typ: "null"}
 	}
-	setCMD := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "SET"}}, args...)}
-	server.Propagate(setCMD)
 	return resp.Value{Typ: "string", Str: "OK"}
 }
 
@@ -128,6 +173,7 @@ func incr(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	kv.StringsMu.Lock()
 	defer kv.StringsMu.Unlock()
 
+	kv.PreserveString(key)
 	value, exists := kv.Strings[key]
 	if !exists || value.Str == "" {
 		value = resp.Value{Typ: "string", Str: "0"}
@@ -142,9 +188,10 @@ func incr(args []resp.Value, server *types.Server, _ *kv.ClientType) resp.Value
 	num++
 	value.Str = strconv.Itoa(num)
 	kv.Strings[key] = value
-	incrementVersion(key, server)
+	signalModifiedKey(key, server)
+	notifyKeyspaceEvent(server, notifyString, "incrby", key)
 	server.IncrementDirty()
 	cmd := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: "INCR"}}, args...)}
 	server.Propagate(cmd)
-	return resp.Value{Typ: "string", Str: value.Str}
+	return resp.Value{Typ: "integer", Num: num}
 }
@@ -10,63 +10,100 @@ import (
 	"github.com/r1i2t3/go-redis/app/writer"
 )
 
+// handleExec checks the client's watched keys and runs its queued commands.
+// The caller holds KeyspaceMu exclusively, so the check and every command
+// happen without any other client observing the keyspace in between.
 func handleExec(server *types.Server, client *kv.ClientType) resp.Value {
-	kV := server.KV
-	kV.VersionsMu.Lock()
-	for key, watchedVersion := range client.WatchedKeys {
-		currentVersion := kV.Versions[key]
-		if currentVersion != watchedVersion {
-			kV.VersionsMu.Unlock()
-			return resp.Value{Typ: "null"}
-		}
+	if server.KV.WatchFailed(client) {
+		return resp.Value{Typ: "null"}
 	}
-	kV.VersionsMu.Unlock()
-	results := make([]resp.Value, len(client.CommandQueue))
-	for i, cmd := range client.CommandQueue {
+	return runQueued(server, client, client.CommandQueue)
+}
+
+// runQueued executes a transaction body. Errors are reported in their slot;
+// the remaining commands still run. Replicas see the writes as a single
+// MULTI/EXEC block.
+func runQueued(server *types.Server, client *kv.ClientType, queue []resp.Value) resp.Value {
+	client.DenyBlocking = true
+	defer func() { client.DenyBlocking = false }()
+	server.BeginAtomicPropagation()
+	defer server.EndAtomicPropagation()
+	results := make([]resp.Value, len(queue))
+	for i, cmd := range queue {
 		command := strings.ToUpper(cmd.Array[0].Bulk)
 		args := cmd.Array[1:]
 		handler, ok := Handlers[command]
 		if !ok {
-			results[i] = resp.Value{Typ: "error", Err: "ERR unknown command in queue '" + command + "'"}
+			results[i] = resp.Value{Typ: "error", Str: "ERR unknown command '" + strings.ToLower(command) + "'"}
 			continue
 		}
-
-		results[i] = handler(args, server, client)
+		results[i] = invoke(handler, args, server, client)
 	}
 
 	return resp.Value{Typ: "array", Array: results}
 }
 
+// ExecAtomically runs a transaction received from a master or read back from
+// disk, isolated from all other clients.
+func ExecAtomically(server *types.Server, client *kv.ClientType, queue []resp.Value) resp.Value {
+	server.KV.KeyspaceMu.Lock()
+	defer server.KV.KeyspaceMu.Unlock()
+	return runQueued(server, client, queue)
+}
+
 func handleWatch(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
-	if len(args) == 0 {
-		return resp.Value{Typ: "error", Err: "ERR wrong number of arguments for 'watch' command"}
+	for _, keyVal := range args {
+		server.KV.Watch(client, keyVal.Bulk)
 	}
-	kV := server.KV
-	kV.VersionsMu.Lock()
-	defer kV.VersionsMu.Unlock()
+	return resp.Value{Typ: "string", Str: "OK"}
+}
 
-	for _, keyVal := range args {
-		key := keyVal.Bulk
-		currentVersion := kV.Versions[key]
-		client.WatchedKeys[key] = currentVersion
+func handleUnwatch(_ []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
+	if client != nil {
+		server.KV.UnwatchAll(client)
 	}
 	return resp.Value{Typ: "string", Str: "OK"}
 }
 
+// blockingDenied reports whether a blocking command must return at once
+// instead of waiting, as inside EXEC.
+func blockingDenied(client *kv.ClientType) bool {
+	return client != nil && client.DenyBlocking
+}
+
+// queueWrites reports whether a transaction contains a write command.
+func queueWrites(queue []resp.Value) bool {
+	for _, cmd := range queue {
+		if Commands[strings.ToUpper(cmd.Array[0].Bulk)].Has(CmdWrite) {
+			return true
+		}
+	}
+	return false
+}
+
+func resetTransaction(kV *kv.KV, client *kv.ClientType) {
+	client.IsInTransaction = false
+	client.TransactionDirty = false
+	client.CommandQueue = make([]resp.Value, 0)
+	kV.UnwatchAll(client)
+}
+
 func HandleTransactionCommands(command string, val resp.Value, writer *writer.Writer, client *kv.ClientType, server *types.Server) bool {
 	kV := server.KV
 	switch command {
 	case "EXEC":
-		kV.TransactionMu.Lock()
+		kV.KeyspaceMu.Lock()
 		defer func() {
-			client.IsInTransaction = false
-			client.CommandQueue = make([]resp.Value, 0)
-			client.WatchedKeys = make(map[string]uint64)
-			kV.TransactionMu.Unlock()
+			resetTransaction(kV, client)
+			kV.KeyspaceMu.Unlock()
 		}()
 
-		if len(client.CommandQueue) == 0 {
-			writer.Write(resp.Value{Typ: "error", Str: "ERR EXEC without commands in queue"})
+		if client.TransactionDirty {
+			writer.Write(resp.Value{Typ: "error", Str: "EXECABORT Transaction discarded because of previous errors."})
+			return true
+		}
+		if denied := writeDenied(server); denied != nil && queueWrites(client.CommandQueue) {
+			writer.Write(*denied)
 			return true
 		}
 		result := handleExec(server, client)
@@ -74,37 +111,70 @@ func HandleTransactionCommands(command string, val resp.Value, writer *writer.Wr
 		return true
 
 	case "DISCARD":
-		client.IsInTransaction = false
-		client.CommandQueue = make([]resp.Value, 0)
-		client.WatchedKeys = make(map[string]uint64)
+		resetTransaction(kV, client)
 		writer.Write(resp.Value{Typ: "string", Str: "OK"})
 		return true
 
-	default:
-		client.CommandQueue = append(client.CommandQueue, val)
-		kV.VersionsMu.Lock()
-		client.WatchedKeys[val.Array[1].Bulk] = kV.Versions[val.Array[1].Bulk]
-		kV.VersionsMu.Unlock()
-		writer.Write(resp.Value{Typ: "string", Str: "QUEUED"})
+	case "MULTI":
+		writer.Write(resp.Value{Typ: "error", Str: "ERR MULTI calls can not be nested"})
+		return true
+
+	case "WATCH":
+		writer.Write(resp.Value{Typ: "error", Str: "ERR WATCH inside MULTI is not allowed"})
 		return true
 	}
+
+	// Like Redis, only problems detectable without running the command are
+	// caught here; they poison the transaction so EXEC refuses to run it.
+	info, errReply := ValidateCommand(command, val.Array[1:])
+	if errReply == nil && info.Has(CmdNoMulti) {
+		errReply = &resp.Value{Typ: "error", Str: "ERR Command not allowed inside a transaction"}
+	}
+	if errReply != nil {
+		client.TransactionDirty = true
+		writer.Write(*errReply)
+		return true
+	}
+	client.CommandQueue = append(client.CommandQueue, val)
+	writer.Write(resp.Value{Typ: "string", Str: "QUEUED"})
+	return true
 }
 
 func HandleNonTransactionCommands(command string, args []resp.Value, writer *writer.Writer, client *kv.ClientType, server *types.Server) bool {
+	info, errReply := ValidateCommand(command, args)
+	if errReply != nil {
+		writer.Write(*errReply)
+		return true
+	}
+	if denied := writeDenied(server); denied != nil && info.Has(CmdWrite) {
+		writer.Write(*denied)
+		return true
+	}
+	if command == "SCRIPT" {
+		writer.Write(scriptCommand(args, server, client))
+		return true
+	}
+	if busy := scripts.busyReply(server); busy != nil {
+		writer.Write(*busy)
+		return true
+	}
 	if command == "WATCH" {
+		server.KV.KeyspaceMu.RLock()
 		result := handleWatch(args, server, client)
+		server.KV.KeyspaceMu.RUnlock()
 		writer.Write(result)
 		return true
 	}
 	if command == "MULTI" {
+		// Keys watched before MULTI stay watched until EXEC or DISCARD.
 		client.IsInTransaction = true
+		client.TransactionDirty = false
 		client.CommandQueue = make([]resp.Value, 0)
-		client.WatchedKeys = make(map[string]uint64)
 		writer.Write(resp.Value{Typ: "string", Str: "OK"})
 		return true
 	}
 	if command == "EXEC" || command == "DISCARD" {
-		writer.Write(resp.Value{Typ: "error", Str: "ERR EXEC without MULTI"})
+		writer.Write(resp.Value{Typ: "error", Str: "ERR " + command + " without MULTI"})
 		return true
 	}
 	if command == "CONFIG" {
@@ -115,15 +185,14 @@ func HandleNonTransactionCommands(command string, args []resp.Value, writer *wri
 	if command == "PSYNC" {
 		HandlePsync(args, server, client)
 	}
-	handler, ok := Handlers[command]
-	if !ok {
+	if _, ok := Handlers[command]; !ok {
 		err := writer.Write(resp.Value{Typ: "string", Str: ""})
 		if err != nil {
 			fmt.Println("Error writing response:", err)
 		}
 		return true
 	}
-	result := handler(args, server, client)
+	result := Call(command, args, server, client)
 	writer.Write(result)
 	return false
 }
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+	"github.com/r1i2t3/go-redis/app/writer"
+)
+
+// dispatch runs a command line the way the connection loop does, through
+// the transaction state machine, and returns the reply written back.
+func dispatch(t *testing.T, server *types.Server, client *kv.ClientType, line string) string {
+	t.Helper()
+	name, args := command(line)
+	val := resp.Value{Typ: "array", Array: append([]resp.Value{{Typ: "bulk", Bulk: name}}, args...)}
+	var out bytes.Buffer
+	w := writer.NewWriter(&out)
+	if client.IsInTransaction {
+		HandleTransactionCommands(name, val, w, client, server)
+	} else {
+		HandleNonTransactionCommands(name, args, w, client, server)
+	}
+	reply, err := resp.NewParser(&out).Parse()
+	if err != nil {
+		t.Fatalf("%s: reading reply: %v", line, err)
+	}
+	return show(parsedReply(reply))
+}
+
+// parsedReply maps a reply read back by the RESP parser onto the types
+// handlers return: the parser reads nil as an empty value and integers as
+// numbers.
+func parsedReply(v resp.Value) resp.Value {
+	switch v.Typ {
+	case "":
+		return resp.Value{Typ: "null"}
+	case "number":
+		v.Typ = "integer"
+	case "array":
+		items := make([]resp.Value, len(v.Array))
+		for i, item := range v.Array {
+			items[i] = parsedReply(item)
+		}
+		v.Array = items
+	}
+	return v
+}
+
+func dispatchSteps(t *testing.T, server *types.Server, client *kv.ClientType, steps []step) {
+	t.Helper()
+	for _, s := range steps {
+		if got := dispatch(t, server, client, s.command); got != s.want {
+			t.Errorf("%s = %s, want %s", s.command, got, s.want)
+		}
+	}
+}
+
+func TestCommandTable(t *testing.T) {
+	for name := range Handlers {
+		if _, ok := Commands[name]; !ok {
+			t.Errorf("%s has a handler but no command table entry", name)
+		}
+	}
+	for name, info := range Commands {
+		if info.Arity == 0 {
+			t.Errorf("%s has arity 0", name)
+		}
+		if info.Has(CmdWrite) && info.Has(CmdReadOnly) {
+			t.Errorf("%s is flagged both write and read-only", name)
+		}
+	}
+	for _, name := range []string{"BLPOP", "XREAD", "XREADGROUP"} {
+		if !Commands[name].Has(CmdBlocking) {
+			t.Errorf("%s is not flagged blocking", name)
+		}
+	}
+	for _, name := range []string{"MULTI", "EXEC", "WATCH", "SUBSCRIBE", "PSYNC"} {
+		if !Commands[name].Has(CmdNoScript) {
+			t.Errorf("%s is callable from scripts", name)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"PING", ""},
+		{"PING hello", ""},
+		{"GET a", ""},
+		{"GET", "ERR wrong number of arguments for 'get' command"},
+		{"GET a b", "ERR wrong number of arguments for 'get' command"},
+		{"INCR a b", "ERR wrong number of arguments for 'incr' command"},
+		{"SET a", "ERR wrong number of arguments for 'set' command"},
+		{"SET a 1 EX 10", ""},
+		{"XREADGROUP GROUP g c STREAMS s", "ERR wrong number of arguments for 'xreadgroup' command"},
+		{"FOO", "ERR unknown command 'foo', with args beginning with: "},
+		{"FOO a b", "ERR unknown command 'foo', with args beginning with: 'a' 'b' "},
+	}
+	for _, tt := range tests {
+		name, args := command(tt.command)
+		_, errReply := ValidateCommand(name, args)
+		got := ""
+		if errReply != nil {
+			got = show(*errReply)
+		}
+		if got != tt.want {
+			t.Errorf("%s: error %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"queued and executed", []step{
+			{"MULTI", "OK"},
+			{"SET a 1", "QUEUED"},
+			{"INCR a", "QUEUED"},
+			{"GET a", "QUEUED"},
+			{"EXEC", "[OK 2 2]"},
+			{"GET a", "2"},
+		}},
+		{"unknown command aborts", []step{
+			{"MULTI", "OK"},
+			{"SET a 1", "QUEUED"},
+			{"FOO a", "ERR unknown command 'foo', with args beginning with: 'a' "},
+			{"SET b 1", "QUEUED"},
+			{"EXEC", "EXECABORT Transaction discarded because of previous errors."},
+			{"GET a", "(nil)"},
+			{"GET b", "(nil)"},
+		}},
+		{"wrong arity aborts", []step{
+			{"MULTI", "OK"},
+			{"SET a 1", "QUEUED"},
+			{"INCR a b", "ERR wrong number of arguments for 'incr' command"},
+			{"EXEC", "EXECABORT Transaction discarded because of previous errors."},
+			{"GET a", "(nil)"},
+		}},
+		{"command not allowed in MULTI aborts", []step{
+			{"MULTI", "OK"},
+			{"PSYNC ? -1", "ERR Command not allowed inside a transaction"},
+			{"EXEC", "EXECABORT Transaction discarded because of previous errors."},
+		}},
+		// Errors while running are reported in their slot; the other
+		// commands still run.
+		{"runtime error does not abort", []step{
+			{"SET a x", "OK"},
+			{"MULTI", "OK"},
+			{"INCR a", "QUEUED"},
+			{"SET b 1", "QUEUED"},
+			{"EXEC", "[ERR value is not an integer or out of range OK]"},
+			{"GET b", "1"},
+		}},
+		// Blocking commands behave as if their timeout expired.
+		{"blocking commands do not block", []step{
+			{"MULTI", "OK"},
+			{"BLPOP l 0", "QUEUED"},
+			{"XREAD BLOCK 0 STREAMS s $", "QUEUED"},
+			{"EXEC", "[(nil) (nil)]"},
+		}},
+		{"discard", []step{
+			{"MULTI", "OK"},
+			{"SET a 1", "QUEUED"},
+			{"DISCARD", "OK"},
+			{"GET a", "(nil)"},
+			{"DISCARD", "ERR DISCARD without MULTI"},
+		}},
+		{"misplaced commands", []step{
+			{"EXEC", "ERR EXEC without MULTI"},
+			{"MULTI", "OK"},
+			{"MULTI", "ERR MULTI calls can not be nested"},
+			{"WATCH a", "ERR WATCH inside MULTI is not allowed"},
+			{"EXEC", "[]"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newTestServer(), newTestClient()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				dispatchSteps(t, server, client, tt.steps)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("transaction blocked")
+			}
+			if client.IsInTransaction || len(client.CommandQueue) != 0 {
+				t.Errorf("transaction state left behind")
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server, client, other := newTestServer(), newTestClient(), newTestClient()
+	dispatchSteps(t, server, client, []step{
+		{"WATCH a", "OK"},
+		{"MULTI", "OK"},
+		{"SET b 1", "QUEUED"},
+	})
+	dispatch(t, server, other, "SET a 1")
+	dispatchSteps(t, server, client, []step{
+		{"EXEC", "(nil)"},
+		{"GET b", "(nil)"},
+
+		// EXEC unwatches everything, whatever its outcome.
+		{"MULTI", "OK"},
+		{"SET b 1", "QUEUED"},
+		{"EXEC", "[OK]"},
+
+		{"WATCH a", "OK"},
+		{"UNWATCH", "OK"},
+	})
+	dispatch(t, server, other, "SET a 2")
+	dispatchSteps(t, server, client, []step{
+		{"MULTI", "OK"},
+		{"SET b 2", "QUEUED"},
+		{"EXEC", "[OK]"},
+		{"GET b", "2"},
+
+		// DISCARD unwatches too.
+		{"WATCH a", "OK"},
+		{"MULTI", "OK"},
+		{"DISCARD", "OK"},
+	})
+	dispatch(t, server, other, "SET a 3")
+	dispatchSteps(t, server, client, []step{
+		{"MULTI", "OK"},
+		{"SET b 3", "QUEUED"},
+		{"EXEC", "[OK]"},
+	})
+}
+
+// TestExecPropagation checks that replicas get a transaction's writes as one
+// MULTI/EXEC block, and that writes from other clients running at the same
+// time are never propagated inside it.
+func TestExecPropagation(t *testing.T) {
+	server, client := newTestServer(), newTestClient()
+	replica := addTestReplica(server)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		other := newTestClient()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			call(server, other, fmt.Sprintf("SET other %d", i))
+		}
+	}()
+	// Each transaction is long enough for the other client's writes to
+	// land while it runs, were it not isolated.
+	for i := 0; i < 100; i++ {
+		dispatchSteps(t, server, client, []step{{"MULTI", "OK"}, {"SET a 1", "QUEUED"}})
+		for j := 0; j < 50; j++ {
+			dispatchSteps(t, server, client, []step{{"INCR b", "QUEUED"}})
+		}
+		reply := dispatch(t, server, client, "EXEC")
+		if !strings.HasPrefix(reply, "[OK ") {
+			t.Fatalf("EXEC = %s", reply)
+		}
+	}
+	close(stop)
+	<-done
+
+	lines := replica.commands()
+	blocks := 0
+	for i := 0; i < len(lines); i++ {
+		switch {
+		case strings.HasPrefix(lines[i], "SET other "):
+		case lines[i] == "MULTI":
+			want := append([]string{"MULTI", "SET a 1"}, slices.Repeat([]string{"INCR b"}, 50)...)
+			want = append(want, "EXEC")
+			if got := lines[i:min(i+len(want), len(lines))]; !slices.Equal(got, want) {
+				t.Fatalf("transaction propagated as %q", got)
+			}
+			blocks++
+			i += len(want) - 1
+		default:
+			t.Fatalf("%q propagated outside a transaction", lines[i])
+		}
+	}
+	if blocks != 100 {
+		t.Errorf("propagated %d transactions, want 100", blocks)
+	}
+
+	// A transaction with a single write is propagated without the wrapper.
+	dispatchSteps(t, server, client, []step{
+		{"MULTI", "OK"},
+		{"GET a", "QUEUED"},
+		{"SET a 2", "QUEUED"},
+		{"EXEC", "[1 OK]"},
+	})
+	if got := replica.commands(); len(got) != 1 || got[0] != "SET a 2" {
+		t.Errorf("propagated %q, want a bare SET", got)
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import "testing"
+
+// TestWatchInvalidation runs each command against the watched key k after
+// the setup, from another client, and checks whether the watcher's EXEC
+// would fail.
+func TestWatchInvalidation(t *testing.T) {
+	tests := []struct {
+		setup   []string
+		command string
+		dirty   bool
+	}{
+		// keyspace
+		{[]string{"SET k v"}, "DEL k", true},
+		{nil, "DEL k", false},
+		{[]string{"SET other v"}, "DEL other", false},
+		{[]string{"SET other v"}, "FLUSHALL", true},
+
+		// strings
+		{nil, "SET k v", true},
+		{[]string{"SET k v"}, "SET k v", true},
+		{[]string{"SET k v"}, "SET k w NX", false},
+		{nil, "SET k v PX 100000", true},
+		{nil, "INCR k", true},
+		{[]string{"SET k v"}, "GET k", false},
+
+		// lists
+		{nil, "RPUSH k a", true},
+		{nil, "LPUSH k a", true},
+		{[]string{"RPUSH k a b"}, "LPOP k", true},
+		{[]string{"RPUSH k a b"}, "RPOP k", true},
+		{[]string{"RPUSH k a"}, "BLPOP k 0", true},
+		{nil, "LPOP k", false},
+		{[]string{"RPUSH k a"}, "LRANGE k 0 -1", false},
+
+		// sets
+		{nil, "SADD k a", true},
+		{[]string{"SADD k a"}, "SADD k b", true},
+		{[]string{"SADD k a"}, "SADD k a", false},
+		{[]string{"SADD k a b"}, "SREM k a", true},
+		{[]string{"SADD k a"}, "SREM k a", true},
+		{[]string{"SADD k a"}, "SREM k b", false},
+		{nil, "SREM k a", false},
+		{[]string{"SADD k a"}, "SMEMBERS k", false},
+
+		// hashes
+		{nil, "HSET k f v", true},
+		{[]string{"HSET k f v"}, "HSET k f w", true},
+		{[]string{"HSET k f v g w"}, "HDEL k f", true},
+		{[]string{"HSET k f v"}, "HDEL k g", false},
+		{[]string{"HSET k f v"}, "HGET k f", false},
+
+		// sorted sets
+		{nil, "ZADD k 1 a", true},
+		{[]string{"ZADD k 1 a"}, "ZADD k 1 a", false},
+		{[]string{"ZADD k 1 a"}, "ZADD k NX 2 a", false},
+		{[]string{"ZADD k 1 a"}, "ZINCRBY k 1 a", true},
+		{[]string{"ZADD k 1 a 2 b"}, "ZREM k a", true},
+		{[]string{"ZADD k 1 a"}, "ZREM k b", false},
+		{[]string{"ZADD k 1 a 2 b"}, "ZPOPMIN k", true},
+		{[]string{"ZADD k 1 a 2 b"}, "ZPOPMAX k", true},
+		{nil, "ZPOPMIN k", false},
+		{[]string{"ZADD k 1 a 2 b"}, "ZMPOP 1 k MIN", true},
+		{[]string{"ZADD k 1 a 2 b"}, "ZREMRANGEBYRANK k 0 0", true},
+		{[]string{"ZADD k 1 a 2 b"}, "ZREMRANGEBYSCORE k 1 1", true},
+		{[]string{"ZADD k 0 a 0 b"}, "ZREMRANGEBYLEX k [a [a", true},
+		{[]string{"ZADD k 1 a"}, "ZREMRANGEBYSCORE k 5 6", false},
+		{[]string{"ZADD src 1 a"}, "ZRANGESTORE k src 0 -1", true},
+		{[]string{"ZADD src 1 a"}, "ZUNIONSTORE k 1 src", true},
+		{[]string{"ZADD src 1 a"}, "ZINTERSTORE k 1 src", true},
+		{[]string{"ZADD src 1 a"}, "ZDIFFSTORE k 1 src", true},
+		{[]string{"ZADD k 1 a"}, "ZRANGE k 0 -1", false},
+
+		// streams
+		{nil, "XADD k 1-1 f v", true},
+		{[]string{"XADD k 1-1 f v", "XADD k 1-2 f v"}, "XDEL k 1-1", true},
+		{[]string{"XADD k 1-1 f v"}, "XDEL k 9-9", false},
+		{[]string{"XADD k 1-1 f v", "XADD k 1-2 f v"}, "XTRIM k MAXLEN 1", true},
+		{[]string{"XADD k 1-1 f v"}, "XTRIM k MAXLEN 5", false},
+		{[]string{"XADD k 1-1 f v"}, "XSETID k 5-0", true},
+		{[]string{"XADD k 1-1 f v"}, "XGROUP CREATE k g 0", true},
+		{[]string{"XADD k 1-1 f v", "XGROUP CREATE k g 0"}, "XGROUP DESTROY k g", true},
+		{[]string{"XADD k 1-1 f v", "XGROUP CREATE k g 0"}, "XREADGROUP GROUP g c STREAMS k >", true},
+		{[]string{"XADD k 1-1 f v", "XGROUP CREATE k g 0", "XREADGROUP GROUP g c STREAMS k >"}, "XACK k g 1-1", true},
+		{[]string{"XADD k 1-1 f v", "XGROUP CREATE k g 0", "XREADGROUP GROUP g c STREAMS k >"}, "XCLAIM k g d 0 1-1", true},
+		{[]string{"XADD k 1-1 f v", "XGROUP CREATE k g 0", "XREADGROUP GROUP g c STREAMS k >"}, "XAUTOCLAIM k g d 0 0", true},
+		{[]string{"XADD k 1-1 f v"}, "XRANGE k - +", false},
+	}
+	for _, tt := range tests {
+		name := tt.command
+		if len(tt.setup) > 0 {
+			name = tt.setup[len(tt.setup)-1] + " then " + name
+		}
+		t.Run(name, func(t *testing.T) {
+			server := newTestServer()
+			other := newTestClient()
+			for _, line := range tt.setup {
+				run(t, server, other, line)
+			}
+			watcher := newTestClient()
+			server.KV.Watch(watcher, "k")
+			run(t, server, other, tt.command)
+			if got := server.KV.WatchFailed(watcher); got != tt.dirty {
+				t.Errorf("EXEC would fail = %v, want %v", got, tt.dirty)
+			}
+		})
+	}
+}
+
+func TestUnwatchForgetsKeys(t *testing.T) {
+	server := newTestServer()
+	watcher, other := newTestClient(), newTestClient()
+	server.KV.Watch(watcher, "k")
+	run(t, server, watcher, "UNWATCH")
+	run(t, server, other, "SET k v")
+	if server.KV.WatchFailed(watcher) {
+		t.Errorf("EXEC would fail after UNWATCH")
+	}
+	if len(server.KV.Watchers) != 0 {
+		t.Errorf("%d keys left in the watch registry", len(server.KV.Watchers))
+	}
+}
@@ -0,0 +1,49 @@
+package kv
+
+import (
+	"crypto/sha1"
+	"strconv"
+)
+
+// MixDigest folds s into digest so that the result depends on the order
+// things were mixed in, as for list elements.
+func MixDigest(digest *[20]byte, s string) {
+	h := sha1.New()
+	h.Write(digest[:])
+	h.Write([]byte(s))
+	copy(digest[:], h.Sum(nil))
+}
+
+// XorDigest folds s into digest independently of order, as for set members.
+func XorDigest(digest *[20]byte, s string) {
+	sum := sha1.Sum([]byte(s))
+	for i := range digest {
+		digest[i] ^= sum[i]
+	}
+}
+
+// Digest is handed to a module type's Digest callback. Elements added
+// between two EndSequence calls form an ordered sequence; the sequences
+// themselves are combined regardless of order. A list is one sequence, a
+// hash is one sequence per field-value pair.
+type Digest struct {
+	o, x [20]byte
+}
+
+func (d *Digest) AddString(s string) {
+	MixDigest(&d.o, s)
+}
+
+func (d *Digest) AddInt(n int64) {
+	MixDigest(&d.o, strconv.FormatInt(n, 10))
+}
+
+func (d *Digest) EndSequence() {
+	XorDigest(&d.x, string(d.o[:]))
+	d.o = [20]byte{}
+}
+
+// Sum returns the digest of every completed sequence.
+func (d *Digest) Sum() [20]byte {
+	return d.x
+}
@@ -0,0 +1,70 @@
+package kv
+
+// Keyspace event classes, matching the classes of Redis'
+// notify-keyspace-events. Subscribers pick the classes they want with a mask.
+const (
+	NotifyGeneric = 1 << iota
+	NotifyString
+	NotifyList
+	NotifySet
+	NotifyHash
+	NotifyZSet
+	NotifyExpired
+	NotifyStream
+	NotifyModule
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZSet | NotifyExpired | NotifyStream | NotifyModule
+)
+
+// KeyspaceEvent describes one change to a key, such as an "lpush" of class
+// NotifyList.
+type KeyspaceEvent struct {
+	Class int
+	Event string
+	Key   string
+}
+
+type EventSubscriber struct {
+	Mask    int
+	Handler func(KeyspaceEvent)
+}
+
+// SubscribeKeyspaceEvents registers handler for the events whose class is in
+// mask. Subscribers are expected to be registered at startup.
+func (kv *KV) SubscribeKeyspaceEvents(mask int, handler func(KeyspaceEvent)) {
+	kv.EventsMu.Lock()
+	defer kv.EventsMu.Unlock()
+	kv.EventSubscribers = append(kv.EventSubscribers, EventSubscriber{Mask: mask, Handler: handler})
+}
+
+// NotifyKeyspaceEvent records an event for delivery by DispatchKeyspaceEvents.
+// Handlers call it while holding their type's lock, so subscribers can't be
+// run from here. Events nobody subscribed to are dropped at once.
+func (kv *KV) NotifyKeyspaceEvent(class int, event, key string) {
+	kv.EventsMu.Lock()
+	defer kv.EventsMu.Unlock()
+	for _, sub := range kv.EventSubscribers {
+		if sub.Mask&class != 0 {
+			kv.PendingEvents = append(kv.PendingEvents, KeyspaceEvent{Class: class, Event: event, Key: key})
+			return
+		}
+	}
+}
+
+// DispatchKeyspaceEvents delivers the pending events to their subscribers,
+// in the order they happened. Events raised by the subscribers themselves are
+// delivered by a later dispatch.
+func (kv *KV) DispatchKeyspaceEvents() {
+	kv.EventsMu.Lock()
+	events := kv.PendingEvents
+	kv.PendingEvents = nil
+	subscribers := kv.EventSubscribers
+	kv.EventsMu.Unlock()
+	for _, event := range events {
+		for _, sub := range subscribers {
+			if sub.Mask&event.Class != 0 {
+				sub.Handler(event)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/r1i2t3/go-redis/app/resp"
@@ -13,7 +14,9 @@ type BlockedClient struct {
 	Ch       chan bool
 	Keys     []string
 	Deadline time.Time
-	Context  map[string]string
+	// StreamIDs holds, per stream key, the ID an XREAD is waiting to see
+	// exceeded. Clients without an entry for a key wake on any change to it.
+	StreamIDs map[string]StreamId
 }
 
 type StreamId struct {
@@ -21,36 +24,75 @@ type StreamId struct {
 	Sequence  uint64
 }
 
+// StreamField is one field-value pair of a stream entry. Entries keep their
+// fields in the order they were added.
+type StreamField struct {
+	Name  string
+	Value string
+}
+
 type StreamEntry struct {
 	ID     StreamId
-	Fields map[string]resp.Value
+	Fields []StreamField
+}
+
+// PendingEntry is a message delivered to a consumer but not yet
+// acknowledged. The same value is shared by the group PEL and the owning
+// consumer's PEL.
+type PendingEntry struct {
+	ID            StreamId
+	Consumer      string
+	DeliveryTime  int64
+	DeliveryCount uint64
 }
 
 type Consumer struct {
-	Name   string
-	LastID string
+	Name       string
+	SeenTime   int64
+	ActiveTime int64
+	Pending    map[StreamId]*PendingEntry
 }
 
 type ConsumerGroup struct {
-	Name      string
-	Consumers map[string]*Consumer
-	Pending   map[string]StreamEntry
+	Name        string
+	LastID      StreamId
+	EntriesRead int64
+	Consumers   map[string]*Consumer
+	Pending     map[StreamId]*PendingEntry
+	// MaxDeliveries, when non-zero, is how many times an entry may be
+	// delivered before it is moved to the DeadLetterKey stream.
+	MaxDeliveries uint64
+	DeadLetterKey string
 }
 
 type Stream struct {
-	Entries         []StreamEntry
-	Groups          map[string]*ConsumerGroup
-	LastGeneratedID []resp.Value
+	// nodes holds the entries in ID order, indexed by each node's master ID.
+	nodes        []*streamNode
+	length       int
+	Groups       map[string]*ConsumerGroup
+	LastID       StreamId
+	EntriesAdded uint64
+	MaxDeletedID StreamId
 }
 
 type ClientType struct {
 	Conn            net.Conn
 	IsInTransaction bool
-	CommandQueue    []resp.Value
-	WatchedKeys     map[string]uint64
-	IsSubscribed    bool
-	Subscriptions   map[string]bool
-	MessageChan     chan resp.Value
+	// TransactionDirty is set when a command failed to queue; EXEC then
+	// aborts the whole transaction.
+	TransactionDirty bool
+	// DenyBlocking makes blocking commands return as if they timed out, as
+	// they must while a transaction executes.
+	DenyBlocking bool
+	CommandQueue []resp.Value
+	// WatchedKeys holds the keys WATCHed by the client, each mapped to
+	// whether it was already expired when watched.
+	WatchedKeys map[string]bool
+	// WatchDirty is set once a watched key changes; EXEC then fails.
+	WatchDirty    bool
+	IsSubscribed  bool
+	Subscriptions map[string]bool
+	MessageChan   chan resp.Value
 }
 
 type KV struct {
@@ -66,20 +108,40 @@ type KV struct {
 	Streams   map[string]*Stream
 	StreamsMu sync.RWMutex
 
-	Sets   map[string]map[*resp.Value]struct{}
+	Sets   map[string]map[string]struct{}
 	SetsMu sync.RWMutex
 
-	Sorteds   map[string]map[string]float64
+	Sorteds   map[string]*SortedSet
 	SortedsMu sync.RWMutex
 
+	// Modules holds the values of types registered by modules.
+	Modules   map[string]*ModuleValue
+	ModulesMu sync.RWMutex
+
 	BlockedClientsMu sync.RWMutex
 	BlockedClients   map[string][]*BlockedClient
 
-	Versions      map[string]uint64
-	VersionsMu    sync.Mutex
-	TransactionMu sync.Mutex
-	Clients       map[string]*ClientType
-	ClientsMu     sync.Mutex
+	// Watchers maps each WATCHed key to the clients watching it. A key is
+	// only present while someone watches it.
+	Watchers   map[string]map[*ClientType]struct{}
+	WatchersMu sync.Mutex
+	// PendingEvents queues keyspace events until DispatchKeyspaceEvents
+	// hands them to EventSubscribers.
+	EventSubscribers []EventSubscriber
+	PendingEvents    []KeyspaceEvent
+	EventsMu         sync.Mutex
+	// KeyspaceMu isolates EXEC and scripts from everything else: ordinary
+	// commands hold it for reading, so they still run concurrently under the
+	// per-type locks, while EXEC holds it for writing. Blocked commands drop
+	// their hold while they wait.
+	KeyspaceMu sync.RWMutex
+	Clients    map[string]*ClientType
+	ClientsMu  sync.Mutex
+
+	// snapshots holds the snapshots being written, which writers keep the
+	// values they change for. snapshotsMu serializes replacing the slice.
+	snapshots   atomic.Pointer[[]*Snapshot]
+	snapshotsMu sync.Mutex
 }
 
 func NewKv() *KV {
@@ -89,12 +151,13 @@ func NewKv() *KV {
 		Hashes:         map[string]map[string]resp.Value{},
 		Lists:          map[string][]resp.Value{},
 		Streams:        map[string]*Stream{},
-		Sorteds:        map[string]map[string]float64{},
+		Sorteds:        map[string]*SortedSet{},
+		Modules:        map[string]*ModuleValue{},
 		Clients:        map[string]*ClientType{},
 		BlockedClients: map[string][]*BlockedClient{},
-		Sets:           map[string]map[*resp.Value]struct{}{},
+		Sets:           map[string]map[string]struct{}{},
 		SetsMu:         sync.RWMutex{},
-		Versions:       map[string]uint64{},
+		Watchers:       map[string]map[*ClientType]struct{}{},
 	}
 }
 
@@ -153,6 +216,23 @@ func (kv *KV) WakeUpClients(key string, wakeAll bool) {
 	}
 }
 
+// WakeUpStreamClients signals the clients blocked on key after an entry with
+// the given ID was added, skipping readers that are waiting for a later ID so
+// they don't all contend for StreamsMu just to block again.
+func (kv *KV) WakeUpStreamClients(key string, id StreamId) {
+	kv.BlockedClientsMu.RLock()
+	defer kv.BlockedClientsMu.RUnlock()
+	for _, bc := range kv.BlockedClients[key] {
+		if after, ok := bc.StreamIDs[key]; ok && id.Compare(after) <= 0 {
+			continue
+		}
+		select {
+		case bc.Ch <- true:
+		default:
+		}
+	}
+}
+
 func (id StreamId) IsGreaterThan(other StreamId) bool {
 	if id.Timestamp >= other.Timestamp {
 		return true
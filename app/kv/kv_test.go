@@ -0,0 +1,46 @@
+package kv
+
+import "testing"
+
+func TestWakeUpStreamClients(t *testing.T) {
+	kv := NewKv()
+	names := []string{"early", "late", "any"}
+	clients := map[string]*BlockedClient{
+		"early": {StreamIDs: map[string]StreamId{"s": {Timestamp: 5}}},
+		"late":  {StreamIDs: map[string]StreamId{"s": {Timestamp: 9}}},
+		// A client with no ID for the key, like XREADGROUP, wakes on any
+		// entry.
+		"any": {},
+	}
+	for _, bc := range clients {
+		bc.Ch = make(chan bool, 1)
+		bc.Keys = []string{"s", "t"}
+		kv.RegisterBlockedClient(bc)
+	}
+
+	tests := []struct {
+		key   string
+		id    StreamId
+		woken string
+	}{
+		{"s", StreamId{Timestamp: 5}, "any "},
+		{"s", StreamId{Timestamp: 5, Sequence: 1}, "early any "},
+		{"s", StreamId{Timestamp: 9, Sequence: 1}, "early late any "},
+		{"t", StreamId{Timestamp: 1}, "early late any "},
+		{"u", StreamId{Timestamp: 1}, ""},
+	}
+	for _, tt := range tests {
+		kv.WakeUpStreamClients(tt.key, tt.id)
+		woken := ""
+		for _, name := range names {
+			select {
+			case <-clients[name].Ch:
+				woken += name + " "
+			default:
+			}
+		}
+		if woken != tt.woken {
+			t.Errorf("adding %s to %s woke %q, want %q", tt.id.ToString(), tt.key, woken, tt.woken)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ModuleWriter is what a module type's RDBSave callback writes its value
+// with. Errors are kept by the writer and reported once the callback returns.
+type ModuleWriter interface {
+	SaveUnsigned(n uint64)
+	SaveSigned(n int64)
+	SaveDouble(f float64)
+	SaveString(s string)
+}
+
+// ModuleReader reads back, in the same order, what RDBSave wrote. After an
+// error every Load returns a zero value and the load fails.
+type ModuleReader interface {
+	LoadUnsigned() uint64
+	LoadSigned() int64
+	LoadDouble() float64
+	LoadString() string
+}
+
+// ModuleType is a value type registered by a module. The server can't look
+// inside its values, so the callbacks persist and digest them.
+type ModuleType struct {
+	// Name identifies the type in RDB files and TYPE replies.
+	Name string
+	// EncVer, from 0 to 1023, is the encoding version written with every
+	// value; RDBLoad receives the version the value was saved with.
+	EncVer  int
+	RDBSave func(w ModuleWriter, value any)
+	RDBLoad func(r ModuleReader, encver int) (any, error)
+	// Digest feeds the value to DEBUG DIGEST. It may be nil.
+	Digest func(d *Digest, value any)
+	// Copy returns a copy of value that later changes to value don't affect,
+	// which is how snapshots capture it. Without it, the value is saved with
+	// RDBSave and loaded back with RDBLoad.
+	Copy func(value any) any
+	// AOFRewrite emits the commands that recreate the value at key when the
+	// AOF is rewritten. Without it, rewriting fails while such a value exists.
+	AOFRewrite func(emit func(command string, args ...string), key string, value any)
+}
+
+// ModuleValue is a key's value of a module type.
+type ModuleValue struct {
+	Type  *ModuleType
+	Value any
+}
+
+// copy returns a copy of mv for a snapshot.
+func (mv *ModuleValue) copy() (*ModuleValue, error) {
+	if mv.Type.Copy != nil {
+		return &ModuleValue{Type: mv.Type, Value: mv.Type.Copy(mv.Value)}, nil
+	}
+	rec := &moduleRecord{}
+	mv.Type.RDBSave(rec, mv.Value)
+	value, err := mv.Type.RDBLoad(rec, mv.Type.EncVer)
+	if err == nil {
+		err = rec.err
+	}
+	if err == nil && rec.pos != len(rec.items) {
+		err = fmt.Errorf("RDBLoad read %d of the %d items RDBSave wrote", rec.pos, len(rec.items))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("module type %s: %w", mv.Type.Name, err)
+	}
+	return &ModuleValue{Type: mv.Type, Value: value}, nil
+}
+
+// moduleRecord keeps what RDBSave writes in memory for RDBLoad to read back.
+type moduleRecord struct {
+	items []any
+	pos   int
+	err   error
+}
+
+func (r *moduleRecord) SaveUnsigned(n uint64) { r.items = append(r.items, n) }
+func (r *moduleRecord) SaveSigned(n int64)    { r.items = append(r.items, n) }
+func (r *moduleRecord) SaveDouble(f float64)  { r.items = append(r.items, f) }
+func (r *moduleRecord) SaveString(s string)   { r.items = append(r.items, s) }
+
+func loadRecorded[T any](r *moduleRecord) T {
+	var item T
+	if r.err != nil {
+		return item
+	}
+	if r.pos == len(r.items) {
+		r.err = fmt.Errorf("RDBLoad read past the %d items RDBSave wrote", len(r.items))
+		return item
+	}
+	item, ok := r.items[r.pos].(T)
+	if !ok {
+		r.err = fmt.Errorf("RDBLoad read item %d as %T, but RDBSave wrote %T", r.pos, item, r.items[r.pos])
+		return item
+	}
+	r.pos++
+	return item
+}
+
+func (r *moduleRecord) LoadUnsigned() uint64 { return loadRecorded[uint64](r) }
+func (r *moduleRecord) LoadSigned() int64    { return loadRecorded[int64](r) }
+func (r *moduleRecord) LoadDouble() float64  { return loadRecorded[float64](r) }
+func (r *moduleRecord) LoadString() string   { return loadRecorded[string](r) }
+
+var (
+	moduleTypes   = map[string]*ModuleType{}
+	moduleTypesMu sync.RWMutex
+)
+
+// RegisterModuleType makes t known to the RDB loader. Type names are unique.
+func RegisterModuleType(t *ModuleType) error {
+	moduleTypesMu.Lock()
+	defer moduleTypesMu.Unlock()
+	if _, ok := moduleTypes[t.Name]; ok {
+		return fmt.Errorf("module type %q is already registered", t.Name)
+	}
+	moduleTypes[t.Name] = t
+	return nil
+}
+
+func LookupModuleType(name string) (*ModuleType, bool) {
+	moduleTypesMu.RLock()
+	defer moduleTypesMu.RUnlock()
+	t, ok := moduleTypes[name]
+	return t, ok
+}
@@ -0,0 +1,309 @@
+package kv
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// Snapshot is a copy-on-write view of the dataset as it was when taken, for
+// BGSAVE, replica syncs and AOF rewrites to serialize while writes go on.
+// Nothing is copied up front. Instead, until Release, every write to a key
+// first hands the key's current value to the snapshot, and writers about to
+// change a value in place change a copy instead, so the snapshot's version
+// is never touched. Keys nobody writes are shared with the live dataset.
+type Snapshot struct {
+	kv      *KV
+	strings snapshotPart[resp.Value]
+	lists   snapshotPart[[]resp.Value]
+	hashes  snapshotPart[map[string]resp.Value]
+	sets    snapshotPart[map[string]struct{}]
+	sorteds snapshotPart[*SortedSet]
+	streams snapshotPart[*Stream]
+	modules snapshotPart[*ModuleValue]
+}
+
+// snapshotPart is what a snapshot keeps of one type's keys.
+type snapshotPart[T any] struct {
+	// saved maps each key written since the snapshot to its value then.
+	saved map[string]savedValue[T]
+	// flushed is the type's map as FLUSHALL left it. Once set, the live map
+	// has nothing to do with the snapshot, which reads flushed instead.
+	flushed map[string]T
+}
+
+// savedValue is a key's value when the snapshot was taken, with ok false if
+// the key didn't exist.
+type savedValue[T any] struct {
+	value T
+	ok    bool
+}
+
+// Snapshot starts a snapshot of the dataset. The caller holds KeyspaceMu
+// exclusively, so the snapshot is of a single instant, between two commands
+// or transactions; that is all the exclusive lock is needed for. The caller
+// must Release the snapshot once it's written.
+func (kv *KV) Snapshot() *Snapshot {
+	snap := &Snapshot{kv: kv}
+	snap.strings.saved = map[string]savedValue[resp.Value]{}
+	snap.lists.saved = map[string]savedValue[[]resp.Value]{}
+	snap.hashes.saved = map[string]savedValue[map[string]resp.Value]{}
+	snap.sets.saved = map[string]savedValue[map[string]struct{}]{}
+	snap.sorteds.saved = map[string]savedValue[*SortedSet]{}
+	snap.streams.saved = map[string]savedValue[*Stream]{}
+	snap.modules.saved = map[string]savedValue[*ModuleValue]{}
+
+	kv.snapshotsMu.Lock()
+	defer kv.snapshotsMu.Unlock()
+	var active []*Snapshot
+	if p := kv.snapshots.Load(); p != nil {
+		active = slices.Clone(*p)
+	}
+	active = append(active, snap)
+	kv.snapshots.Store(&active)
+	return snap
+}
+
+// Release ends the snapshot, so writers stop keeping values for it.
+func (s *Snapshot) Release() {
+	kv := s.kv
+	kv.snapshotsMu.Lock()
+	defer kv.snapshotsMu.Unlock()
+	p := kv.snapshots.Load()
+	if p == nil {
+		return
+	}
+	active := slices.DeleteFunc(slices.Clone(*p), func(other *Snapshot) bool { return other == s })
+	if len(active) == 0 {
+		kv.snapshots.Store(nil)
+		return
+	}
+	kv.snapshots.Store(&active)
+}
+
+// View returns the dataset as of the snapshot, to be serialized. Its values
+// are shared with the live dataset, so it must not be changed, and must not
+// be used after Release.
+func (s *Snapshot) View() *KV {
+	kv, view := s.kv, NewKv()
+
+	kv.StringsMu.RLock()
+	view.Strings = s.strings.view(kv.Strings)
+	kv.StringsMu.RUnlock()
+
+	kv.ListsMu.RLock()
+	view.Lists = s.lists.view(kv.Lists)
+	kv.ListsMu.RUnlock()
+
+	kv.HashesMu.RLock()
+	view.Hashes = s.hashes.view(kv.Hashes)
+	kv.HashesMu.RUnlock()
+
+	kv.SetsMu.RLock()
+	view.Sets = s.sets.view(kv.Sets)
+	kv.SetsMu.RUnlock()
+
+	kv.SortedsMu.RLock()
+	view.Sorteds = s.sorteds.view(kv.Sorteds)
+	kv.SortedsMu.RUnlock()
+
+	kv.StreamsMu.RLock()
+	view.Streams = s.streams.view(kv.Streams)
+	kv.StreamsMu.RUnlock()
+
+	kv.ModulesMu.RLock()
+	view.Modules = s.modules.view(kv.Modules)
+	kv.ModulesMu.RUnlock()
+	return view
+}
+
+// view merges the saved values over live, the type's live map.
+func (p *snapshotPart[T]) view(live map[string]T) map[string]T {
+	if p.flushed != nil {
+		live = p.flushed
+	}
+	view := make(map[string]T, len(live))
+	for key, value := range live {
+		if _, written := p.saved[key]; !written {
+			view[key] = value
+		}
+	}
+	for key, saved := range p.saved {
+		if saved.ok {
+			view[key] = saved.value
+		}
+	}
+	return view
+}
+
+// preserve hands the value at key in live, the map part's type is kept in,
+// to the active snapshots that haven't seen the key written yet. It reports
+// whether any of them now shares the value, which must then not be changed
+// in place. The caller holds the type's lock for writing.
+func preserve[T any](kv *KV, part func(*Snapshot) *snapshotPart[T], live map[string]T, key string) bool {
+	active := kv.snapshots.Load()
+	if active == nil {
+		return false
+	}
+	value, ok := live[key]
+	shared := false
+	for _, snap := range *active {
+		p := part(snap)
+		if p.flushed != nil {
+			continue
+		}
+		if _, written := p.saved[key]; written {
+			continue
+		}
+		p.saved[key] = savedValue[T]{value, ok}
+		shared = shared || ok
+	}
+	return shared
+}
+
+// isShared reports whether preserve would hand an existing value at key to
+// any snapshot.
+func isShared[T any](kv *KV, part func(*Snapshot) *snapshotPart[T], key string) bool {
+	active := kv.snapshots.Load()
+	if active == nil {
+		return false
+	}
+	for _, snap := range *active {
+		p := part(snap)
+		if _, written := p.saved[key]; p.flushed == nil && !written {
+			return true
+		}
+	}
+	return false
+}
+
+// mutable returns the value at key in live for the caller to change in
+// place, first replacing it with a copy made by clone if a snapshot shares
+// it. The caller holds the type's lock for writing.
+func mutable[T any](kv *KV, part func(*Snapshot) *snapshotPart[T], live map[string]T, key string, clone func(T) T) (T, bool) {
+	shared := preserve(kv, part, live, key)
+	value, ok := live[key]
+	if shared {
+		value = clone(value)
+		live[key] = value
+	}
+	return value, ok
+}
+
+func stringsPart(s *Snapshot) *snapshotPart[resp.Value]           { return &s.strings }
+func listsPart(s *Snapshot) *snapshotPart[[]resp.Value]           { return &s.lists }
+func hashesPart(s *Snapshot) *snapshotPart[map[string]resp.Value] { return &s.hashes }
+func setsPart(s *Snapshot) *snapshotPart[map[string]struct{}]     { return &s.sets }
+func sortedsPart(s *Snapshot) *snapshotPart[*SortedSet]           { return &s.sorteds }
+func streamsPart(s *Snapshot) *snapshotPart[*Stream]              { return &s.streams }
+func modulesPart(s *Snapshot) *snapshotPart[*ModuleValue]         { return &s.modules }
+
+// The Preserve methods must be called before the value at key is replaced or
+// deleted, or a key is created there, holding the type's lock for writing.
+// The Mutable methods return the value at key, if any, to be changed in
+// place, under the same lock; they cover creating the key too.
+
+func (kv *KV) PreserveString(key string) {
+	preserve(kv, stringsPart, kv.Strings, key)
+}
+
+func (kv *KV) PreserveList(key string) {
+	preserve(kv, listsPart, kv.Lists, key)
+}
+
+// MutableList is needed before appending to a list, which may write into
+// the array a snapshot reads. Popping only reslices and needs PreserveList.
+func (kv *KV) MutableList(key string) ([]resp.Value, bool) {
+	return mutable(kv, listsPart, kv.Lists, key, slices.Clone[[]resp.Value])
+}
+
+func (kv *KV) PreserveHash(key string) {
+	preserve(kv, hashesPart, kv.Hashes, key)
+}
+
+func (kv *KV) MutableHash(key string) (map[string]resp.Value, bool) {
+	return mutable(kv, hashesPart, kv.Hashes, key, maps.Clone[map[string]resp.Value])
+}
+
+func (kv *KV) PreserveSet(key string) {
+	preserve(kv, setsPart, kv.Sets, key)
+}
+
+func (kv *KV) MutableSet(key string) (map[string]struct{}, bool) {
+	return mutable(kv, setsPart, kv.Sets, key, maps.Clone[map[string]struct{}])
+}
+
+func (kv *KV) PreserveSortedSet(key string) {
+	preserve(kv, sortedsPart, kv.Sorteds, key)
+}
+
+func (kv *KV) MutableSortedSet(key string) (*SortedSet, bool) {
+	return mutable(kv, sortedsPart, kv.Sorteds, key, (*SortedSet).Clone)
+}
+
+func (kv *KV) PreserveStream(key string) {
+	preserve(kv, streamsPart, kv.Streams, key)
+}
+
+func (kv *KV) MutableStream(key string) (*Stream, bool) {
+	return mutable(kv, streamsPart, kv.Streams, key, (*Stream).Clone)
+}
+
+func (kv *KV) PreserveModuleValue(key string) {
+	preserve(kv, modulesPart, kv.Modules, key)
+}
+
+// MutableModuleValue can fail, as copying a value without a Copy callback
+// goes through RDBSave and RDBLoad. The value is left alone then.
+func (kv *KV) MutableModuleValue(key string) (*ModuleValue, bool, error) {
+	mv, ok := kv.Modules[key]
+	if !ok || !isShared(kv, modulesPart, key) {
+		kv.PreserveModuleValue(key)
+		return mv, ok, nil
+	}
+	copied, err := mv.copy()
+	if err != nil {
+		return nil, false, err
+	}
+	kv.PreserveModuleValue(key)
+	kv.Modules[key] = copied
+	return copied, true, nil
+}
+
+// Flush empties the dataset. The old maps go to the active snapshots as they
+// are, since nothing changes them afterwards.
+func (kv *KV) Flush() {
+	kv.StringsMu.Lock()
+	flush(kv, stringsPart, &kv.Strings)
+	kv.StringsMu.Unlock()
+	kv.ListsMu.Lock()
+	flush(kv, listsPart, &kv.Lists)
+	kv.ListsMu.Unlock()
+	kv.HashesMu.Lock()
+	flush(kv, hashesPart, &kv.Hashes)
+	kv.HashesMu.Unlock()
+	kv.SetsMu.Lock()
+	flush(kv, setsPart, &kv.Sets)
+	kv.SetsMu.Unlock()
+	kv.SortedsMu.Lock()
+	flush(kv, sortedsPart, &kv.Sorteds)
+	kv.SortedsMu.Unlock()
+	kv.StreamsMu.Lock()
+	flush(kv, streamsPart, &kv.Streams)
+	kv.StreamsMu.Unlock()
+	kv.ModulesMu.Lock()
+	flush(kv, modulesPart, &kv.Modules)
+	kv.ModulesMu.Unlock()
+}
+
+func flush[T any](kv *KV, part func(*Snapshot) *snapshotPart[T], live *map[string]T) {
+	if active := kv.snapshots.Load(); active != nil {
+		for _, snap := range *active {
+			if p := part(snap); p.flushed == nil {
+				p.flushed = *live
+			}
+		}
+	}
+	*live = map[string]T{}
+}
@@ -0,0 +1,208 @@
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+func bulk(s string) resp.Value {
+	return resp.Value{Typ: "bulk", Bulk: s}
+}
+
+// snapshotDataset fills kv with one key of each type under "k", and a key
+// "other" nobody writes.
+func snapshotDataset(kv *KV) {
+	kv.Strings["k"] = resp.Value{Typ: "string", Str: "v"}
+	kv.Strings["other"] = resp.Value{Typ: "string", Str: "o"}
+	kv.Lists["k"] = []resp.Value{bulk("a"), bulk("b")}
+	kv.Hashes["k"] = map[string]resp.Value{"f": bulk("v")}
+	kv.Sets["k"] = map[string]struct{}{"a": {}}
+	z := NewSortedSet()
+	z.Set("a", 1)
+	kv.Sorteds["k"] = z
+	s := NewStream()
+	s.Append(StreamId{1, 1}, streamFields("f", "v"))
+	kv.Streams["k"] = s
+}
+
+func TestSnapshotKeepsValuesWrittenAfterIt(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(kv *KV)
+	}{
+		{"string replaced", func(kv *KV) {
+			kv.PreserveString("k")
+			kv.Strings["k"] = resp.Value{Typ: "string", Str: "w"}
+		}},
+		{"string created", func(kv *KV) {
+			kv.PreserveString("new")
+			kv.Strings["new"] = resp.Value{Typ: "string", Str: "w"}
+		}},
+		{"list appended to", func(kv *KV) {
+			list, _ := kv.MutableList("k")
+			kv.Lists["k"] = append(list[:1], bulk("c"))
+		}},
+		{"list popped", func(kv *KV) {
+			kv.PreserveList("k")
+			kv.Lists["k"] = kv.Lists["k"][1:]
+		}},
+		{"hash field set", func(kv *KV) {
+			hash, _ := kv.MutableHash("k")
+			hash["f"] = bulk("w")
+			hash["g"] = bulk("x")
+		}},
+		{"set member removed", func(kv *KV) {
+			set, _ := kv.MutableSet("k")
+			delete(set, "a")
+			set["b"] = struct{}{}
+		}},
+		{"sorted set updated", func(kv *KV) {
+			z, _ := kv.MutableSortedSet("k")
+			z.Set("a", 5)
+			z.Set("b", 6)
+		}},
+		{"stream appended to", func(kv *KV) {
+			s, _ := kv.MutableStream("k")
+			s.Append(StreamId{2, 0}, streamFields("f", "w"))
+			s.Delete(StreamId{1, 1})
+		}},
+		{"every key deleted", func(kv *KV) {
+			kv.PreserveString("k")
+			delete(kv.Strings, "k")
+			kv.PreserveList("k")
+			delete(kv.Lists, "k")
+			kv.PreserveHash("k")
+			delete(kv.Hashes, "k")
+			kv.PreserveSet("k")
+			delete(kv.Sets, "k")
+			kv.PreserveSortedSet("k")
+			delete(kv.Sorteds, "k")
+			kv.PreserveStream("k")
+			delete(kv.Streams, "k")
+		}},
+		{"flushed", (*KV).Flush},
+		{"written twice", func(kv *KV) {
+			for _, v := range []string{"w", "x"} {
+				kv.PreserveString("k")
+				kv.Strings["k"] = resp.Value{Typ: "string", Str: v}
+				hash, _ := kv.MutableHash("k")
+				hash["f"] = bulk(v)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live, before := NewKv(), NewKv()
+			snapshotDataset(live)
+			snapshotDataset(before)
+			snap := live.Snapshot()
+			tt.write(live)
+			view := snap.View()
+			compareSnapshotView(t, view, before)
+			snap.Release()
+
+			// Writes after the release are no longer kept.
+			after := live.Snapshot()
+			after.Release()
+			live.PreserveString("other")
+			live.Strings["other"] = resp.Value{Typ: "string", Str: "changed"}
+			if view.Strings["other"].Str != "o" {
+				t.Errorf("a released snapshot's view changed")
+			}
+			if got := after.View().Strings["other"].Str; got != "changed" {
+				t.Errorf("released snapshot kept %q, want the live value", got)
+			}
+		})
+	}
+}
+
+func TestSnapshotsTakenAtDifferentTimes(t *testing.T) {
+	live := NewKv()
+	live.Strings["k"] = resp.Value{Typ: "string", Str: "1"}
+	first := live.Snapshot()
+	defer first.Release()
+	live.PreserveString("k")
+	live.Strings["k"] = resp.Value{Typ: "string", Str: "2"}
+	second := live.Snapshot()
+	defer second.Release()
+	live.PreserveString("k")
+	live.Strings["k"] = resp.Value{Typ: "string", Str: "3"}
+
+	for _, tt := range []struct {
+		snap *Snapshot
+		want string
+	}{{first, "1"}, {second, "2"}} {
+		if got := tt.snap.View().Strings["k"].Str; got != tt.want {
+			t.Errorf("snapshot sees %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func compareSnapshotView(t *testing.T, view, want *KV) {
+	t.Helper()
+	if !reflect.DeepEqual(view.Strings, want.Strings) {
+		t.Errorf("strings = %v, want %v", view.Strings, want.Strings)
+	}
+	if !reflect.DeepEqual(view.Lists, want.Lists) {
+		t.Errorf("lists = %v, want %v", view.Lists, want.Lists)
+	}
+	if !reflect.DeepEqual(view.Hashes, want.Hashes) {
+		t.Errorf("hashes = %v, want %v", view.Hashes, want.Hashes)
+	}
+	if !reflect.DeepEqual(view.Sets, want.Sets) {
+		t.Errorf("sets = %v, want %v", view.Sets, want.Sets)
+	}
+	if len(view.Sorteds) != len(want.Sorteds) || !reflect.DeepEqual(view.Sorteds["k"].Members(), want.Sorteds["k"].Members()) {
+		t.Errorf("sorted sets differ")
+	}
+	if len(view.Streams) != len(want.Streams) || !reflect.DeepEqual(view.Streams["k"].Entries(), want.Streams["k"].Entries()) {
+		t.Errorf("streams differ")
+	}
+}
+
+// box is a module value that is changed in place.
+type box struct{ n int64 }
+
+var boxType = &ModuleType{
+	Name: "testbox",
+	RDBSave: func(w ModuleWriter, value any) {
+		w.SaveSigned(value.(*box).n)
+	},
+	RDBLoad: func(r ModuleReader, encver int) (any, error) {
+		return &box{n: r.LoadSigned()}, nil
+	},
+}
+
+func TestSnapshotKeepsModuleValues(t *testing.T) {
+	live := NewKv()
+	live.Modules["k"] = &ModuleValue{Type: boxType, Value: &box{n: 1}}
+	snap := live.Snapshot()
+	defer snap.Release()
+	// Without Copy, the value is copied through RDBSave and RDBLoad.
+	mv, ok, err := live.MutableModuleValue("k")
+	if err != nil || !ok {
+		t.Fatalf("MutableModuleValue = %v, %v", ok, err)
+	}
+	mv.Value.(*box).n = 2
+	if got := snap.View().Modules["k"].Value.(*box).n; got != 1 {
+		t.Errorf("snapshot value = %d, want 1", got)
+	}
+
+	// A type whose RDBLoad reads less than RDBSave wrote can't be copied,
+	// and the value is left alone.
+	short := *boxType
+	short.RDBLoad = func(r ModuleReader, encver int) (any, error) {
+		return &box{}, nil
+	}
+	live.Modules["other"] = &ModuleValue{Type: &short, Value: &box{n: 1}}
+	other := live.Snapshot()
+	defer other.Release()
+	if _, _, err := live.MutableModuleValue("other"); err == nil {
+		t.Error("copied a value RDBLoad can't read back")
+	}
+	if live.Modules["other"].Value.(*box).n != 1 {
+		t.Error("failed copy changed the value")
+	}
+}
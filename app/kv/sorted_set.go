@@ -0,0 +1,218 @@
+package kv
+
+import (
+	"maps"
+	"slices"
+	"sort"
+)
+
+// Small sorted sets are kept in a flat ordered slice, like Redis' listpack
+// encoding, and are converted to a dict plus skiplist once they outgrow
+// these limits.
+const (
+	ZSetMaxListpackEntries = 128
+	ZSetMaxListpackValue   = 64
+)
+
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// SortedSet orders members by score, then by member bytes.
+type SortedSet struct {
+	listpack []ZMember
+
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{listpack: []ZMember{}}
+}
+
+// Clone returns a copy of z that shares nothing with it.
+func (z *SortedSet) Clone() *SortedSet {
+	if z.zsl == nil {
+		return &SortedSet{listpack: slices.Clone(z.listpack)}
+	}
+	return &SortedSet{dict: maps.Clone(z.dict), zsl: z.zsl.clone()}
+}
+
+func (z *SortedSet) Encoding() string {
+	if z.zsl == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
+func (z *SortedSet) Len() int {
+	if z.zsl == nil {
+		return len(z.listpack)
+	}
+	return z.zsl.length
+}
+
+func (z *SortedSet) Score(member string) (float64, bool) {
+	if z.zsl == nil {
+		i := z.listpackIndex(member)
+		if i < 0 {
+			return 0, false
+		}
+		return z.listpack[i].Score, true
+	}
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Set inserts member with score, or moves it to score when it already
+// exists. It reports whether the member was newly added.
+func (z *SortedSet) Set(member string, score float64) bool {
+	if z.zsl == nil {
+		added := true
+		if i := z.listpackIndex(member); i >= 0 {
+			if z.listpack[i].Score == score {
+				return false
+			}
+			z.listpack = append(z.listpack[:i], z.listpack[i+1:]...)
+			added = false
+		}
+		if added && (len(z.listpack)+1 > ZSetMaxListpackEntries || len(member) > ZSetMaxListpackValue) {
+			z.convertToSkiplist()
+			return z.Set(member, score)
+		}
+		pos := sort.Search(len(z.listpack), func(i int) bool {
+			return !zslLess(z.listpack[i].Score, z.listpack[i].Member, score, member)
+		})
+		z.listpack = append(z.listpack, ZMember{})
+		copy(z.listpack[pos+1:], z.listpack[pos:])
+		z.listpack[pos] = ZMember{Member: member, Score: score}
+		return added
+	}
+
+	if old, ok := z.dict[member]; ok {
+		if old != score {
+			z.zsl.delete(old, member)
+			z.zsl.insert(score, member)
+			z.dict[member] = score
+		}
+		return false
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return true
+}
+
+func (z *SortedSet) Remove(member string) bool {
+	if z.zsl == nil {
+		i := z.listpackIndex(member)
+		if i < 0 {
+			return false
+		}
+		z.listpack = append(z.listpack[:i], z.listpack[i+1:]...)
+		return true
+	}
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// Rank returns the 0-based position of member, counted from the lowest
+// score, or from the highest when reverse is set.
+func (z *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	var rank int
+	if z.zsl == nil {
+		rank = z.listpackIndex(member)
+		if rank < 0 {
+			return 0, false
+		}
+	} else {
+		score, ok := z.dict[member]
+		if !ok {
+			return 0, false
+		}
+		rank = z.zsl.rank(score, member) - 1
+	}
+	if reverse {
+		rank = z.Len() - 1 - rank
+	}
+	return rank, true
+}
+
+// Range returns the members between the 0-based positions start and end,
+// both inclusive. Positions are counted from the highest score when reverse
+// is set. Callers are expected to have clamped the bounds to the set.
+func (z *SortedSet) Range(start, end int, reverse bool) []ZMember {
+	length := z.Len()
+	if start < 0 || end >= length || start > end {
+		return []ZMember{}
+	}
+	result := make([]ZMember, 0, end-start+1)
+	if z.zsl == nil {
+		for i := start; i <= end; i++ {
+			if reverse {
+				result = append(result, z.listpack[length-1-i])
+			} else {
+				result = append(result, z.listpack[i])
+			}
+		}
+		return result
+	}
+
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.byRank(length - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+	for i := start; i <= end && x != nil; i++ {
+		result = append(result, ZMember{Member: x.member, Score: x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return result
+}
+
+// CountWhile returns the number of leading members, in ascending order,
+// for which pred holds. pred must be true for a prefix of the set and false
+// afterwards; the result is then the ascending rank of the first member
+// that fails it.
+func (z *SortedSet) CountWhile(pred func(score float64, member string) bool) int {
+	if z.zsl == nil {
+		return sort.Search(len(z.listpack), func(i int) bool {
+			return !pred(z.listpack[i].Score, z.listpack[i].Member)
+		})
+	}
+	return z.zsl.countWhile(pred)
+}
+
+// Members returns every member in ascending order.
+func (z *SortedSet) Members() []ZMember {
+	return z.Range(0, z.Len()-1, false)
+}
+
+func (z *SortedSet) listpackIndex(member string) int {
+	for i, m := range z.listpack {
+		if m.Member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+func (z *SortedSet) convertToSkiplist() {
+	z.dict = make(map[string]float64, len(z.listpack))
+	z.zsl = newSkiplist()
+	for _, m := range z.listpack {
+		z.dict[m.Member] = m.Score
+		z.zsl.insert(m.Score, m.Member)
+	}
+	z.listpack = nil
+}
@@ -0,0 +1,147 @@
+package kv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSortedSetEncodingConversion(t *testing.T) {
+	long := strings.Repeat("m", ZSetMaxListpackValue+1)
+	tests := []struct {
+		name    string
+		members []string
+		want    string
+	}{
+		{"empty", nil, "listpack"},
+		{"at the entry limit", numberedMembers(ZSetMaxListpackEntries), "listpack"},
+		{"past the entry limit", numberedMembers(ZSetMaxListpackEntries + 1), "skiplist"},
+		{"value at the size limit", []string{strings.Repeat("m", ZSetMaxListpackValue)}, "listpack"},
+		{"value past the size limit", []string{"a", long, "b"}, "skiplist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := NewSortedSet()
+			for i, m := range tt.members {
+				// Scores run against insertion order so that the ordering
+				// has to be maintained, not just appended to.
+				z.Set(m, float64(len(tt.members)-i))
+			}
+			if got := z.Encoding(); got != tt.want {
+				t.Fatalf("encoding = %s, want %s", got, tt.want)
+			}
+			if got := z.Len(); got != len(tt.members) {
+				t.Fatalf("Len = %d, want %d", got, len(tt.members))
+			}
+			checkSortedSet(t, z)
+			clone := z.Clone()
+			if got := clone.Encoding(); got != tt.want {
+				t.Errorf("clone encoding = %s, want %s", got, tt.want)
+			}
+			checkSortedSet(t, clone)
+		})
+	}
+}
+
+func TestSortedSetConversionKeepsContents(t *testing.T) {
+	z := NewSortedSet()
+	want := map[string]float64{}
+	for i := 0; i < ZSetMaxListpackEntries; i++ {
+		m := fmt.Sprintf("m%03d", i)
+		// Ties on score are broken by member.
+		z.Set(m, float64(i%7))
+		want[m] = float64(i % 7)
+	}
+	before := z.Members()
+	if z.Encoding() != "listpack" {
+		t.Fatalf("encoding = %s before conversion", z.Encoding())
+	}
+
+	z.Set("extra", -1)
+	want["extra"] = -1
+	if z.Encoding() != "skiplist" {
+		t.Fatalf("encoding = %s after conversion", z.Encoding())
+	}
+	after := z.Members()
+	if after[0] != (ZMember{Member: "extra", Score: -1}) || !slices.Equal(after[1:], before) {
+		t.Errorf("members changed order across the conversion")
+	}
+	for m, score := range want {
+		if got, ok := z.Score(m); !ok || got != score {
+			t.Errorf("Score(%s) = %v, %v, want %v", m, got, ok, score)
+		}
+	}
+	checkSortedSet(t, z)
+
+	// Removing members never converts back.
+	for m := range want {
+		z.Remove(m)
+	}
+	if z.Len() != 0 || z.Encoding() != "skiplist" {
+		t.Errorf("after removing everything: Len = %d, encoding = %s", z.Len(), z.Encoding())
+	}
+}
+
+func TestSortedSetUpdateInFullListpack(t *testing.T) {
+	z := NewSortedSet()
+	for _, m := range numberedMembers(ZSetMaxListpackEntries) {
+		z.Set(m, 0)
+	}
+	tests := []struct {
+		member string
+		score  float64
+		added  bool
+		want   string
+	}{
+		{"m000", 5, false, "listpack"},
+		{"m000", 5, false, "listpack"},
+		{"new", 1, true, "skiplist"},
+	}
+	for _, tt := range tests {
+		if added := z.Set(tt.member, tt.score); added != tt.added {
+			t.Errorf("Set(%s, %v) = %v, want %v", tt.member, tt.score, added, tt.added)
+		}
+		if got := z.Encoding(); got != tt.want {
+			t.Errorf("after Set(%s, %v): encoding = %s, want %s", tt.member, tt.score, got, tt.want)
+		}
+		checkSortedSet(t, z)
+	}
+}
+
+func numberedMembers(n int) []string {
+	members := make([]string, n)
+	for i := range members {
+		members[i] = fmt.Sprintf("m%03d", i)
+	}
+	return members
+}
+
+// checkSortedSet verifies that ranges, ranks and scores agree with each
+// other whatever the encoding.
+func checkSortedSet(t *testing.T, z *SortedSet) {
+	t.Helper()
+	members := z.Members()
+	if len(members) != z.Len() {
+		t.Fatalf("Members returned %d entries, Len is %d", len(members), z.Len())
+	}
+	for i, m := range members {
+		if i > 0 && !zslLess(members[i-1].Score, members[i-1].Member, m.Score, m.Member) {
+			t.Fatalf("members out of order at %d: %v then %v", i, members[i-1], m)
+		}
+		if rank, ok := z.Rank(m.Member, false); !ok || rank != i {
+			t.Fatalf("Rank(%s) = %d, %v, want %d", m.Member, rank, ok, i)
+		}
+		if rank, ok := z.Rank(m.Member, true); !ok || rank != len(members)-1-i {
+			t.Fatalf("reverse Rank(%s) = %d, %v, want %d", m.Member, rank, ok, len(members)-1-i)
+		}
+		if score, ok := z.Score(m.Member); !ok || score != m.Score {
+			t.Fatalf("Score(%s) = %v, %v, want %v", m.Member, score, ok, m.Score)
+		}
+	}
+	reversed := z.Range(0, z.Len()-1, true)
+	slices.Reverse(reversed)
+	if !slices.Equal(reversed, members) {
+		t.Fatalf("reverse range doesn't mirror the forward range")
+	}
+}
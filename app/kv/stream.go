@@ -0,0 +1,441 @@
+package kv
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// StreamNodeMaxEntries mirrors Redis' stream-node-max-entries. Approximate
+// trimming only ever removes whole nodes of this size.
+const StreamNodeMaxEntries = 100
+
+func NewStream() *Stream {
+	return &Stream{
+		Groups: make(map[string]*ConsumerGroup),
+	}
+}
+
+// Clone returns a copy of s that shares nothing with it, down to the consumer
+// groups and their pending entries.
+func (s *Stream) Clone() *Stream {
+	c := &Stream{
+		nodes:        make([]*streamNode, len(s.nodes)),
+		length:       s.length,
+		Groups:       make(map[string]*ConsumerGroup, len(s.Groups)),
+		LastID:       s.LastID,
+		EntriesAdded: s.EntriesAdded,
+		MaxDeletedID: s.MaxDeletedID,
+	}
+	for i, n := range s.nodes {
+		// The master fields never change once the node exists, so only the
+		// buffer, where deletions set flags, needs copying.
+		node := *n
+		node.buf = slices.Clone(n.buf)
+		c.nodes[i] = &node
+	}
+	for name, g := range s.Groups {
+		group := NewConsumerGroup(g.Name, g.LastID, g.EntriesRead)
+		group.MaxDeliveries = g.MaxDeliveries
+		group.DeadLetterKey = g.DeadLetterKey
+		for id, nack := range g.Pending {
+			copied := *nack
+			group.Pending[id] = &copied
+		}
+		for consumerName, consumer := range g.Consumers {
+			copied := &Consumer{
+				Name:       consumer.Name,
+				SeenTime:   consumer.SeenTime,
+				ActiveTime: consumer.ActiveTime,
+				Pending:    make(map[StreamId]*PendingEntry, len(consumer.Pending)),
+			}
+			for id := range consumer.Pending {
+				copied.Pending[id] = group.Pending[id]
+			}
+			group.Consumers[consumerName] = copied
+		}
+		c.Groups[name] = group
+	}
+	return c
+}
+
+func (id StreamId) Compare(other StreamId) int {
+	switch {
+	case id.Timestamp < other.Timestamp:
+		return -1
+	case id.Timestamp > other.Timestamp:
+		return 1
+	case id.Sequence < other.Sequence:
+		return -1
+	case id.Sequence > other.Sequence:
+		return 1
+	}
+	return 0
+}
+
+// Next returns the smallest ID greater than id. It reports false when id is
+// already the largest possible ID.
+func (id StreamId) Next() (StreamId, bool) {
+	if id.Sequence < math.MaxUint64 {
+		return StreamId{Timestamp: id.Timestamp, Sequence: id.Sequence + 1}, true
+	}
+	if id.Timestamp < math.MaxUint64 {
+		return StreamId{Timestamp: id.Timestamp + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the largest ID smaller than id. It reports false when id is
+// the zero ID.
+func (id StreamId) Prev() (StreamId, bool) {
+	if id.Sequence > 0 {
+		return StreamId{Timestamp: id.Timestamp, Sequence: id.Sequence - 1}, true
+	}
+	if id.Timestamp > 0 {
+		return StreamId{Timestamp: id.Timestamp - 1, Sequence: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+func (s *Stream) Len() int {
+	return s.length
+}
+
+// NextID generates the ID XADD * would assign at the given unix time in
+// milliseconds. It reports false when the stream has exhausted its IDs.
+func (s *Stream) NextID(nowMs uint64) (StreamId, bool) {
+	if nowMs > s.LastID.Timestamp {
+		return StreamId{Timestamp: nowMs}, true
+	}
+	return s.LastID.Next()
+}
+
+// Append adds an entry to the end of the stream. id must be greater than
+// LastID.
+func (s *Stream) Append(id StreamId, fields []StreamField) {
+	entry := StreamEntry{ID: id, Fields: fields}
+	if len(s.nodes) == 0 || s.nodes[len(s.nodes)-1].full() {
+		s.nodes = append(s.nodes, newStreamNode(entry))
+	}
+	s.nodes[len(s.nodes)-1].append(entry)
+	s.length++
+	s.LastID = id
+	s.EntriesAdded++
+}
+
+// Entries returns every entry, oldest first.
+func (s *Stream) Entries() []StreamEntry {
+	return s.Range(StreamId{}, StreamId{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}, 0, false)
+}
+
+// First returns the oldest entry.
+func (s *Stream) First() (StreamEntry, bool) {
+	entries := s.Range(StreamId{}, StreamId{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}, 1, false)
+	if len(entries) == 0 {
+		return StreamEntry{}, false
+	}
+	return entries[0], true
+}
+
+// Last returns the newest entry.
+func (s *Stream) Last() (StreamEntry, bool) {
+	entries := s.Range(StreamId{}, StreamId{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}, 1, true)
+	if len(entries) == 0 {
+		return StreamEntry{}, false
+	}
+	return entries[0], true
+}
+
+// FirstID returns the ID of the oldest entry, or the zero ID when the stream
+// is empty.
+func (s *Stream) FirstID() StreamId {
+	entry, _ := s.First()
+	return entry.ID
+}
+
+// TrimMaxLen evicts the oldest entries until at most maxLen remain and
+// returns how many were removed. With approx set, only whole nodes are
+// removed and at most limit entries (0 for no limit).
+func (s *Stream) TrimMaxLen(maxLen int, approx bool, limit int) int {
+	return s.trim(func(StreamId) bool { return s.length > maxLen }, func(n *streamNode) bool {
+		return s.length-n.live >= maxLen
+	}, approx, limit)
+}
+
+// TrimMinID evicts entries with IDs lower than minID, with the same approx
+// and limit rules as TrimMaxLen.
+func (s *Stream) TrimMinID(minID StreamId, approx bool, limit int) int {
+	return s.trim(func(id StreamId) bool { return id.Compare(minID) < 0 }, func(n *streamNode) bool {
+		return n.last.Compare(minID) < 0
+	}, approx, limit)
+}
+
+// trim works like Redis' streamTrim: whole head nodes are dropped while
+// nodeDone allows it, and unless approx is set, entries of the next node are
+// then marked deleted one at a time while evict holds.
+func (s *Stream) trim(evict func(id StreamId) bool, nodeDone func(n *streamNode) bool, approx bool, limit int) int {
+	removed := 0
+	for len(s.nodes) > 0 {
+		node := s.nodes[0]
+		if nodeDone(node) {
+			if limit > 0 && removed+node.live > limit {
+				break
+			}
+			s.nodes = s.nodes[1:]
+			s.length -= node.live
+			removed += node.live
+			continue
+		}
+		if approx {
+			break
+		}
+		for pos := 0; pos < len(node.buf); {
+			entry, flags, next := node.entryAt(pos, false)
+			if flags&streamFlagDeleted == 0 {
+				if !evict(entry.ID) {
+					break
+				}
+				node.markDeleted(pos)
+				s.length--
+				removed++
+			}
+			pos = next
+		}
+		// The node's last ID may belong to an entry XDEL already removed,
+		// so evicting one entry at a time can empty it too.
+		if node.live == 0 {
+			s.nodes = s.nodes[1:]
+			continue
+		}
+		break
+	}
+	return removed
+}
+
+// Get returns the entry with the given ID.
+func (s *Stream) Get(id StreamId) (StreamEntry, bool) {
+	if len(s.nodes) == 0 {
+		return StreamEntry{}, false
+	}
+	node := s.nodes[s.nodeFor(id)]
+	pos, ok := node.find(id)
+	if !ok {
+		return StreamEntry{}, false
+	}
+	entry, _, _ := node.entryAt(pos, true)
+	return entry, true
+}
+
+// Range returns the entries with IDs between start and end inclusive, oldest
+// first, or newest first when reverse is set. A count of 0 means no limit.
+// Only the nodes overlapping the range are decoded.
+func (s *Stream) Range(start, end StreamId, count int, reverse bool) []StreamEntry {
+	result := []StreamEntry{}
+	if len(s.nodes) == 0 || start.Compare(end) > 0 {
+		return result
+	}
+	if !reverse {
+		for i := s.nodeFor(start); i < len(s.nodes) && s.nodes[i].master.Compare(end) <= 0; i++ {
+			for _, entry := range s.nodes[i].entries(start, end) {
+				if count > 0 && len(result) >= count {
+					return result
+				}
+				result = append(result, entry)
+			}
+		}
+		return result
+	}
+	for i := s.nodeFor(end); i >= 0 && s.nodes[i].last.Compare(start) >= 0; i-- {
+		entries := s.nodes[i].entries(start, end)
+		for j := len(entries) - 1; j >= 0; j-- {
+			if count > 0 && len(result) >= count {
+				return result
+			}
+			result = append(result, entries[j])
+		}
+	}
+	return result
+}
+
+// Delete removes the entry with the given ID, remembering the largest
+// deleted ID so consumer group counters know the history has gaps.
+func (s *Stream) Delete(id StreamId) bool {
+	if len(s.nodes) == 0 {
+		return false
+	}
+	i := s.nodeFor(id)
+	node := s.nodes[i]
+	pos, ok := node.find(id)
+	if !ok {
+		return false
+	}
+	node.markDeleted(pos)
+	if node.live == 0 {
+		s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+	}
+	s.length--
+	if id.Compare(s.MaxDeletedID) > 0 {
+		s.MaxDeletedID = id
+	}
+	return true
+}
+
+// Nodes returns how many nodes the stream's entries are packed into.
+func (s *Stream) Nodes() int {
+	return len(s.nodes)
+}
+
+// EntriesInvalid marks a consumer group whose entries-read counter is
+// unknown, as after XGROUP SETID to an arbitrary ID.
+const EntriesInvalid int64 = -1
+
+func NewConsumerGroup(name string, lastID StreamId, entriesRead int64) *ConsumerGroup {
+	return &ConsumerGroup{
+		Name:        name,
+		LastID:      lastID,
+		EntriesRead: entriesRead,
+		Consumers:   make(map[string]*Consumer),
+		Pending:     make(map[StreamId]*PendingEntry),
+	}
+}
+
+// Consumer returns the named consumer, creating it when create is set. The
+// second result reports whether it was created.
+func (g *ConsumerGroup) Consumer(name string, create bool, nowMs int64) (*Consumer, bool) {
+	if consumer, ok := g.Consumers[name]; ok {
+		consumer.SeenTime = nowMs
+		return consumer, false
+	}
+	if !create {
+		return nil, false
+	}
+	consumer := &Consumer{
+		Name:       name,
+		SeenTime:   nowMs,
+		ActiveTime: -1,
+		Pending:    make(map[StreamId]*PendingEntry),
+	}
+	g.Consumers[name] = consumer
+	return consumer, true
+}
+
+// Deliver records id as delivered to consumer, taking it over from any other
+// consumer that still owns it.
+func (g *ConsumerGroup) Deliver(id StreamId, consumer *Consumer, nowMs int64) *PendingEntry {
+	if nack, ok := g.Pending[id]; ok {
+		if owner, ok := g.Consumers[nack.Consumer]; ok {
+			delete(owner.Pending, id)
+		}
+	}
+	nack := &PendingEntry{ID: id, Consumer: consumer.Name, DeliveryTime: nowMs, DeliveryCount: 1}
+	g.Pending[id] = nack
+	consumer.Pending[id] = nack
+	return nack
+}
+
+// Ack removes id from the group and consumer PELs.
+func (g *ConsumerGroup) Ack(id StreamId) bool {
+	nack, ok := g.Pending[id]
+	if !ok {
+		return false
+	}
+	if owner, ok := g.Consumers[nack.Consumer]; ok {
+		delete(owner.Pending, id)
+	}
+	delete(g.Pending, id)
+	return true
+}
+
+// DeleteConsumer removes a consumer together with its pending entries and
+// returns how many entries it still had pending.
+func (g *ConsumerGroup) DeleteConsumer(name string) (int, bool) {
+	consumer, ok := g.Consumers[name]
+	if !ok {
+		return 0, false
+	}
+	pending := len(consumer.Pending)
+	for id := range consumer.Pending {
+		delete(g.Pending, id)
+	}
+	delete(g.Consumers, name)
+	return pending, true
+}
+
+// SortedPendingIDs returns the IDs of a PEL in ascending order.
+func SortedPendingIDs(pel map[StreamId]*PendingEntry) []StreamId {
+	ids := make([]StreamId, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+	return ids
+}
+
+// RangeHasTombstones reports whether an entry deleted with XDEL may have
+// lived between start and the end of the stream.
+func (s *Stream) RangeHasTombstones(start StreamId) bool {
+	if s.length == 0 || s.MaxDeletedID == (StreamId{}) {
+		return false
+	}
+	return start.Compare(s.MaxDeletedID) <= 0
+}
+
+// EstimateDistanceFromFirstEverEntry returns the logical position of id in
+// the stream, counting every entry ever added, or EntriesInvalid when that
+// cannot be derived.
+func (s *Stream) EstimateDistanceFromFirstEverEntry(id StreamId) int64 {
+	if s.EntriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && id.Compare(s.LastID) <= 0 {
+		return int64(s.EntriesAdded)
+	}
+	cmpLast := id.Compare(s.LastID)
+	if cmpLast == 0 {
+		return int64(s.EntriesAdded)
+	} else if cmpLast > 0 {
+		return EntriesInvalid
+	}
+	first := s.FirstID()
+	if s.MaxDeletedID == (StreamId{}) || s.MaxDeletedID.Compare(first) < 0 {
+		switch id.Compare(first) {
+		case -1:
+			return int64(s.EntriesAdded) - int64(s.length)
+		case 0:
+			return int64(s.EntriesAdded) - int64(s.length) + 1
+		}
+	}
+	return EntriesInvalid
+}
+
+// MarkRead advances the group's last-delivered ID to id, keeping its
+// entries-read counter in step when possible.
+func (s *Stream) MarkRead(g *ConsumerGroup, id StreamId) {
+	if id.Compare(g.LastID) <= 0 {
+		return
+	}
+	if g.EntriesRead != EntriesInvalid && !s.RangeHasTombstones(id) {
+		g.EntriesRead++
+	} else if s.EntriesAdded > 0 {
+		g.EntriesRead = s.EstimateDistanceFromFirstEverEntry(id)
+	}
+	g.LastID = id
+}
+
+// Lag returns how many entries the group has yet to read, or false when
+// deletions make that impossible to tell.
+func (s *Stream) Lag(g *ConsumerGroup) (int64, bool) {
+	if s.EntriesAdded == 0 {
+		return 0, true
+	}
+	if g.EntriesRead != EntriesInvalid && !s.RangeHasTombstones(g.LastID) {
+		return int64(s.EntriesAdded) - g.EntriesRead, true
+	}
+	entriesRead := s.EstimateDistanceFromFirstEverEntry(g.LastID)
+	if entriesRead == EntriesInvalid {
+		return 0, false
+	}
+	return int64(s.EntriesAdded) - entriesRead, true
+}
@@ -0,0 +1,201 @@
+package kv
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// StreamNodeMaxBytes mirrors Redis' stream-node-max-bytes: a node stops
+// taking entries once its encoding grows past this size.
+const StreamNodeMaxBytes = 4096
+
+const (
+	streamFlagDeleted    byte = 1 << 0
+	streamFlagSameFields byte = 1 << 1
+)
+
+// streamNode is a run of consecutive entries packed into one byte buffer,
+// the way Redis packs stream entries into listpacks. IDs are stored as
+// deltas from the node's master ID, and entries whose field names match the
+// master fields (those of the node's first entry) store only their values.
+//
+// Each entry is encoded as:
+//
+//	flags | ms-delta | seq-delta | [field-count | (field value)...] or [value...]
+//
+// with integers as uvarints and strings length-prefixed. Deleting an entry
+// only sets its deleted flag; a node is dropped once no live entries remain.
+type streamNode struct {
+	master       StreamId
+	masterFields []string
+	buf          []byte
+	count        int
+	live         int
+	last         StreamId
+}
+
+func newStreamNode(entry StreamEntry) *streamNode {
+	names := make([]string, len(entry.Fields))
+	for i, f := range entry.Fields {
+		names[i] = f.Name
+	}
+	return &streamNode{master: entry.ID, masterFields: names}
+}
+
+func (n *streamNode) full() bool {
+	return n.count >= StreamNodeMaxEntries || len(n.buf) >= StreamNodeMaxBytes
+}
+
+func (n *streamNode) sameFields(fields []StreamField) bool {
+	if len(fields) != len(n.masterFields) {
+		return false
+	}
+	for i, f := range fields {
+		if f.Name != n.masterFields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func (n *streamNode) append(entry StreamEntry) {
+	flags := byte(0)
+	same := n.sameFields(entry.Fields)
+	if same {
+		flags |= streamFlagSameFields
+	}
+	n.buf = append(n.buf, flags)
+	n.buf = binary.AppendUvarint(n.buf, entry.ID.Timestamp-n.master.Timestamp)
+	// Within the master's millisecond the sequence is delta encoded too;
+	// later milliseconds usually restart at small sequence numbers.
+	seq := entry.ID.Sequence
+	if entry.ID.Timestamp == n.master.Timestamp {
+		seq -= n.master.Sequence
+	}
+	n.buf = binary.AppendUvarint(n.buf, seq)
+	if !same {
+		n.buf = binary.AppendUvarint(n.buf, uint64(len(entry.Fields)))
+	}
+	for _, f := range entry.Fields {
+		if !same {
+			n.buf = appendString(n.buf, f.Name)
+		}
+		n.buf = appendString(n.buf, f.Value)
+	}
+	n.count++
+	n.live++
+	n.last = entry.ID
+}
+
+type streamNodeReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *streamNodeReader) uvarint() uint64 {
+	v, size := binary.Uvarint(r.buf[r.pos:])
+	r.pos += size
+	return v
+}
+
+func (r *streamNodeReader) string(decode bool) string {
+	size := int(r.uvarint())
+	s := ""
+	if decode {
+		s = string(r.buf[r.pos : r.pos+size])
+	}
+	r.pos += size
+	return s
+}
+
+// entryAt decodes the entry starting at pos and returns it with its flags
+// and the position of the following entry. Fields are only decoded when
+// withFields is set.
+func (n *streamNode) entryAt(pos int, withFields bool) (StreamEntry, byte, int) {
+	r := streamNodeReader{buf: n.buf, pos: pos}
+	flags := r.buf[r.pos]
+	r.pos++
+	var entry StreamEntry
+	entry.ID.Timestamp = n.master.Timestamp + r.uvarint()
+	entry.ID.Sequence = r.uvarint()
+	if entry.ID.Timestamp == n.master.Timestamp {
+		entry.ID.Sequence += n.master.Sequence
+	}
+	decode := withFields && flags&streamFlagDeleted == 0
+	if flags&streamFlagSameFields != 0 {
+		if decode {
+			entry.Fields = make([]StreamField, len(n.masterFields))
+		}
+		for i, name := range n.masterFields {
+			value := r.string(decode)
+			if decode {
+				entry.Fields[i] = StreamField{Name: name, Value: value}
+			}
+		}
+	} else {
+		numFields := int(r.uvarint())
+		if decode {
+			entry.Fields = make([]StreamField, numFields)
+		}
+		for i := 0; i < numFields; i++ {
+			name := r.string(decode)
+			value := r.string(decode)
+			if decode {
+				entry.Fields[i] = StreamField{Name: name, Value: value}
+			}
+		}
+	}
+	return entry, flags, r.pos
+}
+
+// find returns the position of the live entry with the given ID.
+func (n *streamNode) find(id StreamId) (int, bool) {
+	for pos := 0; pos < len(n.buf); {
+		entry, flags, next := n.entryAt(pos, false)
+		if cmp := entry.ID.Compare(id); cmp >= 0 {
+			return pos, cmp == 0 && flags&streamFlagDeleted == 0
+		}
+		pos = next
+	}
+	return 0, false
+}
+
+func (n *streamNode) markDeleted(pos int) {
+	n.buf[pos] |= streamFlagDeleted
+	n.live--
+}
+
+// entries decodes the live entries of the node between start and end
+// inclusive, oldest first.
+func (n *streamNode) entries(start, end StreamId) []StreamEntry {
+	result := []StreamEntry{}
+	for pos := 0; pos < len(n.buf); {
+		entry, flags, next := n.entryAt(pos, false)
+		if entry.ID.Compare(end) > 0 {
+			break
+		}
+		if flags&streamFlagDeleted == 0 && entry.ID.Compare(start) >= 0 {
+			entry, _, _ = n.entryAt(pos, true)
+			result = append(result, entry)
+		}
+		pos = next
+	}
+	return result
+}
+
+// nodeFor returns the index of the node that would hold id: the last node
+// whose master ID is not greater than id.
+func (s *Stream) nodeFor(id StreamId) int {
+	i, _ := slices.BinarySearchFunc(s.nodes, id, func(n *streamNode, id StreamId) int {
+		if n.master.Compare(id) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	return max(i-1, 0)
+}
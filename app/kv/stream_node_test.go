@@ -0,0 +1,187 @@
+package kv
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func streamFields(pairs ...string) []StreamField {
+	var f []StreamField
+	for i := 0; i < len(pairs); i += 2 {
+		f = append(f, StreamField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return f
+}
+
+var maxStreamID = StreamId{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}
+
+func TestStreamNodeCodec(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []StreamEntry
+	}{
+		{"single entry", []StreamEntry{
+			{StreamId{5, 3}, streamFields("a", "1")},
+		}},
+		{"master fields repeated", []StreamEntry{
+			{StreamId{5, 3}, streamFields("a", "1", "b", "2")},
+			{StreamId{5, 4}, streamFields("a", "3", "b", "4")},
+			{StreamId{5, 9}, streamFields("a", "", "b", "")},
+		}},
+		{"fields differ from the master", []StreamEntry{
+			{StreamId{5, 0}, streamFields("a", "1")},
+			{StreamId{5, 1}, streamFields("b", "2")},
+			{StreamId{5, 2}, streamFields("a", "1", "b", "2")},
+			{StreamId{5, 3}, streamFields("b", "2", "a", "1")},
+		}},
+		{"sequence restarts in a later millisecond", []StreamEntry{
+			{StreamId{100, 500}, streamFields("f", "v")},
+			{StreamId{100, 501}, streamFields("f", "v")},
+			{StreamId{101, 0}, streamFields("f", "v")},
+			{StreamId{1 << 40, 7}, streamFields("f", "v")},
+		}},
+		{"extreme IDs", []StreamEntry{
+			{StreamId{0, 1}, streamFields("f", "v")},
+			{StreamId{0, math.MaxUint64}, streamFields("f", "v")},
+			{maxStreamID, streamFields("f", "v")},
+		}},
+		{"long and binary values", []StreamEntry{
+			{StreamId{1, 0}, streamFields("k", strings.Repeat("x", 300))},
+			{StreamId{1, 1}, streamFields("k", "\x00\xff\r\n")},
+			{StreamId{1, 2}, streamFields(strings.Repeat("n", 200), "v")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newStreamNode(tt.entries[0])
+			for _, e := range tt.entries {
+				node.append(e)
+			}
+			if node.count != len(tt.entries) || node.live != len(tt.entries) {
+				t.Fatalf("count = %d, live = %d, want %d", node.count, node.live, len(tt.entries))
+			}
+			if node.last != tt.entries[len(tt.entries)-1].ID {
+				t.Fatalf("last = %v, want %v", node.last, tt.entries[len(tt.entries)-1].ID)
+			}
+			if got := node.entries(StreamId{}, maxStreamID); !reflect.DeepEqual(got, tt.entries) {
+				t.Fatalf("entries = %v, want %v", got, tt.entries)
+			}
+			for _, e := range tt.entries {
+				pos, ok := node.find(e.ID)
+				if !ok {
+					t.Fatalf("find(%v) failed", e.ID)
+				}
+				got, _, _ := node.entryAt(pos, true)
+				if !reflect.DeepEqual(got, e) {
+					t.Fatalf("entryAt(find(%v)) = %v, want %v", e.ID, got, e)
+				}
+			}
+
+			// Deleting an entry hides it without disturbing its neighbours.
+			deleted := tt.entries[len(tt.entries)/2]
+			pos, _ := node.find(deleted.ID)
+			node.markDeleted(pos)
+			if _, ok := node.find(deleted.ID); ok {
+				t.Fatalf("find(%v) succeeded after deletion", deleted.ID)
+			}
+			var want []StreamEntry
+			for _, e := range tt.entries {
+				if e.ID != deleted.ID {
+					want = append(want, e)
+				}
+			}
+			got := node.entries(StreamId{}, maxStreamID)
+			if len(want) == 0 {
+				want = []StreamEntry{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("entries after deletion = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamNodeBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		entries int
+		nodes   int
+	}{
+		{"entry limit", "v", 3*StreamNodeMaxEntries + 1, 4},
+		{"byte limit", strings.Repeat("v", StreamNodeMaxBytes/4), 10, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStream()
+			var want []StreamEntry
+			for i := 0; i < tt.entries; i++ {
+				e := StreamEntry{ID: StreamId{uint64(i / 3), uint64(i % 3)}, Fields: streamFields("f", tt.value)}
+				s.Append(e.ID, e.Fields)
+				want = append(want, e)
+			}
+			if got := s.Nodes(); got != tt.nodes {
+				t.Errorf("Nodes = %d, want %d", got, tt.nodes)
+			}
+			if got := s.Entries(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("entries differ after splitting into nodes")
+			}
+			for _, e := range want {
+				if got, ok := s.Get(e.ID); !ok || !reflect.DeepEqual(got, e) {
+					t.Fatalf("Get(%v) = %v, %v", e.ID, got, ok)
+				}
+			}
+			reversed := s.Range(StreamId{}, maxStreamID, 0, true)
+			for i, e := range reversed {
+				if e.ID != want[len(want)-1-i].ID {
+					t.Fatalf("reverse range entry %d = %v, want %v", i, e.ID, want[len(want)-1-i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTrimDropsEmptyNodes(t *testing.T) {
+	last := StreamId{0, StreamNodeMaxEntries - 1}
+	tests := []struct {
+		name    string
+		deleted []StreamId
+		trim    func(s *Stream) int
+		removed int
+		nodes   int
+	}{
+		{"maxlen at a node boundary", nil,
+			func(s *Stream) int { return s.TrimMaxLen(StreamNodeMaxEntries, false, 0) }, StreamNodeMaxEntries, 1},
+		{"minid at a node boundary", nil,
+			func(s *Stream) int { return s.TrimMinID(StreamId{0, StreamNodeMaxEntries}, false, 0) }, StreamNodeMaxEntries, 1},
+		// The first node's last entry is already deleted, so the trim
+		// evicts its live entries one at a time without passing its last ID.
+		{"minid with the node's last entry deleted", []StreamId{last},
+			func(s *Stream) int { return s.TrimMinID(last, false, 0) }, StreamNodeMaxEntries - 1, 1},
+		{"minid stopping inside a node", nil,
+			func(s *Stream) int { return s.TrimMinID(last, false, 0) }, StreamNodeMaxEntries - 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStream()
+			for i := 0; i < 2*StreamNodeMaxEntries; i++ {
+				s.Append(StreamId{0, uint64(i)}, streamFields("f", "v"))
+			}
+			for _, id := range tt.deleted {
+				s.Delete(id)
+			}
+			length := s.Len()
+			if removed := tt.trim(s); removed != tt.removed {
+				t.Errorf("removed %d entries, want %d", removed, tt.removed)
+			}
+			if s.Len() != length-tt.removed {
+				t.Errorf("Len = %d, want %d", s.Len(), length-tt.removed)
+			}
+			if s.Nodes() != tt.nodes {
+				t.Errorf("Nodes = %d, want %d", s.Nodes(), tt.nodes)
+			}
+		})
+	}
+}
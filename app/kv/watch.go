@@ -0,0 +1,102 @@
+package kv
+
+import "time"
+
+// Watch adds key to the client's watched keys. Like Redis, it remembers
+// whether the key was already logically expired, so that deleting it later
+// doesn't count as a change.
+func (kv *KV) Watch(client *ClientType, key string) {
+	if _, ok := client.WatchedKeys[key]; ok {
+		return
+	}
+	// Checked before taking WatchersMu: handlers signal changes while
+	// holding their type's lock, so WatchersMu always nests inside those.
+	expired := kv.isExpired(key)
+	kv.WatchersMu.Lock()
+	defer kv.WatchersMu.Unlock()
+	client.WatchedKeys[key] = expired
+	clients, ok := kv.Watchers[key]
+	if !ok {
+		clients = map[*ClientType]struct{}{}
+		kv.Watchers[key] = clients
+	}
+	clients[client] = struct{}{}
+}
+
+// UnwatchAll forgets every key watched by the client. Keys left with no
+// watchers are dropped from the registry, so unwatched keys cost nothing.
+func (kv *KV) UnwatchAll(client *ClientType) {
+	kv.WatchersMu.Lock()
+	defer kv.WatchersMu.Unlock()
+	for key := range client.WatchedKeys {
+		clients := kv.Watchers[key]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(kv.Watchers, key)
+		}
+	}
+	client.WatchedKeys = map[string]bool{}
+	client.WatchDirty = false
+}
+
+// SignalModifiedKey must be called after any change to key, whatever its
+// type and whatever caused it. It fails the transactions of every client
+// watching the key.
+func (kv *KV) SignalModifiedKey(key string) {
+	kv.WatchersMu.Lock()
+	defer kv.WatchersMu.Unlock()
+	for client := range kv.Watchers[key] {
+		client.WatchDirty = true
+	}
+}
+
+// SignalExpiredKey is SignalModifiedKey for the deletion of an expired key.
+// Clients that watched the key after it had already expired saw it as
+// missing, so its removal doesn't affect them.
+func (kv *KV) SignalExpiredKey(key string) {
+	kv.WatchersMu.Lock()
+	defer kv.WatchersMu.Unlock()
+	for client := range kv.Watchers[key] {
+		if !client.WatchedKeys[key] {
+			client.WatchDirty = true
+		}
+	}
+}
+
+// SignalFlushed fails the transactions of every watching client. It is used
+// when the whole keyspace is replaced or emptied.
+func (kv *KV) SignalFlushed() {
+	kv.WatchersMu.Lock()
+	defer kv.WatchersMu.Unlock()
+	for _, clients := range kv.Watchers {
+		for client := range clients {
+			client.WatchDirty = true
+		}
+	}
+}
+
+// WatchFailed reports whether EXEC must abort for the client: a watched key
+// was modified, or expired after it was watched without being deleted yet.
+func (kv *KV) WatchFailed(client *ClientType) bool {
+	kv.WatchersMu.Lock()
+	dirty := client.WatchDirty
+	kv.WatchersMu.Unlock()
+	if dirty {
+		return true
+	}
+	for key, expiredAtWatch := range client.WatchedKeys {
+		if !expiredAtWatch && kv.isExpired(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpired reports whether key holds a string whose TTL has passed but
+// which hasn't been deleted yet. Only strings carry an expiry.
+func (kv *KV) isExpired(key string) bool {
+	kv.StringsMu.RLock()
+	value, ok := kv.Strings[key]
+	kv.StringsMu.RUnlock()
+	return ok && value.Expires > 0 && value.Expires < time.Now().UnixMilli()
+}
@@ -0,0 +1,121 @@
+package lua
+
+type expr interface{}
+
+type stmt interface{}
+
+type block struct {
+	stmts []stmt
+}
+
+type (
+	nilExpr    struct{}
+	trueExpr   struct{}
+	falseExpr  struct{}
+	varargExpr struct{}
+	numberExpr struct{ value float64 }
+	stringExpr struct{ value string }
+	nameExpr   struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj, key expr
+		line     int
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+		line int
+	}
+	methodCallExpr struct {
+		obj  expr
+		name string
+		args []expr
+		line int
+	}
+	functionExpr struct {
+		name   string
+		params []string
+		vararg bool
+		body   *block
+		line   int
+	}
+	binopExpr struct {
+		op   string
+		l, r expr
+		line int
+	}
+	unopExpr struct {
+		op   string
+		e    expr
+		line int
+	}
+	// parenExpr truncates a multi-valued expression to one value.
+	parenExpr struct{ e expr }
+	tableExpr struct {
+		fields []tableField
+		line   int
+	}
+)
+
+// tableField is one item of a table constructor; key is nil for positional
+// items.
+type tableField struct {
+	key, value expr
+}
+
+type (
+	localStmt struct {
+		names []string
+		exprs []expr
+		line  int
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call expr
+		line int
+	}
+	doStmt    struct{ body *block }
+	whileStmt struct {
+		cond expr
+		body *block
+		line int
+	}
+	repeatStmt struct {
+		body *block
+		cond expr
+		line int
+	}
+	ifStmt struct {
+		conds     []expr
+		blocks    []*block
+		elseBlock *block
+		line      int
+	}
+	numForStmt struct {
+		name               string
+		start, limit, step expr
+		body               *block
+		line               int
+	}
+	genForStmt struct {
+		names []string
+		exprs []expr
+		body  *block
+		line  int
+	}
+	localFunctionStmt struct {
+		name string
+		fn   *functionExpr
+	}
+	returnStmt struct {
+		exprs []expr
+		line  int
+	}
+	breakStmt struct{}
+)
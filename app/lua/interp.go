@@ -0,0 +1,707 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+// maxCallDepth bounds recursion like LUAI_MAXCCALLS does.
+const maxCallDepth = 200
+
+// interruptEvery is how many statements run between Interrupt polls.
+const interruptEvery = 1000
+
+// State runs compiled chunks against a global environment.
+type State struct {
+	Globals *Table
+	// Interrupt, when set, is polled while the script runs; a non-nil error
+	// stops it and cannot be caught by pcall.
+	Interrupt func() error
+	// StrictGlobals rejects reads of undefined globals and the creation of
+	// new ones, as Redis does to keep scripts from leaking state.
+	StrictGlobals bool
+
+	stringLib *Table
+	chunk     string
+	line      int
+	depth     int
+	steps     int
+}
+
+type cell struct {
+	value Value
+}
+
+type scope struct {
+	vars   map[string]*cell
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{parent: parent}
+}
+
+func (sc *scope) declare(name string, v Value) {
+	if sc.vars == nil {
+		sc.vars = map[string]*cell{}
+	}
+	sc.vars[name] = &cell{value: v}
+}
+
+func (sc *scope) lookup(name string) *cell {
+	for ; sc != nil; sc = sc.parent {
+		if c, ok := sc.vars[name]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// frame holds the state of one Lua function call.
+type frame struct {
+	varargs []Value
+}
+
+type flow int
+
+const (
+	flowNormal flow = iota
+	flowBreak
+	flowReturn
+)
+
+// Errorf raises a catchable error located at the line being run, the way
+// luaL_error does.
+func (s *State) Errorf(format string, args ...any) error {
+	return s.errorAt(s.line, fmt.Sprintf(format, args...))
+}
+
+func (s *State) errorAt(line int, msg string) error {
+	return &Error{Value: fmt.Sprintf("%s:%d: %s", s.chunk, line, msg)}
+}
+
+// Where returns the position of the line being run, as "chunk:line:".
+func (s *State) Where() string {
+	return fmt.Sprintf("%s:%d:", s.chunk, s.line)
+}
+
+// Run executes a compiled chunk, passing args as its varargs.
+func (s *State) Run(c *Chunk, args ...Value) ([]Value, error) {
+	s.chunk = c.Name
+	s.line = 0
+	s.depth = 0
+	return s.Call(&Function{Name: c.fn.name, proto: c.fn}, args)
+}
+
+// Call calls a function value with the given arguments.
+func (s *State) Call(fn Value, args []Value) ([]Value, error) {
+	f, ok := fn.(*Function)
+	if !ok {
+		return nil, s.Errorf("attempt to call a %s value", TypeName(fn))
+	}
+	if s.depth >= maxCallDepth {
+		return nil, s.Errorf("stack overflow")
+	}
+	s.depth++
+	defer func() { s.depth-- }()
+	if f.native != nil {
+		return f.native(s, args)
+	}
+	sc := newScope(f.env)
+	for i, name := range f.proto.params {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		sc.declare(name, v)
+	}
+	fr := &frame{}
+	if f.proto.vararg && len(args) > len(f.proto.params) {
+		fr.varargs = args[len(f.proto.params):]
+	}
+	fl, vals, err := s.execBlock(f.proto.body, sc, fr)
+	if err != nil {
+		return nil, err
+	}
+	if fl == flowReturn {
+		return vals, nil
+	}
+	return nil, nil
+}
+
+func (s *State) tick() error {
+	s.steps++
+	if s.Interrupt != nil && s.steps%interruptEvery == 0 {
+		return s.Interrupt()
+	}
+	return nil
+}
+
+func (s *State) execBlock(b *block, sc *scope, fr *frame) (flow, []Value, error) {
+	for _, st := range b.stmts {
+		if err := s.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+		fl, vals, err := s.exec(st, sc, fr)
+		if err != nil || fl != flowNormal {
+			return fl, vals, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (s *State) exec(st stmt, sc *scope, fr *frame) (flow, []Value, error) {
+	switch st := st.(type) {
+	case *localStmt:
+		s.line = st.line
+		vals, err := s.evalList(st.exprs, sc, fr)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, name := range st.names {
+			var v Value
+			if i < len(vals) {
+				v = vals[i]
+			}
+			sc.declare(name, v)
+		}
+	case *localFunctionStmt:
+		sc.declare(st.name, nil)
+		sc.vars[st.name].value = &Function{Name: st.name, proto: st.fn, env: sc}
+	case *assignStmt:
+		s.line = st.line
+		vals, err := s.evalList(st.exprs, sc, fr)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, target := range st.targets {
+			var v Value
+			if i < len(vals) {
+				v = vals[i]
+			}
+			if err := s.assign(target, v, sc, fr); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	case *callStmt:
+		s.line = st.line
+		if _, err := s.evalMulti(st.call, sc, fr); err != nil {
+			return flowNormal, nil, err
+		}
+	case *doStmt:
+		return s.execBlock(st.body, newScope(sc), fr)
+	case *whileStmt:
+		for {
+			s.line = st.line
+			cond, err := s.eval(st.cond, sc, fr)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if !Truthy(cond) {
+				break
+			}
+			if fl, vals, err := s.loopBody(st.body, newScope(sc), fr); err != nil || fl != flowNormal {
+				return loopResult(fl, vals, err)
+			}
+		}
+	case *repeatStmt:
+		for {
+			// The condition can see the body's locals.
+			inner := newScope(sc)
+			if fl, vals, err := s.loopBody(st.body, inner, fr); err != nil || fl != flowNormal {
+				return loopResult(fl, vals, err)
+			}
+			s.line = st.line
+			cond, err := s.eval(st.cond, inner, fr)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if Truthy(cond) {
+				break
+			}
+		}
+	case *ifStmt:
+		s.line = st.line
+		for i, c := range st.conds {
+			cond, err := s.eval(c, sc, fr)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if Truthy(cond) {
+				return s.execBlock(st.blocks[i], newScope(sc), fr)
+			}
+		}
+		if st.elseBlock != nil {
+			return s.execBlock(st.elseBlock, newScope(sc), fr)
+		}
+	case *numForStmt:
+		return s.execNumFor(st, sc, fr)
+	case *genForStmt:
+		return s.execGenFor(st, sc, fr)
+	case *returnStmt:
+		s.line = st.line
+		vals, err := s.evalList(st.exprs, sc, fr)
+		return flowReturn, vals, err
+	case *breakStmt:
+		return flowBreak, nil, nil
+	default:
+		return flowNormal, nil, fmt.Errorf("lua: unknown statement %T", st)
+	}
+	return flowNormal, nil, nil
+}
+
+// loopBody runs one iteration of a loop, polling Interrupt even for loops
+// with empty bodies.
+func (s *State) loopBody(b *block, sc *scope, fr *frame) (flow, []Value, error) {
+	if err := s.tick(); err != nil {
+		return flowNormal, nil, err
+	}
+	return s.execBlock(b, sc, fr)
+}
+
+// loopResult turns the result of a loop body that ended the loop into the
+// result of the loop statement: break stops at the loop, return goes on.
+func loopResult(fl flow, vals []Value, err error) (flow, []Value, error) {
+	if fl == flowBreak {
+		return flowNormal, nil, err
+	}
+	return fl, vals, err
+}
+
+func (s *State) execNumFor(st *numForStmt, sc *scope, fr *frame) (flow, []Value, error) {
+	s.line = st.line
+	bound := func(e expr, what string) (float64, error) {
+		v, err := s.eval(e, sc, fr)
+		if err != nil {
+			return 0, err
+		}
+		n, ok := ToNumber(v)
+		if !ok {
+			return 0, s.errorAt(st.line, "'for' "+what+" must be a number")
+		}
+		return n, nil
+	}
+	start, err := bound(st.start, "initial value")
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	limit, err := bound(st.limit, "limit")
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	step := 1.0
+	if st.step != nil {
+		if step, err = bound(st.step, "step"); err != nil {
+			return flowNormal, nil, err
+		}
+	}
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		inner := newScope(sc)
+		inner.declare(st.name, i)
+		if fl, vals, err := s.loopBody(st.body, inner, fr); err != nil || fl != flowNormal {
+			return loopResult(fl, vals, err)
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (s *State) execGenFor(st *genForStmt, sc *scope, fr *frame) (flow, []Value, error) {
+	s.line = st.line
+	init, err := s.evalList(st.exprs, sc, fr)
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	init = append(init, nil, nil, nil)
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		s.line = st.line
+		vals, err := s.Call(fn, []Value{state, control})
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		if len(vals) == 0 || vals[0] == nil {
+			return flowNormal, nil, nil
+		}
+		control = vals[0]
+		inner := newScope(sc)
+		for i, name := range st.names {
+			var v Value
+			if i < len(vals) {
+				v = vals[i]
+			}
+			inner.declare(name, v)
+		}
+		if fl, vals, err := s.loopBody(st.body, inner, fr); err != nil || fl != flowNormal {
+			return loopResult(fl, vals, err)
+		}
+	}
+}
+
+func (s *State) assign(target expr, v Value, sc *scope, fr *frame) error {
+	switch t := target.(type) {
+	case *nameExpr:
+		if c := sc.lookup(t.name); c != nil {
+			c.value = v
+			return nil
+		}
+		if s.StrictGlobals && s.Globals.Get(t.name) == nil {
+			return s.errorAt(t.line, fmt.Sprintf("Script attempted to create global variable '%s'", t.name))
+		}
+		return s.setIndex(s.Globals, t.name, v, t.line)
+	case *indexExpr:
+		obj, err := s.eval(t.obj, sc, fr)
+		if err != nil {
+			return err
+		}
+		key, err := s.eval(t.key, sc, fr)
+		if err != nil {
+			return err
+		}
+		return s.setIndex(obj, key, v, t.line)
+	}
+	return s.Errorf("cannot assign to this expression")
+}
+
+func (s *State) setIndex(obj, key, v Value, line int) error {
+	t, ok := obj.(*Table)
+	if !ok {
+		return s.errorAt(line, fmt.Sprintf("attempt to index a %s value", TypeName(obj)))
+	}
+	if t.readonly {
+		return s.errorAt(line, "Attempt to modify a readonly table")
+	}
+	if key == nil {
+		return s.errorAt(line, "table index is nil")
+	}
+	if n, ok := key.(float64); ok && math.IsNaN(n) {
+		return s.errorAt(line, "table index is NaN")
+	}
+	t.Set(key, v)
+	return nil
+}
+
+func (s *State) index(obj, key Value, line int) (Value, error) {
+	switch o := obj.(type) {
+	case *Table:
+		return o.Get(key), nil
+	case string:
+		// Strings index the string library, which makes s:upper() work.
+		if s.stringLib != nil {
+			return s.stringLib.Get(key), nil
+		}
+	}
+	return nil, s.errorAt(line, fmt.Sprintf("attempt to index a %s value", TypeName(obj)))
+}
+
+// eval evaluates an expression to exactly one value.
+func (s *State) eval(e expr, sc *scope, fr *frame) (Value, error) {
+	switch e := e.(type) {
+	case *nilExpr:
+		return nil, nil
+	case *trueExpr:
+		return true, nil
+	case *falseExpr:
+		return false, nil
+	case *numberExpr:
+		return e.value, nil
+	case *stringExpr:
+		return e.value, nil
+	case *nameExpr:
+		if c := sc.lookup(e.name); c != nil {
+			return c.value, nil
+		}
+		v := s.Globals.Get(e.name)
+		if v == nil && s.StrictGlobals {
+			return nil, s.errorAt(e.line, fmt.Sprintf("Script attempted to access nonexistent global variable '%s'", e.name))
+		}
+		return v, nil
+	case *indexExpr:
+		obj, err := s.eval(e.obj, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		key, err := s.eval(e.key, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		return s.index(obj, key, e.line)
+	case *parenExpr:
+		return s.eval(e.e, sc, fr)
+	case *functionExpr:
+		return &Function{Name: e.name, proto: e, env: sc}, nil
+	case *tableExpr:
+		return s.evalTable(e, sc, fr)
+	case *binopExpr:
+		return s.evalBinop(e, sc, fr)
+	case *unopExpr:
+		return s.evalUnop(e, sc, fr)
+	case *varargExpr, *callExpr, *methodCallExpr:
+		vals, err := s.evalMulti(e, sc, fr)
+		if err != nil || len(vals) == 0 {
+			return nil, err
+		}
+		return vals[0], nil
+	}
+	return nil, fmt.Errorf("lua: unknown expression %T", e)
+}
+
+// evalMulti evaluates calls and "..." to all of their values.
+func (s *State) evalMulti(e expr, sc *scope, fr *frame) ([]Value, error) {
+	switch e := e.(type) {
+	case *varargExpr:
+		return append([]Value(nil), fr.varargs...), nil
+	case *callExpr:
+		fn, err := s.eval(e.fn, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		args, err := s.evalList(e.args, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fn.(*Function); !ok {
+			return nil, s.errorAt(e.line, fmt.Sprintf("attempt to call %s", describe(e.fn, fn, sc)))
+		}
+		s.line = e.line
+		vals, err := s.Call(fn, args)
+		s.line = e.line
+		return vals, err
+	case *methodCallExpr:
+		obj, err := s.eval(e.obj, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		fn, err := s.index(obj, e.name, e.line)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fn.(*Function); !ok {
+			return nil, s.errorAt(e.line, fmt.Sprintf("attempt to call method '%s' (a %s value)", e.name, TypeName(fn)))
+		}
+		args, err := s.evalList(e.args, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		s.line = e.line
+		vals, err := s.Call(fn, append([]Value{obj}, args...))
+		s.line = e.line
+		return vals, err
+	}
+	v, err := s.eval(e, sc, fr)
+	return []Value{v}, err
+}
+
+// describe names the callee in "attempt to call" errors as Lua 5.1 does.
+func describe(e expr, v Value, sc *scope) string {
+	kind := TypeName(v)
+	switch e := e.(type) {
+	case *nameExpr:
+		if sc.lookup(e.name) != nil {
+			return fmt.Sprintf("local '%s' (a %s value)", e.name, kind)
+		}
+		return fmt.Sprintf("global '%s' (a %s value)", e.name, kind)
+	case *indexExpr:
+		if k, ok := e.key.(*stringExpr); ok {
+			return fmt.Sprintf("field '%s' (a %s value)", k.value, kind)
+		}
+	}
+	return fmt.Sprintf("a %s value", kind)
+}
+
+// evalList evaluates an expression list; only the last expression may
+// produce more than one value.
+func (s *State) evalList(exprs []expr, sc *scope, fr *frame) ([]Value, error) {
+	vals := make([]Value, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			last, err := s.evalMulti(e, sc, fr)
+			if err != nil {
+				return nil, err
+			}
+			return append(vals, last...), nil
+		}
+		v, err := s.eval(e, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func (s *State) evalTable(e *tableExpr, sc *scope, fr *frame) (Value, error) {
+	t := NewTable()
+	n := 0
+	for i, f := range e.fields {
+		if f.key != nil {
+			key, err := s.eval(f.key, sc, fr)
+			if err != nil {
+				return nil, err
+			}
+			v, err := s.eval(f.value, sc, fr)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.setIndex(t, key, v, e.line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if i == len(e.fields)-1 {
+			vals, err := s.evalMulti(f.value, sc, fr)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				n++
+				t.Set(float64(n), v)
+			}
+			continue
+		}
+		v, err := s.eval(f.value, sc, fr)
+		if err != nil {
+			return nil, err
+		}
+		n++
+		t.Set(float64(n), v)
+	}
+	return t, nil
+}
+
+func (s *State) evalBinop(e *binopExpr, sc *scope, fr *frame) (Value, error) {
+	l, err := s.eval(e.l, sc, fr)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "and":
+		if !Truthy(l) {
+			return l, nil
+		}
+		return s.eval(e.r, sc, fr)
+	case "or":
+		if Truthy(l) {
+			return l, nil
+		}
+		return s.eval(e.r, sc, fr)
+	}
+	r, err := s.eval(e.r, sc, fr)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return l == r, nil
+	case "~=":
+		return l != r, nil
+	case "<", "<=", ">", ">=":
+		return s.compare(e.op, l, r, e.line)
+	case "..":
+		ls, lok := concatOperand(l)
+		rs, rok := concatOperand(r)
+		if !lok || !rok {
+			bad := l
+			if lok {
+				bad = r
+			}
+			return nil, s.errorAt(e.line, fmt.Sprintf("attempt to concatenate a %s value", TypeName(bad)))
+		}
+		return ls + rs, nil
+	}
+	a, aok := ToNumber(l)
+	b, bok := ToNumber(r)
+	if !aok || !bok {
+		bad := l
+		if aok {
+			bad = r
+		}
+		return nil, s.errorAt(e.line, fmt.Sprintf("attempt to perform arithmetic on a %s value", TypeName(bad)))
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("lua: unknown operator %s", e.op)
+}
+
+func concatOperand(v Value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatNumber(v), true
+	}
+	return "", false
+}
+
+func (s *State) compare(op string, l, r Value, line int) (Value, error) {
+	var less, equal bool
+	switch a := l.(type) {
+	case float64:
+		b, ok := r.(float64)
+		if !ok {
+			return nil, s.compareError(l, r, line)
+		}
+		less, equal = a < b, a == b
+	case string:
+		b, ok := r.(string)
+		if !ok {
+			return nil, s.compareError(l, r, line)
+		}
+		less, equal = a < b, a == b
+	default:
+		return nil, s.compareError(l, r, line)
+	}
+	switch op {
+	case "<":
+		return less, nil
+	case "<=":
+		return less || equal, nil
+	case ">":
+		return !less && !equal, nil
+	}
+	return !less, nil
+}
+
+func (s *State) compareError(l, r Value, line int) error {
+	if TypeName(l) == TypeName(r) {
+		return s.errorAt(line, fmt.Sprintf("attempt to compare two %s values", TypeName(l)))
+	}
+	return s.errorAt(line, fmt.Sprintf("attempt to compare %s with %s", TypeName(l), TypeName(r)))
+}
+
+func (s *State) evalUnop(e *unopExpr, sc *scope, fr *frame) (Value, error) {
+	v, err := s.eval(e.e, sc, fr)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "not":
+		return !Truthy(v), nil
+	case "-":
+		n, ok := ToNumber(v)
+		if !ok {
+			return nil, s.errorAt(e.line, fmt.Sprintf("attempt to perform arithmetic on a %s value", TypeName(v)))
+		}
+		return -n, nil
+	case "#":
+		switch v := v.(type) {
+		case string:
+			return float64(len(v)), nil
+		case *Table:
+			return float64(v.Len()), nil
+		}
+		return nil, s.errorAt(e.line, fmt.Sprintf("attempt to get length of a %s value", TypeName(v)))
+	}
+	return nil, fmt.Errorf("lua: unknown operator %s", e.op)
+}
@@ -0,0 +1,320 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	tokEOF = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokOp
+)
+
+type token struct {
+	kind int
+	s    string
+	n    float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// Operators, longest first so that "..." wins over ".." and ".".
+var operators = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type lexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string
+}
+
+func (l *lexer) errorf(format string, args ...any) error {
+	return &Error{Value: fmt.Sprintf("%s:%d: %s", l.chunk, l.line, fmt.Sprintf(format, args...))}
+}
+
+// tokens splits the whole source up front; scripts are small.
+func (l *lexer) tokens() ([]token, error) {
+	var toks []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, tok)
+		if tok.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpaceAndComments(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case isLetter(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if keywords[word] {
+			return token{kind: tokKeyword, s: word, line: l.line}, nil
+		}
+		return token{kind: tokName, s: word, line: l.line}, nil
+	case isDigit(c) || (c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		return l.number()
+	case c == '"' || c == '\'':
+		return l.quotedString(c)
+	case c == '[' && l.longBracketLevel() >= 0:
+		line := l.line
+		s, err := l.longString()
+		if err != nil {
+			return token{}, err
+		}
+		return token{kind: tokString, s: s, line: line}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, s: op, line: l.line}, nil
+		}
+	}
+	return token{}, l.errorf("unexpected symbol near '%c'", c)
+}
+
+func (l *lexer) skipSpaceAndComments() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if l.pos < len(l.src) && l.src[l.pos] == '[' && l.longBracketLevel() >= 0 {
+				if _, err := l.longString(); err != nil {
+					return err
+				}
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// longBracketLevel returns the level of the long bracket opening at the
+// current position ("[[" is 0, "[=[" is 1...), or -1 if there is none.
+func (l *lexer) longBracketLevel() int {
+	p := l.pos + 1
+	level := 0
+	for p < len(l.src) && l.src[p] == '=' {
+		level++
+		p++
+	}
+	if p < len(l.src) && l.src[p] == '[' {
+		return level
+	}
+	return -1
+}
+
+func (l *lexer) longString() (string, error) {
+	level := l.longBracketLevel()
+	l.pos += level + 2
+	// A newline right after the opening bracket is skipped.
+	if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+		l.line++
+		l.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		return "", l.errorf("unfinished long string")
+	}
+	s := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(s, "\n")
+	l.pos += end + len(closing)
+	return s, nil
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && isHexDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	} else {
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if isDigit(c) || c == '.' {
+				l.pos++
+			} else if (c == 'e' || c == 'E') && l.pos+1 < len(l.src) {
+				l.pos++
+				if l.src[l.pos] == '+' || l.src[l.pos] == '-' {
+					l.pos++
+				}
+			} else {
+				break
+			}
+		}
+	}
+	for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+	text := l.src[start:l.pos]
+	n, ok := parseNumber(text)
+	if !ok {
+		return token{}, l.errorf("malformed number near '%s'", text)
+	}
+	return token{kind: tokNumber, n: n, line: l.line}, nil
+}
+
+func (l *lexer) quotedString(quote byte) (token, error) {
+	line := l.line
+	l.pos++
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return token{}, l.errorf("unfinished string")
+		}
+		c := l.src[l.pos]
+		if c == quote {
+			l.pos++
+			return token{kind: tokString, s: sb.String(), line: line}, nil
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			l.pos++
+			continue
+		}
+		l.pos++
+		if l.pos >= len(l.src) {
+			return token{}, l.errorf("unfinished string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\\', '"', '\'':
+			sb.WriteByte(c)
+		case '\n':
+			l.line++
+			sb.WriteByte('\n')
+		case 'x':
+			if l.pos+2 > len(l.src) || !isHexDigit(l.src[l.pos]) || !isHexDigit(l.src[l.pos+1]) {
+				return token{}, l.errorf("hexadecimal digit expected")
+			}
+			v, _ := strconv.ParseUint(l.src[l.pos:l.pos+2], 16, 8)
+			sb.WriteByte(byte(v))
+			l.pos += 2
+		case 'z':
+			for l.pos < len(l.src) && strings.IndexByte(" \t\r\n\f\v", l.src[l.pos]) >= 0 {
+				if l.src[l.pos] == '\n' {
+					l.line++
+				}
+				l.pos++
+			}
+		default:
+			if !isDigit(c) {
+				return token{}, l.errorf("invalid escape sequence '\\%c'", c)
+			}
+			v := int(c - '0')
+			for i := 0; i < 2 && l.pos < len(l.src) && isDigit(l.src[l.pos]); i++ {
+				v = v*10 + int(l.src[l.pos]-'0')
+				l.pos++
+			}
+			if v > 255 {
+				return token{}, l.errorf("escape sequence too large")
+			}
+			sb.WriteByte(byte(v))
+		}
+	}
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// parseNumber converts a numeral the way Lua does: decimal with optional
+// fraction and exponent, or hexadecimal integers.
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	body := s
+	if strings.HasPrefix(body, "-") {
+		neg = true
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		v, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(v), true
+		}
+		return float64(v), true
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789+-.eE", r)
+	}) >= 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return v, true
+		}
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,193 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// show renders the values a chunk returned, tables as {k=v ...} in key
+// order.
+func show(vals []Value) string {
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = showValue(v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func showValue(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return `"` + v + `"`
+	case *Table:
+		var items []string
+		for k, val, _ := v.Next(nil); k != nil; k, val, _ = v.Next(k) {
+			items = append(items, showValue(k)+"="+showValue(val))
+		}
+		return "{" + strings.Join(items, " ") + "}"
+	}
+	return ToString(v)
+}
+
+// runChunk compiles and runs src, returning its results or error message.
+func runChunk(s *State, src string) string {
+	chunk, err := Compile(src, "test")
+	if err != nil {
+		return "compile: " + err.Error()
+	}
+	vals, err := s.Run(chunk)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return show(vals)
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// arithmetic and numbers
+		{"return 1 + 2 * 3", "7"},
+		{"return (1 + 2) * 3", "9"},
+		{"return 7 / 2, 7 % 3, -7 % 3, 2 ^ 10", "3.5, 1, 2, 1024"},
+		{"return 1 / 0, -1 / 0", "inf, -inf"},
+		{"return 0x10, 1e3, .5", "16, 1000, 0.5"},
+		{"return 2 ^ 53", "9.007199254741e+15"},
+		{"return 10 == 10.0, 1 < 2, 'a' < 'b', 1 ~= 2", "true, true, true, true"},
+		{"return '10' + 5, '3' * '4'", "15, 12"},
+		{"return 1 .. 2", `"12"`},
+		{"return -(-3), not nil, not 0", "3, true, false"},
+		{"return nil and 1, false or 'x', 1 and 2", `nil, "x", 2`},
+		{"return #'abc', #{1, 2, 3}", "3, 3"},
+		{"return 'a' + 1", `error: test:1: attempt to perform arithmetic on a string value`},
+		{"return {} .. 'x'", "error: test:1: attempt to concatenate a table value"},
+		{"return 1 < 'x'", "error: test:1: attempt to compare number with string"},
+
+		// tostring and string.format
+		{"return tostring(1/3)", `"0.33333333333333"`},
+		{"return tostring(10), tostring(1e15), tostring(1e16), tostring(-0.5)", `"10", "1e+15", "1e+16", "-0.5"`},
+		{"return tostring(nil), tostring(true)", `"nil", "true"`},
+		{"return string.format('%d|%5.2f|%s|%q', 42.9, 3.14159, 'x', 'a\"b')", `"42| 3.14|x|"a\"b""`},
+		{"return string.format('%x %X %o %e %g %%', 255, 255, 8, 1234.5, 0.0001)", `"ff FF 10 1.234500e+03 0.0001 %"`},
+		{"return string.format('%5s|%-5s|', 'ab', 'ab')", `"   ab|ab   |"`},
+		{"return string.format('%d', 'x')", "error: test:1: bad argument #2 to 'format' (number expected, got string)"},
+		{"return tonumber('0x1f'), tonumber('z', 36), tonumber('x')", "31, 35, nil"},
+
+		// strings and tables
+		{"return string.sub('hello', 2, -2), ('x'):rep(3), string.upper('a')", `"ell", "xxx", "A"`},
+		{"return string.find('hello', 'l'), string.find('a.b', '.', 1, true)", "3, 2, 2"},
+		{"return string.byte('A'), string.char(72, 105)", `65, "Hi"`},
+		{"local t = {3, 1, 2} table.sort(t) return table.concat(t, ',')", `"1,2,3"`},
+		{"local t = {} table.insert(t, 'a') table.insert(t, 1, 'b') return t[1], t[2], table.remove(t), #t", `"b", "a", "a", 1`},
+		{"local t = {x = 1, [2] = 'y'} t.z = t.x + 1 return t.x, t[2], t['z']", `1, "y", 2`},
+		{"return unpack({1, 2, 3})", "1, 2, 3"},
+		{"local n = 0 for k, v in pairs({a = 1, b = 2}) do n = n + v end return n", "3"},
+		{"local s = '' for i, v in ipairs({'a', 'b', nil, 'd'}) do s = s .. v end return s", `"ab"`},
+		{"string.x = 1", "error: test:1: Attempt to modify a readonly table"},
+
+		// control flow
+		{"local s = 0 for i = 1, 10, 3 do s = s + i end return s", "22"},
+		{"local s = 0 for i = 10, 1, -1 do if i == 5 then break end s = s + i end return s", "40"},
+		{"local i = 0 while i < 5 do i = i + 1 end return i", "5"},
+		{"local i = 0 repeat i = i + 2 until i > 5 return i", "6"},
+		{"local x = 5 if x < 3 then return 'a' elseif x < 6 then return 'b' else return 'c' end", `"b"`},
+
+		// closures and varargs
+		{`local function counter()
+			local n = 0
+			return function() n = n + 1 return n end
+		end
+		local a, b = counter(), counter()
+		a() a()
+		return a(), b()`, "3, 1"},
+		{`local fs = {}
+		for i = 1, 3 do fs[i] = function() return i end end
+		return fs[1](), fs[2](), fs[3]()`, "1, 2, 3"},
+		{"local function f(...) return select('#', ...), ... end return f(1, nil, 3)", "3, 1, nil, 3"},
+		{"local function f(a, ...) local t = {...} return a, #t, t[2] end return f(1, 2, 3)", "1, 2, 3"},
+		{"local function f() return 1, 2 end return f(), f()", "1, 1, 2"},
+		{"local function f() return 1, 2 end return (f())", "1"},
+		{"return select(2, 'a', 'b', 'c')", `"b", "c"`},
+		{"local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(20)", "6765"},
+
+		// errors
+		{"error('boom')", "error: test:1: boom"},
+		{"error('boom', 0)", "error: boom"},
+		{"error({code = 1})", "error: (error object is a table value)"},
+		{"return pcall(function() error('x') end)", `false, "test:1: x"`},
+		{"return pcall(function() error({code = 7}) end)", "false, {\"code\"=7}"},
+		{"return pcall(function() return 1, 2 end)", "true, 1, 2"},
+		{"return assert(1, 'm'), pcall(assert, false, 'failed')", `1, false, "failed"`},
+		{"local t = nil return t.x", "error: test:1: attempt to index a nil value"},
+		{"local f = 1 f()", "error: test:1: attempt to call local 'f' (a number value)"},
+		{"local function f() return f() + 1 end return f()", "error: test:1: stack overflow"},
+		{"return pcall(function() local function f() return f() + 1 end return f() end)", `false, "test:1: stack overflow"`},
+
+		// syntax
+		{"return 1 +", "compile: test:1: unexpected symbol near '<eof>'"},
+		{"x = = 1", "compile: test:1: unexpected symbol near '='"},
+		{"return 'abc", "compile: test:1: unfinished string"},
+	}
+	for _, tt := range tests {
+		if got := runChunk(NewState(), tt.src); got != tt.want {
+			t.Errorf("%s\n got %s\nwant %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestStrictGlobals(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x = 1", "error: test:1: Script attempted to create global variable 'x'"},
+		{"return y", "error: test:1: Script attempted to access nonexistent global variable 'y'"},
+		{"local function f() z = 1 end f()", "error: test:1: Script attempted to create global variable 'z'"},
+		{"local x = 1 x = 2 return x", "2"},
+		{"KEYS = 5 return KEYS", "5"},
+		{"return rawget(_G or {}, 'x')", "error: test:1: Script attempted to access nonexistent global variable '_G'"},
+		{"return type(string), type(nil)", `"table", "nil"`},
+	}
+	for _, tt := range tests {
+		s := NewState()
+		s.Globals.Set("KEYS", NewTable())
+		s.StrictGlobals = true
+		if got := runChunk(s, tt.src); got != tt.want {
+			t.Errorf("%s\n got %s\nwant %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []string{
+		"while true do end",
+		"repeat until false",
+		"for i = 1, math.huge do end",
+		"local function f() return f() end while true do pcall(f) end",
+		// pcall must not catch the interruption.
+		"while true do pcall(function() while true do end end) end",
+	}
+	for _, src := range tests {
+		s := NewState()
+		polls := 0
+		s.Interrupt = func() error {
+			polls++
+			if polls == 3 {
+				return errStop
+			}
+			return nil
+		}
+		chunk, err := Compile(src, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Run(chunk); !errors.Is(err, errStop) {
+			t.Errorf("%s: error %v, want the interruption", src, err)
+		}
+	}
+}
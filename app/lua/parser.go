@@ -0,0 +1,628 @@
+package lua
+
+import "fmt"
+
+// Chunk is a compiled script, ready to run on a State.
+type Chunk struct {
+	Name string
+	fn   *functionExpr
+}
+
+// Compile parses a script. Errors are reported as "name:line: message".
+func Compile(src, name string) (*Chunk, error) {
+	lex := &lexer{src: src, line: 1, chunk: name}
+	toks, err := lex.tokens()
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, chunk: name}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("'<eof>' expected near '%s'", p.peek().text())
+	}
+	return &Chunk{Name: name, fn: &functionExpr{name: "main chunk", vararg: true, body: body}}, nil
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	chunk string
+}
+
+func (t token) text() string {
+	switch t.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return formatNumber(t.n)
+	}
+	return t.s
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) advance() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &Error{Value: fmt.Sprintf("%s:%d: %s", p.chunk, p.peek().line, fmt.Sprintf(format, args...))}
+}
+
+// check reports whether the next token is the keyword or operator s.
+func (p *parser) check(s string) bool {
+	tok := p.peek()
+	return (tok.kind == tokKeyword || tok.kind == tokOp) && tok.s == s
+}
+
+func (p *parser) accept(s string) bool {
+	if p.check(s) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return p.errorf("'%s' expected near '%s'", s, p.peek().text())
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != tokName {
+		return "", p.errorf("<name> expected near '%s'", tok.text())
+	}
+	p.advance()
+	return tok.s, nil
+}
+
+func (p *parser) blockEnds() bool {
+	tok := p.peek()
+	if tok.kind == tokEOF {
+		return true
+	}
+	if tok.kind != tokKeyword {
+		return false
+	}
+	switch tok.s {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() (*block, error) {
+	b := &block{}
+	for !p.blockEnds() {
+		if p.check("return") {
+			line := p.advance().line
+			ret := &returnStmt{line: line}
+			if !p.blockEnds() && !p.check(";") {
+				exprs, err := p.exprList()
+				if err != nil {
+					return nil, err
+				}
+				ret.exprs = exprs
+			}
+			p.accept(";")
+			b.stmts = append(b.stmts, ret)
+			if !p.blockEnds() {
+				return nil, p.errorf("'end' expected near '%s'", p.peek().text())
+			}
+			break
+		}
+		if p.accept("break") {
+			p.accept(";")
+			b.stmts = append(b.stmts, &breakStmt{})
+			if !p.blockEnds() {
+				return nil, p.errorf("'end' expected near '%s'", p.peek().text())
+			}
+			break
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			b.stmts = append(b.stmts, s)
+		}
+		p.accept(";")
+	}
+	return b, nil
+}
+
+func (p *parser) statement() (stmt, error) {
+	line := p.peek().line
+	switch {
+	case p.accept("do"):
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &doStmt{body: body}, p.expect("end")
+	case p.accept("while"):
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{cond: cond, body: body, line: line}, p.expect("end")
+	case p.accept("repeat"):
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("until"); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &repeatStmt{body: body, cond: cond, line: line}, nil
+	case p.accept("if"):
+		return p.ifStatement(line)
+	case p.accept("for"):
+		return p.forStatement(line)
+	case p.accept("function"):
+		return p.functionStatement(line)
+	case p.accept("local"):
+		if p.accept("function") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := p.functionBody(name, line, false)
+			if err != nil {
+				return nil, err
+			}
+			return &localFunctionStmt{name: name, fn: fn}, nil
+		}
+		names, err := p.nameList()
+		if err != nil {
+			return nil, err
+		}
+		s := &localStmt{names: names, line: line}
+		if p.accept("=") {
+			if s.exprs, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return p.exprStatement(line)
+}
+
+func (p *parser) ifStatement(line int) (stmt, error) {
+	s := &ifStmt{line: line}
+	for {
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.conds = append(s.conds, cond)
+		s.blocks = append(s.blocks, body)
+		if p.accept("elseif") {
+			continue
+		}
+		if p.accept("else") {
+			if s.elseBlock, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return s, p.expect("end")
+	}
+}
+
+func (p *parser) forStatement(line int) (stmt, error) {
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("=") {
+		s := &numForStmt{name: first, line: line}
+		if s.start, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if s.limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if p.accept(",") {
+			if s.step, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		if s.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		return s, p.expect("end")
+	}
+	s := &genForStmt{names: []string{first}, line: line}
+	for p.accept(",") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		s.names = append(s.names, name)
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	if s.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	if s.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return s, p.expect("end")
+}
+
+// functionStatement desugars "function a.b:c() end" into an assignment.
+func (p *parser) functionStatement(line int) (stmt, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	var target expr = &nameExpr{name: name, line: line}
+	fullName := name
+	method := false
+	for p.check(".") || p.check(":") {
+		method = p.advance().s == ":"
+		key, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		fullName += "." + key
+		target = &indexExpr{obj: target, key: &stringExpr{value: key}, line: line}
+		if method {
+			break
+		}
+	}
+	fn, err := p.functionBody(fullName, line, method)
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: line}, nil
+}
+
+func (p *parser) functionBody(name string, line int, method bool) (*functionExpr, error) {
+	fn := &functionExpr{name: name, line: line}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if !p.check(")") {
+		for {
+			if p.accept("...") {
+				fn.vararg = true
+				break
+			}
+			param, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn.params = append(fn.params, param)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, p.expect("end")
+}
+
+func (p *parser) exprStatement(line int) (stmt, error) {
+	e, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.check("=") || p.check(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			t, err := p.suffixedExpr()
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		for _, t := range targets {
+			switch t.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				return nil, p.errorf("syntax error near '='")
+			}
+		}
+		exprs, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{targets: targets, exprs: exprs, line: line}, nil
+	}
+	switch e.(type) {
+	case *callExpr, *methodCallExpr:
+		return &callStmt{call: e, line: line}, nil
+	}
+	return nil, p.errorf("syntax error near '%s'", p.peek().text())
+}
+
+func (p *parser) nameList() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *parser) exprList() ([]expr, error) {
+	var exprs []expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// Binary operator priorities as in Lua 5.1: left and right binding power.
+var binaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expr() (expr, error) {
+	return p.subExpr(0)
+}
+
+func (p *parser) subExpr(limit int) (expr, error) {
+	var left expr
+	var err error
+	tok := p.peek()
+	if (tok.kind == tokKeyword && tok.s == "not") || (tok.kind == tokOp && (tok.s == "-" || tok.s == "#")) {
+		p.advance()
+		operand, err := p.subExpr(unaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &unopExpr{op: tok.s, e: operand, line: tok.line}
+	} else if left, err = p.simpleExpr(); err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp && tok.kind != tokKeyword {
+			return left, nil
+		}
+		prio, ok := binaryPriority[tok.s]
+		if !ok || prio[0] <= limit {
+			return left, nil
+		}
+		p.advance()
+		right, err := p.subExpr(prio[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &binopExpr{op: tok.s, l: left, r: right, line: tok.line}
+	}
+}
+
+func (p *parser) simpleExpr() (expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		p.advance()
+		return &numberExpr{value: tok.n}, nil
+	case tokString:
+		p.advance()
+		return &stringExpr{value: tok.s}, nil
+	case tokKeyword:
+		switch tok.s {
+		case "nil":
+			p.advance()
+			return &nilExpr{}, nil
+		case "true":
+			p.advance()
+			return &trueExpr{}, nil
+		case "false":
+			p.advance()
+			return &falseExpr{}, nil
+		case "function":
+			p.advance()
+			return p.functionBody("anonymous", tok.line, false)
+		}
+	case tokOp:
+		switch tok.s {
+		case "...":
+			p.advance()
+			return &varargExpr{}, nil
+		case "{":
+			return p.tableConstructor()
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() (expr, error) {
+	tok := p.peek()
+	if tok.kind == tokName {
+		p.advance()
+		return &nameExpr{name: tok.s, line: tok.line}, nil
+	}
+	if p.accept("(") {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &parenExpr{e: e}, p.expect(")")
+	}
+	return nil, p.errorf("unexpected symbol near '%s'", tok.text())
+}
+
+func (p *parser) suffixedExpr() (expr, error) {
+	e, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		switch {
+		case p.accept("."):
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: &stringExpr{value: key}, line: tok.line}
+		case p.accept("["):
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: key, line: tok.line}
+		case p.accept(":"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &methodCallExpr{obj: e, name: name, args: args, line: tok.line}
+		case p.check("(") || p.check("{") || tok.kind == tokString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, line: tok.line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) callArgs() ([]expr, error) {
+	tok := p.peek()
+	if tok.kind == tokString {
+		p.advance()
+		return []expr{&stringExpr{value: tok.s}}, nil
+	}
+	if p.check("{") {
+		t, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+		return []expr{t}, nil
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.accept(")") {
+		return nil, nil
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expect(")")
+}
+
+func (p *parser) tableConstructor() (expr, error) {
+	t := &tableExpr{line: p.peek().line}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.check("}") {
+		var field tableField
+		switch {
+		case p.accept("["):
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			field.key = key
+		case p.peek().kind == tokName && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].s == "=":
+			field.key = &stringExpr{value: p.advance().s}
+			p.advance()
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		field.value = value
+		t.fields = append(t.fields, field)
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	return t, p.expect("}")
+}
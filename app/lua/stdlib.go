@@ -0,0 +1,741 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NewState returns a state with the base, string, table and math libraries
+// loaded. Library tables are read-only.
+func NewState() *State {
+	s := &State{Globals: NewTable()}
+	register(s.Globals, map[string]GoFunction{
+		"assert":   baseAssert,
+		"error":    baseError,
+		"ipairs":   baseIpairs,
+		"pairs":    basePairs,
+		"pcall":    basePcall,
+		"rawequal": baseRawequal,
+		"rawget":   baseRawget,
+		"rawset":   baseRawset,
+		"select":   baseSelect,
+		"tonumber": baseTonumber,
+		"tostring": baseTostring,
+		"type":     baseType,
+		"unpack":   tableUnpack,
+	})
+	s.Globals.Set("next", nextFunction)
+	s.stringLib = library(map[string]GoFunction{
+		"byte":    stringByte,
+		"char":    stringChar,
+		"find":    stringFind,
+		"format":  stringFormat,
+		"len":     stringLen,
+		"lower":   stringLower,
+		"rep":     stringRep,
+		"reverse": stringReverse,
+		"sub":     stringSub,
+		"upper":   stringUpper,
+	})
+	s.Globals.Set("string", s.stringLib)
+	s.Globals.Set("table", library(map[string]GoFunction{
+		"concat": tableConcat,
+		"getn":   tableGetn,
+		"insert": tableInsert,
+		"remove": tableRemove,
+		"sort":   tableSort,
+		"unpack": tableUnpack,
+	}))
+	mathLib := NewTable()
+	register(mathLib, map[string]GoFunction{
+		"abs":   mathFunc("abs", math.Abs),
+		"ceil":  mathFunc("ceil", math.Ceil),
+		"floor": mathFunc("floor", math.Floor),
+		"sqrt":  mathFunc("sqrt", math.Sqrt),
+		"exp":   mathFunc("exp", math.Exp),
+		"log":   mathFunc("log", math.Log),
+		"fmod":  mathFmod,
+		"max":   mathMax,
+		"min":   mathMin,
+		"pow":   mathPow,
+	})
+	mathLib.Set("huge", math.Inf(1))
+	mathLib.Set("pi", math.Pi)
+	mathLib.SetReadOnly()
+	s.Globals.Set("math", mathLib)
+	return s
+}
+
+func register(t *Table, funcs map[string]GoFunction) {
+	for name, fn := range funcs {
+		t.Set(name, NewFunction(name, fn))
+	}
+}
+
+func library(funcs map[string]GoFunction) *Table {
+	t := NewTable()
+	register(t, funcs)
+	t.SetReadOnly()
+	return t
+}
+
+func (s *State) argError(i int, fname, msg string) error {
+	return s.Errorf("bad argument #%d to '%s' (%s)", i+1, fname, msg)
+}
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// CheckString returns argument i as a string; numbers are converted.
+func (s *State) CheckString(args []Value, i int, fname string) (string, error) {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v, nil
+	case float64:
+		return formatNumber(v), nil
+	}
+	return "", s.argError(i, fname, "string expected, got "+typeNameArg(args, i))
+}
+
+// CheckNumber returns argument i as a number; numeric strings are converted.
+func (s *State) CheckNumber(args []Value, i int, fname string) (float64, error) {
+	if n, ok := ToNumber(arg(args, i)); ok {
+		return n, nil
+	}
+	return 0, s.argError(i, fname, "number expected, got "+typeNameArg(args, i))
+}
+
+func (s *State) optNumber(args []Value, i int, fname string, def float64) (float64, error) {
+	if arg(args, i) == nil {
+		return def, nil
+	}
+	return s.CheckNumber(args, i, fname)
+}
+
+func (s *State) checkTable(args []Value, i int, fname string) (*Table, error) {
+	if t, ok := arg(args, i).(*Table); ok {
+		return t, nil
+	}
+	return nil, s.argError(i, fname, "table expected, got "+typeNameArg(args, i))
+}
+
+func typeNameArg(args []Value, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return TypeName(args[i])
+}
+
+func baseAssert(s *State, args []Value) ([]Value, error) {
+	if len(args) == 0 || !Truthy(args[0]) {
+		if len(args) > 1 {
+			return nil, &Error{Value: args[1]}
+		}
+		return nil, s.Errorf("assertion failed!")
+	}
+	return args, nil
+}
+
+func baseError(s *State, args []Value) ([]Value, error) {
+	v := arg(args, 0)
+	level, err := s.optNumber(args, 1, "error", 1)
+	if err != nil {
+		return nil, err
+	}
+	if msg, ok := v.(string); ok && level > 0 {
+		v = s.Where() + " " + msg
+	}
+	return nil, &Error{Value: v}
+}
+
+var nextFunction = NewFunction("next", baseNext)
+
+var ipairsIterator = NewFunction("ipairs_iter", func(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "ipairs_iter")
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.CheckNumber(args, 1, "ipairs_iter")
+	if err != nil {
+		return nil, err
+	}
+	v := t.Get(i + 1)
+	if v == nil {
+		return []Value{nil}, nil
+	}
+	return []Value{i + 1, v}, nil
+})
+
+func baseIpairs(s *State, args []Value) ([]Value, error) {
+	if _, err := s.checkTable(args, 0, "ipairs"); err != nil {
+		return nil, err
+	}
+	return []Value{ipairsIterator, args[0], 0.0}, nil
+}
+
+func baseNext(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "next")
+	if err != nil {
+		return nil, err
+	}
+	k, v, ok := t.Next(arg(args, 1))
+	if !ok {
+		return nil, s.Errorf("invalid key to 'next'")
+	}
+	if k == nil {
+		return []Value{nil}, nil
+	}
+	return []Value{k, v}, nil
+}
+
+func basePairs(s *State, args []Value) ([]Value, error) {
+	if _, err := s.checkTable(args, 0, "pairs"); err != nil {
+		return nil, err
+	}
+	return []Value{nextFunction, args[0], nil}, nil
+}
+
+func basePcall(s *State, args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return nil, s.argError(0, "pcall", "value expected")
+	}
+	vals, err := s.Call(args[0], args[1:])
+	if err != nil {
+		if luaErr, ok := err.(*Error); ok {
+			return []Value{false, luaErr.Value}, nil
+		}
+		return nil, err
+	}
+	return append([]Value{true}, vals...), nil
+}
+
+func baseRawequal(s *State, args []Value) ([]Value, error) {
+	return []Value{arg(args, 0) == arg(args, 1)}, nil
+}
+
+func baseRawget(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{t.Get(arg(args, 1))}, nil
+}
+
+func baseRawset(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setIndex(t, arg(args, 1), arg(args, 2), s.line); err != nil {
+		return nil, err
+	}
+	return []Value{t}, nil
+}
+
+func baseSelect(s *State, args []Value) ([]Value, error) {
+	if str, ok := arg(args, 0).(string); ok && str == "#" {
+		return []Value{float64(len(args) - 1)}, nil
+	}
+	n, err := s.CheckNumber(args, 0, "select")
+	if err != nil {
+		return nil, err
+	}
+	i := int(n)
+	if i < 0 {
+		i = len(args) + i
+	}
+	if i <= 0 {
+		return nil, s.argError(0, "select", "index out of range")
+	}
+	if i >= len(args) {
+		return nil, nil
+	}
+	return args[i:], nil
+}
+
+func baseTonumber(s *State, args []Value) ([]Value, error) {
+	base, err := s.optNumber(args, 1, "tonumber", 10)
+	if err != nil {
+		return nil, err
+	}
+	v := arg(args, 0)
+	if base == 10 {
+		if n, ok := ToNumber(v); ok {
+			return []Value{n}, nil
+		}
+		return []Value{nil}, nil
+	}
+	str, err := s.CheckString(args, 0, "tonumber")
+	if err != nil {
+		return nil, err
+	}
+	if base < 2 || base > 36 {
+		return nil, s.argError(1, "tonumber", "base out of range")
+	}
+	n, perr := strconv.ParseInt(strings.TrimSpace(str), int(base), 64)
+	if perr != nil {
+		return []Value{nil}, nil
+	}
+	return []Value{float64(n)}, nil
+}
+
+func baseTostring(s *State, args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return nil, s.argError(0, "tostring", "value expected")
+	}
+	return []Value{ToString(args[0])}, nil
+}
+
+func baseType(s *State, args []Value) ([]Value, error) {
+	if len(args) == 0 {
+		return nil, s.argError(0, "type", "value expected")
+	}
+	return []Value{TypeName(args[0])}, nil
+}
+
+// stringRange converts Lua's 1-based, negative-from-the-end positions into
+// a Go slice range.
+func stringRange(length int, i, j float64) (int, int) {
+	start, end := int(i), int(j)
+	if start < 0 {
+		start = max(length+start+1, 1)
+	} else if start == 0 {
+		start = 1
+	}
+	if end < 0 {
+		end = length + end + 1
+	} else if end > length {
+		end = length
+	}
+	return start - 1, end
+}
+
+func stringByte(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "byte")
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.optNumber(args, 1, "byte", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.optNumber(args, 2, "byte", i)
+	if err != nil {
+		return nil, err
+	}
+	start, end := stringRange(len(str), i, j)
+	var vals []Value
+	for k := start; k < end; k++ {
+		vals = append(vals, float64(str[k]))
+	}
+	return vals, nil
+}
+
+func stringChar(s *State, args []Value) ([]Value, error) {
+	b := make([]byte, len(args))
+	for i := range args {
+		n, err := s.CheckNumber(args, i, "char")
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, s.argError(i, "char", "invalid value")
+		}
+		b[i] = byte(n)
+	}
+	return []Value{string(b)}, nil
+}
+
+// stringFind supports plain searches only; Lua patterns are not implemented.
+func stringFind(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "find")
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := s.CheckString(args, 1, "find")
+	if err != nil {
+		return nil, err
+	}
+	init, err := s.optNumber(args, 2, "find", 1)
+	if err != nil {
+		return nil, err
+	}
+	if !Truthy(arg(args, 3)) && strings.ContainsAny(pattern, "^$*+?.([%-") {
+		return nil, s.Errorf("patterns are not supported, pass true as the 'plain' argument")
+	}
+	start, _ := stringRange(len(str), init, -1)
+	if start > len(str) {
+		return []Value{nil}, nil
+	}
+	i := strings.Index(str[start:], pattern)
+	if i < 0 {
+		return []Value{nil}, nil
+	}
+	return []Value{float64(start + i + 1), float64(start + i + len(pattern))}, nil
+}
+
+func stringFormat(s *State, args []Value) ([]Value, error) {
+	format, err := s.CheckString(args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	argi := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		spec := "%"
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			spec += string(format[i])
+			i++
+		}
+		if i >= len(format) {
+			return nil, s.Errorf("invalid option '%s' to 'format'", spec)
+		}
+		verb := format[i]
+		switch verb {
+		case 'd', 'i':
+			n, err := s.CheckNumber(args, argi, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+"d", int64(n))
+		case 'x', 'X', 'o', 'c':
+			n, err := s.CheckNumber(args, argi, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+string(verb), int64(n))
+		case 'e', 'E', 'f', 'g', 'G':
+			n, err := s.CheckNumber(args, argi, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+string(verb), n)
+		case 's':
+			v := arg(args, argi)
+			if argi >= len(args) {
+				return nil, s.argError(argi, "format", "no value")
+			}
+			fmt.Fprintf(&sb, spec+"s", ToString(v))
+		case 'q':
+			str, err := s.CheckString(args, argi, "format")
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteString(strconv.Quote(str))
+		default:
+			return nil, s.Errorf("invalid option '%%%c' to 'format'", verb)
+		}
+		argi++
+	}
+	return []Value{sb.String()}, nil
+}
+
+func stringLen(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "len")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{float64(len(str))}, nil
+}
+
+func stringLower(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "lower")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{strings.ToLower(str)}, nil
+}
+
+func stringUpper(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "upper")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{strings.ToUpper(str)}, nil
+}
+
+func stringRep(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "rep")
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.CheckNumber(args, 1, "rep")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return []Value{""}, nil
+	}
+	if float64(len(str))*n > 512*1024*1024 {
+		return nil, s.Errorf("resulting string too large")
+	}
+	return []Value{strings.Repeat(str, int(n))}, nil
+}
+
+func stringReverse(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "reverse")
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(str)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return []Value{string(b)}, nil
+}
+
+func stringSub(s *State, args []Value) ([]Value, error) {
+	str, err := s.CheckString(args, 0, "sub")
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.optNumber(args, 1, "sub", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.optNumber(args, 2, "sub", -1)
+	if err != nil {
+		return nil, err
+	}
+	start, end := stringRange(len(str), i, j)
+	if start >= end {
+		return []Value{""}, nil
+	}
+	return []Value{str[start:end]}, nil
+}
+
+func tableConcat(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "concat")
+	if err != nil {
+		return nil, err
+	}
+	sep := ""
+	if arg(args, 1) != nil {
+		if sep, err = s.CheckString(args, 1, "concat"); err != nil {
+			return nil, err
+		}
+	}
+	i, err := s.optNumber(args, 2, "concat", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.optNumber(args, 3, "concat", float64(t.Len()))
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for k := i; k <= j; k++ {
+		part, ok := concatOperand(t.Get(k))
+		if !ok {
+			return nil, s.Errorf("invalid value (at index %s) in table for 'concat'", formatNumber(k))
+		}
+		parts = append(parts, part)
+	}
+	return []Value{strings.Join(parts, sep)}, nil
+}
+
+func tableGetn(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "getn")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{float64(t.Len())}, nil
+}
+
+func tableInsert(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "insert")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, s.Errorf("Attempt to modify a readonly table")
+	}
+	n := t.Len()
+	switch len(args) {
+	case 2:
+		t.Set(float64(n+1), args[1])
+	case 3:
+		pos, err := s.CheckNumber(args, 1, "insert")
+		if err != nil {
+			return nil, err
+		}
+		if pos < 1 || int(pos) > n+1 {
+			return nil, s.argError(1, "insert", "position out of bounds")
+		}
+		for k := n; k >= int(pos); k-- {
+			t.Set(float64(k+1), t.Get(float64(k)))
+		}
+		t.Set(pos, args[2])
+	default:
+		return nil, s.Errorf("wrong number of arguments to 'insert'")
+	}
+	return nil, nil
+}
+
+func tableRemove(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "remove")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, s.Errorf("Attempt to modify a readonly table")
+	}
+	n := t.Len()
+	pos, err := s.optNumber(args, 1, "remove", float64(n))
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return []Value{nil}, nil
+	}
+	if pos < 1 || int(pos) > n {
+		return nil, s.argError(1, "remove", "position out of bounds")
+	}
+	removed := t.Get(pos)
+	for k := int(pos); k < n; k++ {
+		t.Set(float64(k), t.Get(float64(k+1)))
+	}
+	t.Set(float64(n), nil)
+	return []Value{removed}, nil
+}
+
+func tableSort(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "sort")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, s.Errorf("Attempt to modify a readonly table")
+	}
+	less := arg(args, 1)
+	items := make([]Value, t.Len())
+	for i := range items {
+		items[i] = t.Get(float64(i + 1))
+	}
+	var sortErr error
+	sort.SliceStable(items, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		if less != nil {
+			vals, err := s.Call(less, []Value{items[i], items[j]})
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			return len(vals) > 0 && Truthy(vals[0])
+		}
+		r, err := s.compare("<", items[i], items[j], s.line)
+		if err != nil {
+			sortErr = err
+			return false
+		}
+		return r.(bool)
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+	for i, v := range items {
+		t.Set(float64(i+1), v)
+	}
+	return nil, nil
+}
+
+func tableUnpack(s *State, args []Value) ([]Value, error) {
+	t, err := s.checkTable(args, 0, "unpack")
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.optNumber(args, 1, "unpack", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.optNumber(args, 2, "unpack", float64(t.Len()))
+	if err != nil {
+		return nil, err
+	}
+	if j-i >= 8000 {
+		return nil, s.Errorf("too many results to unpack")
+	}
+	var vals []Value
+	for k := i; k <= j; k++ {
+		vals = append(vals, t.Get(k))
+	}
+	return vals, nil
+}
+
+func mathFunc(name string, f func(float64) float64) GoFunction {
+	return func(s *State, args []Value) ([]Value, error) {
+		n, err := s.CheckNumber(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		return []Value{f(n)}, nil
+	}
+}
+
+func mathFmod(s *State, args []Value) ([]Value, error) {
+	a, err := s.CheckNumber(args, 0, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.CheckNumber(args, 1, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{math.Mod(a, b)}, nil
+}
+
+func mathPow(s *State, args []Value) ([]Value, error) {
+	a, err := s.CheckNumber(args, 0, "pow")
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.CheckNumber(args, 1, "pow")
+	if err != nil {
+		return nil, err
+	}
+	return []Value{math.Pow(a, b)}, nil
+}
+
+func mathMax(s *State, args []Value) ([]Value, error) {
+	return mathPick(s, args, "max", func(a, b float64) bool { return a > b })
+}
+
+func mathMin(s *State, args []Value) ([]Value, error) {
+	return mathPick(s, args, "min", func(a, b float64) bool { return a < b })
+}
+
+func mathPick(s *State, args []Value, fname string, better func(a, b float64) bool) ([]Value, error) {
+	best, err := s.CheckNumber(args, 0, fname)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := s.CheckNumber(args, i, fname)
+		if err != nil {
+			return nil, err
+		}
+		if better(n, best) {
+			best = n
+		}
+	}
+	return []Value{best}, nil
+}
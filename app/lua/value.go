@@ -0,0 +1,272 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Value is a Lua value: nil, bool, float64, string, *Table or *Function.
+// Numbers are always float64, as in Lua 5.1.
+type Value any
+
+// GoFunction implements a function in Go. Returning an *Error raises a Lua
+// error that pcall can catch; any other error aborts the script.
+type GoFunction func(s *State, args []Value) ([]Value, error)
+
+// Function is a Lua closure or a Go function.
+type Function struct {
+	Name   string
+	native GoFunction
+	proto  *functionExpr
+	env    *scope
+}
+
+// NewFunction wraps a Go function so scripts can call it.
+func NewFunction(name string, fn GoFunction) *Function {
+	return &Function{Name: name, native: fn}
+}
+
+// Error is a Lua error carrying the value passed to error().
+type Error struct {
+	Value Value
+}
+
+func (e *Error) Error() string {
+	if s, ok := e.Value.(string); ok {
+		return s
+	}
+	if n, ok := e.Value.(float64); ok {
+		return formatNumber(n)
+	}
+	return fmt.Sprintf("(error object is a %s value)", TypeName(e.Value))
+}
+
+type tableEntry struct {
+	key, value Value
+}
+
+// Table is a Lua table. Keys 1..n live in an array part; other keys keep
+// their insertion order so that next() can walk them while fields are
+// cleared.
+type Table struct {
+	arr     []Value
+	entries []tableEntry
+	index   map[Value]int
+	dead    int
+	// readonly tables reject assignments from scripts.
+	readonly bool
+}
+
+func NewTable() *Table {
+	return &Table{index: map[Value]int{}}
+}
+
+// SetReadOnly stops scripts from modifying the table.
+func (t *Table) SetReadOnly() {
+	t.readonly = true
+}
+
+func arrayIndex(k Value) (int, bool) {
+	n, ok := k.(float64)
+	if !ok || n < 1 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n) - 1, true
+}
+
+func (t *Table) Get(k Value) Value {
+	if i, ok := arrayIndex(k); ok && i < len(t.arr) {
+		return t.arr[i]
+	}
+	if i, ok := t.index[k]; ok {
+		return t.entries[i].value
+	}
+	return nil
+}
+
+// Set stores v under k; storing nil removes the key. k must not be nil or NaN.
+func (t *Table) Set(k, v Value) {
+	if i, ok := arrayIndex(k); ok && i <= len(t.arr) {
+		if i < len(t.arr) {
+			// Trailing nils are left in place rather than trimmed, so that
+			// the positions next() works from stay put.
+			t.arr[i] = v
+			return
+		}
+		if v == nil {
+			t.setHash(k, nil)
+			return
+		}
+		t.setHash(k, nil)
+		t.arr = append(t.arr, v)
+		// Move following integer keys out of the hash part.
+		for {
+			next := float64(len(t.arr) + 1)
+			j, ok := t.index[next]
+			if !ok || t.entries[j].value == nil {
+				return
+			}
+			t.arr = append(t.arr, t.entries[j].value)
+			t.setHash(next, nil)
+		}
+	}
+	t.setHash(k, v)
+}
+
+func (t *Table) setHash(k, v Value) {
+	if i, ok := t.index[k]; ok {
+		old := t.entries[i].value
+		t.entries[i].value = v
+		if old != nil && v == nil {
+			t.dead++
+		} else if old == nil && v != nil {
+			t.dead--
+		}
+		return
+	}
+	if v == nil {
+		return
+	}
+	// Compacting only when adding a key keeps next() valid while a
+	// traversal clears fields, as Lua allows.
+	if t.dead > 16 && t.dead > len(t.entries)/2 {
+		t.compact()
+	}
+	t.index[k] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{key: k, value: v})
+}
+
+func (t *Table) compact() {
+	live := t.entries[:0]
+	t.index = make(map[Value]int, len(t.entries)-t.dead)
+	for _, e := range t.entries {
+		if e.value != nil {
+			t.index[e.key] = len(live)
+			live = append(live, e)
+		}
+	}
+	clear(t.entries[len(live):])
+	t.entries = live
+	t.dead = 0
+}
+
+// Len returns a border of the table as defined by Lua: the array part up to
+// its last non-nil value.
+func (t *Table) Len() int {
+	n := len(t.arr)
+	for n > 0 && t.arr[n-1] == nil {
+		n--
+	}
+	return n
+}
+
+// Append sets t[#t+1] = v.
+func (t *Table) Append(v Value) {
+	t.Set(float64(t.Len()+1), v)
+}
+
+// Next returns the key and value following k in traversal order, with a nil
+// key once the traversal ends. ok is false if k is not in the table.
+func (t *Table) Next(k Value) (Value, Value, bool) {
+	start := 0
+	if k != nil {
+		if i, isArr := arrayIndex(k); isArr && i < len(t.arr) {
+			start = i + 1
+		} else if j, found := t.index[k]; found {
+			start = len(t.arr) + j + 1
+		} else {
+			return nil, nil, false
+		}
+	}
+	for i := start; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for j := max(start-len(t.arr), 0); j < len(t.entries); j++ {
+		if t.entries[j].value != nil {
+			return t.entries[j].key, t.entries[j].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+// TypeName returns the Lua type name of v.
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Truthy reports whether v counts as true: everything but nil and false.
+func Truthy(v Value) bool {
+	if v == nil {
+		return false
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return true
+}
+
+// formatNumber formats n like Lua 5.1's "%.14g".
+func formatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return fmt.Sprintf("%.14g", n)
+}
+
+// ToString converts v the way tostring() does.
+func ToString(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *Table:
+		return fmt.Sprintf("table: %p", v)
+	case *Function:
+		if v.native != nil {
+			return fmt.Sprintf("builtin: %p", v)
+		}
+		return fmt.Sprintf("function: %p", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// ToNumber converts numbers and numeric strings to a number.
+func ToNumber(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(v)
+	}
+	return 0, false
+}
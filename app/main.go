@@ -2,16 +2,21 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/r1i2t3/go-redis/app/aof"
 	"github.com/r1i2t3/go-redis/app/handlers"
 	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/module"
 	pubsub "github.com/r1i2t3/go-redis/app/pub_sub"
 	"github.com/r1i2t3/go-redis/app/rdb"
 	"github.com/r1i2t3/go-redis/app/replication"
@@ -24,8 +29,20 @@ import (
 func main() {
 	dir := flag.String("dir", "/tmp", "data directory")
 	dbfileName := flag.String("dbfilename", "dump.rdb", "database file name")
+	save := flag.String("save", "900 1", "save points as pairs of seconds and changes, \"\" to disable saving")
+	stopWritesOnBGSaveError := flag.String("stop-writes-on-bgsave-error", "yes", "refuse writes while the last background save failed (yes/no)")
+	rdbFormat := flag.String("rdb-format", rdb.FormatRedis, "format RDB files are written in (redis/legacy)")
 	portString := flag.String("port", "6379", "server port")
 	replicaof := flag.String("replicaof", "", "Replica host and port")
+	luaTimeLimit := flag.Int("lua-time-limit", 5000, "milliseconds a script may run before other clients get BUSY")
+	appendOnly := flag.String("appendonly", "no", "log every write to the append only file (yes/no)")
+	appendDirname := flag.String("appenddirname", "appendonlydir", "directory, inside dir, holding the append only files")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "base name of the append only files")
+	appendFsync := flag.String("appendfsync", aof.FsyncEverySec, "when to fsync the append only file (always/everysec/no)")
+	aofLoadTruncated := flag.String("aof-load-truncated", "yes", "load an append only file whose last command is incomplete (yes/no)")
+	aofUseRDBPreamble := flag.String("aof-use-rdb-preamble", "yes", "write the base of a rewritten append only file in the RDB format (yes/no)")
+	autoAOFRewritePercentage := flag.Int("auto-aof-rewrite-percentage", 100, "rewrite the append only file once it grows by this percentage (0 disables)")
+	autoAOFRewriteMinSize := flag.String("auto-aof-rewrite-min-size", "64mb", "smallest append only file rewritten automatically")
 	MasterHost := ""
 	MasterPort := 0
 	IsSlave := false
@@ -38,9 +55,60 @@ func main() {
 	config := &types.Config{
 		Dir:            *dir,
 		DbFileName:     *dbfileName,
-		RDBSaveSeconds: 900,
-		RDBSaveChanges: 1,
+		RDBFormat:      *rdbFormat,
 		PORT:           port,
+		LuaTimeLimit:   *luaTimeLimit,
+		AppendDirname:  *appendDirname,
+		AppendFilename: *appendFilename,
+		AppendFsync:    *appendFsync,
+
+		AutoAOFRewritePercentage: *autoAOFRewritePercentage,
+	}
+	for _, opt := range []struct {
+		name  string
+		value string
+		dst   *bool
+	}{
+		{"stop-writes-on-bgsave-error", *stopWritesOnBGSaveError, &config.StopWritesOnBGSaveError},
+		{"appendonly", *appendOnly, &config.AppendOnly},
+		{"aof-load-truncated", *aofLoadTruncated, &config.AOFLoadTruncated},
+		{"aof-use-rdb-preamble", *aofUseRDBPreamble, &config.AOFUseRDBPreamble},
+	} {
+		switch opt.value {
+		case "yes":
+			*opt.dst = true
+		case "no":
+			*opt.dst = false
+		default:
+			fmt.Printf("Invalid %s value %q, expected yes or no\n", opt.name, opt.value)
+			os.Exit(1)
+		}
+	}
+	if config.SavePoints, err = rdb.ParseSavePoints(*save); err != nil {
+		fmt.Println("Invalid save value:", err)
+		os.Exit(1)
+	}
+	if !rdb.ValidFormat(config.RDBFormat) {
+		fmt.Printf("Invalid rdb-format value %q, expected redis or legacy\n", config.RDBFormat)
+		os.Exit(1)
+	}
+	if !aof.ValidFsyncPolicy(config.AppendFsync) {
+		fmt.Printf("Invalid appendfsync value %q\n", config.AppendFsync)
+		os.Exit(1)
+	}
+	for _, name := range []string{config.AppendDirname, config.AppendFilename} {
+		if name == "" || strings.ContainsAny(name, "/ \t\r\n") {
+			fmt.Printf("Invalid append only file or directory name %q\n", name)
+			os.Exit(1)
+		}
+	}
+	if config.AutoAOFRewritePercentage < 0 {
+		fmt.Println("Invalid auto-aof-rewrite-percentage, expected a non-negative integer")
+		os.Exit(1)
+	}
+	if config.AutoAOFRewriteMinSize, err = utils.ParseMemory(*autoAOFRewriteMinSize); err != nil {
+		fmt.Println("Invalid auto-aof-rewrite-min-size:", err)
+		os.Exit(1)
 	}
 	if *replicaof != "" {
 		parts := strings.Split(*replicaof, ":")
@@ -53,18 +121,81 @@ func main() {
 		IsSlave = true
 	}
 	server := NewServer(config, MasterHost, MasterPort, IsSlave)
+	// Modules come first: loading the dataset needs their types.
+	if err := module.LoadAll(server); err != nil {
+		fmt.Println("Failed to load modules:", err)
+		os.Exit(1)
+	}
+	if *replicaof == "" {
+		if config.AppendOnly {
+			loadAOF(server)
+		} else {
+			path := fmt.Sprintf("%s/%s", config.Dir, config.DbFileName)
+			// A load that fails partway leaves part of the dataset behind,
+			// which the next save would write over the file, so don't go on.
+			if err := rdb.Load(path, server.KV, true); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				fmt.Println("Failed to load the RDB file:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if config.AppendOnly {
+		dir := fmt.Sprintf("%s/%s", config.Dir, config.AppendDirname)
+		writeBase := handlers.AOFBaseWriter(server, server.KV)
+		server.AOF, err = aof.Open(dir, config.AppendFilename, config.AppendFsync, writeBase, config.AOFUseRDBPreamble)
+		if err != nil {
+			fmt.Println("Can't open the append-only file:", err)
+			os.Exit(1)
+		}
+		// An AOF made of incremental files alone gets a base holding what
+		// they loaded.
+		if !server.AOF.HasBase() {
+			if err := handlers.TriggerAOFRewrite(server); err != nil {
+				fmt.Println("Can't create the append only base file:", err)
+			}
+		}
+		go handlers.StartAOFRewriteCron(server)
+	}
+	// The save points look at server.AOF, so they start once it is open.
+	if *replicaof == "" {
+		go rdb.StartRDBackgroundSave(server)
+	}
+	// Replication starts last, as a full sync rewrites the AOF.
 	if *replicaof != "" {
 		go replication.StartReplication(server)
-	} else {
-		path := fmt.Sprintf("%s/%s", config.Dir, config.DbFileName)
-		rdb.Load(path, server.KV)
-		go rdb.StartRDBackgroundSave(server)
-
 	}
 	ListenAndServer(server)
 
 }
 
+// loadAOF replays the append only files, which hold every write and so
+// replace the RDB file when enabled. Each command runs as its own
+// transaction, isolated like EXEC.
+func loadAOF(server *types.Server) {
+	config := server.Config
+	dir := fmt.Sprintf("%s/%s", config.Dir, config.AppendDirname)
+	oldPath := fmt.Sprintf("%s/%s", config.Dir, config.AppendFilename)
+	if err := aof.UpgradeSingleFile(oldPath, dir, config.AppendFilename); err != nil {
+		fmt.Println("Failed to move the append only file into", dir+":", err)
+		os.Exit(1)
+	}
+	client := &kv.ClientType{WatchedKeys: map[string]bool{}}
+	// As in Redis, keys of the base that have expired are loaded anyway:
+	// the commands logged after it may refer to them.
+	loadRDB := func(path string) error {
+		return rdb.Load(path, server.KV, false)
+	}
+	err := aof.Load(dir, config.AppendFilename, config.AOFLoadTruncated, loadRDB, func(cmds []resp.Value) {
+		handlers.ExecAtomically(server, client, cmds)
+	})
+	if err != nil {
+		fmt.Println("Failed to load the append only file:", err)
+		os.Exit(1)
+	}
+	server.Dirty = 0
+	fmt.Println("DB loaded from append only file")
+}
+
 func NewServer(conf *types.Config, MasterHost string, MasterPort int, IsSlave bool) *types.Server {
 	replication_id, err := utils.GenerateRandomID()
 	if err != nil {
@@ -83,6 +214,8 @@ func NewServer(conf *types.Config, MasterHost string, MasterPort int, IsSlave bo
 		ReplicasMutex:     sync.RWMutex{},
 		ReplicationID:     replication_id,
 		ReplicationOffset: 0,
+		// As in Redis, save points count from startup.
+		LastSave: time.Now(),
 	}
 }
 
@@ -113,7 +246,7 @@ func handleConnection(conn net.Conn, kV *kv.KV, server *types.Server) {
 		Conn:            conn,
 		IsInTransaction: false,
 		CommandQueue:    make([]resp.Value, 0),
-		WatchedKeys:     make(map[string]uint64),
+		WatchedKeys:     make(map[string]bool),
 		Subscriptions:   make(map[string]bool),
 		MessageChan:     make(chan resp.Value, 16),
 	}
@@ -124,6 +257,7 @@ func handleConnection(conn net.Conn, kV *kv.KV, server *types.Server) {
 		kV.ClientsMu.Lock()
 		delete(kV.Clients, conn.RemoteAddr().String())
 		kV.ClientsMu.Unlock()
+		kV.UnwatchAll(client)
 		server.PS.RemoveClient(client)
 
 	}()
@@ -0,0 +1,93 @@
+package module
+
+import (
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/handlers"
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// BlockOnKeys waits until one of keys is signalled ready, by
+// SignalKeyAsReady or by a built-in command such as LPUSH, or until timeout
+// passes. A zero timeout waits forever. Other clients run while it waits, so
+// the command must check its keys again afterwards. It reports whether it
+// was woken up; inside MULTI or a script it returns false at once.
+func (ctx *Context) BlockOnKeys(keys []string, timeout time.Duration) bool {
+	kV := ctx.server.KV
+	bc := &kv.BlockedClient{
+		Ch:   make(chan bool, 1),
+		Keys: keys,
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		bc.Deadline = time.Now().Add(timeout)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	kV.RegisterBlockedClient(bc)
+	defer kV.UnregisterBlockedClient(bc)
+	woken := false
+	handlers.BlockModuleClient(ctx.server, ctx.client, func() {
+		select {
+		case <-bc.Ch:
+			woken = true
+		case <-expired:
+		}
+	})
+	return woken
+}
+
+// SignalKeyAsReady wakes the clients blocked on key.
+func (ctx *Context) SignalKeyAsReady(key string) {
+	ctx.server.KV.WakeUpClients(key, true)
+}
+
+// BlockedClient is a client waiting for a reply produced outside of the
+// command, typically by a goroutine the command started.
+type BlockedClient struct {
+	ctx     *Context
+	timeout time.Duration
+	reply   chan resp.Value
+}
+
+// BlockClient prepares to block the client for up to timeout, or forever if
+// timeout is zero. The command hands the BlockedClient to whatever produces
+// the reply and then returns the result of Wait.
+func (ctx *Context) BlockClient(timeout time.Duration) *BlockedClient {
+	return &BlockedClient{ctx: ctx, timeout: timeout, reply: make(chan resp.Value, 1)}
+}
+
+// Unblock delivers the reply. It may be called from any goroutine, but must
+// not use the command's Context. Only the first call counts, and a reply
+// arriving after the timeout is dropped.
+func (bc *BlockedClient) Unblock(reply resp.Value) {
+	select {
+	case bc.reply <- reply:
+	default:
+	}
+}
+
+// Wait blocks until Unblock is called and returns its reply, or returns
+// timeoutReply once the timeout passes. Other clients run meanwhile. Inside
+// MULTI or a script, where clients can't block, it returns an error.
+func (bc *BlockedClient) Wait(timeoutReply resp.Value) resp.Value {
+	var expired <-chan time.Time
+	if bc.timeout > 0 {
+		timer := time.NewTimer(bc.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	reply := timeoutReply
+	ok := handlers.BlockModuleClient(bc.ctx.server, bc.ctx.client, func() {
+		select {
+		case reply = <-bc.reply:
+		case <-expired:
+		}
+	})
+	if !ok {
+		return ReplyError("ERR Blocking module command called from transaction or script")
+	}
+	return reply
+}
@@ -0,0 +1,37 @@
+package module
+
+import "github.com/r1i2t3/go-redis/app/kv"
+
+// Keyspace event classes for SubscribeKeyspaceEvents and
+// NotifyKeyspaceEvent. Modules raise their own events as EventModule.
+const (
+	EventGeneric = kv.NotifyGeneric
+	EventString  = kv.NotifyString
+	EventList    = kv.NotifyList
+	EventSet     = kv.NotifySet
+	EventHash    = kv.NotifyHash
+	EventZSet    = kv.NotifyZSet
+	EventExpired = kv.NotifyExpired
+	EventStream  = kv.NotifyStream
+	EventModule  = kv.NotifyModule
+	EventAll     = kv.NotifyAll
+)
+
+type KeyspaceEvent = kv.KeyspaceEvent
+
+// SubscribeKeyspaceEvents calls handler for every event whose class is in
+// mask. It runs right after the command that raised the event, once that
+// command has released its locks, and may use ctx.Call. Replicas raise
+// events too, but there the handler can't Call write commands: the master
+// replicates the writes its own handler makes.
+func (ctx *Context) SubscribeKeyspaceEvents(mask int, handler func(ctx *Context, event KeyspaceEvent)) {
+	server := ctx.server
+	server.KV.SubscribeKeyspaceEvents(mask, func(event kv.KeyspaceEvent) {
+		handler(&Context{server: server, client: newCallClient(), readOnly: server.IsSlave}, event)
+	})
+}
+
+// NotifyKeyspaceEvent raises an event for the subscribers.
+func (ctx *Context) NotifyKeyspaceEvent(class int, event, key string) {
+	ctx.server.KV.NotifyKeyspaceEvent(class, event, key)
+}
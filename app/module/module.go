@@ -0,0 +1,213 @@
+// Package module lets Go code extend the server in the manner of Redis
+// modules: new commands, new value types persisted in the RDB file,
+// keyspace event subscriptions and commands that block.
+//
+// A module registers itself from an init function and is compiled in by
+// importing its package for side effects from main:
+//
+//	func init() {
+//		module.Register(module.Module{Name: "hello", OnLoad: func(ctx *module.Context) error {
+//			return ctx.CreateCommand(module.Command{
+//				Name:    "HELLO.ECHO",
+//				Arity:   2,
+//				Flags:   module.FlagReadOnly,
+//				Handler: func(ctx *module.Context, args []string) resp.Value { return module.ReplyBulk(args[0]) },
+//			})
+//		}})
+//	}
+//
+// Module commands run one at a time, holding the whole keyspace, so module
+// code doesn't need locks of its own.
+package module
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/r1i2t3/go-redis/app/handlers"
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+// Module is a named set of extensions. OnLoad creates its commands, types and
+// subscriptions once the server exists.
+type Module struct {
+	Name   string
+	OnLoad func(ctx *Context) error
+}
+
+var (
+	modules   []Module
+	modulesMu sync.Mutex
+)
+
+// Register records a module to be loaded by LoadAll. It panics if a module
+// with the same name is already registered.
+func Register(m Module) {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	for _, other := range modules {
+		if other.Name == m.Name {
+			panic("module: Register called twice for module " + m.Name)
+		}
+	}
+	modules = append(modules, m)
+}
+
+// LoadAll runs the OnLoad function of every registered module. It must run
+// before the dataset is loaded, so that the module types are known, and
+// before clients are served.
+func LoadAll(server *types.Server) error {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	for _, m := range modules {
+		if m.OnLoad == nil {
+			continue
+		}
+		ctx := &Context{server: server, client: newCallClient()}
+		if err := m.OnLoad(ctx); err != nil {
+			return fmt.Errorf("module %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Command flags, see handlers.CmdWrite and the rest.
+const (
+	FlagWrite    = handlers.CmdWrite
+	FlagReadOnly = handlers.CmdReadOnly
+	FlagBlocking = handlers.CmdBlocking
+	FlagNoMulti  = handlers.CmdNoMulti
+	FlagNoScript = handlers.CmdNoScript
+	FlagPubSub   = handlers.CmdPubSub
+	FlagAdmin    = handlers.CmdAdmin
+)
+
+// CommandFunc implements a module command. args excludes the command name.
+type CommandFunc func(ctx *Context, args []string) resp.Value
+
+// Command describes a module command. Arity counts the command name, and a
+// negative -N means at least N, as for built-in commands. Categories are ACL
+// categories in addition to those implied by Flags.
+type Command struct {
+	Name       string
+	Arity      int
+	Flags      int
+	Categories []string
+	Handler    CommandFunc
+}
+
+// Context gives module code access to the server while it handles a
+// command, an event or OnLoad.
+type Context struct {
+	server *types.Server
+	client *kv.ClientType
+	// command and args are what the client sent, for ReplicateVerbatim.
+	command string
+	args    []resp.Value
+	// readOnly makes Call refuse write commands.
+	readOnly bool
+}
+
+// newCallClient returns the client that commands run through Call use. It
+// never blocks.
+func newCallClient() *kv.ClientType {
+	return &kv.ClientType{DenyBlocking: true, WatchedKeys: map[string]bool{}}
+}
+
+// CreateCommand adds a command to the server.
+func (ctx *Context) CreateCommand(cmd Command) error {
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s has no handler", cmd.Name)
+	}
+	fn := cmd.Handler
+	handler := func(args []resp.Value, server *types.Server, client *kv.ClientType) resp.Value {
+		strArgs := make([]string, len(args))
+		for i, arg := range args {
+			strArgs[i] = arg.Bulk
+		}
+		// Whatever the command replicates reaches replicas as one
+		// MULTI/EXEC block, as with scripts.
+		server.BeginAtomicPropagation()
+		defer server.EndAtomicPropagation()
+		return fn(&Context{server: server, client: client, command: cmd.Name, args: args}, strArgs)
+	}
+	info := handlers.CommandInfo{Arity: cmd.Arity, Flags: cmd.Flags}
+	return handlers.RegisterCommand(cmd.Name, info, cmd.Categories, handler)
+}
+
+// Call runs a command, as redis.call does for scripts, and returns its
+// reply. Write commands replicate themselves. Commands can't block and
+// those not allowed from scripts aren't allowed here either.
+func (ctx *Context) Call(command string, args ...string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	return handlers.CallFromModule(command, values, ctx.server, newCallClient(), ctx.readOnly)
+}
+
+// Replicate sends a command to the replicas and marks the dataset dirty.
+// Use it for changes the replicas can't learn about through Call.
+func (ctx *Context) Replicate(command string, args ...string) {
+	cmd := []resp.Value{{Typ: "bulk", Bulk: command}}
+	for _, arg := range args {
+		cmd = append(cmd, resp.Value{Typ: "bulk", Bulk: arg})
+	}
+	ctx.server.IncrementDirty()
+	ctx.server.Propagate(resp.Value{Typ: "array", Array: cmd})
+}
+
+// ReplicateVerbatim replicates the running command exactly as the client
+// sent it.
+func (ctx *Context) ReplicateVerbatim() {
+	if ctx.command == "" {
+		return
+	}
+	cmd := append([]resp.Value{{Typ: "bulk", Bulk: ctx.command}}, ctx.args...)
+	ctx.server.IncrementDirty()
+	ctx.server.Propagate(resp.Value{Typ: "array", Array: cmd})
+}
+
+// SignalModifiedKey invalidates the transactions WATCHing key. SetValue and
+// DeleteKey do it themselves; call it after changing a value in place.
+func (ctx *Context) SignalModifiedKey(key string) {
+	ctx.server.KV.SignalModifiedKey(key)
+}
+
+// KeyType returns the type of the value at key as TYPE reports it, which is
+// the type name for module types, or "none".
+func (ctx *Context) KeyType(key string) string {
+	return handlers.KeyType(ctx.server.KV, key)
+}
+
+func ReplyOK() resp.Value {
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+func ReplySimple(s string) resp.Value {
+	return resp.Value{Typ: "string", Str: s}
+}
+
+// ReplyError replies with msg, which should start with an error code such
+// as "ERR".
+func ReplyError(msg string) resp.Value {
+	return resp.Value{Typ: "error", Str: msg}
+}
+
+func ReplyBulk(s string) resp.Value {
+	return resp.Value{Typ: "bulk", Bulk: s}
+}
+
+func ReplyInteger(n int) resp.Value {
+	return resp.Value{Typ: "integer", Num: n}
+}
+
+func ReplyArray(items ...resp.Value) resp.Value {
+	return resp.Value{Typ: "array", Array: items}
+}
+
+func ReplyNull() resp.Value {
+	return resp.Value{Typ: "null"}
+}
@@ -0,0 +1,522 @@
+package module
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/handlers"
+	"github.com/r1i2t3/go-redis/app/kv"
+	pubsub "github.com/r1i2t3/go-redis/app/pub_sub"
+	"github.com/r1i2t3/go-redis/app/rdb"
+	"github.com/r1i2t3/go-redis/app/resp"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+func newTestServer() *types.Server {
+	return &types.Server{
+		KV:                kv.NewKv(),
+		PS:                pubsub.NewPubSub(),
+		IsMaster:          true,
+		ConnectedReplicas: map[net.Conn]*types.ReplicaInfo{},
+	}
+}
+
+// newTestContext returns the context OnLoad would get.
+func newTestContext(server *types.Server) *Context {
+	return &Context{server: server, client: newCallClient()}
+}
+
+// call runs a command line through handlers.Call, as a client would, and
+// renders the reply. Arguments are separated by spaces.
+func call(server *types.Server, line string) string {
+	fields := strings.Fields(line)
+	args := make([]resp.Value, len(fields)-1)
+	for i, field := range fields[1:] {
+		args[i] = resp.Value{Typ: "bulk", Bulk: field}
+	}
+	name := strings.ToUpper(fields[0])
+	if _, errReply := handlers.ValidateCommand(name, args); errReply != nil {
+		return show(*errReply)
+	}
+	return show(handlers.Call(name, args, server, &kv.ClientType{WatchedKeys: map[string]bool{}}))
+}
+
+func show(v resp.Value) string {
+	switch v.Typ {
+	case "array":
+		items := make([]string, len(v.Array))
+		for i, item := range v.Array {
+			items[i] = show(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case "bulk":
+		return v.Bulk
+	case "integer":
+		return fmt.Sprint(v.Num)
+	case "null":
+		return "(nil)"
+	}
+	return v.Str
+}
+
+// createCommand registers cmd unless an earlier run of the test did:
+// commands are registered for the whole process.
+func createCommand(t *testing.T, ctx *Context, cmd Command) {
+	t.Helper()
+	if _, ok := handlers.Commands[strings.ToUpper(cmd.Name)]; ok {
+		return
+	}
+	if err := ctx.CreateCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateCommand(t *testing.T) {
+	ctx := newTestContext(newTestServer())
+	echo := func(ctx *Context, args []string) resp.Value { return ReplyBulk(args[0]) }
+	createCommand(t, ctx, Command{
+		Name:       "test.echo",
+		Arity:      2,
+		Flags:      FlagReadOnly,
+		Categories: []string{"testing"},
+		Handler:    echo,
+	})
+	info, ok := handlers.Commands["TEST.ECHO"]
+	if !ok {
+		t.Fatal("TEST.ECHO is not in the command table")
+	}
+	if info.Arity != 2 || info.Flags != FlagReadOnly {
+		t.Errorf("TEST.ECHO info = %+v", info)
+	}
+	if got := handlers.CommandCategories("TEST.ECHO"); !slices.Equal(got, []string{"read", "testing"}) {
+		t.Errorf("TEST.ECHO categories = %q, want [read testing]", got)
+	}
+
+	invalid := []Command{
+		{Name: "TEST.ECHO", Arity: 2, Handler: echo},
+		{Name: "GET", Arity: 2, Handler: echo},
+		{Name: "", Arity: 1, Handler: echo},
+		{Name: "test echo", Arity: 1, Handler: echo},
+		{Name: "test|echo", Arity: 1, Handler: echo},
+		{Name: "test.zero", Arity: 0, Handler: echo},
+		{Name: "test.nohandler", Arity: 1},
+		{Name: "test.at", Arity: 1, Categories: []string{"@read"}, Handler: echo},
+		{Name: "test.space", Arity: 1, Categories: []string{"my category"}, Handler: echo},
+		{Name: "test.empty", Arity: 1, Categories: []string{""}, Handler: echo},
+	}
+	for _, cmd := range invalid {
+		if err := ctx.CreateCommand(cmd); err == nil {
+			t.Errorf("CreateCommand(%+v) succeeded", cmd)
+		}
+		if name := strings.ToUpper(cmd.Name); name != "TEST.ECHO" && name != "GET" {
+			if _, ok := handlers.Handlers[name]; ok {
+				t.Errorf("rejected command %q was added", cmd.Name)
+			}
+		}
+	}
+}
+
+func TestCommandDispatch(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	createCommand(t, ctx, Command{
+		Name:       "test.swap",
+		Arity:      3,
+		Flags:      FlagWrite,
+		Categories: []string{"swapping"},
+		Handler: func(ctx *Context, args []string) resp.Value {
+			a, b := ctx.Call("GET", args[0]), ctx.Call("GET", args[1])
+			if a.Typ != "bulk" || b.Typ != "bulk" {
+				return ReplyError("ERR both keys must hold strings")
+			}
+			ctx.Call("SET", args[0], b.Bulk)
+			ctx.Call("SET", args[1], a.Bulk)
+			return ReplyOK()
+		},
+	})
+	createCommand(t, ctx, Command{
+		Name:  "test.call",
+		Arity: -2,
+		Handler: func(ctx *Context, args []string) resp.Value {
+			return ctx.Call(args[0], args[1:]...)
+		},
+	})
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"SET a 1", "OK"},
+		{"SET b 2", "OK"},
+		{"TEST.SWAP a b", "OK"},
+		{"GET a", "2"},
+		{"GET b", "1"},
+		{"test.swap a missing", "ERR both keys must hold strings"},
+		{"TEST.SWAP a", "ERR wrong number of arguments for 'test.swap' command"},
+		{"TEST.CALL INCR a", "3"},
+		{"TEST.CALL MULTI", "ERR This command is not allowed from modules"},
+		{"TEST.CALL EVAL x 0", "ERR This command is not allowed from modules"},
+		{"TEST.CALL NOSUCH", "ERR unknown command 'nosuch', with args beginning with: "},
+		// Module commands can't block the client that calls them.
+		{"TEST.CALL BLPOP empty 0", "(nil)"},
+		{"ACL CAT swapping", "[test.swap]"},
+		{"ACL CAT @swapping", "[test.swap]"},
+	}
+	for _, tt := range tests {
+		if got := call(server, tt.command); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+// counter is a module type holding an int64 and a label.
+type counter struct {
+	n     int64
+	label string
+}
+
+var counterType = &Type{
+	Name:   "testcount",
+	EncVer: 2,
+	RDBSave: func(w Writer, value any) {
+		c := value.(*counter)
+		w.SaveSigned(c.n)
+		w.SaveString(c.label)
+	},
+	RDBLoad: func(r Reader, encver int) (any, error) {
+		c := &counter{n: r.LoadSigned()}
+		// Version 1 had no label.
+		if encver >= 2 {
+			c.label = r.LoadString()
+		}
+		return c, nil
+	},
+	Digest: func(d *Digest, value any) {
+		c := value.(*counter)
+		d.AddInt(c.n)
+		d.AddString(c.label)
+		d.EndSequence()
+	},
+}
+
+// registerCounterType registers counterType once for the whole test binary.
+func registerCounterType(t *testing.T, ctx *Context) {
+	t.Helper()
+	if _, ok := kv.LookupModuleType(counterType.Name); ok {
+		return
+	}
+	if err := ctx.CreateDataType(counterType); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateDataType(t *testing.T) {
+	ctx := newTestContext(newTestServer())
+	registerCounterType(t, ctx)
+	noop := func(w Writer, value any) {}
+	load := func(r Reader, encver int) (any, error) { return nil, nil }
+	invalid := []*Type{
+		{Name: counterType.Name, RDBSave: noop, RDBLoad: load},
+		{Name: "short", RDBSave: noop, RDBLoad: load},
+		{Name: "too-long-1", RDBSave: noop, RDBLoad: load},
+		{Name: "bad.name1", RDBSave: noop, RDBLoad: load},
+		{Name: "negative1", EncVer: -1, RDBSave: noop, RDBLoad: load},
+		{Name: "nosaving1", RDBLoad: load},
+		{Name: "noloadin1", RDBSave: noop},
+	}
+	for _, typ := range invalid {
+		if err := ctx.CreateDataType(typ); err == nil {
+			t.Errorf("CreateDataType(%q) succeeded", typ.Name)
+		}
+	}
+}
+
+func TestModuleValues(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	registerCounterType(t, ctx)
+
+	if v, err := ctx.GetValue("c", counterType); v != nil || err != nil {
+		t.Errorf("GetValue of a missing key = %v, %v", v, err)
+	}
+	if err := ctx.SetValue("c", counterType, &counter{n: 7, label: "seven"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ctx.GetValue("c", counterType); err != nil || *v.(*counter) != (counter{n: 7, label: "seven"}) {
+		t.Errorf("GetValue = %v, %v", v, err)
+	}
+	if got := call(server, "TYPE c"); got != "testcount" {
+		t.Errorf("TYPE c = %s, want testcount", got)
+	}
+	call(server, "SET s x")
+	if _, err := ctx.GetValue("s", counterType); err != ErrWrongType {
+		t.Errorf("GetValue of a string = %v, want ErrWrongType", err)
+	}
+	if err := ctx.SetValue("s", counterType, &counter{}); err != ErrWrongType {
+		t.Errorf("SetValue over a string = %v, want ErrWrongType", err)
+	}
+	if !ctx.DeleteKey("c") || ctx.DeleteKey("c") {
+		t.Error("DeleteKey did not report the key existing once")
+	}
+}
+
+// TestModuleTypeRoundTrip saves module values to an RDB file and loads them
+// back, checking the values and their digests.
+func TestModuleTypeRoundTrip(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	registerCounterType(t, ctx)
+	values := map[string]*counter{
+		"a": {n: 1, label: "one"},
+		"b": {n: -1 << 40},
+		"c": {n: 0, label: strings.Repeat("x", 1000)},
+	}
+	for key, c := range values {
+		if err := ctx.SetValue(key, counterType, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call(server, "SET s x")
+
+	for _, format := range []string{rdb.FormatRedis, rdb.FormatLegacy} {
+		var buf bytes.Buffer
+		if err := rdb.SaveTo(&buf, server.KV, format); err != nil {
+			t.Fatal(err)
+		}
+		loaded := newTestServer()
+		if err := rdb.LoadFrom(&buf, loaded.KV, false); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range values {
+			mv, ok := loaded.KV.Modules[key]
+			if !ok {
+				t.Errorf("%s: %s missing after load", format, key)
+				continue
+			}
+			if mv.Type != counterType || *mv.Value.(*counter) != *want {
+				t.Errorf("%s: %s = %+v, want %+v", format, key, mv.Value, want)
+			}
+		}
+		if got, want := call(loaded, "DEBUG DIGEST"), call(server, "DEBUG DIGEST"); got != want {
+			t.Errorf("%s: digest after load %s, want %s", format, got, want)
+		}
+	}
+	before := call(server, "DEBUG DIGEST-VALUE a")
+	ctx.SetValue("a", counterType, &counter{n: 2, label: "one"})
+	if after := call(server, "DEBUG DIGEST-VALUE a"); after == before {
+		t.Error("digest of a did not change with its value")
+	}
+}
+
+func TestModuleTypeLoadErrors(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	registerCounterType(t, ctx)
+	ctx.SetValue("a", counterType, &counter{n: 1, label: "one"})
+	var buf bytes.Buffer
+	if err := rdb.SaveTo(&buf, server.KV, rdb.FormatRedis); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// A type that reads back less than it wrote fails to load.
+	saved := counterType.RDBLoad
+	defer func() { counterType.RDBLoad = saved }()
+	counterType.RDBLoad = func(r Reader, encver int) (any, error) {
+		return &counter{n: r.LoadSigned()}, nil
+	}
+	if err := rdb.LoadFrom(bytes.NewReader(data), kv.NewKv(), false); err == nil {
+		t.Error("a short read loaded")
+	}
+	// So does one that reads items of the wrong kind.
+	counterType.RDBLoad = func(r Reader, encver int) (any, error) {
+		return &counter{label: r.LoadString()}, nil
+	}
+	if err := rdb.LoadFrom(bytes.NewReader(data), kv.NewKv(), false); err == nil {
+		t.Error("a mistyped read loaded")
+	}
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	var events []string
+	ctx.SubscribeKeyspaceEvents(EventList|EventGeneric|EventModule, func(ctx *Context, event KeyspaceEvent) {
+		events = append(events, event.Event+" "+event.Key)
+		// Handlers run after the command released its locks, so they can
+		// call commands on the same keys.
+		if event.Event == "lpush" {
+			ctx.Call("RPUSH", "log", event.Key)
+		}
+	})
+	createCommand(t, ctx, Command{
+		Name:  "test.notify",
+		Arity: 2,
+		Flags: FlagWrite,
+		Handler: func(ctx *Context, args []string) resp.Value {
+			ctx.NotifyKeyspaceEvent(EventModule, "test.notify", args[0])
+			return ReplyOK()
+		},
+	})
+
+	for _, line := range []string{"LPUSH l a", "SET s 1", "TEST.NOTIFY k", "DEL l s", "LPOP missing"} {
+		call(server, line)
+	}
+	want := []string{"lpush l", "rpush log", "test.notify k", "del l", "del s"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	if got := call(server, "LRANGE log 0 -1"); got != "[l]" {
+		t.Errorf("LRANGE log = %s, want [l]", got)
+	}
+}
+
+func TestBlockClient(t *testing.T) {
+	server := newTestServer()
+	ctx := newTestContext(server)
+	createCommand(t, ctx, Command{
+		Name:  "test.later",
+		Arity: 2,
+		Flags: FlagBlocking,
+		Handler: func(ctx *Context, args []string) resp.Value {
+			timeout, _ := time.ParseDuration(args[0])
+			bc := ctx.BlockClient(timeout)
+			if timeout > time.Second {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					bc.Unblock(ReplySimple("LATER"))
+				}()
+			}
+			return bc.Wait(ReplyNull())
+		},
+	})
+	createCommand(t, ctx, Command{
+		Name:  "test.popwait",
+		Arity: 2,
+		Flags: FlagWrite | FlagBlocking,
+		Handler: func(ctx *Context, args []string) resp.Value {
+			for {
+				if reply := ctx.Call("LPOP", args[0]); reply.Typ != "null" {
+					return reply
+				}
+				if !ctx.BlockOnKeys([]string{args[0]}, 5*time.Second) {
+					return ReplyNull()
+				}
+			}
+		},
+	})
+
+	if got := call(server, "TEST.LATER 10s"); got != "LATER" {
+		t.Errorf("TEST.LATER 10s = %s, want LATER", got)
+	}
+	if got := call(server, "TEST.LATER 10ms"); got != "(nil)" {
+		t.Errorf("TEST.LATER 10ms = %s, want a timeout", got)
+	}
+
+	replies := make(chan string)
+	go func() { replies <- call(server, "TEST.POPWAIT q") }()
+	// The waiting command must let other clients in.
+	time.Sleep(20 * time.Millisecond)
+	if got := call(server, "RPUSH q x"); got != "1" {
+		t.Errorf("RPUSH q x = %s", got)
+	}
+	select {
+	case got := <-replies:
+		if got != "x" {
+			t.Errorf("TEST.POPWAIT q = %s, want x", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TEST.POPWAIT was not woken up")
+	}
+
+	// Inside MULTI, module commands can't block.
+	client := &kv.ClientType{WatchedKeys: map[string]bool{}, DenyBlocking: true}
+	later := Context{server: server, client: client}
+	if got := show(later.BlockClient(0).Wait(ReplyNull())); got != "ERR Blocking module command called from transaction or script" {
+		t.Errorf("Wait inside MULTI = %s", got)
+	}
+}
+
+// replicaConn is an online replica connection that keeps what it is sent.
+type replicaConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *replicaConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(b)
+}
+
+// commands returns the command lines propagated since the last call.
+func (c *replicaConn) commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parser := resp.NewParser(&c.buf)
+	var lines []string
+	for {
+		cmd, err := parser.Parse()
+		if err != nil {
+			return lines
+		}
+		args := make([]string, len(cmd.Array))
+		for i, arg := range cmd.Array {
+			args[i] = arg.Bulk
+		}
+		lines = append(lines, strings.Join(args, " "))
+	}
+}
+
+// held receives the clients TEST.HOLD blocks. It outlives the test, as the
+// command does.
+var held = make(chan *BlockedClient, 1)
+
+// TestBlockedClientPropagation checks that a blocked module command lets
+// the writes of other clients through to replicas at once, rather than
+// holding them in its own propagation batch.
+func TestBlockedClientPropagation(t *testing.T) {
+	server := newTestServer()
+	replica := &replicaConn{}
+	server.ConnectedReplicas[replica] = &types.ReplicaInfo{Conn: replica, State: types.ReplicaStateOnline}
+	ctx := newTestContext(server)
+	createCommand(t, ctx, Command{
+		Name:  "test.hold",
+		Arity: 1,
+		Flags: FlagWrite | FlagBlocking,
+		Handler: func(ctx *Context, args []string) resp.Value {
+			ctx.Call("SET", "before", "1")
+			bc := ctx.BlockClient(5 * time.Second)
+			held <- bc
+			reply := bc.Wait(ReplyNull())
+			ctx.Call("SET", "after", "1")
+			return reply
+		},
+	})
+
+	replies := make(chan string)
+	go func() { replies <- call(server, "TEST.HOLD") }()
+	bc := <-held
+	if got := call(server, "SET other 1"); got != "OK" {
+		t.Fatalf("SET while TEST.HOLD is blocked = %s", got)
+	}
+	want := []string{"SET before 1", "SET other 1"}
+	if got := replica.commands(); !slices.Equal(got, want) {
+		t.Errorf("propagated while blocked = %q, want %q", got, want)
+	}
+
+	bc.Unblock(ReplySimple("DONE"))
+	if got := <-replies; got != "DONE" {
+		t.Errorf("TEST.HOLD = %s, want DONE", got)
+	}
+	if got := replica.commands(); !slices.Equal(got, []string{"SET after 1"}) {
+		t.Errorf("propagated after the unblock = %q", got)
+	}
+}
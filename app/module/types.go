@@ -0,0 +1,97 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/r1i2t3/go-redis/app/handlers"
+	"github.com/r1i2t3/go-redis/app/kv"
+)
+
+// Type is a module value type. Its callbacks save values with a Writer, load
+// them with a Reader, digest them with a Digest and, for AOF rewrites, emit
+// the commands that rebuild them.
+type (
+	Type   = kv.ModuleType
+	Writer = kv.ModuleWriter
+	Reader = kv.ModuleReader
+	Digest = kv.Digest
+)
+
+// ErrWrongType is returned when a key holds a value of another type.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// CreateDataType registers t. Like Redis, type names are nine characters
+// from A-Z, a-z, 0-9, '-' and '_', which keeps them apart from the built-in
+// type names.
+func (ctx *Context) CreateDataType(t *Type) error {
+	if len(t.Name) != 9 {
+		return fmt.Errorf("type name %q must be 9 characters long", t.Name)
+	}
+	for _, c := range t.Name {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("type name %q contains %q", t.Name, c)
+		}
+	}
+	if t.EncVer < 0 || t.EncVer > 1023 {
+		return fmt.Errorf("type %s: encoding version must be between 0 and 1023", t.Name)
+	}
+	if t.RDBSave == nil || t.RDBLoad == nil {
+		return fmt.Errorf("type %s: RDBSave and RDBLoad are required", t.Name)
+	}
+	return kv.RegisterModuleType(t)
+}
+
+// GetValue returns the value of type t at key, or nil if the key doesn't
+// exist. The caller may change the value in place, so while a snapshot of
+// the dataset is being saved, the value is copied the first time it is
+// fetched and the snapshot keeps the original. A value fetched before Wait
+// must be fetched again after it.
+func (ctx *Context) GetValue(key string, t *Type) (any, error) {
+	kV := ctx.server.KV
+	kV.ModulesMu.Lock()
+	mv, ok := kV.Modules[key]
+	var err error
+	if ok && mv.Type == t {
+		mv, _, err = kV.MutableModuleValue(key)
+	}
+	kV.ModulesMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("can't copy the value at %q for the snapshot being saved: %w", key, err)
+	}
+	if ok {
+		if mv.Type != t {
+			return nil, ErrWrongType
+		}
+		return mv.Value, nil
+	}
+	if handlers.KeyType(kV, key) != "none" {
+		return nil, ErrWrongType
+	}
+	return nil, nil
+}
+
+// SetValue stores value at key, replacing any value of type t already
+// there.
+func (ctx *Context) SetValue(key string, t *Type, value any) error {
+	kV := ctx.server.KV
+	if kt := handlers.KeyType(kV, key); kt != "none" && kt != t.Name {
+		return ErrWrongType
+	}
+	kV.ModulesMu.Lock()
+	kV.PreserveModuleValue(key)
+	kV.Modules[key] = &kv.ModuleValue{Type: t, Value: value}
+	kV.ModulesMu.Unlock()
+	kV.SignalModifiedKey(key)
+	return nil
+}
+
+// DeleteKey removes key whatever its type and reports whether it existed.
+// Unlike DEL, it doesn't replicate anything.
+func (ctx *Context) DeleteKey(key string) bool {
+	if !handlers.DeleteKey(ctx.server.KV, key) {
+		return false
+	}
+	ctx.server.KV.SignalModifiedKey(key)
+	return true
+}
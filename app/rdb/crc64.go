@@ -0,0 +1,82 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+)
+
+// jonesTable is for the CRC-64 Redis checksums RDB files with: the Jones
+// polynomial, reflected, with neither an initial nor a final inversion.
+var jonesTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// crc64Jones continues the checksum crc over p. The standard library
+// inverts the CRC before and after, so undo both.
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, jonesTable, p)
+}
+
+// jonesHash is an io.Writer checksumming what is written to it.
+type jonesHash struct {
+	crc uint64
+}
+
+func (h *jonesHash) Write(p []byte) (int, error) {
+	h.crc = crc64Jones(h.crc, p)
+	return len(p), nil
+}
+
+// crcReader reads from r while checksumming the bytes handed out, so that a
+// file is checked as it loads instead of being read whole first. Bytes r
+// has buffered but not handed out aren't in the checksum yet.
+type crcReader struct {
+	r      *bufio.Reader
+	crc    uint64
+	update func(crc uint64, p []byte) uint64
+	one    [1]byte
+}
+
+func newCRCReader(r *bufio.Reader, update func(crc uint64, p []byte) uint64) *crcReader {
+	return &crcReader{r: r, update: update}
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = c.update(c.crc, p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.one[0] = b
+		c.crc = c.update(c.crc, c.one[:])
+	}
+	return b, err
+}
+
+// Discard skips n bytes, which still count towards the checksum.
+func (c *crcReader) Discard(n int) (int, error) {
+	skipped, err := io.CopyN(io.Discard, c, int64(n))
+	return int(skipped), err
+}
+
+// verify reads the checksum ending the file, stored in order, and compares
+// it with that of everything read before it. A zero checksum, which Redis
+// writes when rdbchecksum is off, isn't checked if allowZero is set.
+func (c *crcReader) verify(order binary.ByteOrder, allowZero bool) error {
+	want := c.crc
+	var stored uint64
+	if err := binary.Read(c.r, order, &stored); err != nil {
+		return fmt.Errorf("rdb file is truncated: %w", err)
+	}
+	if stored == 0 && allowZero {
+		return nil
+	}
+	if stored != want {
+		return fmt.Errorf("rdb checksum verification failed")
+	}
+	return nil
+}
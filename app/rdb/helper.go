@@ -3,57 +3,167 @@ package rdb
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/types"
 )
 
+// bgsaveRetryDelay is how long save points wait after a failed BGSAVE
+// before trying again, as in Redis.
+const bgsaveRetryDelay = 5 * time.Second
+
+// ParseSavePoints parses the save setting: pairs of seconds and changes
+// separated by spaces, as in "3600 1 300 100". An empty setting disables
+// saving.
+func ParseSavePoints(s string) ([]types.SavePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save points are pairs of seconds and changes")
+	}
+	points := make([]types.SavePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid number of seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid number of changes %q", fields[i+1])
+		}
+		points = append(points, types.SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+// FormatSavePoints renders save points the way ParseSavePoints reads them.
+func FormatSavePoints(points []types.SavePoint) string {
+	parts := make([]string, 0, 2*len(points))
+	for _, p := range points {
+		parts = append(parts, strconv.FormatInt(p.Seconds, 10), strconv.FormatInt(p.Changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// StartRDBackgroundSave runs saveCron every second.
 func StartRDBackgroundSave(server *types.Server) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		server.StateMutex.Lock()
-		shouldSave := time.Since(server.LastSave).Seconds() >= float64(server.Config.RDBSaveSeconds) &&
-			server.Dirty >= int64(server.Config.RDBSaveChanges)
-		server.StateMutex.Unlock()
+		saveCron(server)
+	}
+}
+
+// saveCron starts a BGSAVE if a save point is reached. After a failed BGSAVE
+// it waits bgsaveRetryDelay before trying again.
+func saveCron(server *types.Server) {
+	var reached *types.SavePoint
+	server.StateMutex.Lock()
+	if server.LastBGSaveErr == nil || time.Since(server.LastBGSaveTry) >= bgsaveRetryDelay {
+		for i, p := range server.Config.SavePoints {
+			if server.Dirty >= p.Changes && time.Since(server.LastSave) >= time.Duration(p.Seconds)*time.Second {
+				reached = &server.Config.SavePoints[i]
+				break
+			}
+		}
+	}
+	server.StateMutex.Unlock()
 
-		if shouldSave {
-			fmt.Println("Save conditions met, starting BGSAVE.")
-			TriggerBackgroundSave(server)
+	// Like Redis, save points wait while another background job runs.
+	busy := server.IsSaving.Load() || server.AOF != nil && server.AOF.Rewriting()
+	if reached != nil && !busy {
+		fmt.Printf("%d changes in %d seconds. Saving...\n", reached.Changes, reached.Seconds)
+		if err := TriggerBackgroundSave(server); err != nil {
+			fmt.Printf("Can't start BGSAVE: %v\n", err)
 		}
 	}
 }
 
+// TriggerBackgroundSave snapshots the dataset and saves the snapshot in the
+// background, so the file holds the dataset as it was when the save began.
+// The caller must not hold KeyspaceMu.
 func TriggerBackgroundSave(server *types.Server) error {
+	server.BackgroundMu.Lock()
+	defer server.BackgroundMu.Unlock()
 	if server.IsSaving.Load() {
 		return fmt.Errorf("background save already in progress")
 	}
+	if server.AOF != nil && server.AOF.Rewriting() {
+		return fmt.Errorf("background append only file rewriting in progress")
+	}
+
+	kV := server.KV
+	kV.KeyspaceMu.Lock()
+	snapshot := kV.Snapshot()
+	// Changes made from here on aren't in the file and stay dirty.
+	server.StateMutex.Lock()
+	dirtyBefore := server.Dirty
+	server.LastBGSaveTry = time.Now()
+	server.StateMutex.Unlock()
+	kV.KeyspaceMu.Unlock()
+	server.RDBSaveBytes.Store(0)
+	server.IsSaving.Store(true)
 
 	go func() {
-		server.IsSaving.Store(true)
 		defer server.IsSaving.Store(false)
+		defer snapshot.Release()
 
-		dbfilePath := fmt.Sprintf("%s/%s", server.Config.Dir, server.Config.DbFileName)
-
-		err := Save(dbfilePath+".tmp", server.KV)
-		if err != nil {
-			fmt.Printf("BGSAVE failed during save: %v\n", err)
-			return
+		err := saveToDisk(server, snapshot.View(), &server.RDBSaveBytes)
+		server.StateMutex.Lock()
+		server.LastBGSaveErr = err
+		if err == nil {
+			server.Dirty -= dirtyBefore
+			server.LastSave = time.Now()
 		}
-
-		if err := os.Rename(dbfilePath+".tmp", dbfilePath); err != nil {
-			fmt.Printf("BGSAVE failed during rename: %v\n", err)
+		server.StateMutex.Unlock()
+		if err != nil {
+			fmt.Printf("BGSAVE failed: %v\n", err)
 			return
 		}
-
 		fmt.Println("Background save successful.")
-
-		server.StateMutex.Lock()
-		server.Dirty = 0
-		server.LastSave = time.Now()
-		server.StateMutex.Unlock()
 	}()
 
 	return nil
 }
+
+// SaveForeground saves the dataset while holding the keyspace, so no
+// command runs until the file is written, as SAVE does. The caller must not
+// hold KeyspaceMu.
+func SaveForeground(server *types.Server) error {
+	server.BackgroundMu.Lock()
+	defer server.BackgroundMu.Unlock()
+	if server.IsSaving.Load() {
+		return fmt.Errorf("background save already in progress")
+	}
+
+	server.KV.KeyspaceMu.Lock()
+	defer server.KV.KeyspaceMu.Unlock()
+	if err := saveToDisk(server, server.KV, nil); err != nil {
+		fmt.Printf("SAVE failed: %v\n", err)
+		return err
+	}
+	fmt.Println("DB saved on disk")
+	server.StateMutex.Lock()
+	// A successful save clears the error of a failed BGSAVE, as in Redis.
+	server.LastBGSaveErr = nil
+	server.Dirty = 0
+	server.LastSave = time.Now()
+	server.StateMutex.Unlock()
+	return nil
+}
+
+// saveToDisk writes kv to a temporary file and renames it over the RDB
+// file, so a failed save leaves the previous file intact. written, if not
+// nil, counts the bytes written.
+func saveToDisk(server *types.Server, kv *kv.KV, written *atomic.Int64) error {
+	dbfilePath := fmt.Sprintf("%s/%s", server.Config.Dir, server.Config.DbFileName)
+	if err := Save(dbfilePath+".tmp", kv, server.Config.RDBFormat, written); err != nil {
+		os.Remove(dbfilePath + ".tmp")
+		return err
+	}
+	return os.Rename(dbfilePath+".tmp", dbfilePath)
+}
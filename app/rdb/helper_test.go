@@ -0,0 +1,132 @@
+package rdb
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/types"
+)
+
+func TestParseSavePoints(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []types.SavePoint
+		wantErr bool
+	}{
+		{"", []types.SavePoint{}, false},
+		{"  ", []types.SavePoint{}, false},
+		{"900 1", []types.SavePoint{{Seconds: 900, Changes: 1}}, false},
+		{"3600 1 300 100 60 10000", []types.SavePoint{{Seconds: 3600, Changes: 1}, {Seconds: 300, Changes: 100}, {Seconds: 60, Changes: 10000}}, false},
+		{"60 0", []types.SavePoint{{Seconds: 60, Changes: 0}}, false},
+		{"900", nil, true},
+		{"0 1", nil, true},
+		{"60 -1", nil, true},
+		{"a 1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSavePoints(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSavePoints(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSavePoints(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if !tt.wantErr && len(got) > 0 {
+			if back, _ := ParseSavePoints(FormatSavePoints(got)); !slices.Equal(back, got) {
+				t.Errorf("FormatSavePoints(%v) = %q doesn't parse back", got, FormatSavePoints(got))
+			}
+		}
+	}
+}
+
+// newSaveServer returns a server with 10 unsaved changes, the last save an
+// hour ago, and the given save points.
+func newSaveServer(t *testing.T, points []types.SavePoint) *types.Server {
+	server := &types.Server{
+		Config: types.Config{
+			Dir:        t.TempDir(),
+			DbFileName: "dump.rdb",
+			SavePoints: points,
+			RDBFormat:  FormatRedis,
+		},
+		KV:       kv.NewKv(),
+		Dirty:    10,
+		LastSave: time.Now().Add(-time.Hour),
+	}
+	return server
+}
+
+// waitSave waits for the BGSAVE in progress, if any, to finish.
+func waitSave(t *testing.T, server *types.Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.IsSaving.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSaveCron(t *testing.T) {
+	tests := []struct {
+		name   string
+		points string
+		saved  bool
+	}{
+		{"disabled", "", false},
+		{"too few changes", "60 100", false},
+		{"too recent", "7200 1", false},
+		{"reached", "60 5", true},
+		{"any point will do", "7200 1 60 5", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := ParseSavePoints(tt.points)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newSaveServer(t, points)
+			saveCron(server)
+			waitSave(t, server)
+			_, err = os.Stat(filepath.Join(server.Config.Dir, "dump.rdb"))
+			if saved := err == nil; saved != tt.saved {
+				t.Fatalf("saved = %v, want %v", saved, tt.saved)
+			}
+			if tt.saved && server.Dirty != 0 {
+				t.Errorf("Dirty = %d after the save", server.Dirty)
+			}
+		})
+	}
+}
+
+// TestSaveCronRetryDelay checks that save points don't retry a failed
+// BGSAVE before bgsaveRetryDelay.
+func TestSaveCronRetryDelay(t *testing.T) {
+	server := newSaveServer(t, []types.SavePoint{{Seconds: 60, Changes: 1}})
+	good := server.Config.Dir
+	server.Config.Dir = filepath.Join(good, "missing")
+	saveCron(server)
+	waitSave(t, server)
+	if server.LastBGSaveErr == nil {
+		t.Fatal("BGSAVE into a missing directory succeeded")
+	}
+
+	server.Config.Dir = good
+	saveCron(server)
+	waitSave(t, server)
+	if server.LastBGSaveErr == nil {
+		t.Fatal("BGSAVE retried at once")
+	}
+	server.LastBGSaveTry = time.Now().Add(-bgsaveRetryDelay)
+	saveCron(server)
+	waitSave(t, server)
+	if server.LastBGSaveErr != nil {
+		t.Fatalf("retried BGSAVE failed: %v", server.LastBGSaveErr)
+	}
+}
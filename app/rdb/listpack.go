@@ -0,0 +1,316 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var (
+	errListpack = errors.New("invalid listpack")
+	errZiplist  = errors.New("invalid ziplist")
+	errIntset   = errors.New("invalid intset")
+)
+
+// canonicalInt parses s as Redis does before storing a string as an
+// integer: only if formatting the integer gives s back.
+func canonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// listpack builds a listpack, the serialized list Redis keeps small
+// collections in: a header with the size and element count, the elements,
+// each followed by its length for walking backwards, and an end byte.
+type listpack struct {
+	buf   []byte
+	count int
+}
+
+func newListpack() *listpack {
+	return &listpack{buf: make([]byte, 6, 64)}
+}
+
+// appendString adds s, as an integer if it is one.
+func (lp *listpack) appendString(s string) {
+	if n, ok := canonicalInt(s); ok {
+		lp.appendInt(n)
+		return
+	}
+	start := len(lp.buf)
+	switch l := len(s); {
+	case l < 1<<6:
+		lp.buf = append(lp.buf, 0x80|byte(l))
+	case l < 1<<12:
+		lp.buf = append(lp.buf, 0xE0|byte(l>>8), byte(l))
+	default:
+		lp.buf = binary.LittleEndian.AppendUint32(append(lp.buf, 0xF0), uint32(l))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.endEntry(start)
+}
+
+func (lp *listpack) appendInt(n int64) {
+	start := len(lp.buf)
+	switch {
+	case n >= 0 && n <= 127:
+		lp.buf = append(lp.buf, byte(n))
+	case n >= -4096 && n <= 4095:
+		u := uint64(n) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(u>>8), byte(u))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		lp.buf = binary.LittleEndian.AppendUint16(append(lp.buf, 0xF1), uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		lp.buf = append(lp.buf, 0xF2, byte(n), byte(n>>8), byte(n>>16))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		lp.buf = binary.LittleEndian.AppendUint32(append(lp.buf, 0xF3), uint32(n))
+	default:
+		lp.buf = binary.LittleEndian.AppendUint64(append(lp.buf, 0xF4), uint64(n))
+	}
+	lp.endEntry(start)
+}
+
+// endEntry appends the back length of the entry starting at start.
+func (lp *listpack) endEntry(start int) {
+	l := uint64(len(lp.buf) - start)
+	size := backlenSize(int(l))
+	for i := size - 1; i >= 0; i-- {
+		b := byte(l>>(7*i)) & 127
+		if i != size-1 {
+			b |= 128
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.count++
+}
+
+// size returns the size of the listpack so far.
+func (lp *listpack) size() int {
+	return len(lp.buf) + 1
+}
+
+func (lp *listpack) bytes() []byte {
+	buf := append(lp.buf, 0xFF)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	// Counts that don't fit are left for readers to work out.
+	binary.LittleEndian.PutUint16(buf[4:], uint16(min(lp.count, math.MaxUint16)))
+	return buf
+}
+
+// backlenSize returns how many bytes the back length of an entry of l
+// bytes takes: 7 bits per byte.
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackEntries returns the elements of a listpack, integers formatted
+// as strings.
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < 7 || binary.LittleEndian.Uint32(lp) != uint32(len(lp)) || lp[len(lp)-1] != 0xFF {
+		return nil, errListpack
+	}
+	var entries []string
+	end := len(lp) - 1
+	for p := 6; p < end; {
+		b := lp[p]
+		// need reports whether the entry's n bytes, encoding included, fit.
+		need := func(n int) bool { return p+n <= end }
+		var entry string
+		var l int
+		switch {
+		case b&0x80 == 0:
+			entry, l = strconv.Itoa(int(b)), 1
+		case b&0xC0 == 0x80:
+			l = 1 + int(b&0x3F)
+			if !need(l) {
+				return nil, errListpack
+			}
+			entry = string(lp[p+1 : p+l])
+		case b&0xE0 == 0xC0:
+			if !need(2) {
+				return nil, errListpack
+			}
+			v := int64(b&0x1F)<<8 | int64(lp[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry, l = strconv.FormatInt(v, 10), 2
+		case b&0xF0 == 0xE0:
+			if !need(2) {
+				return nil, errListpack
+			}
+			l = 2 + (int(b&0x0F)<<8 | int(lp[p+1]))
+			if !need(l) {
+				return nil, errListpack
+			}
+			entry = string(lp[p+2 : p+l])
+		case b == 0xF0:
+			if !need(5) {
+				return nil, errListpack
+			}
+			n := binary.LittleEndian.Uint32(lp[p+1:])
+			if uint64(n) > uint64(end-p-5) {
+				return nil, errListpack
+			}
+			l = 5 + int(n)
+			entry = string(lp[p+5 : p+l])
+		case b >= 0xF1 && b <= 0xF4:
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[b]
+			l = 1 + width
+			if !need(l) {
+				return nil, errListpack
+			}
+			entry = strconv.FormatInt(littleEndianInt(lp[p+1:p+l]), 10)
+		default:
+			return nil, errListpack
+		}
+		p += l + backlenSize(l)
+		if p > end {
+			return nil, errListpack
+		}
+		entries = append(entries, entry)
+	}
+	if count := binary.LittleEndian.Uint16(lp[4:]); count != math.MaxUint16 && int(count) != len(entries) {
+		return nil, errListpack
+	}
+	return entries, nil
+}
+
+// littleEndianInt decodes a signed little-endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(u<<shift) >> shift
+}
+
+// ziplistEntries returns the elements of a ziplist, which listpacks
+// replaced in Redis 7 and which older RDB files still hold.
+func ziplistEntries(zl []byte) ([]string, error) {
+	if len(zl) < 11 || binary.LittleEndian.Uint32(zl) != uint32(len(zl)) || zl[len(zl)-1] != 0xFF {
+		return nil, errZiplist
+	}
+	var entries []string
+	end := len(zl) - 1
+	for p := 10; p < end; {
+		// Skip the length of the previous entry.
+		if zl[p] == 0xFE {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= end {
+			return nil, errZiplist
+		}
+		b := zl[p]
+		need := func(n int) bool { return p+n <= end }
+		var entry string
+		var l int
+		switch b >> 6 {
+		case 0:
+			l = 1 + int(b&0x3F)
+			if !need(l) {
+				return nil, errZiplist
+			}
+			entry = string(zl[p+1 : p+l])
+		case 1:
+			if !need(2) {
+				return nil, errZiplist
+			}
+			l = 2 + (int(b&0x3F)<<8 | int(zl[p+1]))
+			if !need(l) {
+				return nil, errZiplist
+			}
+			entry = string(zl[p+2 : p+l])
+		case 2:
+			if b != 0x80 || !need(5) {
+				return nil, errZiplist
+			}
+			n := binary.BigEndian.Uint32(zl[p+1:])
+			if uint64(n) > uint64(end-p-5) {
+				return nil, errZiplist
+			}
+			l = 5 + int(n)
+			entry = string(zl[p+5 : p+l])
+		default:
+			width, ok := map[byte]int{0xC0: 2, 0xD0: 4, 0xE0: 8, 0xF0: 3, 0xFE: 1}[b]
+			switch {
+			case ok:
+				l = 1 + width
+				if !need(l) {
+					return nil, errZiplist
+				}
+				entry = strconv.FormatInt(littleEndianInt(zl[p+1:p+l]), 10)
+			case b >= 0xF1 && b <= 0xFD:
+				// Small integers live in the encoding byte, offset by one.
+				entry, l = strconv.Itoa(int(b&0x0F)-1), 1
+			default:
+				return nil, errZiplist
+			}
+		}
+		p += l
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// intsetEncode returns an intset holding values: a sorted array of
+// integers, all of the smallest width that fits them.
+func intsetEncode(values []int64) []byte {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	width := 2
+	for _, v := range values {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			width = 8
+			break
+		}
+		if v < math.MinInt16 || v > math.MaxInt16 {
+			width = 4
+		}
+	}
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(width))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(values)))
+	for _, v := range values {
+		for i := 0; i < width; i++ {
+			buf = append(buf, byte(v>>(8*i)))
+		}
+	}
+	return buf
+}
+
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errIntset
+	}
+	width := binary.LittleEndian.Uint32(is)
+	count := binary.LittleEndian.Uint32(is[4:])
+	if width != 2 && width != 4 && width != 8 || uint64(len(is)-8) != uint64(width)*uint64(count) {
+		return nil, errIntset
+	}
+	entries := make([]string, count)
+	for i := range entries {
+		p := 8 + i*int(width)
+		entries[i] = strconv.FormatInt(littleEndianInt(is[p:p+int(width)]), 10)
+	}
+	return entries, nil
+}
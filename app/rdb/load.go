@@ -1,12 +1,13 @@
 package rdb
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"hash/crc64"
 	"io"
 	"os"
+	"time"
 
 	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/resp"
@@ -14,40 +15,51 @@ import (
 )
 
 type rdbLoader struct {
-	reader *bytes.Reader
+	reader *crcReader
 	kv     *kv.KV
+	// skipExpired drops keys whose TTL has passed, as a master does; a
+	// replica keeps them and waits for the master to delete them.
+	skipExpired bool
 }
 
-func newLoader(data []byte, kv *kv.KV) *rdbLoader {
+// legacyTable is for the CRC-64 checksum ending files in the legacy format.
+var legacyTable = crc64.MakeTable(crc64.ISO)
+
+func newLoader(r *bufio.Reader, kv *kv.KV, skipExpired bool) *rdbLoader {
 	return &rdbLoader{
-		reader: bytes.NewReader(data),
-		kv:     kv,
+		reader: newCRCReader(r, func(crc uint64, p []byte) uint64 {
+			return crc64.Update(crc, legacyTable, p)
+		}),
+		kv:          kv,
+		skipExpired: skipExpired,
 	}
 }
 
-func Load(path string, kv *kv.KV) error {
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("RDB file does not exist")
-	}
-	data, err := readFileAndVerifyChecksum(path)
+// Load loads the RDB file at path, in either format. With skipExpired, as
+// when a master loads its dataset, keys already expired are left out.
+func Load(path string, kv *kv.KV, skipExpired bool) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	loader := newLoader(data, kv)
+	defer file.Close()
+	return LoadFrom(file, kv, skipExpired)
+}
 
-	if err := loader.loadHeader(); err != nil {
-		return err
+// LoadFrom loads an RDB payload, in either format, as it is read from r,
+// verifying its checksum at the end. r is read ahead, so it should end with
+// the payload. A replica loads the payload of a full sync with it, keeping keys
+// already expired.
+func LoadFrom(r io.Reader, kv *kv.KV, skipExpired bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(len(MagicString) + 4)
+	if err != nil {
+		return fmt.Errorf("rdb file is too small")
 	}
-	if err := loader.loadData(); err != nil {
-		return err
+	if isRedisFormat(head) {
+		return loadRedis(br, kv, skipExpired)
 	}
-
-	return nil
-}
-
-func LoadFromBuffer(data []byte, kv *kv.KV) error {
-	loader := newLoader(data, kv)
+	loader := newLoader(br, kv, skipExpired)
 
 	if err := loader.loadHeader(); err != nil {
 		return err
@@ -59,32 +71,6 @@ func LoadFromBuffer(data []byte, kv *kv.KV) error {
 	return nil
 }
 
-func readFileAndVerifyChecksum(path string) ([]byte, error) {
-	file, err := os.Open(path)
-
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	fileInfo, _ := file.Stat()
-	if fileInfo.Size() < 18 {
-		return nil, fmt.Errorf("rdb file is too small")
-	}
-
-	buf := make([]byte, fileInfo.Size())
-	if _, err := io.ReadFull(file, buf); err != nil {
-		return nil, err
-	}
-	storedChecksum := binary.BigEndian.Uint64(buf[len(buf)-8:])
-	data := buf[:len(buf)-8]
-	calculatedChecksum := crc64.Checksum(data, crc64.MakeTable(crc64.ISO))
-	if storedChecksum != calculatedChecksum {
-		return nil, fmt.Errorf("rdb checksum verification failed")
-	}
-	return data, nil
-}
-
 func (l *rdbLoader) loadHeader() error {
 	magic := make([]byte, len(MagicString))
 	if _, err := io.ReadFull(l.reader, magic); err != nil {
@@ -97,7 +83,7 @@ func (l *rdbLoader) loadHeader() error {
 	if err := binary.Read(l.reader, binary.BigEndian, &version); err != nil {
 		return err
 	}
-	if version != Version {
+	if version < 1 || version > Version {
 		return fmt.Errorf("unsupported rdb version: %d", version)
 	}
 
@@ -105,39 +91,60 @@ func (l *rdbLoader) loadHeader() error {
 }
 
 func (l *rdbLoader) loadData() error {
+	// expireAt is the expiry, in unix milliseconds, given ahead of the next
+	// key.
+	expireAt := int64(0)
 	for {
 		opcode := make([]byte, 1)
 		_, err := io.ReadFull(l.reader, opcode)
 		if err != nil {
 			return fmt.Errorf("unexpected eof before rdb eof opcode")
 		}
-		if opcode[0] == OpCodeEOF {
-			return nil
+		switch opcode[0] {
+		case OpCodeEOF:
+			return l.reader.verify(binary.BigEndian, false)
+		case OpCodeExpireTime:
+			if expireAt, err = l.readInt64(); err != nil {
+				return err
+			}
+			continue
 		}
-		if err := l.loadObject(opcode[0]); err != nil {
+		if err := l.loadObject(opcode[0], expireAt); err != nil {
 			return err
 		}
+		expireAt = 0
 	}
 }
 
-func (l *rdbLoader) loadObject(opcode byte) error {
+// loadObject loads a key of the type given by opcode. Only strings have
+// TTLs, so an expiry can only precede a string.
+func (l *rdbLoader) loadObject(opcode byte, expireAt int64) error {
+	if expireAt != 0 && opcode != OpCodeString {
+		return fmt.Errorf("expire time ahead of a key of opcode %x, which can't expire", opcode)
+	}
 	switch opcode {
 	case OpCodeString:
-		return l.loadStringObject()
+		return l.loadStringObject(expireAt)
 	case OpCodeList:
 		return l.loadListObject()
 	case OpCodeHash:
 		return l.loadHashObject()
+	case OpCodeSet:
+		return l.loadSetObject()
 	case OpCodeZSet:
 		return l.loadZSetObject()
 	case OpCodeStream:
-		return l.loadStreamObject()
+		return l.loadStreamObject(false)
+	case OpCodeStreamGroups:
+		return l.loadStreamObject(true)
+	case OpCodeModule:
+		return l.loadModuleObject()
 	default:
 		return fmt.Errorf("unknown opcode: %x", opcode)
 	}
 }
 
-func (l *rdbLoader) loadStringObject() error {
+func (l *rdbLoader) loadStringObject(expireAt int64) error {
 	key, err := ReadString(l.reader)
 	if err != nil {
 		return err
@@ -146,7 +153,10 @@ func (l *rdbLoader) loadStringObject() error {
 	if err != nil {
 		return err
 	}
-	l.kv.Strings[key] = resp.Value{Typ: "string", Str: val}
+	if l.skipExpired && expireAt > 0 && expireAt < time.Now().UnixMilli() {
+		return nil
+	}
+	l.kv.Strings[key] = resp.Value{Typ: "string", Str: val, Expires: expireAt}
 	return nil
 }
 
@@ -161,13 +171,13 @@ func (l *rdbLoader) loadListObject() error {
 		return err
 	}
 
-	list := make([]resp.Value, count)
+	list := make([]resp.Value, 0, sizeHint(count))
 	for i := uint64(0); i < count; i++ {
 		item, err := ReadString(l.reader)
 		if err != nil {
 			return err
 		}
-		list[i] = resp.Value{Typ: "bulk", Bulk: item}
+		list = append(list, resp.Value{Typ: "bulk", Bulk: item})
 	}
 	l.kv.Lists[key] = list
 	return nil
@@ -184,7 +194,7 @@ func (l *rdbLoader) loadHashObject() error {
 		return err
 	}
 
-	fields := make(map[string]resp.Value, fieldCount)
+	fields := make(map[string]resp.Value, sizeHint(fieldCount))
 	for i := uint64(0); i < fieldCount; i++ {
 		field, err := ReadString(l.reader)
 		if err != nil {
@@ -200,6 +210,28 @@ func (l *rdbLoader) loadHashObject() error {
 	return nil
 }
 
+func (l *rdbLoader) loadSetObject() error {
+	key, err := ReadString(l.reader)
+	if err != nil {
+		return err
+	}
+
+	var memberCount uint64
+	if err := binary.Read(l.reader, binary.BigEndian, &memberCount); err != nil {
+		return err
+	}
+	members := make(map[string]struct{}, sizeHint(memberCount))
+	for i := uint64(0); i < memberCount; i++ {
+		member, err := ReadString(l.reader)
+		if err != nil {
+			return err
+		}
+		members[member] = struct{}{}
+	}
+	l.kv.Sets[key] = members
+	return nil
+}
+
 func (l *rdbLoader) loadZSetObject() error {
 	key, err := ReadString(l.reader)
 	if err != nil {
@@ -210,7 +242,7 @@ func (l *rdbLoader) loadZSetObject() error {
 	if err := binary.Read(l.reader, binary.BigEndian, &memberCount); err != nil {
 		return err
 	}
-	members := make(map[string]float64, memberCount)
+	members := kv.NewSortedSet()
 	for i := uint64(0); i < memberCount; i++ {
 		member, err := ReadString(l.reader)
 		if err != nil {
@@ -220,13 +252,13 @@ func (l *rdbLoader) loadZSetObject() error {
 		if err := binary.Read(l.reader, binary.BigEndian, &score); err != nil {
 			return err
 		}
-		members[member] = score
+		members.Set(member, score)
 	}
 	l.kv.Sorteds[key] = members
 	return nil
 }
 
-func (l *rdbLoader) loadStreamObject() error {
+func (l *rdbLoader) loadStreamObject(withGroups bool) error {
 	key, err := ReadString(l.reader)
 	if err != nil {
 		return err
@@ -237,9 +269,8 @@ func (l *rdbLoader) loadStreamObject() error {
 		return err
 	}
 
-	stream := &kv.Stream{}
-	entries := make([]kv.StreamEntry, entryCount)
-	for i := range entries {
+	stream := kv.NewStream()
+	for i := uint64(0); i < entryCount; i++ {
 		id, err := ReadString(l.reader)
 		if err != nil {
 			return err
@@ -250,7 +281,7 @@ func (l *rdbLoader) loadStreamObject() error {
 			return err
 		}
 
-		fields := make(map[string]resp.Value, fieldCount)
+		fields := make([]kv.StreamField, 0, sizeHint(fieldCount))
 		for j := uint64(0); j < fieldCount; j++ {
 			field, err := ReadString(l.reader)
 			if err != nil {
@@ -260,16 +291,139 @@ func (l *rdbLoader) loadStreamObject() error {
 			if err != nil {
 				return err
 			}
-			fields[field] = resp.Value{Typ: "bulk", Bulk: value}
+			fields = append(fields, kv.StreamField{Name: field, Value: value})
 		}
 
 		parsedID, err := utils.ParseStreamID(id)
 		if err != nil {
 			return err
 		}
-		entries[i] = kv.StreamEntry{ID: parsedID, Fields: fields}
+		stream.Append(parsedID, fields)
+	}
+	if withGroups {
+		if err := l.loadStreamMetadata(stream); err != nil {
+			return fmt.Errorf("stream %q: %w", key, err)
+		}
 	}
-	stream.Entries = entries
 	l.kv.Streams[key] = stream
 	return nil
 }
+
+func (l *rdbLoader) readStreamID() (kv.StreamId, error) {
+	s, err := ReadString(l.reader)
+	if err != nil {
+		return kv.StreamId{}, err
+	}
+	return utils.ParseStreamID(s)
+}
+
+func (l *rdbLoader) readUint64() (uint64, error) {
+	var n uint64
+	err := binary.Read(l.reader, binary.BigEndian, &n)
+	return n, err
+}
+
+func (l *rdbLoader) readInt64() (int64, error) {
+	var n int64
+	err := binary.Read(l.reader, binary.BigEndian, &n)
+	return n, err
+}
+
+// loadStreamMetadata reads what saveStreamMetadata wrote, relinking every
+// consumer's pending IDs to the entries of its group's PEL.
+func (l *rdbLoader) loadStreamMetadata(stream *kv.Stream) error {
+	var err error
+	if stream.LastID, err = l.readStreamID(); err != nil {
+		return err
+	}
+	if stream.EntriesAdded, err = l.readUint64(); err != nil {
+		return err
+	}
+	if stream.MaxDeletedID, err = l.readStreamID(); err != nil {
+		return err
+	}
+	groupCount, err := l.readUint64()
+	if err != nil {
+		return err
+	}
+	for range groupCount {
+		name, err := ReadString(l.reader)
+		if err != nil {
+			return err
+		}
+		lastID, err := l.readStreamID()
+		if err != nil {
+			return err
+		}
+		entriesRead, err := l.readInt64()
+		if err != nil {
+			return err
+		}
+		group := kv.NewConsumerGroup(name, lastID, entriesRead)
+		if group.MaxDeliveries, err = l.readUint64(); err != nil {
+			return err
+		}
+		if group.DeadLetterKey, err = ReadString(l.reader); err != nil {
+			return err
+		}
+
+		pendingCount, err := l.readUint64()
+		if err != nil {
+			return err
+		}
+		for range pendingCount {
+			nack := &kv.PendingEntry{}
+			if nack.ID, err = l.readStreamID(); err != nil {
+				return err
+			}
+			if nack.DeliveryTime, err = l.readInt64(); err != nil {
+				return err
+			}
+			if nack.DeliveryCount, err = l.readUint64(); err != nil {
+				return err
+			}
+			group.Pending[nack.ID] = nack
+		}
+
+		consumerCount, err := l.readUint64()
+		if err != nil {
+			return err
+		}
+		for range consumerCount {
+			consumer := &kv.Consumer{Pending: make(map[kv.StreamId]*kv.PendingEntry)}
+			if consumer.Name, err = ReadString(l.reader); err != nil {
+				return err
+			}
+			if consumer.SeenTime, err = l.readInt64(); err != nil {
+				return err
+			}
+			if consumer.ActiveTime, err = l.readInt64(); err != nil {
+				return err
+			}
+			ownedCount, err := l.readUint64()
+			if err != nil {
+				return err
+			}
+			for range ownedCount {
+				id, err := l.readStreamID()
+				if err != nil {
+					return err
+				}
+				nack, ok := group.Pending[id]
+				if !ok || nack.Consumer != "" {
+					return fmt.Errorf("consumer %q pending entry %s not in group %q PEL", consumer.Name, id.ToString(), name)
+				}
+				nack.Consumer = consumer.Name
+				consumer.Pending[id] = nack
+			}
+			group.Consumers[consumer.Name] = consumer
+		}
+		for id, nack := range group.Pending {
+			if nack.Consumer == "" {
+				return fmt.Errorf("group %q pending entry %s has no consumer", name, id.ToString())
+			}
+		}
+		stream.Groups[name] = group
+	}
+	return nil
+}
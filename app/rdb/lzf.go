@@ -0,0 +1,120 @@
+package rdb
+
+import "errors"
+
+var errLZF = errors.New("invalid LZF compressed string")
+
+// LZF limits: a literal run holds up to 32 bytes, and a back reference
+// reaches up to 8 KB back and copies up to 264 bytes.
+const (
+	lzfHashLog    = 14
+	lzfMaxLiteral = 32
+	lzfMaxOffset  = 1 << 13
+	lzfMaxRef     = 264
+)
+
+// lzfCompress compresses in as liblzf does, for the long strings Redis
+// stores compressed. It returns nil if the result doesn't fit in limit
+// bytes.
+func lzfCompress(in []byte, limit int) []byte {
+	// table maps the hash of three bytes to the position after them.
+	var table [1 << lzfHashLog]int32
+	out := make([]byte, 1, limit+1)
+	// lit is the length of the literal run in progress, whose control byte
+	// is at out[len(out)-lit-1].
+	lit := 0
+	endRun := func() {
+		if lit == 0 {
+			out = out[:len(out)-1]
+		} else {
+			out[len(out)-lit-1] = byte(lit - 1)
+		}
+	}
+	for ip := 0; ip < len(in); {
+		if ip+2 < len(in) {
+			h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashLog)
+			ref := int(table[h]) - 1
+			table[h] = int32(ip + 1)
+			if ref >= 0 && ip-ref-1 < lzfMaxOffset &&
+				in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+				n := 3
+				for n < min(lzfMaxRef, len(in)-ip) && in[ref+n] == in[ip+n] {
+					n++
+				}
+				endRun()
+				off, l := ip-ref-1, n-2
+				if l < 7 {
+					out = append(out, byte(l<<5|off>>8))
+				} else {
+					out = append(out, byte(7<<5|off>>8), byte(l-7))
+				}
+				out = append(out, byte(off), 0)
+				lit = 0
+				ip += n
+				if len(out) > limit+1 {
+					return nil
+				}
+				continue
+			}
+		}
+		out = append(out, in[ip])
+		lit++
+		ip++
+		if lit == lzfMaxLiteral {
+			endRun()
+			out = append(out, 0)
+			lit = 0
+		}
+		if len(out) > limit+1 {
+			return nil
+		}
+	}
+	endRun()
+	if len(out) > limit {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress decompresses in, which must expand to exactly size bytes.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > size {
+				return nil, errLZF
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errLZF
+			}
+			n += int(in[i])
+			i++
+		}
+		n += 2
+		if i >= len(in) {
+			return nil, errLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+n > size {
+			return nil, errLZF
+		}
+		// The reference may overlap what it copies, so copy byte by byte.
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != size {
+		return nil, errLZF
+	}
+	return out, nil
+}
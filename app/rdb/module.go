@@ -0,0 +1,161 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+)
+
+// Every item a module type saves is tagged with its kind, so a value written
+// by a mismatched RDBSave/RDBLoad pair fails to load instead of loading
+// garbage. The payload ends with moduleOpEOF.
+const (
+	moduleOpEOF      byte = 0
+	moduleOpUnsigned byte = 1
+	moduleOpSigned   byte = 2
+	moduleOpDouble   byte = 3
+	moduleOpString   byte = 4
+)
+
+// moduleWriter implements kv.ModuleWriter, keeping the first error.
+type moduleWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *moduleWriter) write(op byte, data any) {
+	if m.err != nil {
+		return
+	}
+	if _, m.err = m.w.Write([]byte{op}); m.err != nil {
+		return
+	}
+	if s, ok := data.(string); ok {
+		m.err = WriteString(m.w, s)
+		return
+	}
+	m.err = binary.Write(m.w, binary.BigEndian, data)
+}
+
+func (m *moduleWriter) SaveUnsigned(n uint64) { m.write(moduleOpUnsigned, n) }
+func (m *moduleWriter) SaveSigned(n int64)    { m.write(moduleOpSigned, n) }
+func (m *moduleWriter) SaveDouble(f float64)  { m.write(moduleOpDouble, f) }
+func (m *moduleWriter) SaveString(s string)   { m.write(moduleOpString, s) }
+
+// moduleReader implements kv.ModuleReader, keeping the first error.
+type moduleReader struct {
+	r   io.Reader
+	err error
+}
+
+func (m *moduleReader) expect(op byte) bool {
+	if m.err != nil {
+		return false
+	}
+	got := make([]byte, 1)
+	if _, m.err = io.ReadFull(m.r, got); m.err != nil {
+		return false
+	}
+	if got[0] != op {
+		m.err = fmt.Errorf("module value item has kind %d, expected %d", got[0], op)
+		return false
+	}
+	return true
+}
+
+func (m *moduleReader) read(op byte, data any) {
+	if m.expect(op) {
+		m.err = binary.Read(m.r, binary.BigEndian, data)
+	}
+}
+
+func (m *moduleReader) LoadUnsigned() uint64 {
+	var n uint64
+	m.read(moduleOpUnsigned, &n)
+	return n
+}
+
+func (m *moduleReader) LoadSigned() int64 {
+	var n int64
+	m.read(moduleOpSigned, &n)
+	return n
+}
+
+func (m *moduleReader) LoadDouble() float64 {
+	var f float64
+	m.read(moduleOpDouble, &f)
+	return f
+}
+
+func (m *moduleReader) LoadString() string {
+	if !m.expect(moduleOpString) {
+		return ""
+	}
+	var s string
+	s, m.err = ReadString(m.r)
+	return s
+}
+
+func saveModules(writer io.Writer, kV *kv.KV) error {
+	kV.ModulesMu.RLock()
+	defer kV.ModulesMu.RUnlock()
+
+	for key, mv := range kV.Modules {
+		if _, err := writer.Write([]byte{OpCodeModule}); err != nil {
+			return err
+		}
+		if err := WriteString(writer, key); err != nil {
+			return err
+		}
+		if err := WriteString(writer, mv.Type.Name); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint64(mv.Type.EncVer)); err != nil {
+			return err
+		}
+		w := &moduleWriter{w: writer}
+		mv.Type.RDBSave(w, mv.Value)
+		if w.err != nil {
+			return fmt.Errorf("module type %s, key %q: %w", mv.Type.Name, key, w.err)
+		}
+		if _, err := writer.Write([]byte{moduleOpEOF}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *rdbLoader) loadModuleObject() error {
+	key, err := ReadString(l.reader)
+	if err != nil {
+		return err
+	}
+	name, err := ReadString(l.reader)
+	if err != nil {
+		return err
+	}
+	encver, err := l.readUint64()
+	if err != nil {
+		return err
+	}
+	t, ok := kv.LookupModuleType(name)
+	if !ok {
+		return fmt.Errorf("key %q has module type %s, which is not registered", key, name)
+	}
+	if encver > uint64(t.EncVer) {
+		return fmt.Errorf("key %q has module type %s encoding version %d, newer than %d", key, name, encver, t.EncVer)
+	}
+	r := &moduleReader{r: l.reader}
+	value, err := t.RDBLoad(r, int(encver))
+	if err == nil {
+		r.expect(moduleOpEOF)
+		err = r.err
+	}
+	if err != nil {
+		return fmt.Errorf("module type %s, key %q: %w", name, key, err)
+	}
+	l.kv.Modules[key] = &kv.ModuleValue{Type: t, Value: value}
+	return nil
+}
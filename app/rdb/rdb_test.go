@@ -0,0 +1,463 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// testDataset returns a dataset with every built-in type, in both the
+// compact and the general encodings where the format has two.
+func testDataset() *kv.KV {
+	kV := kv.NewKv()
+	future := time.Now().Add(time.Hour).UnixMilli()
+	kV.Strings["str"] = resp.Value{Typ: "string", Str: "hello"}
+	kV.Strings["int"] = resp.Value{Typ: "string", Str: "-12345"}
+	kV.Strings["empty"] = resp.Value{Typ: "string", Str: ""}
+	kV.Strings["binary"] = resp.Value{Typ: "string", Str: "\x00\xff\r\n"}
+	kV.Strings["long"] = resp.Value{Typ: "string", Str: strings.Repeat("abc", 1000)}
+	kV.Strings["ttl"] = resp.Value{Typ: "string", Str: "v", Expires: future}
+
+	kV.Lists["list"] = []resp.Value{{Typ: "bulk", Bulk: "a"}, {Typ: "bulk", Bulk: "7"}, {Typ: "bulk", Bulk: ""}}
+	var long []resp.Value
+	for i := 0; i < 1000; i++ {
+		long = append(long, resp.Value{Typ: "bulk", Bulk: fmt.Sprintf("item-%d", i)})
+	}
+	kV.Lists["biglist"] = long
+
+	kV.Hashes["hash"] = map[string]resp.Value{"f": {Typ: "bulk", Bulk: "v"}, "n": {Typ: "bulk", Bulk: "42"}}
+	big := map[string]resp.Value{}
+	for i := 0; i < 600; i++ {
+		big[fmt.Sprintf("field-%d", i)] = resp.Value{Typ: "bulk", Bulk: strings.Repeat("x", i%80)}
+	}
+	kV.Hashes["bighash"] = big
+
+	kV.Sets["intset"] = setOf("1", "-5", "100000")
+	kV.Sets["set"] = setOf("a", "b", "12")
+	var bigSet []string
+	for i := 0; i < 600; i++ {
+		bigSet = append(bigSet, fmt.Sprintf("member-%d", i))
+	}
+	kV.Sets["bigset"] = setOf(bigSet...)
+
+	small, large := kv.NewSortedSet(), kv.NewSortedSet()
+	small.Set("a", 1.5)
+	small.Set("b", -2)
+	small.Set("c", 1e300)
+	for i := 0; i < 300; i++ {
+		large.Set(fmt.Sprintf("m%d", i), float64(i)/3)
+	}
+	kV.Sorteds["zset"] = small
+	kV.Sorteds["bigzset"] = large
+
+	stream := kv.NewStream()
+	for i := 1; i <= 250; i++ {
+		stream.Append(kv.StreamId{Timestamp: uint64(1000 + i/4), Sequence: uint64(i % 4)},
+			[]kv.StreamField{{Name: "n", Value: fmt.Sprint(i)}, {Name: "s", Value: "v"}})
+	}
+	stream.Delete(kv.StreamId{Timestamp: 1001, Sequence: 1})
+	group := kv.NewConsumerGroup("g", kv.StreamId{Timestamp: 1002}, 8)
+	consumer, _ := group.Consumer("alice", true, 5000)
+	group.Deliver(kv.StreamId{Timestamp: 1001, Sequence: 2}, consumer, 6000)
+	group.Deliver(kv.StreamId{Timestamp: 1002}, consumer, 7000)
+	group.Consumer("bob", true, 5500)
+	stream.Groups["g"] = group
+	kV.Streams["stream"] = stream
+	kV.Streams["emptystream"] = kv.NewStream()
+	return kV
+}
+
+func setOf(members ...string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, m := range members {
+		set[m] = struct{}{}
+	}
+	return set
+}
+
+// saveToBuffer returns kV saved in format.
+func saveToBuffer(kV *kv.KV, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := SaveTo(&buf, kV, format)
+	return buf.Bytes(), err
+}
+
+// load loads data through a file, as the server does, which checks the
+// checksum in both formats.
+func load(t *testing.T, data []byte, kV *kv.KV, skipExpired bool) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path, kV, skipExpired)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		t.Run(format, func(t *testing.T) {
+			want := testDataset()
+			data, err := saveToBuffer(want, format)
+			if err != nil {
+				t.Fatalf("SaveTo: %v", err)
+			}
+			got := kv.NewKv()
+			if err := load(t, data, got, true); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			compareDatasets(t, want, got)
+		})
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	want := kv.NewKv()
+	stream := kv.NewStream()
+	for i := uint64(1); i <= 150; i++ {
+		stream.Append(kv.StreamId{Timestamp: 1000 + i/4, Sequence: i % 4}, []kv.StreamField{{Name: "n", Value: "v"}})
+	}
+	stream.Delete(kv.StreamId{Timestamp: 1001, Sequence: 1})
+	group := kv.NewConsumerGroup("g", kv.StreamId{Timestamp: 1002}, 8)
+	consumer, _ := group.Consumer("alice", true, 5000)
+	group.Deliver(kv.StreamId{Timestamp: 1001, Sequence: 2}, consumer, 6000)
+	group.Deliver(kv.StreamId{Timestamp: 1002}, consumer, 7000)
+	group.Consumer("bob", true, 5500)
+	stream.Groups["g"] = group
+	stream.Groups["unread"] = kv.NewConsumerGroup("unread", kv.StreamId{}, kv.EntriesInvalid)
+	want.Streams["stream"] = stream
+	want.Streams["empty"] = kv.NewStream()
+
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		data, err := saveToBuffer(want, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := kv.NewKv()
+		if err := LoadFrom(bytes.NewReader(data), got, false); err != nil {
+			t.Fatal(err)
+		}
+		checkStreams(t, format, want, got)
+	}
+}
+
+func checkStreams(t *testing.T, format string, want, got *kv.KV) {
+	t.Helper()
+	for key, w := range want.Streams {
+		g, ok := got.Streams[key]
+		if !ok {
+			t.Fatalf("%s: stream %s missing after load", format, key)
+		}
+		if !reflect.DeepEqual(g.Entries(), w.Entries()) {
+			t.Errorf("%s: %s entries differ after load", format, key)
+		}
+		if g.LastID != w.LastID || g.EntriesAdded != w.EntriesAdded || g.MaxDeletedID != w.MaxDeletedID {
+			t.Errorf("%s: %s metadata = %v %d %v, want %v %d %v", format, key, g.LastID, g.EntriesAdded, g.MaxDeletedID, w.LastID, w.EntriesAdded, w.MaxDeletedID)
+		}
+		if !reflect.DeepEqual(g.Groups, w.Groups) {
+			t.Errorf("%s: %s groups = %+v, want %+v", format, key, g.Groups, w.Groups)
+		}
+	}
+	// The consumer PELs must share the group PEL's entries.
+	loaded := got.Streams["stream"].Groups["g"]
+	for id, nack := range loaded.Pending {
+		if loaded.Consumers[nack.Consumer].Pending[id] != nack {
+			t.Errorf("%s: pending entry %s is not shared with its consumer", format, id.ToString())
+		}
+	}
+}
+
+func TestRoundTripExpired(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	tests := []struct {
+		name string
+		load func(t *testing.T, data []byte, kV *kv.KV) error
+		// wantKey is whether the expired key is kept.
+		wantKey bool
+	}{
+		{"master", func(t *testing.T, data []byte, kV *kv.KV) error { return load(t, data, kV, true) }, false},
+		{"aof base", func(t *testing.T, data []byte, kV *kv.KV) error { return load(t, data, kV, false) }, true},
+		{"replica", func(t *testing.T, data []byte, kV *kv.KV) error { return LoadFrom(bytes.NewReader(data), kV, false) }, true},
+	}
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				src := kv.NewKv()
+				src.Strings["gone"] = resp.Value{Typ: "string", Str: "v", Expires: past}
+				data, err := saveToBuffer(src, format)
+				if err != nil {
+					t.Fatalf("SaveTo: %v", err)
+				}
+				got := kv.NewKv()
+				if err := tt.load(t, data, got); err != nil {
+					t.Fatalf("load: %v", err)
+				}
+				value, ok := got.Strings["gone"]
+				if ok != tt.wantKey {
+					t.Fatalf("key loaded = %v, want %v", ok, tt.wantKey)
+				}
+				if ok && value.Expires != past {
+					t.Errorf("expiry = %d, want %d", value.Expires, past)
+				}
+			})
+		}
+	}
+}
+
+// TestNonStringTTL loads a Redis payload with TTLs on a list and a set,
+// which are dropped since only strings have TTLs here, and checks that the
+// keys then round-trip without them while a string keeps its own.
+func TestNonStringTTL(t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixMilli()
+	expire := func() []byte {
+		return binary.LittleEndian.AppendUint64([]byte{redisOpExpireTimeMs}, uint64(future))
+	}
+	payload := []byte("REDIS0009")
+	payload = append(payload, redisOpSelectDB, 0)
+	payload = append(payload, expire()...)
+	payload = append(payload, redisTypeList, 1, 'l', 2, 1, 'a', 1, 'b')
+	payload = append(payload, expire()...)
+	payload = append(payload, redisTypeSet, 1, 's', 1, 1, 'm')
+	payload = append(payload, expire()...)
+	payload = append(payload, redisTypeString, 1, 'k', 1, 'v')
+	// A zero checksum isn't verified.
+	payload = append(payload, redisOpEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	want := kv.NewKv()
+	want.Lists["l"] = []resp.Value{{Typ: "bulk", Bulk: "a"}, {Typ: "bulk", Bulk: "b"}}
+	want.Sets["s"] = setOf("m")
+	want.Strings["k"] = resp.Value{Typ: "string", Str: "v", Expires: future}
+
+	got := kv.NewKv()
+	l := &redisLoader{r: newCRCReader(bufio.NewReader(bytes.NewReader(payload[len("REDIS0009"):])), crc64Jones), kv: got}
+	if err := l.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if l.droppedTTLs != 2 {
+		t.Errorf("dropped %d TTLs, want 2", l.droppedTTLs)
+	}
+	compareDatasets(t, want, got)
+
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		t.Run(format, func(t *testing.T) {
+			data, err := saveToBuffer(got, format)
+			if err != nil {
+				t.Fatalf("SaveTo: %v", err)
+			}
+			again := kv.NewKv()
+			if err := load(t, data, again, true); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			compareDatasets(t, want, again)
+		})
+	}
+
+	// The legacy format never holds a TTL ahead of anything but a string.
+	lists := kv.NewKv()
+	lists.Lists["l"] = want.Lists["l"]
+	legacy, err := saveToBuffer(lists, FormatLegacy)
+	if err != nil {
+		t.Fatalf("SaveTo: %v", err)
+	}
+	header := len(MagicString) + 4
+	i := header + bytes.IndexByte(legacy[header:], OpCodeList)
+	bad := binary.BigEndian.AppendUint64(append(slices.Clone(legacy[:i]), OpCodeExpireTime), uint64(future))
+	bad = append(bad, legacy[i:]...)
+	if err := LoadFrom(bytes.NewReader(bad), kv.NewKv(), false); err == nil || !strings.Contains(err.Error(), "can't expire") {
+		t.Errorf("legacy load of a TTL ahead of a list = %v", err)
+	}
+}
+
+// TestStreamingLoad loads payloads handed over a byte at a time, as from a
+// slow socket, so that nothing depends on reads filling their buffers.
+func TestStreamingLoad(t *testing.T) {
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		t.Run(format, func(t *testing.T) {
+			want := testDataset()
+			data, err := saveToBuffer(want, format)
+			if err != nil {
+				t.Fatalf("SaveTo: %v", err)
+			}
+			got := kv.NewKv()
+			if err := LoadFrom(iotest.OneByteReader(bytes.NewReader(data)), got, true); err != nil {
+				t.Fatalf("LoadFrom: %v", err)
+			}
+			compareDatasets(t, want, got)
+
+			// A payload cut short anywhere fails to load.
+			for _, n := range []int{5, len(data) / 2, len(data) - 9, len(data) - 1} {
+				if err := LoadFrom(bytes.NewReader(data[:n]), kv.NewKv(), true); err == nil {
+					t.Errorf("payload cut to %d of %d bytes loaded", n, len(data))
+				}
+			}
+		})
+	}
+}
+
+// TestCorruptPayloads flips every byte of a small payload in turn: the
+// checksum is only checked at the end, so the loaders must get there
+// without panicking on the lengths and counts they read on the way.
+func TestCorruptPayloads(t *testing.T) {
+	src := kv.NewKv()
+	src.Strings["s"] = resp.Value{Typ: "string", Str: "v"}
+	src.Lists["l"] = []resp.Value{{Typ: "bulk", Bulk: "a"}}
+	src.Hashes["h"] = map[string]resp.Value{"f": {Typ: "bulk", Bulk: "v"}}
+	src.Sets["s"] = setOf("m")
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		data, err := saveToBuffer(src, format)
+		if err != nil {
+			t.Fatalf("SaveTo: %v", err)
+		}
+		for i := range data {
+			corrupt := bytes.Clone(data)
+			corrupt[i] ^= 0xff
+			if err := LoadFrom(bytes.NewReader(corrupt), kv.NewKv(), true); err == nil {
+				t.Errorf("%s: payload with byte %d flipped loaded", format, i)
+			}
+		}
+	}
+}
+
+func TestSaveCountsBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	var written atomic.Int64
+	if err := Save(path, testDataset(), FormatRedis, &written); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.Load() != info.Size() {
+		t.Errorf("counted %d bytes, the file has %d", written.Load(), info.Size())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(payload []byte) []byte
+		wantErr bool
+	}{
+		{"intact", func(p []byte) []byte { return p }, false},
+		{"flipped byte in the data", func(p []byte) []byte { p[len(p)/2] ^= 0x40; return p }, true},
+		{"flipped byte in the checksum", func(p []byte) []byte { p[len(p)-1] ^= 0x01; return p }, true},
+		{"truncated", func(p []byte) []byte { return p[:len(p)-20] }, true},
+		{"checksum missing", func(p []byte) []byte { return p[:len(p)-8] }, true},
+	}
+	for _, format := range []string{FormatRedis, FormatLegacy} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				data, err := saveToBuffer(testDataset(), format)
+				if err != nil {
+					t.Fatalf("SaveTo: %v", err)
+				}
+				err = load(t, tt.corrupt(data), kv.NewKv(), true)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Load error = %v, want error %v", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+// Redis writes a zero checksum with rdbchecksum off, and skips the check
+// when loading such a file.
+func TestZeroChecksumIsNotVerified(t *testing.T) {
+	data, err := saveToBuffer(testDataset(), FormatRedis)
+	if err != nil {
+		t.Fatalf("SaveTo: %v", err)
+	}
+	binary.LittleEndian.PutUint64(data[len(data)-8:], 0)
+	if err := load(t, data, kv.NewKv(), true); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestCRC64Jones(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0},
+		// The check value from Redis' own crc64 test.
+		{"123456789", 0xe9c6d914c4b8d9ca},
+	}
+	for _, tt := range tests {
+		if got := crc64Jones(0, []byte(tt.input)); got != tt.want {
+			t.Errorf("crc64Jones(%q) = %#x, want %#x", tt.input, got, tt.want)
+		}
+		// Checksumming in pieces gives the same result.
+		half := len(tt.input) / 2
+		if got := crc64Jones(crc64Jones(0, []byte(tt.input[:half])), []byte(tt.input[half:])); got != tt.want {
+			t.Errorf("crc64Jones(%q) in two pieces = %#x, want %#x", tt.input, got, tt.want)
+		}
+	}
+}
+
+func compareDatasets(t *testing.T, want, got *kv.KV) {
+	t.Helper()
+	if len(got.Strings) != len(want.Strings) {
+		t.Errorf("%d strings, want %d", len(got.Strings), len(want.Strings))
+	}
+	for key, value := range want.Strings {
+		if loaded := got.Strings[key]; loaded.Str != value.Str || loaded.Expires != value.Expires {
+			t.Errorf("string %s = %q expiring at %d, want %q at %d", key, loaded.Str, loaded.Expires, value.Str, value.Expires)
+		}
+	}
+	if len(got.Lists) != len(want.Lists) {
+		t.Errorf("%d lists, want %d", len(got.Lists), len(want.Lists))
+	}
+	for key, list := range want.Lists {
+		if !reflect.DeepEqual(got.Lists[key], list) {
+			t.Errorf("list %s differs", key)
+		}
+	}
+	if !reflect.DeepEqual(got.Hashes, want.Hashes) {
+		t.Errorf("hashes differ")
+	}
+	if !reflect.DeepEqual(got.Sets, want.Sets) {
+		t.Errorf("sets differ")
+	}
+	if len(got.Sorteds) != len(want.Sorteds) {
+		t.Errorf("%d sorted sets, want %d", len(got.Sorteds), len(want.Sorteds))
+	}
+	for key, zset := range want.Sorteds {
+		loaded, ok := got.Sorteds[key]
+		if !ok || !reflect.DeepEqual(loaded.Members(), zset.Members()) {
+			t.Errorf("sorted set %s differs", key)
+		}
+	}
+	if len(got.Streams) != len(want.Streams) {
+		t.Errorf("%d streams, want %d", len(got.Streams), len(want.Streams))
+	}
+	for key, stream := range want.Streams {
+		loaded, ok := got.Streams[key]
+		if !ok {
+			t.Errorf("stream %s missing", key)
+			continue
+		}
+		if !reflect.DeepEqual(loaded.Entries(), stream.Entries()) {
+			t.Errorf("stream %s entries differ", key)
+		}
+		if loaded.LastID != stream.LastID || loaded.EntriesAdded != stream.EntriesAdded || loaded.MaxDeletedID != stream.MaxDeletedID {
+			t.Errorf("stream %s metadata = %v %d %v, want %v %d %v", key,
+				loaded.LastID, loaded.EntriesAdded, loaded.MaxDeletedID, stream.LastID, stream.EntriesAdded, stream.MaxDeletedID)
+		}
+		if !reflect.DeepEqual(loaded.Groups, stream.Groups) {
+			t.Errorf("stream %s consumer groups differ", key)
+		}
+	}
+}
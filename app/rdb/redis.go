@@ -0,0 +1,228 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+)
+
+// RDB formats, for the rdb-format setting. FormatRedis is the format of
+// Redis itself, so dumps move between Redis and this server both ways;
+// FormatLegacy is the format this server used before. Both load either way.
+const (
+	FormatRedis  = "redis"
+	FormatLegacy = "legacy"
+)
+
+func ValidFormat(format string) bool {
+	return format == FormatRedis || format == FormatLegacy
+}
+
+// Files are written as RDB version 11, that of Redis 7.2, and versions up
+// to 12, that of Redis 7.4 and 8, load.
+const (
+	redisRDBVersion    = 11
+	maxRedisRDBVersion = 12
+	redisVersion       = "7.2.0"
+)
+
+// Opcodes of the Redis format, each starting a record that isn't a key.
+const (
+	redisOpSlotInfo      byte = 0xF4
+	redisOpFunction2     byte = 0xF5
+	redisOpFunctionPreGA byte = 0xF6
+	redisOpModuleAux     byte = 0xF7
+	redisOpIdle          byte = 0xF8
+	redisOpFreq          byte = 0xF9
+	redisOpAux           byte = 0xFA
+	redisOpResizeDB      byte = 0xFB
+	redisOpExpireTimeMs  byte = 0xFC
+	redisOpExpireTime    byte = 0xFD
+	redisOpSelectDB      byte = 0xFE
+	redisOpEOF           byte = 0xFF
+)
+
+// Value types of the Redis format. A key starts with its value's type.
+const (
+	redisTypeString              byte = 0
+	redisTypeList                byte = 1
+	redisTypeSet                 byte = 2
+	redisTypeZSet                byte = 3
+	redisTypeHash                byte = 4
+	redisTypeZSet2               byte = 5
+	redisTypeModulePreGA         byte = 6
+	redisTypeModule2             byte = 7
+	redisTypeHashZipmap          byte = 9
+	redisTypeListZiplist         byte = 10
+	redisTypeSetIntset           byte = 11
+	redisTypeZSetZiplist         byte = 12
+	redisTypeHashZiplist         byte = 13
+	redisTypeListQuicklist       byte = 14
+	redisTypeStreamListpacks     byte = 15
+	redisTypeHashListpack        byte = 16
+	redisTypeZSetListpack        byte = 17
+	redisTypeListQuicklist2      byte = 18
+	redisTypeStreamListpacks2    byte = 19
+	redisTypeSetListpack         byte = 20
+	redisTypeStreamListpacks3    byte = 21
+	redisTypeHashMetadataPreGA   byte = 22
+	redisTypeHashListpackExPreGA byte = 23
+	redisTypeHashMetadata        byte = 24
+	redisTypeHashListpackEx      byte = 25
+)
+
+// Special string encodings, flagged by the top two bits of the length.
+const (
+	redisEncInt8  = 0
+	redisEncInt16 = 1
+	redisEncInt32 = 2
+	redisEncLZF   = 3
+)
+
+// Quicklist nodes hold either one plain element or a listpack.
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+// Stream entries in a listpack are flagged as deleted, or as having the
+// same fields as the node's master entry, which are then left out.
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// Small collections are saved as listpacks or intsets, as Redis keeps them
+// with its default settings; larger ones element by element.
+const (
+	listpackMaxEntries = 128
+	listpackMaxValue   = 64
+	intsetMaxEntries   = 512
+	listNodeMaxBytes   = 8 << 10
+)
+
+// Module values are tagged with the type's name and encoding version,
+// packed in 64 bits: nine 6-bit characters from moduleTypeCharset, then 10
+// bits of version. Each item they hold is preceded by its kind.
+const (
+	moduleTypeCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	redisModuleOpEOF    = 0
+	redisModuleOpSigned = 1
+	redisModuleOpUint   = 2
+	redisModuleOpFloat  = 3
+	redisModuleOpDouble = 4
+	redisModuleOpString = 5
+)
+
+func moduleTypeID(name string, encver int) uint64 {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleTypeCharset, name[i]))
+	}
+	return id<<10 | uint64(encver&1023)
+}
+
+func moduleTypeName(id uint64) (string, int) {
+	encver := int(id & 1023)
+	id >>= 10
+	name := make([]byte, 9)
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleTypeCharset[id&63]
+		id >>= 6
+	}
+	return string(name), encver
+}
+
+// deadLetterAux is the AUX field recording a consumer group's dead letter
+// setting, which the Redis format has no place for. Redis ignores AUX
+// fields it doesn't know.
+const deadLetterAux = "go-redis-stream-deadletter"
+
+// redisWriter writes the Redis format, keeping the first error.
+type redisWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (rw *redisWriter) write(p []byte) {
+	if rw.err == nil {
+		_, rw.err = rw.w.Write(p)
+	}
+}
+
+func (rw *redisWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+// writeLen writes n in 1, 2, 5 or 9 bytes: the top two bits of the first
+// byte say which.
+func (rw *redisWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.write([]byte{byte(n)})
+	case n < 1<<14:
+		rw.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		rw.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		rw.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+// writeString writes s as an integer if it is a small one, compressed if
+// that saves space, and as is otherwise.
+func (rw *redisWriter) writeString(s string) {
+	if n, ok := canonicalInt(s); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+		switch {
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			rw.write([]byte{0xC0 | redisEncInt8, byte(n)})
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			rw.write(binary.LittleEndian.AppendUint16([]byte{0xC0 | redisEncInt16}, uint16(n)))
+		default:
+			rw.write(binary.LittleEndian.AppendUint32([]byte{0xC0 | redisEncInt32}, uint32(n)))
+		}
+		return
+	}
+	if len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			rw.writeByte(0xC0 | redisEncLZF)
+			rw.writeLen(uint64(len(compressed)))
+			rw.writeLen(uint64(len(s)))
+			rw.write(compressed)
+			return
+		}
+	}
+	rw.writeLen(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *redisWriter) writeMillis(ms int64) {
+	rw.write(binary.LittleEndian.AppendUint64(nil, uint64(ms)))
+}
+
+func (rw *redisWriter) writeDouble(f float64) {
+	rw.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func (rw *redisWriter) writeAux(key, value string) {
+	rw.writeByte(redisOpAux)
+	rw.writeString(key)
+	rw.writeString(value)
+}
+
+// isRedisFormat reports whether data starts like a file in the Redis
+// format: the magic string followed by four ASCII digits of version, where
+// the legacy format has a binary version.
+func isRedisFormat(data []byte) bool {
+	if len(data) < len(MagicString)+4 || string(data[:len(MagicString)]) != MagicString {
+		return false
+	}
+	for _, c := range data[len(MagicString) : len(MagicString)+4] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1016 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+	"github.com/r1i2t3/go-redis/app/resp"
+)
+
+// redisLoader reads a file in the Redis format.
+type redisLoader struct {
+	r  *crcReader
+	kv *kv.KV
+	// skipExpired drops keys whose TTL has passed, as for rdbLoader.
+	skipExpired bool
+	// deadLetters holds the dead letter AUX fields, applied once the
+	// streams they refer to are loaded.
+	deadLetters []string
+	// Keys left out or changed are counted, to report once.
+	expiredKeys   int
+	otherDBKeys   int
+	droppedTTLs   int
+	expiredFields int
+}
+
+// loadRedis loads a file in the Redis format as it is read from r. The
+// checksum is verified once the whole file is read; files written with
+// rdbchecksum off have a zero checksum, which isn't checked.
+func loadRedis(r *bufio.Reader, kV *kv.KV, skipExpired bool) error {
+	l := &redisLoader{r: newCRCReader(r, crc64Jones), kv: kV, skipExpired: skipExpired}
+	header := make([]byte, len(MagicString)+4)
+	if _, err := io.ReadFull(l.r, header); err != nil {
+		return err
+	}
+	version, _ := strconv.Atoi(string(header[len(MagicString):]))
+	if version < 1 || version > maxRedisRDBVersion {
+		return fmt.Errorf("can't handle RDB format version %d", version)
+	}
+	if err := l.load(); err != nil {
+		return err
+	}
+	// Checksums came with version 5.
+	if version >= 5 {
+		if err := l.r.verify(binary.LittleEndian, true); err != nil {
+			return err
+		}
+	}
+	if l.expiredKeys > 0 {
+		fmt.Printf("Skipped %d keys that had already expired\n", l.expiredKeys)
+	}
+	if l.otherDBKeys > 0 {
+		fmt.Printf("Skipped %d keys of databases other than 0, which this server doesn't have\n", l.otherDBKeys)
+	}
+	if l.droppedTTLs > 0 {
+		fmt.Printf("Loaded %d keys without their TTL, which only strings keep here\n", l.droppedTTLs)
+	}
+	if l.expiredFields > 0 {
+		fmt.Printf("Skipped %d expired hash fields; the TTLs of the others were dropped\n", l.expiredFields)
+	}
+	return nil
+}
+
+func (l *redisLoader) load() error {
+	db := uint64(0)
+	expireAt := int64(0)
+	for {
+		op, err := l.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("unexpected eof before rdb eof opcode")
+		}
+		switch op {
+		case redisOpExpireTime:
+			var secs int32
+			if err := binary.Read(l.r, binary.LittleEndian, &secs); err != nil {
+				return err
+			}
+			expireAt = int64(secs) * 1000
+		case redisOpExpireTimeMs:
+			if expireAt, err = l.readMillis(); err != nil {
+				return err
+			}
+		case redisOpFreq:
+			if _, err := l.r.ReadByte(); err != nil {
+				return err
+			}
+		case redisOpIdle:
+			if _, err := l.readLen(); err != nil {
+				return err
+			}
+		case redisOpSelectDB:
+			if db, err = l.readLen(); err != nil {
+				return err
+			}
+		case redisOpResizeDB:
+			if err := l.skipLens(2); err != nil {
+				return err
+			}
+		case redisOpSlotInfo:
+			if err := l.skipLens(3); err != nil {
+				return err
+			}
+		case redisOpAux:
+			if err := l.loadAux(); err != nil {
+				return err
+			}
+		case redisOpModuleAux:
+			if err := l.skipModuleAux(); err != nil {
+				return err
+			}
+		case redisOpFunction2:
+			if _, err := l.readString(); err != nil {
+				return err
+			}
+			fmt.Println("Skipped a function library in the RDB file; functions aren't supported")
+		case redisOpFunctionPreGA:
+			return fmt.Errorf("functions saved by a Redis 7 release candidate aren't supported")
+		case redisOpEOF:
+			return l.applyDeadLetters()
+		default:
+			key, err := l.readString()
+			if err != nil {
+				return err
+			}
+			value, err := l.loadValue(op)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			if db != 0 {
+				l.otherDBKeys++
+			} else {
+				l.store(key, value, expireAt)
+			}
+			expireAt = 0
+		}
+	}
+}
+
+func (l *redisLoader) loadAux() error {
+	key, err := l.readString()
+	if err != nil {
+		return err
+	}
+	value, err := l.readString()
+	if err != nil {
+		return err
+	}
+	switch key {
+	case "redis-ver":
+		fmt.Printf("Loading RDB produced by version %s\n", value)
+	case deadLetterAux:
+		l.deadLetters = append(l.deadLetters, value)
+	}
+	return nil
+}
+
+// applyDeadLetters restores the dead letter settings of consumer groups.
+func (l *redisLoader) applyDeadLetters() error {
+	for _, value := range l.deadLetters {
+		aux := &redisLoader{r: newCRCReader(bufio.NewReader(bytes.NewReader([]byte(value))), crc64Jones)}
+		key, err := aux.readString()
+		if err != nil {
+			return err
+		}
+		name, err := aux.readString()
+		if err != nil {
+			return err
+		}
+		maxDeliveries, err := aux.readLen()
+		if err != nil {
+			return err
+		}
+		deadLetterKey, err := aux.readString()
+		if err != nil {
+			return err
+		}
+		if stream, ok := l.kv.Streams[key]; ok {
+			if group, ok := stream.Groups[name]; ok {
+				group.MaxDeliveries, group.DeadLetterKey = maxDeliveries, deadLetterKey
+			}
+		}
+	}
+	return nil
+}
+
+// store adds a loaded key, unless it has expired and skipExpired is set.
+// Only strings have TTLs here, so any other key is loaded without its TTL
+// and will never expire; each such key is named in a warning.
+func (l *redisLoader) store(key string, value any, expireAt int64) {
+	if l.skipExpired && expireAt > 0 && expireAt < time.Now().UnixMilli() {
+		l.expiredKeys++
+		return
+	}
+	if _, ok := value.(string); !ok && expireAt != 0 {
+		fmt.Printf("!!! Warning: loaded key %q without its TTL; only strings can expire here !!!\n", key)
+		l.droppedTTLs++
+	}
+	switch v := value.(type) {
+	case string:
+		l.kv.Strings[key] = resp.Value{Typ: "string", Str: v, Expires: expireAt}
+	case []resp.Value:
+		l.kv.Lists[key] = v
+	case map[string]resp.Value:
+		l.kv.Hashes[key] = v
+	case map[string]struct{}:
+		l.kv.Sets[key] = v
+	case *kv.SortedSet:
+		l.kv.Sorteds[key] = v
+	case *kv.Stream:
+		l.kv.Streams[key] = v
+	case *kv.ModuleValue:
+		l.kv.Modules[key] = v
+	}
+}
+
+// loadValue reads a value of type typ, in any of the encodings Redis has
+// used for it.
+func (l *redisLoader) loadValue(typ byte) (any, error) {
+	switch typ {
+	case redisTypeString:
+		return l.readString()
+	case redisTypeList:
+		items, err := l.readStrings(1)
+		return listValue(items), err
+	case redisTypeSet:
+		items, err := l.readStrings(1)
+		return setValue(items), err
+	case redisTypeZSet, redisTypeZSet2:
+		return l.loadZSet(typ)
+	case redisTypeHash:
+		items, err := l.readStrings(2)
+		if err != nil {
+			return nil, err
+		}
+		return hashValue(items)
+	case redisTypeModule2:
+		return l.loadModule()
+	case redisTypeListZiplist:
+		items, err := l.readBlob(ziplistEntries)
+		return listValue(items), err
+	case redisTypeSetIntset:
+		items, err := l.readBlob(intsetEntries)
+		return setValue(items), err
+	case redisTypeSetListpack:
+		items, err := l.readBlob(listpackEntries)
+		return setValue(items), err
+	case redisTypeZSetZiplist, redisTypeZSetListpack:
+		decode := listpackEntries
+		if typ == redisTypeZSetZiplist {
+			decode = ziplistEntries
+		}
+		items, err := l.readBlob(decode)
+		if err != nil {
+			return nil, err
+		}
+		return zsetValue(items)
+	case redisTypeHashZiplist, redisTypeHashListpack:
+		decode := listpackEntries
+		if typ == redisTypeHashZiplist {
+			decode = ziplistEntries
+		}
+		items, err := l.readBlob(decode)
+		if err != nil {
+			return nil, err
+		}
+		return hashValue(items)
+	case redisTypeListQuicklist, redisTypeListQuicklist2:
+		return l.loadQuicklist(typ)
+	case redisTypeStreamListpacks, redisTypeStreamListpacks2, redisTypeStreamListpacks3:
+		return l.loadStream(typ)
+	case redisTypeHashMetadataPreGA, redisTypeHashMetadata:
+		return l.loadHashMetadata(typ)
+	case redisTypeHashListpackExPreGA, redisTypeHashListpackEx:
+		return l.loadHashListpackEx(typ)
+	case redisTypeModulePreGA, redisTypeHashZipmap:
+		return nil, fmt.Errorf("RDB value type %d is too old to load", typ)
+	}
+	return nil, fmt.Errorf("unknown RDB value type %d", typ)
+}
+
+func listValue(items []string) []resp.Value {
+	list := make([]resp.Value, len(items))
+	for i, item := range items {
+		list[i] = resp.Value{Typ: "bulk", Bulk: item}
+	}
+	return list
+}
+
+func setValue(items []string) map[string]struct{} {
+	members := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		members[item] = struct{}{}
+	}
+	return members
+}
+
+func hashValue(items []string) (map[string]resp.Value, error) {
+	if len(items)%2 != 0 {
+		return nil, errors.New("hash with an odd number of elements")
+	}
+	hash := make(map[string]resp.Value, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		hash[items[i]] = resp.Value{Typ: "bulk", Bulk: items[i+1]}
+	}
+	return hash, nil
+}
+
+// zsetValue builds a sorted set from members alternating with scores.
+func zsetValue(items []string) (*kv.SortedSet, error) {
+	if len(items)%2 != 0 {
+		return nil, errors.New("sorted set with an odd number of elements")
+	}
+	sortedSet := kv.NewSortedSet()
+	for i := 0; i < len(items); i += 2 {
+		score, err := strconv.ParseFloat(items[i+1], 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, fmt.Errorf("invalid sorted set score %q", items[i+1])
+		}
+		sortedSet.Set(items[i], score)
+	}
+	return sortedSet, nil
+}
+
+func (l *redisLoader) loadZSet(typ byte) (*kv.SortedSet, error) {
+	n, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	sortedSet := kv.NewSortedSet()
+	for range n {
+		member, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if typ == redisTypeZSet2 {
+			score, err = l.readDouble()
+		} else {
+			score, err = l.readStringDouble()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, errors.New("sorted set score is NaN")
+		}
+		sortedSet.Set(member, score)
+	}
+	return sortedSet, nil
+}
+
+// loadQuicklist reads a list split in nodes: ziplists in a quicklist, and
+// in a quicklist2 listpacks or, for large elements, plain strings.
+func (l *redisLoader) loadQuicklist(typ byte) ([]resp.Value, error) {
+	n, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for range n {
+		container := uint64(quicklistPacked)
+		if typ == redisTypeListQuicklist2 {
+			if container, err = l.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		var node []string
+		switch {
+		case container == quicklistPlain:
+			node = []string{blob}
+		case container != quicklistPacked:
+			return nil, fmt.Errorf("unknown quicklist container %d", container)
+		case typ == redisTypeListQuicklist:
+			node, err = ziplistEntries([]byte(blob))
+		default:
+			node, err = listpackEntries([]byte(blob))
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, node...)
+	}
+	return listValue(items), nil
+}
+
+// loadHashMetadata reads a hash whose fields have TTLs. Fields already
+// expired are skipped and the TTLs of the rest dropped, as fields don't
+// expire here.
+func (l *redisLoader) loadHashMetadata(typ byte) (map[string]resp.Value, error) {
+	minExpire := int64(0)
+	var err error
+	if typ == redisTypeHashMetadata {
+		if minExpire, err = l.readMillis(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	var items []string
+	for range n {
+		ttl, err := l.readLen()
+		if err != nil {
+			return nil, err
+		}
+		pair, err := l.readPair()
+		if err != nil {
+			return nil, err
+		}
+		// TTLs are stored relative to the earliest, plus one so that zero
+		// still means none.
+		expireAt := int64(ttl)
+		if typ == redisTypeHashMetadata && ttl != 0 {
+			expireAt = minExpire + int64(ttl) - 1
+		}
+		if ttl != 0 && expireAt <= now {
+			l.expiredFields++
+			continue
+		}
+		items = append(items, pair...)
+	}
+	return hashValue(items)
+}
+
+// loadHashListpackEx reads a small hash whose fields have TTLs: a listpack
+// of fields, values and expiry times, zero for none.
+func (l *redisLoader) loadHashListpackEx(typ byte) (map[string]resp.Value, error) {
+	if typ == redisTypeHashListpackEx {
+		if _, err := l.readMillis(); err != nil {
+			return nil, err
+		}
+	}
+	items, err := l.readBlob(listpackEntries)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%3 != 0 {
+		return nil, errors.New("hash with field TTLs with a bad number of elements")
+	}
+	now := time.Now().UnixMilli()
+	var pairs []string
+	for i := 0; i < len(items); i += 3 {
+		expireAt, err := strconv.ParseInt(items[i+2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash field TTL %q", items[i+2])
+		}
+		if expireAt != 0 && expireAt <= now {
+			l.expiredFields++
+			continue
+		}
+		pairs = append(pairs, items[i], items[i+1])
+	}
+	return hashValue(pairs)
+}
+
+// loadStream reads a stream: its entries in listpacks keyed by their
+// master ID, its counters, then its consumer groups. Version 1 lacks the
+// counters Redis 7 added, and versions before 3 consumers' active times.
+func (l *redisLoader) loadStream(typ byte) (*kv.Stream, error) {
+	stream := kv.NewStream()
+	nodes, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for range nodes {
+		nodeKey, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeKey) != 16 {
+			return nil, errors.New("stream node key is not a stream ID")
+		}
+		items, err := l.readBlob(listpackEntries)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return nil, errors.New("empty listpack inside stream")
+		}
+		if err := appendStreamNode(stream, parseStreamIDBytes([]byte(nodeKey)), items); err != nil {
+			return nil, err
+		}
+	}
+	length, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(stream.Len()) {
+		return nil, fmt.Errorf("stream length %d doesn't match its %d entries", length, stream.Len())
+	}
+	if stream.LastID, err = l.readStreamID(); err != nil {
+		return nil, err
+	}
+	stream.EntriesAdded = length
+	stream.MaxDeletedID = kv.StreamId{}
+	if typ != redisTypeStreamListpacks {
+		// The first ID is worked out from the entries.
+		if _, err := l.readStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedID, err = l.readStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, err = l.readLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for range groups {
+		name, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := l.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		var entriesRead int64
+		if typ == redisTypeStreamListpacks {
+			entriesRead = stream.EstimateDistanceFromFirstEverEntry(lastID)
+		} else {
+			n, err := l.readLen()
+			if err != nil {
+				return nil, err
+			}
+			entriesRead = int64(n)
+		}
+		group := kv.NewConsumerGroup(name, lastID, entriesRead)
+		pending, err := l.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for range pending {
+			nack := &kv.PendingEntry{}
+			if nack.ID, err = l.readRawStreamID(); err != nil {
+				return nil, err
+			}
+			if nack.DeliveryTime, err = l.readMillis(); err != nil {
+				return nil, err
+			}
+			if nack.DeliveryCount, err = l.readLen(); err != nil {
+				return nil, err
+			}
+			group.Pending[nack.ID] = nack
+		}
+		consumers, err := l.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for range consumers {
+			consumer := &kv.Consumer{ActiveTime: -1, Pending: make(map[kv.StreamId]*kv.PendingEntry)}
+			if consumer.Name, err = l.readString(); err != nil {
+				return nil, err
+			}
+			if consumer.SeenTime, err = l.readMillis(); err != nil {
+				return nil, err
+			}
+			if typ == redisTypeStreamListpacks3 {
+				if consumer.ActiveTime, err = l.readMillis(); err != nil {
+					return nil, err
+				}
+			}
+			owned, err := l.readLen()
+			if err != nil {
+				return nil, err
+			}
+			for range owned {
+				id, err := l.readRawStreamID()
+				if err != nil {
+					return nil, err
+				}
+				nack, ok := group.Pending[id]
+				if !ok || nack.Consumer != "" {
+					return nil, fmt.Errorf("consumer %q pending entry %s not in group %q PEL", consumer.Name, id.ToString(), name)
+				}
+				nack.Consumer = consumer.Name
+				consumer.Pending[id] = nack
+			}
+			group.Consumers[consumer.Name] = consumer
+		}
+		for id, nack := range group.Pending {
+			if nack.Consumer == "" {
+				return nil, fmt.Errorf("group %q pending entry %s has no consumer", name, id.ToString())
+			}
+		}
+		stream.Groups[name] = group
+	}
+	return stream, nil
+}
+
+// appendStreamNode appends the live entries of a stream node, as
+// streamListpack lays them out, to stream.
+func appendStreamNode(stream *kv.Stream, master kv.StreamId, items []string) error {
+	errNode := errors.New("invalid stream listpack")
+	next := func() (string, error) {
+		if len(items) == 0 {
+			return "", errNode
+		}
+		item := items[0]
+		items = items[1:]
+		return item, nil
+	}
+	nextInt := func() (int64, error) {
+		item, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return 0, errNode
+		}
+		return n, nil
+	}
+	count, err := nextInt()
+	if err != nil {
+		return err
+	}
+	deleted, err := nextInt()
+	if err != nil {
+		return err
+	}
+	numFields, err := nextInt()
+	if err != nil {
+		return err
+	}
+	if count < 0 || deleted < 0 || numFields < 0 || numFields > int64(len(items)) {
+		return errNode
+	}
+	masterFields := make([]string, numFields)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return err
+		}
+	}
+	if terminator, err := nextInt(); err != nil || terminator != 0 {
+		return errNode
+	}
+	for range count + deleted {
+		flags, err := nextInt()
+		if err != nil {
+			return err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return err
+		}
+		id := kv.StreamId{Timestamp: master.Timestamp + uint64(msDiff), Sequence: master.Sequence + uint64(seqDiff)}
+		var fields []kv.StreamField
+		if flags&streamItemSameFields != 0 {
+			for _, name := range masterFields {
+				value, err := next()
+				if err != nil {
+					return err
+				}
+				fields = append(fields, kv.StreamField{Name: name, Value: value})
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil || n < 0 || 2*n > int64(len(items)) {
+				return errNode
+			}
+			for range n {
+				name, err := next()
+				if err != nil {
+					return err
+				}
+				value, err := next()
+				if err != nil {
+					return err
+				}
+				fields = append(fields, kv.StreamField{Name: name, Value: value})
+			}
+		}
+		if _, err := nextInt(); err != nil {
+			return err
+		}
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		if stream.Len() > 0 && id.Compare(stream.LastID) <= 0 {
+			return fmt.Errorf("stream entry %s out of order", id.ToString())
+		}
+		stream.Append(id, fields)
+	}
+	if len(items) != 0 {
+		return errNode
+	}
+	return nil
+}
+
+func parseStreamIDBytes(b []byte) kv.StreamId {
+	return kv.StreamId{Timestamp: binary.BigEndian.Uint64(b), Sequence: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (l *redisLoader) readStreamID() (kv.StreamId, error) {
+	ms, err := l.readLen()
+	if err != nil {
+		return kv.StreamId{}, err
+	}
+	seq, err := l.readLen()
+	return kv.StreamId{Timestamp: ms, Sequence: seq}, err
+}
+
+func (l *redisLoader) readRawStreamID() (kv.StreamId, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(l.r, b); err != nil {
+		return kv.StreamId{}, err
+	}
+	return parseStreamIDBytes(b), nil
+}
+
+// redisModuleReader implements kv.ModuleReader for the Redis format.
+type redisModuleReader struct {
+	l   *redisLoader
+	err error
+}
+
+func (m *redisModuleReader) expect(op uint64) bool {
+	if m.err != nil {
+		return false
+	}
+	got, err := m.l.readLen()
+	if err != nil {
+		m.err = err
+		return false
+	}
+	if got != op {
+		m.err = fmt.Errorf("module value item has kind %d, expected %d", got, op)
+		return false
+	}
+	return true
+}
+
+func (m *redisModuleReader) LoadUnsigned() uint64 {
+	if !m.expect(redisModuleOpUint) {
+		return 0
+	}
+	var n uint64
+	n, m.err = m.l.readLen()
+	return n
+}
+
+func (m *redisModuleReader) LoadSigned() int64 {
+	if !m.expect(redisModuleOpSigned) {
+		return 0
+	}
+	var n uint64
+	n, m.err = m.l.readLen()
+	return int64(n)
+}
+
+func (m *redisModuleReader) LoadDouble() float64 {
+	if !m.expect(redisModuleOpDouble) {
+		return 0
+	}
+	var f float64
+	f, m.err = m.l.readDouble()
+	return f
+}
+
+func (m *redisModuleReader) LoadString() string {
+	if !m.expect(redisModuleOpString) {
+		return ""
+	}
+	var s string
+	s, m.err = m.l.readString()
+	return s
+}
+
+func (l *redisLoader) loadModule() (*kv.ModuleValue, error) {
+	id, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	name, encver := moduleTypeName(id)
+	t, ok := kv.LookupModuleType(name)
+	if !ok {
+		return nil, fmt.Errorf("module type %s is not registered", name)
+	}
+	if encver > t.EncVer {
+		return nil, fmt.Errorf("module type %s encoding version %d, newer than %d", name, encver, t.EncVer)
+	}
+	r := &redisModuleReader{l: l}
+	value, err := t.RDBLoad(r, encver)
+	if err == nil {
+		r.expect(redisModuleOpEOF)
+		err = r.err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("module type %s: %w", name, err)
+	}
+	return &kv.ModuleValue{Type: t, Value: value}, nil
+}
+
+// skipModuleAux skips data a module saved outside of keys, which has no
+// place here.
+func (l *redisLoader) skipModuleAux() error {
+	if err := l.skipLens(3); err != nil {
+		return err
+	}
+	for {
+		op, err := l.readLen()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case redisModuleOpEOF:
+			fmt.Println("Skipped module data in the RDB file that isn't part of a key")
+			return nil
+		case redisModuleOpSigned, redisModuleOpUint:
+			_, err = l.readLen()
+		case redisModuleOpFloat:
+			_, err = l.r.Discard(4)
+		case redisModuleOpDouble:
+			_, err = l.r.Discard(8)
+		case redisModuleOpString:
+			_, err = l.readString()
+		default:
+			return fmt.Errorf("unknown module data kind %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLenOrEncoding reads a length, or for a string stored in a special
+// encoding, which one.
+func (l *redisLoader) readLenOrEncoding() (uint64, bool, error) {
+	b, err := l.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		b2, err := l.r.ReadByte()
+		return uint64(b&0x3F)<<8 | uint64(b2), false, err
+	case 2:
+		switch b {
+		case 0x80:
+			var n uint32
+			err := binary.Read(l.r, binary.BigEndian, &n)
+			return uint64(n), false, err
+		case 0x81:
+			var n uint64
+			err := binary.Read(l.r, binary.BigEndian, &n)
+			return n, false, err
+		}
+		return 0, false, fmt.Errorf("unknown length encoding %#x", b)
+	}
+	return uint64(b & 0x3F), true, nil
+}
+
+func (l *redisLoader) readLen() (uint64, error) {
+	n, encoded, err := l.readLenOrEncoding()
+	if err == nil && encoded {
+		err = errors.New("unexpected string encoding where a length belongs")
+	}
+	return n, err
+}
+
+func (l *redisLoader) skipLens(n int) error {
+	for range n {
+		if _, err := l.readLen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *redisLoader) readString() (string, error) {
+	n, encoded, err := l.readLenOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		return l.readBytes(n)
+	}
+	switch n {
+	case redisEncInt8:
+		b, err := l.r.ReadByte()
+		return strconv.Itoa(int(int8(b))), err
+	case redisEncInt16:
+		var v int16
+		err := binary.Read(l.r, binary.LittleEndian, &v)
+		return strconv.Itoa(int(v)), err
+	case redisEncInt32:
+		var v int32
+		err := binary.Read(l.r, binary.LittleEndian, &v)
+		return strconv.Itoa(int(v)), err
+	case redisEncLZF:
+		clen, err := l.readLen()
+		if err != nil {
+			return "", err
+		}
+		size, err := l.readLen()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := l.readBytes(clen)
+		if err != nil {
+			return "", err
+		}
+		if size > math.MaxInt32 {
+			return "", errLZF
+		}
+		s, err := lzfDecompress([]byte(compressed), int(size))
+		return string(s), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+// readBytes reads n bytes, growing the buffer as they arrive so that a
+// corrupt length runs into the end of the file rather than out of memory.
+func (l *redisLoader) readBytes(n uint64) (string, error) {
+	buf, err := io.ReadAll(io.LimitReader(l.r, int64(min(n, math.MaxInt64))))
+	if err == nil && uint64(len(buf)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return string(buf), err
+}
+
+// readStrings reads a count of elements followed by that many elements of
+// width strings each.
+func (l *redisLoader) readStrings(width int) ([]string, error) {
+	n, err := l.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for range n * uint64(width) {
+		s, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// readPair reads a field and its value.
+func (l *redisLoader) readPair() ([]string, error) {
+	field, err := l.readString()
+	if err != nil {
+		return nil, err
+	}
+	value, err := l.readString()
+	return []string{field, value}, err
+}
+
+// readBlob reads a string holding an encoded collection and decodes it.
+func (l *redisLoader) readBlob(decode func([]byte) ([]string, error)) ([]string, error) {
+	blob, err := l.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(blob))
+}
+
+func (l *redisLoader) readMillis() (int64, error) {
+	var ms int64
+	err := binary.Read(l.r, binary.LittleEndian, &ms)
+	return ms, err
+}
+
+func (l *redisLoader) readDouble() (float64, error) {
+	var bits uint64
+	err := binary.Read(l.r, binary.LittleEndian, &bits)
+	return math.Float64frombits(bits), err
+}
+
+// readStringDouble reads a score as the first sorted set type stored it: a
+// length byte then the number as text, or a special length for NaN and the
+// infinities.
+func (l *redisLoader) readStringDouble() (float64, error) {
+	n, err := l.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	s, err := l.readBytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
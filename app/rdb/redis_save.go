@@ -0,0 +1,395 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/r1i2t3/go-redis/app/kv"
+)
+
+// saveRedis writes the dataset in the Redis format, as database 0,
+// followed by the CRC-64 of everything before it.
+func saveRedis(w io.Writer, kV *kv.KV) error {
+	crc := &jonesHash{}
+	rw := &redisWriter{w: io.MultiWriter(w, crc)}
+	rw.write([]byte(fmt.Sprintf("%s%04d", MagicString, redisRDBVersion)))
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rw.writeAux("redis-ver", redisVersion)
+	rw.writeAux("redis-bits", "64")
+	rw.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.writeAux("used-mem", strconv.FormatUint(mem.Alloc, 10))
+
+	rw.writeByte(redisOpSelectDB)
+	rw.writeLen(0)
+	keys, expires := countKeys(kV)
+	rw.writeByte(redisOpResizeDB)
+	rw.writeLen(uint64(keys))
+	rw.writeLen(uint64(expires))
+
+	saveRedisStrings(rw, kV)
+	saveRedisLists(rw, kV)
+	saveRedisHashes(rw, kV)
+	saveRedisSets(rw, kV)
+	saveRedisSortedSets(rw, kV)
+	saveRedisStreams(rw, kV)
+	saveRedisModules(rw, kV)
+	rw.writeByte(redisOpEOF)
+	if rw.err != nil {
+		return rw.err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.crc)
+}
+
+// countKeys counts the keys, and those with a TTL, for RESIZEDB.
+func countKeys(kV *kv.KV) (keys, expires int) {
+	kV.StringsMu.RLock()
+	keys += len(kV.Strings)
+	for _, value := range kV.Strings {
+		if value.Expires > 0 {
+			expires++
+		}
+	}
+	kV.StringsMu.RUnlock()
+	kV.ListsMu.RLock()
+	keys += len(kV.Lists)
+	kV.ListsMu.RUnlock()
+	kV.HashesMu.RLock()
+	keys += len(kV.Hashes)
+	kV.HashesMu.RUnlock()
+	kV.SetsMu.RLock()
+	keys += len(kV.Sets)
+	kV.SetsMu.RUnlock()
+	kV.SortedsMu.RLock()
+	keys += len(kV.Sorteds)
+	kV.SortedsMu.RUnlock()
+	kV.StreamsMu.RLock()
+	keys += len(kV.Streams)
+	kV.StreamsMu.RUnlock()
+	kV.ModulesMu.RLock()
+	keys += len(kV.Modules)
+	kV.ModulesMu.RUnlock()
+	return keys, expires
+}
+
+func saveRedisStrings(rw *redisWriter, kV *kv.KV) {
+	kV.StringsMu.RLock()
+	defer kV.StringsMu.RUnlock()
+	for key, value := range kV.Strings {
+		if value.Expires > 0 {
+			rw.writeByte(redisOpExpireTimeMs)
+			rw.writeMillis(value.Expires)
+		}
+		rw.writeByte(redisTypeString)
+		rw.writeString(key)
+		rw.writeString(value.Str)
+	}
+}
+
+// saveRedisLists writes lists as quicklists of listpacks of at most
+// listpackMaxEntries elements and about listNodeMaxBytes.
+func saveRedisLists(rw *redisWriter, kV *kv.KV) {
+	kV.ListsMu.RLock()
+	defer kV.ListsMu.RUnlock()
+	for key, list := range kV.Lists {
+		if len(list) == 0 {
+			continue
+		}
+		var nodes [][]byte
+		lp := newListpack()
+		for _, item := range list {
+			if lp.count == listpackMaxEntries || lp.count > 0 && lp.size()+len(item.Bulk) > listNodeMaxBytes {
+				nodes = append(nodes, lp.bytes())
+				lp = newListpack()
+			}
+			lp.appendString(item.Bulk)
+		}
+		nodes = append(nodes, lp.bytes())
+		rw.writeByte(redisTypeListQuicklist2)
+		rw.writeString(key)
+		rw.writeLen(uint64(len(nodes)))
+		for _, node := range nodes {
+			rw.writeLen(quicklistPacked)
+			rw.writeString(string(node))
+		}
+	}
+}
+
+func saveRedisHashes(rw *redisWriter, kV *kv.KV) {
+	kV.HashesMu.RLock()
+	defer kV.HashesMu.RUnlock()
+	for key, hash := range kV.Hashes {
+		if len(hash) == 0 {
+			continue
+		}
+		small := len(hash) <= listpackMaxEntries
+		for field, value := range hash {
+			small = small && len(field) <= listpackMaxValue && len(value.Bulk) <= listpackMaxValue
+		}
+		if small {
+			lp := newListpack()
+			for field, value := range hash {
+				lp.appendString(field)
+				lp.appendString(value.Bulk)
+			}
+			rw.writeByte(redisTypeHashListpack)
+			rw.writeString(key)
+			rw.writeString(string(lp.bytes()))
+			continue
+		}
+		rw.writeByte(redisTypeHash)
+		rw.writeString(key)
+		rw.writeLen(uint64(len(hash)))
+		for field, value := range hash {
+			rw.writeString(field)
+			rw.writeString(value.Bulk)
+		}
+	}
+}
+
+// saveRedisSets writes sets of integers as intsets, other small sets as
+// listpacks, and the rest member by member.
+func saveRedisSets(rw *redisWriter, kV *kv.KV) {
+	kV.SetsMu.RLock()
+	defer kV.SetsMu.RUnlock()
+	for key, members := range kV.Sets {
+		if len(members) == 0 {
+			continue
+		}
+		ints := make([]int64, 0, len(members))
+		small := len(members) <= listpackMaxEntries
+		for member := range members {
+			if n, ok := canonicalInt(member); ok {
+				ints = append(ints, n)
+			}
+			small = small && len(member) <= listpackMaxValue
+		}
+		switch {
+		case len(ints) == len(members) && len(ints) <= intsetMaxEntries:
+			rw.writeByte(redisTypeSetIntset)
+			rw.writeString(key)
+			rw.writeString(string(intsetEncode(ints)))
+		case small:
+			lp := newListpack()
+			for member := range members {
+				lp.appendString(member)
+			}
+			rw.writeByte(redisTypeSetListpack)
+			rw.writeString(key)
+			rw.writeString(string(lp.bytes()))
+		default:
+			rw.writeByte(redisTypeSet)
+			rw.writeString(key)
+			rw.writeLen(uint64(len(members)))
+			for member := range members {
+				rw.writeString(member)
+			}
+		}
+	}
+}
+
+// saveRedisSortedSets writes small sorted sets as listpacks of members and
+// scores, in order, and the rest with binary scores.
+func saveRedisSortedSets(rw *redisWriter, kV *kv.KV) {
+	kV.SortedsMu.RLock()
+	defer kV.SortedsMu.RUnlock()
+	for key, sortedSet := range kV.Sorteds {
+		members := sortedSet.Members()
+		if len(members) == 0 {
+			continue
+		}
+		small := len(members) <= listpackMaxEntries
+		for _, m := range members {
+			small = small && len(m.Member) <= listpackMaxValue
+		}
+		if small {
+			lp := newListpack()
+			for _, m := range members {
+				lp.appendString(m.Member)
+				lp.appendString(formatScore(m.Score))
+			}
+			rw.writeByte(redisTypeZSetListpack)
+			rw.writeString(key)
+			rw.writeString(string(lp.bytes()))
+			continue
+		}
+		rw.writeByte(redisTypeZSet2)
+		rw.writeString(key)
+		rw.writeLen(uint64(len(members)))
+		for _, m := range members {
+			rw.writeString(m.Member)
+			rw.writeDouble(m.Score)
+		}
+	}
+}
+
+// formatScore formats a score the way Redis stores it in a listpack.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score > -1<<53 && score < 1<<53 && score == math.Trunc(score):
+		return strconv.FormatInt(int64(score), 10)
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// saveRedisStreams writes each stream as listpacks of up to
+// kv.StreamNodeMaxEntries entries, then its counters and consumer groups.
+// Dead letter settings follow the keys as AUX fields.
+func saveRedisStreams(rw *redisWriter, kV *kv.KV) {
+	kV.StreamsMu.RLock()
+	defer kV.StreamsMu.RUnlock()
+	var deadLetters [][]byte
+	for key, stream := range kV.Streams {
+		rw.writeByte(redisTypeStreamListpacks3)
+		rw.writeString(key)
+		entries := stream.Entries()
+		rw.writeLen(uint64((len(entries) + kv.StreamNodeMaxEntries - 1) / kv.StreamNodeMaxEntries))
+		for start := 0; start < len(entries); start += kv.StreamNodeMaxEntries {
+			node := entries[start:min(start+kv.StreamNodeMaxEntries, len(entries))]
+			rw.writeString(string(streamIDBytes(node[0].ID)))
+			rw.writeString(string(streamListpack(node)))
+		}
+		rw.writeLen(uint64(len(entries)))
+		writeStreamID(rw, stream.LastID)
+		writeStreamID(rw, stream.FirstID())
+		writeStreamID(rw, stream.MaxDeletedID)
+		rw.writeLen(stream.EntriesAdded)
+
+		rw.writeLen(uint64(len(stream.Groups)))
+		for _, group := range stream.Groups {
+			rw.writeString(group.Name)
+			writeStreamID(rw, group.LastID)
+			rw.writeLen(uint64(group.EntriesRead))
+			rw.writeLen(uint64(len(group.Pending)))
+			for _, id := range kv.SortedPendingIDs(group.Pending) {
+				nack := group.Pending[id]
+				rw.write(streamIDBytes(id))
+				rw.writeMillis(nack.DeliveryTime)
+				rw.writeLen(nack.DeliveryCount)
+			}
+			rw.writeLen(uint64(len(group.Consumers)))
+			for _, consumer := range group.Consumers {
+				rw.writeString(consumer.Name)
+				rw.writeMillis(consumer.SeenTime)
+				rw.writeMillis(consumer.ActiveTime)
+				rw.writeLen(uint64(len(consumer.Pending)))
+				for _, id := range kv.SortedPendingIDs(consumer.Pending) {
+					rw.write(streamIDBytes(id))
+				}
+			}
+			if group.MaxDeliveries > 0 {
+				var buf bytes.Buffer
+				aux := &redisWriter{w: &buf}
+				aux.writeString(key)
+				aux.writeString(group.Name)
+				aux.writeLen(group.MaxDeliveries)
+				aux.writeString(group.DeadLetterKey)
+				deadLetters = append(deadLetters, buf.Bytes())
+			}
+		}
+	}
+	for _, value := range deadLetters {
+		rw.writeAux(deadLetterAux, string(value))
+	}
+}
+
+func writeStreamID(rw *redisWriter, id kv.StreamId) {
+	rw.writeLen(id.Timestamp)
+	rw.writeLen(id.Sequence)
+}
+
+// streamIDBytes returns id as 128 big-endian bits, the form of node keys
+// and PEL entries.
+func streamIDBytes(id kv.StreamId) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, id.Timestamp), id.Sequence)
+}
+
+// streamListpack returns the listpack of a stream node. It starts with a
+// master entry, the first entry's fields; entries with the same fields
+// store only their values. IDs are stored relative to the first entry's.
+func streamListpack(entries []kv.StreamEntry) []byte {
+	lp := newListpack()
+	master := entries[0]
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(master.Fields)))
+	for _, f := range master.Fields {
+		lp.appendString(f.Name)
+	}
+	lp.appendInt(0)
+	for _, entry := range entries {
+		same := len(entry.Fields) == len(master.Fields)
+		for i := 0; same && i < len(entry.Fields); i++ {
+			same = entry.Fields[i].Name == master.Fields[i].Name
+		}
+		flags, count := int64(0), int64(4+2*len(entry.Fields))
+		if same {
+			flags, count = streamItemSameFields, int64(3+len(entry.Fields))
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.ID.Timestamp - master.ID.Timestamp))
+		lp.appendInt(int64(entry.ID.Sequence - master.ID.Sequence))
+		if !same {
+			lp.appendInt(int64(len(entry.Fields)))
+		}
+		for _, f := range entry.Fields {
+			if !same {
+				lp.appendString(f.Name)
+			}
+			lp.appendString(f.Value)
+		}
+		lp.appendInt(count)
+	}
+	return lp.bytes()
+}
+
+// redisModuleWriter implements kv.ModuleWriter for the Redis format.
+type redisModuleWriter struct {
+	rw *redisWriter
+}
+
+func (m *redisModuleWriter) SaveUnsigned(n uint64) {
+	m.rw.writeLen(redisModuleOpUint)
+	m.rw.writeLen(n)
+}
+
+func (m *redisModuleWriter) SaveSigned(n int64) {
+	m.rw.writeLen(redisModuleOpSigned)
+	m.rw.writeLen(uint64(n))
+}
+
+func (m *redisModuleWriter) SaveDouble(f float64) {
+	m.rw.writeLen(redisModuleOpDouble)
+	m.rw.writeDouble(f)
+}
+
+func (m *redisModuleWriter) SaveString(s string) {
+	m.rw.writeLen(redisModuleOpString)
+	m.rw.writeString(s)
+}
+
+func saveRedisModules(rw *redisWriter, kV *kv.KV) {
+	kV.ModulesMu.RLock()
+	defer kV.ModulesMu.RUnlock()
+	for key, mv := range kV.Modules {
+		rw.writeByte(redisTypeModule2)
+		rw.writeString(key)
+		rw.writeLen(moduleTypeID(mv.Type.Name, mv.Type.EncVer))
+		mv.Type.RDBSave(&redisModuleWriter{rw: rw}, mv.Value)
+		rw.writeLen(redisModuleOpEOF)
+		if rw.err != nil {
+			rw.err = fmt.Errorf("module type %s, key %q: %w", mv.Type.Name, key, rw.err)
+			return
+		}
+	}
+}
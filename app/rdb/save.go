@@ -2,85 +2,97 @@ package rdb
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash"
 	"hash/crc64"
 	"io"
 	"os"
+	"sync/atomic"
 
 	"github.com/r1i2t3/go-redis/app/kv"
 )
 
-func Save(path string, kv *kv.KV) error {
+// Save writes the dataset to path in the given format. written, if not
+// nil, counts the bytes written to the file so far.
+func Save(path string, kv *kv.KV, format string, written *atomic.Int64) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	buf := bufio.NewWriter(file)
-	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
-	writer := io.MultiWriter(buf, hasher)
-
-	if err := writeHeader(writer); err != nil {
-		return fmt.Errorf("failed to write rdb header: %w", err)
-	}
-	if err := saveStrings(writer, kv); err != nil {
-		return fmt.Errorf("failed to save strings: %w", err)
+	var w io.Writer = file
+	if written != nil {
+		w = &countingWriter{w: file, n: written}
 	}
-	if err := saveLists(writer, kv); err != nil {
-		return fmt.Errorf("failed to save lists: %w", err)
-	}
-	if err := saveHashes(writer, kv); err != nil {
-		return fmt.Errorf("failed to save hashes: %w", err)
+	buf := bufio.NewWriterSize(w, 64*1024)
+	if err := SaveTo(buf, kv, format); err != nil {
+		return err
 	}
-	if err := saveStreams(writer, kv); err != nil {
-		return fmt.Errorf("failed to save streams: %w", err)
+	if err := buf.Flush(); err != nil {
+		return err
 	}
-	if err := saveSortedSrings(writer, kv); err != nil {
-		return fmt.Errorf("failed to save sorted Srings: %w", err)
+	// Errors such as a full disk may only show up once the data is synced.
+	if err := file.Sync(); err != nil {
+		return err
 	}
-	if err := writeFooter(writer, buf, hasher); err != nil {
-		return fmt.Errorf("failed to write rdb footer: %w", err)
+	return file.Close()
+}
+
+// SaveTo writes the dataset to w in the given format as it serializes it,
+// without holding the whole payload in memory.
+func SaveTo(w io.Writer, kv *kv.KV, format string) error {
+	if format == FormatRedis {
+		return saveRedis(w, kv)
 	}
-	return buf.Flush()
+	return saveLegacy(w, kv)
+}
+
+// countingWriter adds the number of bytes written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
 }
 
-func SaveToBuffer(kv *kv.KV) ([]byte, error) {
-	var buf bytes.Buffer
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func saveLegacy(w io.Writer, kv *kv.KV) error {
 	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
-	writer := io.MultiWriter(&buf, hasher)
+	writer := io.MultiWriter(w, hasher)
 
 	if err := writeHeader(writer); err != nil {
-		return nil, fmt.Errorf("failed to write rdb header: %w", err)
+		return fmt.Errorf("failed to write rdb header: %w", err)
 	}
 	if err := saveStrings(writer, kv); err != nil {
-		return nil, fmt.Errorf("failed to save strings: %w", err)
+		return fmt.Errorf("failed to save strings: %w", err)
 	}
 	if err := saveLists(writer, kv); err != nil {
-		return nil, fmt.Errorf("failed to save lists: %w", err)
+		return fmt.Errorf("failed to save lists: %w", err)
 	}
 	if err := saveHashes(writer, kv); err != nil {
-		return nil, fmt.Errorf("failed to save hashes: %w", err)
+		return fmt.Errorf("failed to save hashes: %w", err)
+	}
+	if err := saveSets(writer, kv); err != nil {
+		return fmt.Errorf("failed to save sets: %w", err)
 	}
 	if err := saveStreams(writer, kv); err != nil {
-		return nil, fmt.Errorf("failed to save streams: %w", err)
+		return fmt.Errorf("failed to save streams: %w", err)
 	}
 	if err := saveSortedSrings(writer, kv); err != nil {
-		return nil, fmt.Errorf("failed to save sorted Srings: %w", err)
+		return fmt.Errorf("failed to save sorted Srings: %w", err)
 	}
-	if _, err := writer.Write([]byte{OpCodeEOF}); err != nil {
-		return nil, fmt.Errorf("failed to write rdb eof marker: %w", err)
+	if err := saveModules(writer, kv); err != nil {
+		return fmt.Errorf("failed to save module values: %w", err)
 	}
-
-	checksum := hasher.Sum64()
-	if err := binary.Write(&buf, binary.BigEndian, checksum); err != nil {
-		return nil, fmt.Errorf("failed to write rdb checksum: %w", err)
+	if err := writeFooter(writer, w, hasher); err != nil {
+		return fmt.Errorf("failed to write rdb footer: %w", err)
 	}
-
-	return buf.Bytes(), nil
+	return nil
 }
 
 func writeHeader(writer io.Writer) error {
@@ -90,12 +102,12 @@ func writeHeader(writer io.Writer) error {
 	return binary.Write(writer, binary.BigEndian, uint32(Version))
 }
 
-func writeFooter(writer io.Writer, buf *bufio.Writer, hasher hash.Hash64) error {
+func writeFooter(writer io.Writer, w io.Writer, hasher hash.Hash64) error {
 	if _, err := writer.Write([]byte{OpCodeEOF}); err != nil {
 		return err
 	}
 	checksum := hasher.Sum64()
-	return binary.Write(buf, binary.BigEndian, checksum)
+	return binary.Write(w, binary.BigEndian, checksum)
 }
 
 func saveStrings(writer io.Writer, kv *kv.KV) error {
@@ -103,6 +115,14 @@ func saveStrings(writer io.Writer, kv *kv.KV) error {
 	defer kv.StringsMu.RUnlock()
 
 	for key, value := range kv.Strings {
+		if value.Expires > 0 {
+			if _, err := writer.Write([]byte{OpCodeExpireTime}); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, value.Expires); err != nil {
+				return err
+			}
+		}
 		if _, err := writer.Write([]byte{OpCodeString}); err != nil {
 			return err
 		}
@@ -131,7 +151,6 @@ func saveLists(writer io.Writer, kv *kv.KV) error {
 			return err
 		}
 		for _, item := range list {
-			fmt.Println(item.Bulk)
 			if err := WriteString(writer, item.Bulk); err != nil {
 				return err
 			}
@@ -168,32 +187,132 @@ func saveHashes(writer io.Writer, kv *kv.KV) error {
 	return nil
 }
 
+func saveSets(writer io.Writer, kv *kv.KV) error {
+	kv.SetsMu.RLock()
+	defer kv.SetsMu.RUnlock()
+
+	for key, members := range kv.Sets {
+		if _, err := writer.Write([]byte{OpCodeSet}); err != nil {
+			return err
+		}
+		if err := WriteString(writer, key); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint64(len(members))); err != nil {
+			return err
+		}
+		for member := range members {
+			if err := WriteString(writer, member); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func saveStreams(writer io.Writer, kv *kv.KV) error {
 	kv.StreamsMu.RLock()
 	defer kv.StreamsMu.RUnlock()
 
 	for key, stream := range kv.Streams {
-		if _, err := writer.Write([]byte{OpCodeStream}); err != nil {
+		if _, err := writer.Write([]byte{OpCodeStreamGroups}); err != nil {
 			return err
 		}
 		if err := WriteString(writer, key); err != nil {
 			return err
 		}
-		if err := binary.Write(writer, binary.BigEndian, uint64(len(stream.Entries))); err != nil {
+		entries := stream.Entries()
+		if err := binary.Write(writer, binary.BigEndian, uint64(len(entries))); err != nil {
 			return err
 		}
-		for _, entry := range stream.Entries {
+		for _, entry := range entries {
 			if err := WriteString(writer, entry.ID.ToString()); err != nil {
 				return err
 			}
 			if err := binary.Write(writer, binary.BigEndian, uint64(len(entry.Fields))); err != nil {
 				return err
 			}
-			for field, value := range entry.Fields {
-				if err := WriteString(writer, field); err != nil {
+			for _, f := range entry.Fields {
+				if err := WriteString(writer, f.Name); err != nil {
+					return err
+				}
+				if err := WriteString(writer, f.Value); err != nil {
 					return err
 				}
-				if err := WriteString(writer, value.Bulk); err != nil {
+			}
+		}
+		if err := saveStreamMetadata(writer, stream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveStreamMetadata writes the stream counters followed by every consumer
+// group with its global PEL and consumers. Consumers list only the IDs they
+// own; delivery metadata lives in the group PEL.
+func saveStreamMetadata(writer io.Writer, stream *kv.Stream) error {
+	if err := WriteString(writer, stream.LastID.ToString()); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, stream.EntriesAdded); err != nil {
+		return err
+	}
+	if err := WriteString(writer, stream.MaxDeletedID.ToString()); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint64(len(stream.Groups))); err != nil {
+		return err
+	}
+	for _, group := range stream.Groups {
+		if err := WriteString(writer, group.Name); err != nil {
+			return err
+		}
+		if err := WriteString(writer, group.LastID.ToString()); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, group.EntriesRead); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, group.MaxDeliveries); err != nil {
+			return err
+		}
+		if err := WriteString(writer, group.DeadLetterKey); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint64(len(group.Pending))); err != nil {
+			return err
+		}
+		for _, id := range kv.SortedPendingIDs(group.Pending) {
+			nack := group.Pending[id]
+			if err := WriteString(writer, id.ToString()); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, nack.DeliveryTime); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, nack.DeliveryCount); err != nil {
+				return err
+			}
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint64(len(group.Consumers))); err != nil {
+			return err
+		}
+		for _, consumer := range group.Consumers {
+			if err := WriteString(writer, consumer.Name); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, consumer.SeenTime); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, consumer.ActiveTime); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, uint64(len(consumer.Pending))); err != nil {
+				return err
+			}
+			for _, id := range kv.SortedPendingIDs(consumer.Pending) {
+				if err := WriteString(writer, id.ToString()); err != nil {
 					return err
 				}
 			}
@@ -213,14 +332,14 @@ func saveSortedSrings(writer io.Writer, kv *kv.KV) error {
 		if err := WriteString(writer, key); err != nil {
 			return err
 		}
-		if err := binary.Write(writer, binary.BigEndian, uint64(len(sortedSet))); err != nil {
+		if err := binary.Write(writer, binary.BigEndian, uint64(sortedSet.Len())); err != nil {
 			return err
 		}
-		for member, score := range sortedSet {
-			if err := WriteString(writer, member); err != nil {
+		for _, m := range sortedSet.Members() {
+			if err := WriteString(writer, m.Member); err != nil {
 				return err
 			}
-			if err := binary.Write(writer, binary.BigEndian, score); err != nil {
+			if err := binary.Write(writer, binary.BigEndian, m.Score); err != nil {
 				return err
 			}
 		}
@@ -3,11 +3,14 @@ package rdb
 import (
 	"encoding/binary"
 	"io"
+	"math"
 )
 
+// Version 2 of the legacy format added expiry times ahead of keys. Files
+// of version 1 still load.
 const (
 	MagicString = "REDIS"
-	Version     = 1
+	Version     = 2
 )
 
 const (
@@ -17,8 +20,16 @@ const (
 	OpCodeSet    byte = 3
 	OpCodeZSet   byte = 4
 	OpCodeStream byte = 5
+	// OpCodeStreamGroups is a stream followed by its metadata and consumer
+	// groups. OpCodeStream records from older files still load.
+	OpCodeStreamGroups byte = 6
+	// OpCodeModule is a value of a type registered by a module, followed by
+	// the type's name and encoding version.
+	OpCodeModule byte = 7
 
 	OpCodeDBSelector byte = 0xFB
+	// OpCodeExpireTime is followed by the expiry of the next key, in unix
+	// milliseconds.
 	OpCodeExpireTime byte = 0xFD
 	OpCodeEOF        byte = 0xFF
 )
@@ -31,14 +42,23 @@ func WriteString(w io.Writer, s string) error {
 	return err
 }
 
+// ReadString reads a string written by WriteString. Loads are checksummed
+// only at the end, so the buffer grows as the data arrives: a corrupt length
+// runs into the end of the file rather than out of memory.
 func ReadString(r io.Reader) (string, error) {
 	var length uint64
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 		return "", err
 	}
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return "", err
+	buf, err := io.ReadAll(io.LimitReader(r, int64(min(length, math.MaxInt64))))
+	if err == nil && uint64(len(buf)) != length {
+		err = io.ErrUnexpectedEOF
 	}
-	return string(buf), nil
+	return string(buf), err
+}
+
+// sizeHint caps a count read from a file for preallocating, for the same
+// reason.
+func sizeHint(n uint64) int {
+	return int(min(n, 1024))
 }
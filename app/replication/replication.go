@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/r1i2t3/go-redis/app/handlers"
+	"github.com/r1i2t3/go-redis/app/kv"
 	"github.com/r1i2t3/go-redis/app/rdb"
 	"github.com/r1i2t3/go-redis/app/resp"
 	"github.com/r1i2t3/go-redis/app/types"
@@ -66,22 +67,39 @@ func handleSyncWithMaster(conn net.Conn, server *types.Server) {
 		return
 	}
 	fmt.Println("Handshake successful. Receiving RDB file from master...")
-	rdbLength, err := parser.ParseRDBLength()
+	rdbReader, err := parser.RDBReader()
 	if err != nil {
-		fmt.Println("Failed to read RDB file length:", err)
+		fmt.Println("Failed to read RDB file header:", err)
 		return
 	}
-	fmt.Println("RDB file length:", rdbLength)
-	rdbData := make([]byte, rdbLength)
-	if _, err := io.ReadFull(parser.Reader, rdbData); err != nil {
-		fmt.Println("Failed to read RDB file data:", err)
-		return
+	server.KV.KeyspaceMu.Lock()
+	server.KV.Flush()
+	err = rdb.LoadFrom(rdbReader, server.KV, false)
+	if err == nil {
+		// Whatever follows the checksum is still part of the payload.
+		_, err = io.Copy(io.Discard, rdbReader)
 	}
-	if err := rdb.LoadFromBuffer(rdbData, server.KV); err != nil {
+	// The dataset was replaced wholesale, so every watched key changed.
+	server.KV.SignalFlushed()
+	server.KV.KeyspaceMu.Unlock()
+	if err != nil {
 		fmt.Println("Failed to load RDB data from master:", err)
 		return
 	}
 	fmt.Println("RDB file loaded. Entering continuous replication mode.")
+	// The AOF still describes the old dataset; have it rewritten from the
+	// new one, after any rewrite already running.
+	if server.AOF != nil {
+		server.AOFRewriteScheduled.Store(true)
+	}
+	// Commands from the master never block, and a MULTI/EXEC block from the
+	// master is applied as one isolated transaction.
+	masterClient := &kv.ClientType{
+		DenyBlocking: true,
+		WatchedKeys:  make(map[string]bool),
+	}
+	var transaction []resp.Value
+	inTransaction := false
 	for {
 		cmdValue, err := parser.Parse()
 		if err != nil {
@@ -106,10 +124,21 @@ func handleSyncWithMaster(conn net.Conn, server *types.Server) {
 			continue
 		}
 
-		handler, ok := handlers.Handlers[command]
-		if ok {
-			fmt.Println("Handling command:", command)
-			handler(args, server, nil)
+		switch {
+		case command == "MULTI":
+			inTransaction = true
+			transaction = nil
+		case command == "EXEC" && inTransaction:
+			handlers.ExecAtomically(server, masterClient, transaction)
+			inTransaction = false
+			transaction = nil
+		case inTransaction:
+			transaction = append(transaction, cmdValue)
+		default:
+			if _, ok := handlers.Handlers[command]; ok {
+				fmt.Println("Handling command:", command)
+				handlers.Call(command, args, server, masterClient)
+			}
 		}
 
 	}
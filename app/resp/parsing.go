@@ -2,10 +2,12 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -151,7 +153,7 @@ func (p *Parser) readLine() (string, error) {
 	for {
 		part, isPrefix, err := p.Reader.ReadLine()
 		if err != nil {
-			return "", nil
+			return "", err
 		}
 		b = append(b, part...)
 		if len(b) > p.maxLine {
@@ -179,24 +181,90 @@ func (d *Parser) expectCRLF() error {
 	return nil
 }
 
-func (p *Parser) ParseRDBLength() (int, error) {
+// RDBReader reads the header of an RDB payload sent by a master and returns
+// a reader over the payload itself, which ends either after the length given
+// in the header or, for "$EOF:<mark>", at the mark. The payload must be read
+// to io.EOF before parsing the commands that follow it.
+func (p *Parser) RDBReader() (io.Reader, error) {
 	prefix, err := p.Reader.ReadByte()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if prefix != '$' {
-		return 0, fmt.Errorf("expected '$' prefix for RDB length, but got '%c'", prefix)
+		return nil, fmt.Errorf("expected '$' prefix for RDB length, but got '%c'", prefix)
 	}
 
-	lengthBytes, err := p.Reader.ReadBytes('\n')
+	lineBytes, err := p.Reader.ReadBytes('\n')
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	line := strings.TrimSuffix(string(lineBytes), "\r\n")
+	if mark, ok := strings.CutPrefix(line, "EOF:"); ok {
+		if mark == "" {
+			return nil, fmt.Errorf("empty RDB EOF mark")
+		}
+		return &eofMarkReader{r: p.Reader, mark: []byte(mark)}, nil
+	}
+	length, err := strconv.ParseInt(line, 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid RDB length format: %q", line)
+	}
+	return &exactReader{r: io.LimitReader(p.Reader, length), left: length}, nil
+}
+
+// exactReader reads a payload of known length, reporting a connection that
+// closes early as io.ErrUnexpectedEOF rather than as the end of the payload.
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (e *exactReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	e.left -= int64(n)
+	if err == io.EOF && e.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// eofMarkReader reads a payload that ends with mark, without reading past
+// the mark, as the bytes after it belong to the command stream.
+type eofMarkReader struct {
+	r    *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (e *eofMarkReader) Read(b []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// Make sure at least a mark's worth of bytes is buffered, so that a mark
+	// is always seen whole.
+	peeked, err := e.r.Peek(len(e.mark))
+	if bytes.Equal(peeked, e.mark) {
+		e.r.Discard(len(e.mark))
+		e.done = true
+		return 0, io.EOF
 	}
-	lengthStr := string(lengthBytes[:len(lengthBytes)-2])
-	length, err := strconv.Atoi(lengthStr)
 	if err != nil {
-		return 0, fmt.Errorf("invalid RDB length format: %w", err)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
 	}
 
-	return length, nil
+	buffered, _ := e.r.Peek(e.r.Buffered())
+	n := bytes.Index(buffered, e.mark)
+	if n < 0 {
+		// The tail may be the start of a mark; leave it for the next read.
+		n = len(buffered) - (len(e.mark) - 1)
+	}
+	n = copy(b, buffered[:n])
+	e.r.Discard(n)
+	return n, nil
 }
@@ -0,0 +1,71 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestRDBReader reads RDB payloads followed by a command, as a replica gets
+// them at the start of a full sync.
+func TestRDBReader(t *testing.T) {
+	const mark = "0123456789abcdef0123456789abcdef01234567"
+	// The payload holds the start of the mark, which mustn't end it.
+	payload := "REDIS0011" + mark[:39] + "x" + strings.Repeat("data", 5000) + mark[:10]
+	ping := "*1\r\n$4\r\nPING\r\n"
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"length", "$" + strconv.Itoa(len(payload)) + "\r\n" + payload + ping},
+		{"eof mark", "$EOF:" + mark + "\r\n" + payload + mark + ping},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(iotest.OneByteReader(strings.NewReader(tt.stream)))
+			r, err := p.RDBReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != payload {
+				t.Fatalf("payload of %d bytes, want %d", len(got), len(payload))
+			}
+			cmd, err := p.Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cmd.Array) != 1 || cmd.Array[0].Bulk != "PING" {
+				t.Errorf("command after the payload = %+v", cmd)
+			}
+		})
+	}
+}
+
+func TestRDBReaderTruncated(t *testing.T) {
+	for _, stream := range []string{
+		"$100\r\nREDIS",
+		"$EOF:0123456789\r\nREDIS",
+		"$EOF:0123456789\r\nREDIS012345678",
+	} {
+		p := NewParser(strings.NewReader(stream))
+		r, err := p.RDBReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%q: error %v, want %v", stream, err, io.ErrUnexpectedEOF)
+		}
+	}
+	for _, stream := range []string{"+OK\r\n", "$-1\r\n", "$x\r\n", "$EOF:\r\n"} {
+		if _, err := NewParser(strings.NewReader(stream)).RDBReader(); err == nil {
+			t.Errorf("%q: no error", stream)
+		}
+	}
+}
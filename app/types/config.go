@@ -6,24 +6,62 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/r1i2t3/go-redis/app/aof"
 	"github.com/r1i2t3/go-redis/app/kv"
 	pubsub "github.com/r1i2t3/go-redis/app/pub_sub"
 	"github.com/r1i2t3/go-redis/app/resp"
 	"github.com/r1i2t3/go-redis/app/writer"
 )
 
+// SavePoint is a save rule: a BGSAVE starts once Changes writes have
+// happened and Seconds have passed since the last save.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
 type Config struct {
-	Dir            string
-	DbFileName     string
-	RDBSaveSeconds int
-	RDBSaveChanges int
-	PORT           int
+	Dir        string
+	DbFileName string
+	// SavePoints are the rules that trigger a BGSAVE; any of them will do.
+	// Without any, the dataset is only saved on request.
+	SavePoints []SavePoint
+	// StopWritesOnBGSaveError makes write commands fail with MISCONF while
+	// the last background save failed, as long as there are save points.
+	StopWritesOnBGSaveError bool
+	// RDBFormat is the format RDB files are written in, rdb.FormatRedis or
+	// rdb.FormatLegacy. Files in either format load.
+	RDBFormat string
+	PORT      int
+	// LuaTimeLimit is how long, in milliseconds, a script may run before
+	// other clients get BUSY replies and SCRIPT KILL becomes the way out.
+	LuaTimeLimit int
+	// AppendOnly enables the AOF, which is then loaded at startup instead
+	// of the RDB file.
+	AppendOnly bool
+	// The AOF is kept in AppendDirname, inside Dir, as files named after
+	// AppendFilename. With AOFUseRDBPreamble, rewrites write the base file
+	// in the RDB format, which loads faster.
+	AppendDirname     string
+	AppendFilename    string
+	AppendFsync       string
+	AOFLoadTruncated  bool
+	AOFUseRDBPreamble bool
+	// The AOF is rewritten automatically once it has grown by
+	// AutoAOFRewritePercentage percent since the last rewrite and is at
+	// least AutoAOFRewriteMinSize bytes. A zero percentage disables it.
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
 }
 
 type ReplicaInfo struct {
 	Conn   net.Conn
 	State  int
 	Offset int64
+	// pending holds the writes made after the replica's snapshot was taken,
+	// until the snapshot is sent and they can follow it.
+	pending   []resp.Value
+	pendingMu sync.Mutex
 }
 type Server struct {
 	Config            Config
@@ -41,6 +79,27 @@ type Server struct {
 	ReplicasMutex     sync.RWMutex
 	ReplicationID     string
 	ReplicationOffset int64
+	// LastBGSaveErr is why the last background save failed, or nil if it
+	// succeeded; LastBGSaveTry is when it started. Both are guarded by
+	// StateMutex, like Dirty and LastSave.
+	LastBGSaveErr error
+	LastBGSaveTry time.Time
+	// RDBSaveBytes counts the bytes the running BGSAVE has written.
+	RDBSaveBytes atomic.Int64
+	// AOF logs the propagated writes when appendonly is enabled.
+	AOF *aof.AOF
+	// BackgroundMu guards starting a BGSAVE or an AOF rewrite: like the
+	// child processes of Redis, only one of them runs at a time.
+	BackgroundMu sync.Mutex
+	// AOFRewriteScheduled is set when BGREWRITEAOF arrives during a BGSAVE;
+	// the rewrite starts once the save is done.
+	AOFRewriteScheduled atomic.Bool
+
+	propagationMu sync.Mutex
+	// atomicBatch collects the commands propagated by an EXEC while
+	// atomicDepth is non-zero.
+	atomicBatch []resp.Value
+	atomicDepth int
 }
 
 const (
@@ -55,13 +114,71 @@ func (s *Server) IncrementDirty() {
 	defer s.StateMutex.Unlock()
 }
 
+// BeginAtomicPropagation starts collecting propagated commands so that
+// EndAtomicPropagation can send them to replicas as one MULTI/EXEC block.
+// Calls nest; only the outermost End sends the batch.
+//
+// The batch is server-wide, not per client: everything propagated while it
+// is open joins it. Whoever opens one must therefore hold KeyspaceMu for
+// writing from Begin to End, as EXEC, scripts and module commands do, so
+// that no other client's writes run meanwhile and end up in the block. A
+// caller that has to release KeyspaceMu, like a blocked module client, ends
+// the batch first and begins a new one once it has the lock back.
+func (s *Server) BeginAtomicPropagation() {
+	s.propagationMu.Lock()
+	defer s.propagationMu.Unlock()
+	s.atomicDepth++
+}
+
+func (s *Server) EndAtomicPropagation() {
+	s.propagationMu.Lock()
+	s.atomicDepth--
+	if s.atomicDepth > 0 {
+		s.propagationMu.Unlock()
+		return
+	}
+	batch := s.atomicBatch
+	s.atomicBatch = nil
+	s.propagationMu.Unlock()
+
+	switch len(batch) {
+	case 0:
+	case 1:
+		s.propagate(batch[0])
+	default:
+		s.propagate(resp.Value{Typ: "array", Array: []resp.Value{{Typ: "bulk", Bulk: "MULTI"}}})
+		for _, cmd := range batch {
+			s.propagate(cmd)
+		}
+		s.propagate(resp.Value{Typ: "array", Array: []resp.Value{{Typ: "bulk", Bulk: "EXEC"}}})
+	}
+}
+
 func (s *Server) Propagate(cmd resp.Value) {
+	s.propagationMu.Lock()
+	if s.atomicDepth > 0 {
+		s.atomicBatch = append(s.atomicBatch, cmd)
+		s.propagationMu.Unlock()
+		return
+	}
+	s.propagationMu.Unlock()
+	s.propagate(cmd)
+}
+
+func (s *Server) propagate(cmd resp.Value) {
+	if s.AOF != nil {
+		s.AOF.Feed(cmd)
+	}
 	s.ReplicasMutex.RLock()
 	defer s.ReplicasMutex.RUnlock()
 
 	for _, replica := range s.ConnectedReplicas {
-		// Only send to fully synchronized, online replicas
-		if replica.State == ReplicaStateOnline {
+		switch replica.State {
+		case ReplicaStateSendingRDB:
+			replica.pendingMu.Lock()
+			replica.pending = append(replica.pending, cmd)
+			replica.pendingMu.Unlock()
+		case ReplicaStateOnline:
 			writer := writer.NewWriter(replica.Conn)
 			writer.Write(cmd)
 		}
@@ -79,8 +196,24 @@ func (s *Server) AddReplica(conn net.Conn) *ReplicaInfo {
 	return replicaInfo
 }
 
+// SetReplicaSendingRDB starts keeping the writes for the replica, whose
+// snapshot is being taken. The caller holds KeyspaceMu exclusively, so the
+// writes kept are exactly those the snapshot misses.
+func (s *Server) SetReplicaSendingRDB(replica *ReplicaInfo) {
+	s.ReplicasMutex.Lock()
+	defer s.ReplicasMutex.Unlock()
+	replica.State = ReplicaStateSendingRDB
+}
+
+// SetReplicaOnline sends the replica the writes kept while its snapshot was
+// sent, and from then on every write as it happens.
 func (s *Server) SetReplicaOnline(replica *ReplicaInfo) {
 	s.ReplicasMutex.Lock()
 	defer s.ReplicasMutex.Unlock()
+	writer := writer.NewWriter(replica.Conn)
+	for _, cmd := range replica.pending {
+		writer.Write(cmd)
+	}
+	replica.pending = nil
 	replica.State = ReplicaStateOnline
 }
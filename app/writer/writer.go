@@ -1,6 +1,9 @@
 package writer
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 
@@ -20,14 +23,24 @@ func (w Writer) Write(v resp.Value) error {
 	return err
 }
 
-func (w *Writer) WriteRDB(rdbBuffer []byte) error {
-	prefix := fmt.Sprintf("$%d\r\n", len(rdbBuffer))
-	if _, err := w.writer.Write([]byte(prefix)); err != nil {
+// rdbEOFMarkLen is the length of the mark delimiting a streamed RDB payload.
+const rdbEOFMarkLen = 40
+
+// WriteRDB sends the RDB payload of a full sync as save writes it. Its
+// length isn't known up front, so, as in Redis' diskless replication, the
+// payload is sent as $EOF:<mark>\r\n, the payload, then the mark again,
+// where mark is rdbEOFMarkLen random hex digits.
+func (w *Writer) WriteRDB(save func(w io.Writer) error) error {
+	random := make([]byte, rdbEOFMarkLen/2)
+	if _, err := rand.Read(random); err != nil {
 		return err
 	}
-	fmt.Println(rdbBuffer)
-	if _, err := w.writer.Write(rdbBuffer); err != nil {
+	mark := hex.EncodeToString(random)
+	buf := bufio.NewWriterSize(w.writer, 64*1024)
+	fmt.Fprintf(buf, "$EOF:%s\r\n", mark)
+	if err := save(buf); err != nil {
 		return err
 	}
-	return nil
+	buf.WriteString(mark)
+	return buf.Flush()
 }